@@ -5,4 +5,7 @@ go 1.14
 require (
 	github.com/go-redis/redis/v7 v7.2.0
 	github.com/smartystreets/goconvey v1.6.4
+	k8s.io/api v0.17.0
+	k8s.io/apimachinery v0.17.0
+	k8s.io/client-go v0.17.0
 )
@@ -0,0 +1,80 @@
+package recycler
+
+import (
+	"log"
+	"os"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Labels and annotations set by the workers on the jobs they create.
+const (
+	managedBySelector = "app.kubernetes.io/managed-by=chainr"
+	runIDAnnotation   = "chainr.io/run-id"
+	jobIDAnnotation   = "chainr.io/job-id"
+)
+
+type K8SCluster struct {
+	kube kubernetes.Interface
+}
+
+// If the Kubernetes client can not be created,
+// this function panics.
+func NewK8SCluster() K8SCluster {
+	var config *rest.Config
+	var err error
+
+	if val, ok := os.LookupEnv("KUBECONFIG"); ok {
+		log.Println("Program is running outside the cluster, loading config from", val)
+		config, err = clientcmd.BuildConfigFromFlags("", val)
+	} else {
+		log.Println("Program is running inside the cluster")
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return K8SCluster{kubernetes.NewForConfigOrDie(config)}
+}
+
+// Jobs being deleted are skipped.
+func (c K8SCluster) ListJobs() ([]ManagedJob, error) {
+	list, err := c.kube.BatchV1().Jobs(metav1.NamespaceAll).List(metav1.ListOptions{
+		LabelSelector: managedBySelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]ManagedJob, 0, len(list.Items))
+	for _, k8sJob := range list.Items {
+		if k8sJob.DeletionTimestamp == nil {
+			jobs = append(jobs, makeManagedJob(k8sJob))
+		}
+	}
+	return jobs, nil
+}
+
+func makeManagedJob(k8sJob batchv1.Job) ManagedJob {
+	return ManagedJob{
+		Namespace: k8sJob.Namespace,
+		Name:      k8sJob.Name,
+		RunID:     k8sJob.Annotations[runIDAnnotation],
+		JobID:     k8sJob.Annotations[jobIDAnnotation],
+		Created:   k8sJob.CreationTimestamp.Time,
+	}
+}
+
+// The pods of the job are deleted with it.
+func (c K8SCluster) DeleteJob(job ManagedJob) error {
+	propagationPolicy := metav1.DeletePropagationForeground
+	opts := metav1.DeleteOptions{
+		PropagationPolicy: &propagationPolicy,
+	}
+	return c.kube.BatchV1().Jobs(job.Namespace).Delete(job.Name, &opts)
+}
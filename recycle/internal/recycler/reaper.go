@@ -0,0 +1,152 @@
+package recycler
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// A job created on the cluster by a chainr worker.
+// The keys of its run and job are read from its annotations.
+type ManagedJob struct {
+	Namespace string
+	Name      string
+	RunID     string
+	JobID     string
+	Created   time.Time
+}
+
+type Cluster interface {
+	// Lists the jobs managed by chainr, in all namespaces.
+	ListJobs() ([]ManagedJob, error)
+	DeleteJob(job ManagedJob) error
+}
+
+// The reaper deletes the jobs left on the cluster by workers which were
+// killed, or which failed to delete them.
+// Jobs are kept for a grace period after their creation, so that a job
+// created before its status is stored is not deleted.
+type reaper struct {
+	client      redis.Cmdable
+	cluster     Cluster
+	gracePeriod time.Duration
+	// If set, jobs to delete are logged but not deleted.
+	dryRun bool
+}
+
+const defaultGracePeriod = time.Hour
+
+// The reaper is enabled with REAPER_ENABLED, as it requires access to the
+// cluster. If the cluster client can not be created, this function panics.
+func newReaperFromEnv(client redis.Cmdable) (reaper, bool) {
+	if os.Getenv("REAPER_ENABLED") != "true" {
+		return reaper{}, false
+	}
+
+	r := reaper{client, NewK8SCluster(), defaultGracePeriod, false}
+	if val, ok := os.LookupEnv("REAPER_GRACE_PERIOD"); ok {
+		gracePeriod, err := time.ParseDuration(val)
+		if err != nil {
+			log.Println("Invalid REAPER_GRACE_PERIOD value " + val + ", using default " + defaultGracePeriod.String())
+		} else {
+			r.gracePeriod = gracePeriod
+		}
+	}
+	r.dryRun = os.Getenv("REAPER_DRY_RUN") == "true"
+	return r, true
+}
+
+// If a job can not be checked or deleted, the other jobs are still reaped,
+// and the last error is returned.
+func (r reaper) Reap() error {
+	jobs, err := r.cluster.ListJobs()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if time.Since(job.Created) < r.gracePeriod {
+			continue
+		}
+		reason, checkErr := r.orphanReason(job)
+		if checkErr != nil {
+			log.Println("Unable to check job", job.Namespace+"/"+job.Name+":", checkErr.Error())
+			err = checkErr
+			continue
+		}
+		if len(reason) == 0 {
+			continue
+		}
+
+		if r.dryRun {
+			log.Println("Job", job.Namespace+"/"+job.Name, "would be deleted:", reason)
+			continue
+		}
+		log.Println("Deleting job", job.Namespace+"/"+job.Name+":", reason)
+		if deleteErr := r.cluster.DeleteJob(job); deleteErr != nil {
+			log.Println("Unable to delete job", job.Namespace+"/"+job.Name+":", deleteErr.Error())
+			err = deleteErr
+		}
+	}
+
+	return err
+}
+
+// Returns why the job is no longer needed, or an empty string if its run
+// may still wait for it.
+// Jobs created before their keys were annotated are kept, as their run can
+// not be found.
+func (r reaper) orphanReason(job ManagedJob) (string, error) {
+	if len(job.RunID) == 0 || len(job.JobID) == 0 {
+		return "", nil
+	}
+
+	runStatus, err := r.status(job.RunID)
+	if err != nil {
+		return "", err
+	}
+	switch runStatus {
+	case "":
+		return "run " + job.RunID + " is unknown", nil
+	case "SUCCESSFUL", "FAILED", "CANCELED":
+		return "run " + job.RunID + " is " + runStatus, nil
+	}
+
+	jobStatus, err := r.status(job.JobID)
+	if err != nil {
+		return "", err
+	}
+	switch jobStatus {
+	case "":
+		return "job " + job.JobID + " is unknown", nil
+	case "SUCCESSFUL", "FAILED", "SKIPPED":
+		return "job " + job.JobID + " is " + jobStatus, nil
+	}
+
+	return "", nil
+}
+
+// Returns the status of the run or job hash, or an empty string if it does
+// not exist.
+func (r reaper) status(key string) (string, error) {
+	status, err := r.client.HGet(key, "status").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return status, err
+}
+
+func (r reaper) Start() {
+	if r.dryRun {
+		log.Println("Reaper started in dry-run mode, jobs will not be deleted")
+	}
+
+	for {
+		if err := r.Reap(); err != nil {
+			log.Println("An error occurred while reaping jobs:", err.Error())
+		}
+		time.Sleep(time.Minute)
+	}
+}
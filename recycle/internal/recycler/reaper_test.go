@@ -0,0 +1,146 @@
+package recycler
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+
+	"errors"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Stores the status of runs and jobs.
+type statusRedisMock struct {
+	t *testing.T
+	*redis.Client
+
+	statuses map[string]string
+	// Keys whose status can not be read.
+	failing map[string]bool
+}
+
+func (r *statusRedisMock) HGet(key, field string) *redis.StringCmd {
+	if field != "status" {
+		r.t.Errorf("HGet: field = %v, expected status", field)
+	}
+	if r.failing[key] {
+		return redis.NewStringResult("", errors.New("connection refused"))
+	}
+
+	status, ok := r.statuses[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(status, nil)
+}
+
+// Stores the names of the deleted jobs.
+type clusterMock struct {
+	jobs    []ManagedJob
+	deleted []string
+	// Names of the jobs which can not be deleted.
+	failing map[string]bool
+}
+
+func (c *clusterMock) ListJobs() ([]ManagedJob, error) {
+	return c.jobs, nil
+}
+
+func (c *clusterMock) DeleteJob(job ManagedJob) error {
+	if c.failing[job.Name] {
+		return errors.New("forbidden")
+	}
+	c.deleted = append(c.deleted, job.Name)
+	return nil
+}
+
+func newManagedJob(name, runID, jobID string, age time.Duration) ManagedJob {
+	return ManagedJob{"default", name, runID, jobID, time.Now().Add(-age)}
+}
+
+func TestReap(t *testing.T) {
+	Convey("Scenario: reap jobs left on the cluster", t, func() {
+		Convey("Given jobs are left on the cluster", func() {
+			client := &statusRedisMock{t: t, statuses: map[string]string{
+				"run:running":                      "RUNNING",
+				"run:successful":                   "SUCCESSFUL",
+				"project:a:run:canceled":           "CANCELED",
+				"job:build:run:running":            "RUNNING",
+				"job:test:run:running":             "SUCCESSFUL",
+				"job:build:run:successful":         "SUCCESSFUL",
+				"job:build:project:a:run:canceled": "RUNNING",
+			}}
+			cluster := &clusterMock{jobs: []ManagedJob{
+				newManagedJob("running", "run:running", "job:build:run:running", 2*time.Hour),
+				newManagedJob("completed-job", "run:running", "job:test:run:running", 2*time.Hour),
+				newManagedJob("unknown-job", "run:running", "job:lint:run:running", 2*time.Hour),
+				newManagedJob("successful", "run:successful", "job:build:run:successful", 2*time.Hour),
+				newManagedJob("canceled", "project:a:run:canceled", "job:build:project:a:run:canceled", 2*time.Hour),
+				newManagedJob("unknown-run", "run:deleted", "job:build:run:deleted", 2*time.Hour),
+				newManagedJob("recent", "run:deleted", "job:build:run:deleted", time.Minute),
+				newManagedJob("unannotated", "", "", 2*time.Hour),
+			}}
+
+			Convey("When the reaper runs", func() {
+				r := reaper{client, cluster, time.Hour, false}
+				err := r.Reap()
+
+				Convey("Jobs of terminal or unknown runs and jobs should be deleted", func() {
+					So(err, ShouldBeNil)
+					So(cluster.deleted, ShouldResemble, []string{"completed-job", "unknown-job", "successful", "canceled", "unknown-run"})
+				})
+			})
+
+			Convey("When a job can not be checked and another one can not be deleted", func() {
+				client.failing = map[string]bool{"run:running": true}
+				cluster.failing = map[string]bool{"successful": true}
+				r := reaper{client, cluster, time.Hour, false}
+				err := r.Reap()
+
+				Convey("The other jobs should still be deleted, and an error returned", func() {
+					So(err, ShouldNotBeNil)
+					So(cluster.deleted, ShouldResemble, []string{"canceled", "unknown-run"})
+				})
+			})
+
+			Convey("When the reaper runs in dry-run mode", func() {
+				r := reaper{client, cluster, time.Hour, true}
+				err := r.Reap()
+
+				Convey("No job should be deleted", func() {
+					So(err, ShouldBeNil)
+					So(cluster.deleted, ShouldBeEmpty)
+				})
+			})
+		})
+	})
+}
+
+func TestNewReaperFromEnvDisabled(t *testing.T) {
+	os.Unsetenv("REAPER_ENABLED")
+	if _, ok := newReaperFromEnv(nil); ok {
+		t.Errorf("reaper enabled, expected it to be disabled by default")
+	}
+}
+
+func TestMakeManagedJob(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var k8sJob batchv1.Job
+	k8sJob.Namespace = "team-a"
+	k8sJob.Name = "build-abc"
+	k8sJob.CreationTimestamp = metav1.NewTime(created)
+	k8sJob.Annotations = map[string]string{
+		"chainr.io/run-id": "project:team-a:run:abc",
+		"chainr.io/job-id": "job:build:project:team-a:run:abc",
+	}
+
+	job := makeManagedJob(k8sJob)
+	expected := ManagedJob{"team-a", "build-abc", "project:team-a:run:abc", "job:build:project:team-a:run:abc", created}
+	if job != expected {
+		t.Errorf("job = %v, expected %v", job, expected)
+	}
+}
@@ -1,9 +1,11 @@
 // Package recycler contains the recycling logic.
 // The recycler reads the workers status on redis and re-schedules
-// items from expired workers.
+// items from expired workers. The reaper deletes the Kubernetes jobs left
+// by workers.
 package recycler
 
 import (
+	"encoding/json"
 	"log"
 	"strings"
 	"time"
@@ -43,7 +45,13 @@ func (r recycler) recycleWorker(workerKey string) error {
 
 	if expiry.Before(time.Now()) {
 		log.Println("Worker", workerKey, "has expired")
-		if err := r.rescheduleItems(worker["processQueue"], worker["queue"]); err != nil {
+		var priorityQueues map[string]string
+		if val, ok := worker["priorityQueues"]; ok {
+			if err := json.Unmarshal([]byte(val), &priorityQueues); err != nil {
+				return err
+			}
+		}
+		if err := r.rescheduleItems(worker["processQueue"], worker["queue"], priorityQueues); err != nil {
 			return err
 		}
 		if err := r.deleteWorker(workerKey); err != nil {
@@ -54,19 +62,37 @@ func (r recycler) recycleWorker(workerKey string) error {
 	return nil
 }
 
-func (r recycler) rescheduleItems(processQueue string, queue string) error {
+// Items are re-scheduled in the queue of their priority, read from the
+// priority field of their hash, if the worker has priority queues. Otherwise,
+// or if their priority has no queue, they are re-scheduled in the worker
+// queue.
+func (r recycler) rescheduleItems(processQueue string, queue string, priorityQueues map[string]string) error {
 	items, err := r.client.LRange(processQueue, 0, -1).Result()
 	if err != nil {
 		return err
 	}
 
-	if len(items) > 0 {
-		log.Println("Rescheduling items", strings.Join(items, ", "), "on queue", queue)
-		values := make([]interface{}, len(items))
-		for i, v := range items {
-			values[i] = v
+	queues := make([]string, 0)
+	queueItems := make(map[string][]interface{})
+	for _, item := range items {
+		itemQueue, err := r.itemQueue(item, queue, priorityQueues)
+		if err != nil {
+			return err
 		}
-		if err := r.client.RPush(queue, values...).Err(); err != nil {
+		if _, ok := queueItems[itemQueue]; !ok {
+			queues = append(queues, itemQueue)
+		}
+		queueItems[itemQueue] = append(queueItems[itemQueue], item)
+	}
+
+	for _, q := range queues {
+		values := queueItems[q]
+		names := make([]string, len(values))
+		for i, v := range values {
+			names[i] = v.(string)
+		}
+		log.Println("Rescheduling items", strings.Join(names, ", "), "on queue", q)
+		if err := r.client.RPush(q, values...).Err(); err != nil {
 			return err
 		}
 	}
@@ -79,6 +105,23 @@ func (r recycler) rescheduleItems(processQueue string, queue string) error {
 	return nil
 }
 
+func (r recycler) itemQueue(item string, queue string, priorityQueues map[string]string) (string, error) {
+	if len(priorityQueues) == 0 {
+		return queue, nil
+	}
+
+	priority, err := r.client.HGet(item, "priority").Result()
+	if err == redis.Nil {
+		return queue, nil
+	} else if err != nil {
+		return "", err
+	}
+	if priorityQueue, ok := priorityQueues[priority]; ok {
+		return priorityQueue, nil
+	}
+	return queue, nil
+}
+
 func (r recycler) deleteWorker(workerKey string) error {
 	log.Println("Deleting worker", workerKey)
 	if err := r.client.SRem("workers", workerKey).Err(); err != nil {
@@ -92,7 +135,12 @@ func (r recycler) deleteWorker(workerKey string) error {
 }
 
 func Start() {
-	r := recycler{NewRedisClient()}
+	client := NewRedisClient()
+	if reaper, ok := newReaperFromEnv(client); ok {
+		go reaper.Start()
+	}
+
+	r := recycler{client}
 
 	for {
 		if err := r.Recycle(); err != nil {
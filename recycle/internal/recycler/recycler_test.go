@@ -123,3 +123,77 @@ func TestRecycle(t *testing.T) {
 		})
 	})
 }
+
+// Stores the items pushed in each queue.
+type priorityRedisMock struct {
+	t *testing.T
+	*redis.Client
+
+	pushed map[string][]interface{}
+}
+
+func (r *priorityRedisMock) SMembers(key string) *redis.StringSliceCmd {
+	return redis.NewStringSliceResult([]string{"expired"}, nil)
+}
+
+func (r *priorityRedisMock) HGetAll(key string) *redis.StringStringMapCmd {
+	return redis.NewStringStringMapResult(map[string]string{
+		"queue":          "runs:work",
+		"processQueue":   "runs:worker:expired",
+		"priorityQueues": `{"high":"runs:work:high","normal":"runs:work","low":"runs:work:low"}`,
+		"expiry":         time.Now().Add(-1 * time.Second).Format(time.RFC3339),
+	}, nil)
+}
+
+func (r *priorityRedisMock) LRange(key string, start, stop int64) *redis.StringSliceCmd {
+	return redis.NewStringSliceResult([]string{"run:abc", "run:def", "run:ghi", "run:jkl"}, nil)
+}
+
+func (r *priorityRedisMock) HGet(key, field string) *redis.StringCmd {
+	if field != "priority" {
+		r.t.Errorf("HGet: field = %v, expected priority", field)
+	}
+
+	switch key {
+	case "run:abc":
+		return redis.NewStringResult("high", nil)
+	case "run:def":
+		return redis.NewStringResult("low", nil)
+	case "run:ghi":
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult("high", nil)
+}
+
+func (r *priorityRedisMock) RPush(key string, values ...interface{}) *redis.IntCmd {
+	r.pushed[key] = append(r.pushed[key], values...)
+	return redis.NewIntResult(int64(len(r.pushed[key])), nil)
+}
+
+func (r *priorityRedisMock) Del(keys ...string) *redis.IntCmd {
+	return redis.NewIntResult(1, nil)
+}
+
+func (r *priorityRedisMock) SRem(key string, members ...interface{}) *redis.IntCmd {
+	return redis.NewIntResult(1, nil)
+}
+
+func TestRecyclePriority(t *testing.T) {
+	Convey("Scenario: recycle workers with priority queues", t, func() {
+		Convey("Given the recycle procedure is started", func() {
+			r := &priorityRedisMock{t: t, pushed: make(map[string][]interface{})}
+			recycler{r}.Recycle()
+
+			Convey("When an expired worker has priority queues", func() {
+				Convey("Items should be rescheduled in the queue of their priority", func() {
+					So(r.pushed["runs:work:high"], ShouldResemble, []interface{}{"run:abc", "run:jkl"})
+					So(r.pushed["runs:work:low"], ShouldResemble, []interface{}{"run:def"})
+				})
+
+				Convey("Items without priority should be rescheduled in the worker queue", func() {
+					So(r.pushed["runs:work"], ShouldResemble, []interface{}{"run:ghi"})
+				})
+			})
+		})
+	})
+}
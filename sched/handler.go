@@ -2,9 +2,12 @@ package main
 
 import (
 	"net/http"
+	"strings"
 
+	"github.com/Tyrame/chainr/sched/internal/hook"
 	"github.com/Tyrame/chainr/sched/internal/httputil"
 	"github.com/Tyrame/chainr/sched/internal/run"
+	"github.com/Tyrame/chainr/sched/internal/trigger"
 )
 
 type apiResourceList struct {
@@ -34,7 +37,11 @@ func newApiResourceList() *apiResourceList {
 			SelfLink: "/api",
 		},
 		Resources: map[string]apiResource{
-			"runs": apiResource{"/api/runs", "Interact with runs", run.NewHandler()},
+			"runs":      apiResource{"/api/runs", "Interact with runs of the default project", run.NewHandler()},
+			"projects":  apiResource{"/api/projects", "Manage projects and interact with their runs", run.NewProjectHandler()},
+			"pipelines": apiResource{"/api/pipelines", "Store pipelines run by triggers", run.NewPipelineHandler()},
+			"hooks":     apiResource{"/api/hooks", "Run stored pipelines on git events", hook.NewHandler()},
+			"triggers":  apiResource{"/api/triggers", "Run stored pipelines with trigger tokens", trigger.NewHandler()},
 		},
 	}
 }
@@ -47,7 +54,60 @@ func NewHandler() http.Handler {
 		mux.Handle(res.URL+"/", res.Handler)
 	}
 	mux.Handle("/api", &apiHandler{lst})
-	return httputil.NewAccessLogger(mux)
+
+	auth, err := httputil.NewAuthenticator()
+	if err != nil {
+		panic("configure authentication: " + err.Error())
+	}
+	return httputil.NewAccessLogger(httputil.NewAuthHandler(mux, auth, routeRole))
+}
+
+// Returns the role required by each route, and the project it accesses.
+// Git hooks and trigger tokens are authenticated by their own secret, and
+// the root path is left open for probes.
+// Runs are accessed with a role on their project, while projects are managed
+// by admins of all projects.
+func routeRole(r *http.Request) (httputil.Role, string) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	project := routeProject(path)
+	switch {
+	case path == "":
+		return httputil.Anonymous, ""
+	case strings.HasPrefix(path, "/api/hooks/"):
+		return httputil.Anonymous, ""
+	case strings.HasPrefix(path, "/api/triggers/") && r.Method == "POST":
+		return httputil.Anonymous, ""
+	case path == "/api/triggers" || strings.HasPrefix(path, "/api/triggers/"):
+		return httputil.Admin, ""
+	case isRunsPath(path) && r.Method == "POST":
+		return httputil.Submitter, project
+	case r.Method == "GET" || r.Method == "HEAD":
+		return httputil.Viewer, project
+	}
+	return httputil.Admin, ""
+}
+
+// Runs are submitted to /api/runs, or /api/projects/<name>/runs.
+func isRunsPath(path string) bool {
+	if path == "/api/runs" {
+		return true
+	}
+	parts := strings.Split(path, "/")
+	return len(parts) == 5 && parts[2] == "projects" && parts[4] == "runs"
+}
+
+// Returns the project of the path: the default project for /api/runs, and
+// <name> for /api/projects/<name> and its runs. Other paths access no
+// project.
+func routeProject(path string) string {
+	if path == "/api/runs" || strings.HasPrefix(path, "/api/runs/") {
+		return run.DefaultProject
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) >= 4 && parts[1] == "api" && parts[2] == "projects" {
+		return parts[3]
+	}
+	return ""
 }
 
 func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -7,11 +7,15 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
 
 	"github.com/Tyrame/chainr/sched/internal/httputil"
 )
 
 func TestHandler(t *testing.T) {
+	os.Setenv("AUTH_DISABLED", "true")
+	defer os.Unsetenv("AUTH_DISABLED")
+
 	Convey("Scenario: get API resources", t, func() {
 		Convey("Given API resources are requested", func() {
 			w := httptest.NewRecorder()
@@ -95,3 +99,83 @@ func TestHandler(t *testing.T) {
 		})
 	})
 }
+
+func TestRouteRole(t *testing.T) {
+	tests := []struct {
+		method  string
+		path    string
+		role    httputil.Role
+		project string
+	}{
+		{"GET", "/", httputil.Anonymous, ""},
+		{"GET", "/api", httputil.Viewer, ""},
+		{"GET", "/api/runs", httputil.Viewer, "default"},
+		{"GET", "/api/runs/uid", httputil.Viewer, "default"},
+		{"POST", "/api/runs", httputil.Submitter, "default"},
+		{"GET", "/api/projects", httputil.Viewer, ""},
+		{"GET", "/api/projects/team", httputil.Viewer, "team"},
+		{"GET", "/api/projects/team/runs", httputil.Viewer, "team"},
+		{"GET", "/api/projects/team/runs/uid", httputil.Viewer, "team"},
+		{"POST", "/api/projects/team/runs", httputil.Submitter, "team"},
+		{"PUT", "/api/projects/team", httputil.Admin, ""},
+		{"DELETE", "/api/projects/team", httputil.Admin, ""},
+		{"DELETE", "/api/projects/team/runs/uid", httputil.Admin, ""},
+		{"GET", "/api/pipelines/ci", httputil.Viewer, ""},
+		{"PUT", "/api/pipelines/ci", httputil.Admin, ""},
+		{"DELETE", "/api/pipelines/ci", httputil.Admin, ""},
+		{"POST", "/api/hooks/git", httputil.Anonymous, ""},
+		{"POST", "/api/triggers/token", httputil.Anonymous, ""},
+		{"POST", "/api/triggers", httputil.Admin, ""},
+		{"GET", "/api/triggers", httputil.Admin, ""},
+		{"DELETE", "/api/triggers/id", httputil.Admin, ""},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role, project := routeRole(r); role != test.role || project != test.project {
+			t.Errorf("routeRole(%v %v) = %v, %q, expected %v, %q", test.method, test.path, role, project, test.role, test.project)
+		}
+	}
+}
+
+// Principals granted a role on a project can not access the runs of other
+// projects.
+func TestRouteRoleProjects(t *testing.T) {
+	tokens := make(httputil.StaticTokens)
+	tokens.Add("team-token", httputil.Principal{Name: "team", Projects: map[string]httputil.Role{"team-a": httputil.Submitter}})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := httputil.NewAuthHandler(ok, tokens, routeRole)
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"POST", "/api/projects/team-a/runs", http.StatusOK},
+		{"GET", "/api/projects/team-a/runs", http.StatusOK},
+		{"GET", "/api/projects/team-a/runs/uid", http.StatusOK},
+		{"GET", "/api/projects/team-a", http.StatusOK},
+		{"POST", "/api/projects/team-b/runs", http.StatusForbidden},
+		{"GET", "/api/projects/team-b/runs", http.StatusForbidden},
+		{"GET", "/api/projects/team-b/runs/uid", http.StatusForbidden},
+		{"POST", "/api/runs", http.StatusForbidden},
+		{"GET", "/api/runs", http.StatusForbidden},
+		{"GET", "/api/projects", http.StatusForbidden},
+		{"PUT", "/api/projects/team-a", http.StatusForbidden},
+		{"GET", "/api/pipelines", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "Bearer team-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%v %v: w.Code = %v, expected %v", test.method, test.path, w.Code, test.code)
+		}
+	}
+}
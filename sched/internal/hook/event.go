@@ -0,0 +1,252 @@
+package hook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Types of git events triggering pipelines.
+const (
+	pushEvent        = "push"
+	pullRequestEvent = "pullRequest"
+)
+
+// A git event, independent of the git server sending it.
+// For pull requests, the branch is the target branch, and the head branch is
+// the branch containing the changes.
+type gitEvent struct {
+	Type        string
+	Repos       []string
+	Branch      string
+	HeadBranch  string
+	Commit      string
+	PullRequest int
+}
+
+type SignatureError struct {
+	msg string
+}
+
+func (e *SignatureError) Error() string {
+	return e.msg
+}
+
+// Verifies the request signature, and parses the payload into a git event.
+// GitHub, Gitea and GitLab payloads are supported.
+// If the event does not trigger pipelines, e.g. a ping or a tag push, nil is
+// returned.
+func parseEvent(r *http.Request, body []byte, secret string) (*gitEvent, error) {
+	switch {
+	case len(r.Header.Get("X-Gitea-Event")) > 0:
+		if err := verifyHMAC(body, secret, r.Header.Get("X-Gitea-Signature")); err != nil {
+			return nil, err
+		}
+		return parseGitHubEvent(r.Header.Get("X-Gitea-Event"), body)
+
+	case len(r.Header.Get("X-GitHub-Event")) > 0:
+		signature := r.Header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") {
+			return nil, &SignatureError{"missing X-Hub-Signature-256 header"}
+		}
+		if err := verifyHMAC(body, secret, strings.TrimPrefix(signature, "sha256=")); err != nil {
+			return nil, err
+		}
+		return parseGitHubEvent(r.Header.Get("X-GitHub-Event"), body)
+
+	case len(r.Header.Get("X-Gitlab-Event")) > 0:
+		token := r.Header.Get("X-Gitlab-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return nil, &SignatureError{"invalid X-Gitlab-Token header"}
+		}
+		return parseGitLabEvent(r.Header.Get("X-Gitlab-Event"), body)
+	}
+
+	return nil, errors.New("unsupported git hook, expected a GitHub, Gitea or GitLab event")
+}
+
+// The signature is the hex encoded HMAC-SHA256 of the body.
+func verifyHMAC(body []byte, secret, signature string) error {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(signature) == 0 {
+		return &SignatureError{"invalid signature"}
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return &SignatureError{"invalid signature"}
+	}
+	return nil
+}
+
+type gitHubRepository struct {
+	CloneURL string `json:"clone_url"`
+	SSHURL   string `json:"ssh_url"`
+	HTMLURL  string `json:"html_url"`
+}
+
+func (r gitHubRepository) urls() []string {
+	return []string{r.CloneURL, r.SSHURL, r.HTMLURL}
+}
+
+type gitHubPayload struct {
+	Ref         string           `json:"ref"`
+	After       string           `json:"after"`
+	Deleted     bool             `json:"deleted"`
+	Action      string           `json:"action"`
+	Number      int              `json:"number"`
+	Repository  gitHubRepository `json:"repository"`
+	PullRequest struct {
+		Head struct {
+			Ref string `json:"ref"`
+			SHA string `json:"sha"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	} `json:"pull_request"`
+}
+
+// Gitea payloads are compatible with GitHub payloads.
+func parseGitHubEvent(eventType string, body []byte) (*gitEvent, error) {
+	var payload gitHubPayload
+
+	switch eventType {
+	case "push":
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+		branch, ok := branchFromRef(payload.Ref)
+		if !ok || payload.Deleted || isZeroCommit(payload.After) {
+			return nil, nil
+		}
+		return &gitEvent{
+			Type:       pushEvent,
+			Repos:      payload.Repository.urls(),
+			Branch:     branch,
+			HeadBranch: branch,
+			Commit:     payload.After,
+		}, nil
+
+	case "pull_request":
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+		switch payload.Action {
+		case "opened", "reopened", "synchronize", "synchronized":
+		default:
+			return nil, nil
+		}
+		return &gitEvent{
+			Type:        pullRequestEvent,
+			Repos:       payload.Repository.urls(),
+			Branch:      payload.PullRequest.Base.Ref,
+			HeadBranch:  payload.PullRequest.Head.Ref,
+			Commit:      payload.PullRequest.Head.SHA,
+			PullRequest: payload.Number,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+type gitLabPayload struct {
+	Ref         string `json:"ref"`
+	CheckoutSHA string `json:"checkout_sha"`
+	After       string `json:"after"`
+	Project     struct {
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+	ObjectAttributes struct {
+		Action       string `json:"action"`
+		IID          int    `json:"iid"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		LastCommit   struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+func parseGitLabEvent(eventType string, body []byte) (*gitEvent, error) {
+	var payload gitLabPayload
+
+	switch eventType {
+	case "Push Hook":
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+		branch, ok := branchFromRef(payload.Ref)
+		if !ok || isZeroCommit(payload.After) {
+			return nil, nil
+		}
+		commit := payload.CheckoutSHA
+		if len(commit) == 0 {
+			commit = payload.After
+		}
+		return &gitEvent{
+			Type:       pushEvent,
+			Repos:      []string{payload.Project.GitHTTPURL, payload.Project.GitSSHURL, payload.Project.WebURL},
+			Branch:     branch,
+			HeadBranch: branch,
+			Commit:     commit,
+		}, nil
+
+	case "Merge Request Hook":
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+		attrs := payload.ObjectAttributes
+		switch attrs.Action {
+		case "open", "reopen", "update":
+		default:
+			return nil, nil
+		}
+		return &gitEvent{
+			Type:        pullRequestEvent,
+			Repos:       []string{payload.Project.GitHTTPURL, payload.Project.GitSSHURL, payload.Project.WebURL},
+			Branch:      attrs.TargetBranch,
+			HeadBranch:  attrs.SourceBranch,
+			Commit:      attrs.LastCommit.ID,
+			PullRequest: attrs.IID,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// Only branches trigger pipelines, tags are ignored.
+func branchFromRef(ref string) (string, bool) {
+	if !strings.HasPrefix(ref, "refs/heads/") {
+		return "", false
+	}
+	return strings.TrimPrefix(ref, "refs/heads/"), true
+}
+
+// Deleted branches are pushed with a zero commit.
+func isZeroCommit(commit string) bool {
+	return len(strings.Trim(commit, "0")) == 0
+}
+
+// Returns the parameters the runs are scheduled with.
+func (e gitEvent) params() map[string]string {
+	params := map[string]string{
+		"event":  e.Type,
+		"branch": e.HeadBranch,
+		"commit": e.Commit,
+	}
+	if e.Type == pullRequestEvent {
+		params["baseBranch"] = e.Branch
+		params["pullRequest"] = strconv.Itoa(e.PullRequest)
+	}
+	return params
+}
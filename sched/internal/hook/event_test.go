@@ -0,0 +1,153 @@
+package hook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testSecret = "s3cr3t"
+
+const gitHubPushPayload = `{
+	"ref": "refs/heads/main",
+	"after": "9fceb02d0ae598e95dc970b74767f19372d61af8",
+	"repository": {
+		"clone_url": "https://github.com/Tyrame/chainr.git",
+		"ssh_url": "git@github.com:Tyrame/chainr.git",
+		"html_url": "https://github.com/Tyrame/chainr"
+	}
+}`
+
+func sign(body string) string {
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newTestRequest(t *testing.T, body string, headers map[string]string) *http.Request {
+	r, err := http.NewRequest("POST", "/api/hooks/git", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func TestParseGitHubPush(t *testing.T) {
+	r := newTestRequest(t, gitHubPushPayload, map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-Hub-Signature-256": "sha256=" + sign(gitHubPushPayload),
+	})
+	event, err := parseEvent(r, []byte(gitHubPushPayload), testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event == nil {
+		t.Fatal("event = nil, expected push event")
+	}
+	if event.Type != pushEvent || event.Branch != "main" || event.Commit != "9fceb02d0ae598e95dc970b74767f19372d61af8" {
+		t.Errorf("event = %v, expected push of main", event)
+	}
+}
+
+func TestParseInvalidSignature(t *testing.T) {
+	r := newTestRequest(t, gitHubPushPayload, map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-Hub-Signature-256": "sha256=" + sign("tampered"),
+	})
+	_, err := parseEvent(r, []byte(gitHubPushPayload), testSecret)
+	if _, ok := err.(*SignatureError); !ok {
+		t.Errorf("err = %v, expected signature error", err)
+	}
+
+	r = newTestRequest(t, gitHubPushPayload, map[string]string{
+		"X-Gitlab-Event": "Push Hook",
+		"X-Gitlab-Token": "wrong",
+	})
+	_, err = parseEvent(r, []byte(gitHubPushPayload), testSecret)
+	if _, ok := err.(*SignatureError); !ok {
+		t.Errorf("err = %v, expected signature error", err)
+	}
+}
+
+func TestParseGiteaPush(t *testing.T) {
+	r := newTestRequest(t, gitHubPushPayload, map[string]string{
+		"X-Gitea-Event":     "push",
+		"X-Gitea-Signature": sign(gitHubPushPayload),
+	})
+	event, err := parseEvent(r, []byte(gitHubPushPayload), testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event == nil || event.Type != pushEvent || event.Branch != "main" {
+		t.Errorf("event = %v, expected push of main", event)
+	}
+}
+
+func TestParseTagPush(t *testing.T) {
+	body := `{"ref": "refs/tags/v1.0.0", "after": "9fceb02d0ae598e95dc970b74767f19372d61af8"}`
+	r := newTestRequest(t, body, map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-Hub-Signature-256": "sha256=" + sign(body),
+	})
+	event, err := parseEvent(r, []byte(body), testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event != nil {
+		t.Errorf("event = %v, expected nil", event)
+	}
+}
+
+func TestParseGitLabMergeRequest(t *testing.T) {
+	body := `{
+		"project": {
+			"git_http_url": "https://gitlab.com/tyrame/chainr.git",
+			"git_ssh_url": "git@gitlab.com:tyrame/chainr.git"
+		},
+		"object_attributes": {
+			"action": "open",
+			"iid": 42,
+			"source_branch": "feature",
+			"target_branch": "main",
+			"last_commit": {"id": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7"}
+		}
+	}`
+	r := newTestRequest(t, body, map[string]string{
+		"X-Gitlab-Event": "Merge Request Hook",
+		"X-Gitlab-Token": testSecret,
+	})
+	event, err := parseEvent(r, []byte(body), testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event == nil {
+		t.Fatal("event = nil, expected pull request event")
+	}
+
+	params := event.params()
+	expected := map[string]string{
+		"event":       pullRequestEvent,
+		"branch":      "feature",
+		"baseBranch":  "main",
+		"commit":      "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+		"pullRequest": "42",
+	}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Errorf("params[%v] = %v, expected %v", k, params[k], v)
+		}
+	}
+}
+
+func TestParseUnsupportedEvent(t *testing.T) {
+	r := newTestRequest(t, "{}", nil)
+	if _, err := parseEvent(r, []byte("{}"), testSecret); err == nil {
+		t.Errorf("err = nil, expected unsupported git hook")
+	}
+}
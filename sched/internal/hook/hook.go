@@ -0,0 +1,193 @@
+// Package hook contains the HTTP handler receiving git webhooks,
+// and scheduling runs of the stored pipelines matching the git events.
+package hook
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Tyrame/chainr/sched/internal/httputil"
+	"github.com/Tyrame/chainr/sched/internal/run"
+)
+
+type hookHandler struct {
+	pf     run.PipelineFactory
+	store  run.PipelineStore
+	sched  run.Scheduler
+	secret string
+}
+
+// The secret shared with git servers is read from HOOKS_SECRET.
+// If it is not set, hooks are refused.
+func NewHandler() http.Handler {
+	return newHandler(
+		run.NewPipelineFactory(),
+		run.NewPipelineStore(),
+		run.NewScheduler(),
+		os.Getenv("HOOKS_SECRET"),
+	)
+}
+func newHandler(pf run.PipelineFactory, store run.PipelineStore, sched run.Scheduler, secret string) http.Handler {
+	handler := &hookHandler{pf, store, sched, secret}
+
+	mux := httputil.NewServeMux()
+	mux.Handle("/api/hooks/git", handler)
+	return mux
+}
+
+func (h *hookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		httputil.WriteError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.post(w, r)
+}
+
+// Maximum size of the payloads, read before their signature is verified.
+const maxPayloadSize = 5 << 20
+
+// List of the runs scheduled for an event, with the errors of the runs which
+// could not be scheduled.
+type hookResult struct {
+	run.RunList
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Schedules a run of each stored pipeline matching the event, and returns
+// the list of scheduled runs.
+// Runs are scheduled even if scheduling another one failed, and the request
+// only fails if no run could be scheduled, so that git servers retrying
+// failed hooks do not schedule runs twice.
+func (h *hookHandler) post(w http.ResponseWriter, r *http.Request) {
+	if len(h.secret) == 0 {
+		httputil.WriteError(w, "Git hooks are not configured", http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+	if err != nil {
+		httputil.WriteError(w, err, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	event, err := parseEvent(r, body, h.secret)
+	if err != nil {
+		switch err.(type) {
+		case *SignatureError:
+			httputil.WriteError(w, err, http.StatusUnauthorized)
+		default:
+			httputil.WriteError(w, err, http.StatusBadRequest)
+		}
+		return
+	}
+
+	items := make([]run.StatusListItem, 0)
+	if event == nil {
+		httputil.WriteResponse(w, run.NewList(items), http.StatusOK)
+		return
+	}
+
+	var errs []string
+
+	pipelines, err := h.store.List()
+	if err != nil {
+		log.Println("Unable to list pipelines:", err.Error())
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	for _, stored := range pipelines {
+		p, err := h.pf.Create(stored.Spec)
+		if err != nil {
+			log.Printf("Stored pipeline %v is invalid: %v", stored.Name, err.Error())
+			continue
+		}
+		if !matches(p, *event) {
+			continue
+		}
+
+		p.OverrideParams(event.params())
+		p.Name = stored.Name
+		rn := run.New(p)
+		status, err := h.sched.Schedule(rn)
+		if err != nil {
+			log.Printf("Run scheduling of pipeline %v failed: %v", stored.Name, err.Error())
+			errs = append(errs, "pipeline "+stored.Name+": "+err.Error())
+			continue
+		}
+		log.Printf("Scheduled run %v of pipeline %v for commit %v", rn.Metadata.UID, stored.Name, event.Commit)
+		items = append(items, run.StatusListItem{RunUID: rn.Metadata.UID, Status: status})
+	}
+
+	if len(items) == 0 && len(errs) > 0 {
+		httputil.WriteError(w, "Run scheduling failed: "+strings.Join(errs, ", "), http.StatusInternalServerError)
+		return
+	}
+	httputil.WriteResponse(w, hookResult{run.NewList(items), errs}, http.StatusAccepted)
+}
+
+// A pipeline matches an event if its source is the event repository, and if
+// one of its triggers matches the event type and branch.
+func matches(p run.Pipeline, event gitEvent) bool {
+	if p.Source == nil || p.On == nil {
+		return false
+	}
+
+	found := false
+	repo := normalizeRepo(p.Source.Repo)
+	for _, eventRepo := range event.Repos {
+		if len(eventRepo) > 0 && normalizeRepo(eventRepo) == repo {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	var filter *run.BranchFilter
+	switch event.Type {
+	case pushEvent:
+		filter = p.On.Push
+	case pullRequestEvent:
+		filter = p.On.PullRequest
+	}
+	if filter == nil {
+		return false
+	}
+	if len(filter.Branches) == 0 {
+		return true
+	}
+	for _, pattern := range filter.Branches {
+		if ok, _ := path.Match(pattern, event.Branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalizes repository URLs, so that the HTTP and SSH URLs of a repository
+// are equal, e.g. https://github.com/Tyrame/chainr.git and
+// git@github.com:Tyrame/chainr.git are both normalized to
+// github.com/tyrame/chainr.
+func normalizeRepo(repo string) string {
+	repo = strings.ToLower(strings.TrimSpace(repo))
+	if i := strings.Index(repo, "://"); i >= 0 {
+		repo = repo[i+3:]
+	} else if i := strings.Index(repo, ":"); i >= 0 {
+		// scp-like syntax, e.g. git@github.com:Tyrame/chainr.git
+		repo = repo[:i] + "/" + repo[i+1:]
+	}
+	if i := strings.Index(repo, "@"); i >= 0 && i < strings.Index(repo+"/", "/") {
+		repo = repo[i+1:]
+	}
+	repo = strings.TrimSuffix(repo, "/")
+	return strings.TrimSuffix(repo, ".git")
+}
@@ -0,0 +1,203 @@
+package hook
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/Tyrame/chainr/sched/internal/run"
+)
+
+type testPipelineStore struct {
+	pipelines []run.StoredPipeline
+}
+
+func (s testPipelineStore) Save(pipeline run.StoredPipeline) error {
+	return errors.New("not implemented")
+}
+func (s testPipelineStore) Get(name string) (run.StoredPipeline, error) {
+	return run.StoredPipeline{}, &run.PipelineNotFoundError{Name: name}
+}
+func (s testPipelineStore) List() ([]run.StoredPipeline, error) {
+	return s.pipelines, nil
+}
+func (s testPipelineStore) Delete(name string) error {
+	return errors.New("not implemented")
+}
+
+// Counts the scheduled runs.
+type countingScheduler struct {
+	scheduled int
+}
+
+func (s *countingScheduler) Schedule(rn run.Run) (run.Status, error) {
+	s.scheduled++
+	return run.Status{Run: "PENDING", Jobs: make([]run.RunJob, 0)}, nil
+}
+func (s *countingScheduler) Status(runUID string) (run.Status, error) {
+	return run.Status{}, nil
+}
+func (s *countingScheduler) StatusList() ([]run.StatusListItem, error) {
+	return nil, nil
+}
+
+// Fails to schedule the first run.
+type failingScheduler struct {
+	countingScheduler
+}
+
+func (s *failingScheduler) Schedule(rn run.Run) (run.Status, error) {
+	if s.scheduled == 0 {
+		s.scheduled++
+		return run.Status{}, errors.New("Redis is unavailable")
+	}
+	return s.countingScheduler.Schedule(rn)
+}
+
+func newTestPipeline(repo, on string) run.StoredPipeline {
+	return run.StoredPipeline{
+		Name: "ci",
+		Spec: []byte(`{
+			"kind": "Pipeline",
+			"source": {"repo": "` + repo + `", "ref": "${{ params.commit }}"},
+			"on": ` + on + `,
+			"jobs": {
+				"test": {"image": "golang", "run": "go test ./..."}
+			}
+		}`),
+	}
+}
+
+func TestHookHandler(t *testing.T) {
+	Convey("Scenario: receive a git push hook", t, func() {
+		sched := &countingScheduler{}
+		w := httptest.NewRecorder()
+		headers := map[string]string{
+			"X-GitHub-Event":      "push",
+			"X-Hub-Signature-256": "sha256=" + sign(gitHubPushPayload),
+		}
+
+		Convey("Given a stored pipeline matches the repository and branch", func() {
+			store := testPipelineStore{[]run.StoredPipeline{
+				newTestPipeline("git@github.com:Tyrame/chainr.git", `{"push": {"branches": ["main"]}}`),
+				newTestPipeline("https://github.com/Tyrame/other.git", `{"push": {}}`),
+			}}
+			handler := newHandler(run.NewPipelineFactory(), store, sched, testSecret)
+
+			Convey("When the hook is received", func() {
+				handler.ServeHTTP(w, newTestRequest(t, gitHubPushPayload, headers))
+				var list run.RunList
+				json.NewDecoder(w.Body).Decode(&list)
+
+				Convey("The request should succeed with code 202", func() {
+					So(w.Code, ShouldEqual, 202)
+				})
+
+				Convey("A run of the matching pipeline should be scheduled", func() {
+					So(sched.scheduled, ShouldEqual, 1)
+					So(len(list.Items), ShouldEqual, 1)
+				})
+			})
+		})
+
+		Convey("Given the scheduling of a run of a matching pipeline fails", func() {
+			store := testPipelineStore{[]run.StoredPipeline{
+				newTestPipeline("git@github.com:Tyrame/chainr.git", `{"push": {}}`),
+				newTestPipeline("https://github.com/Tyrame/chainr.git", `{"push": {}}`),
+			}}
+			failing := &failingScheduler{}
+			handler := newHandler(run.NewPipelineFactory(), store, failing, testSecret)
+
+			Convey("When the hook is received", func() {
+				handler.ServeHTTP(w, newTestRequest(t, gitHubPushPayload, headers))
+				var result hookResult
+				json.NewDecoder(w.Body).Decode(&result)
+
+				Convey("The request should succeed with code 202", func() {
+					So(w.Code, ShouldEqual, 202)
+				})
+
+				Convey("The runs of the other pipelines should be scheduled", func() {
+					So(failing.scheduled, ShouldEqual, 2)
+					So(len(result.Items), ShouldEqual, 1)
+				})
+
+				Convey("The scheduling error should be returned", func() {
+					So(result.Errors, ShouldResemble, []string{"pipeline ci: Redis is unavailable"})
+				})
+			})
+		})
+
+		Convey("Given the payload is too large", func() {
+			handler := newHandler(run.NewPipelineFactory(), testPipelineStore{}, sched, testSecret)
+			payload := strings.Repeat(" ", maxPayloadSize) + gitHubPushPayload
+			headers["X-Hub-Signature-256"] = "sha256=" + sign(payload)
+
+			Convey("When the hook is received", func() {
+				handler.ServeHTTP(w, newTestRequest(t, payload, headers))
+
+				Convey("The request should fail with code 413", func() {
+					So(w.Code, ShouldEqual, 413)
+				})
+			})
+		})
+
+		Convey("Given no stored pipeline matches the branch", func() {
+			store := testPipelineStore{[]run.StoredPipeline{
+				newTestPipeline("https://github.com/Tyrame/chainr", `{"push": {"branches": ["release/*"]}}`),
+			}}
+			handler := newHandler(run.NewPipelineFactory(), store, sched, testSecret)
+
+			Convey("When the hook is received", func() {
+				handler.ServeHTTP(w, newTestRequest(t, gitHubPushPayload, headers))
+
+				Convey("No run should be scheduled", func() {
+					So(w.Code, ShouldEqual, 202)
+					So(sched.scheduled, ShouldEqual, 0)
+				})
+			})
+		})
+
+		Convey("Given hooks are not configured", func() {
+			handler := newHandler(run.NewPipelineFactory(), testPipelineStore{}, sched, "")
+
+			Convey("When the hook is received", func() {
+				handler.ServeHTTP(w, newTestRequest(t, gitHubPushPayload, headers))
+
+				Convey("The request should fail with code 403", func() {
+					So(w.Code, ShouldEqual, 403)
+				})
+			})
+		})
+
+		Convey("Given the signature is invalid", func() {
+			handler := newHandler(run.NewPipelineFactory(), testPipelineStore{}, sched, "other")
+
+			Convey("When the hook is received", func() {
+				handler.ServeHTTP(w, newTestRequest(t, gitHubPushPayload, headers))
+
+				Convey("The request should fail with code 401", func() {
+					So(w.Code, ShouldEqual, 401)
+				})
+			})
+		})
+	})
+}
+
+func TestNormalizeRepo(t *testing.T) {
+	repos := []string{
+		"https://github.com/Tyrame/chainr.git",
+		"git@github.com:Tyrame/chainr.git",
+		"ssh://git@github.com/Tyrame/chainr",
+		"https://user@github.com/tyrame/chainr/",
+	}
+	for _, repo := range repos {
+		if normalized := normalizeRepo(repo); normalized != "github.com/tyrame/chainr" {
+			t.Errorf("normalizeRepo(%v) = %v, expected github.com/tyrame/chainr", repo, normalized)
+		}
+	}
+}
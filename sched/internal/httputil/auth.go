@@ -0,0 +1,283 @@
+package httputil
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Roles are ordered: each role is granted the permissions of the previous
+// ones.
+type Role int
+
+const (
+	// Anonymous routes do not require authentication, e.g. routes
+	// authenticated by their own secret like git hooks.
+	Anonymous Role = iota
+	// Viewers can read resources.
+	Viewer
+	// Submitters can also run pipelines.
+	Submitter
+	// Admins can also manage stored pipelines and triggers.
+	Admin
+)
+
+var roleNames = map[Role]string{
+	Anonymous: "anonymous",
+	Viewer:    "viewer",
+	Submitter: "submitter",
+	Admin:     "admin",
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// Parses a role name. Anonymous can not be granted, so it is not parsed.
+func ParseRole(name string) (Role, bool) {
+	for role, roleName := range roleNames {
+		if role != Anonymous && roleName == name {
+			return role, true
+		}
+	}
+	return Anonymous, false
+}
+
+// Parses a role granted on all projects, e.g. viewer, or on a project, e.g.
+// team-a:submitter. The project is empty for roles granted on all projects.
+func ParseGrant(grant string) (string, Role, bool) {
+	project := ""
+	if i := strings.LastIndex(grant, ":"); i >= 0 {
+		project, grant = grant[:i], grant[i+1:]
+		if len(project) == 0 {
+			return "", Anonymous, false
+		}
+	}
+	role, ok := ParseRole(grant)
+	return project, role, ok
+}
+
+// The principal is the authenticated caller.
+type Principal struct {
+	Name string
+	// Role on all projects.
+	Role Role
+	// Roles granted on specific projects, by project name.
+	Projects map[string]Role
+}
+
+// Grants the role on the project, or on all projects if the project is
+// empty. A principal keeps its highest role.
+func (p *Principal) Grant(project string, role Role) {
+	if len(project) == 0 {
+		if role > p.Role {
+			p.Role = role
+		}
+		return
+	}
+	if p.Projects == nil {
+		p.Projects = make(map[string]Role)
+	}
+	if role > p.Projects[project] {
+		p.Projects[project] = role
+	}
+}
+
+// Returns the role of the principal on the project: its role on all
+// projects, or the role granted on the project if it is higher.
+func (p *Principal) ProjectRole(project string) Role {
+	if role := p.Projects[project]; role > p.Role {
+		return role
+	}
+	return p.Role
+}
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Authenticator authenticates the bearer tokens of requests.
+// If the token is not valid, an error is returned.
+type Authenticator interface {
+	Authenticate(token string) (*Principal, error)
+}
+
+// Authenticators tries each authenticator in order, and returns the first
+// principal authenticated.
+type Authenticators []Authenticator
+
+func (a Authenticators) Authenticate(token string) (*Principal, error) {
+	err := ErrInvalidToken
+	for _, auth := range a {
+		var principal *Principal
+		principal, err = auth.Authenticate(token)
+		if err == nil {
+			return principal, nil
+		}
+	}
+	return nil, err
+}
+
+// StaticTokens authenticates a fixed set of tokens. Tokens are indexed by
+// their hash, so that looking them up does not leak their value.
+type StaticTokens map[[sha256.Size]byte]Principal
+
+func (s StaticTokens) Add(token string, principal Principal) {
+	s[sha256.Sum256([]byte(token))] = principal
+}
+
+func (s StaticTokens) Authenticate(token string) (*Principal, error) {
+	principal, ok := s[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return &principal, nil
+}
+
+// Reads static tokens from a file containing a token per line, in the format
+// `<token> <roles> <name>`, roles being a comma-separated list of grants, see
+// ParseGrant. Empty lines and lines starting with # are ignored.
+func LoadStaticTokens(path string) (StaticTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(StaticTokens)
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%v:%v: expected <token> <roles> <name>", path, i)
+		}
+		principal := Principal{Name: fields[2]}
+		for _, grant := range strings.Split(fields[1], ",") {
+			project, role, ok := ParseGrant(grant)
+			if !ok {
+				return nil, fmt.Errorf("%v:%v: unknown role %v", path, i, grant)
+			}
+			principal.Grant(project, role)
+		}
+		tokens.Add(fields[0], principal)
+	}
+	return tokens, scanner.Err()
+}
+
+// Creates the authenticator from the environment.
+// Static tokens are read from the file set in AUTH_TOKENS_FILE, and JWTs are
+// validated against the JWKS at AUTH_JWKS_URL. See NewJWTAuthenticator for
+// the JWT claims settings. The audience is required with AUTH_JWKS_URL, as
+// the provider may issue tokens for other applications.
+// If neither is set, an error is returned, unless authentication is
+// explicitly disabled with AUTH_DISABLED=true: nil is then returned, and the
+// API is not authenticated.
+func NewAuthenticator() (Authenticator, error) {
+	var auth Authenticators
+
+	if path, ok := os.LookupEnv("AUTH_TOKENS_FILE"); ok {
+		tokens, err := LoadStaticTokens(path)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, tokens)
+	}
+
+	if url, ok := os.LookupEnv("AUTH_JWKS_URL"); ok {
+		if len(os.Getenv("AUTH_JWT_AUDIENCE")) == 0 {
+			return nil, errors.New("set AUTH_JWT_AUDIENCE to accept JWTs issued for the API only")
+		}
+		rolesClaim := "roles"
+		if val, ok := os.LookupEnv("AUTH_JWT_ROLES_CLAIM"); ok {
+			rolesClaim = val
+		}
+		auth = append(auth, NewJWTAuthenticator(
+			NewRemoteKeySet(url),
+			os.Getenv("AUTH_JWT_ISSUER"),
+			os.Getenv("AUTH_JWT_AUDIENCE"),
+			rolesClaim,
+		))
+	}
+
+	if len(auth) == 0 {
+		if os.Getenv("AUTH_DISABLED") != "true" {
+			return nil, errors.New("set AUTH_TOKENS_FILE or AUTH_JWKS_URL, or AUTH_DISABLED=true to open the API to anyone")
+		}
+		log.Println("WARNING: authentication is disabled, the API is open to anyone")
+		return nil, nil
+	}
+	return auth, nil
+}
+
+// Policy returns the role required by a request, and the project the request
+// accesses. If the project is empty, the role must be granted on all
+// projects.
+type Policy func(r *http.Request) (Role, string)
+
+type principalKey struct{}
+
+// Returns the principal authenticated by the AuthHandler, or nil if the
+// request was not authenticated.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// AuthHandler authenticates requests with their bearer token, and checks the
+// principal has the role required by the policy.
+type AuthHandler struct {
+	h      http.Handler
+	auth   Authenticator
+	policy Policy
+}
+
+// If auth is nil, requests are not authenticated.
+func NewAuthHandler(h http.Handler, auth Authenticator, policy Policy) http.Handler {
+	if auth == nil {
+		return h
+	}
+	return &AuthHandler{h, auth, policy}
+}
+
+func (a *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	role, project := a.policy(r)
+	if role == Anonymous {
+		a.h.ServeHTTP(w, r)
+		return
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chainr"`)
+		WriteError(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	principal, err := a.auth.Authenticate(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		log.Println("Authentication failed:", err.Error())
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chainr", error="invalid_token"`)
+		WriteError(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	granted := principal.Role
+	if len(project) > 0 {
+		granted = principal.ProjectRole(project)
+	}
+	if granted < role {
+		WriteError(w, fmt.Sprintf("Role %v is required", role), http.StatusForbidden)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), principalKey{}, principal)
+	a.h.ServeHTTP(w, r.WithContext(ctx))
+}
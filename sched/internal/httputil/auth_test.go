@@ -0,0 +1,187 @@
+package httputil
+
+import (
+	"testing"
+
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Writes the name of the authenticated principal.
+type principalHandler struct{}
+
+func (h principalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if principal := PrincipalFromContext(r.Context()); principal != nil {
+		w.Header().Set("Principal", principal.Name)
+	}
+}
+
+// Requests access the project of their path, if any.
+func methodRole(r *http.Request) (Role, string) {
+	project := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case "OPTIONS":
+		return Anonymous, project
+	case "GET":
+		return Viewer, project
+	case "POST":
+		return Submitter, project
+	}
+	return Admin, ""
+}
+
+func TestAuthHandler(t *testing.T) {
+	tokens := make(StaticTokens)
+	tokens.Add("viewer-token", Principal{Name: "alice", Role: Viewer})
+	tokens.Add("admin-token", Principal{Name: "bob", Role: Admin})
+	tokens.Add("team-token", Principal{Name: "carol", Role: Viewer, Projects: map[string]Role{"team-a": Admin}})
+	handler := NewAuthHandler(principalHandler{}, tokens, methodRole)
+
+	tests := []struct {
+		method    string
+		path      string
+		token     string
+		code      int
+		principal string
+	}{
+		{"OPTIONS", "/", "", http.StatusOK, ""},
+		{"GET", "/", "", http.StatusUnauthorized, ""},
+		{"GET", "/", "invalid", http.StatusUnauthorized, ""},
+		{"GET", "/", "viewer-token", http.StatusOK, "alice"},
+		{"POST", "/", "viewer-token", http.StatusForbidden, ""},
+		{"POST", "/", "admin-token", http.StatusOK, "bob"},
+		{"POST", "/team-a", "admin-token", http.StatusOK, "bob"},
+		{"POST", "/team-a", "team-token", http.StatusOK, "carol"},
+		{"POST", "/team-b", "team-token", http.StatusForbidden, ""},
+		{"GET", "/team-b", "team-token", http.StatusOK, "carol"},
+		{"DELETE", "/team-a", "team-token", http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(test.token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("%v %v with token %q: w.Code = %v, expected %v", test.method, test.path, test.token, w.Code, test.code)
+		}
+		if principal := w.Header().Get("Principal"); principal != test.principal {
+			t.Errorf("%v %v with token %q: principal = %v, expected %v", test.method, test.path, test.token, principal, test.principal)
+		}
+		if w.Code == http.StatusUnauthorized && len(w.Header().Get("WWW-Authenticate")) == 0 {
+			t.Errorf("%v %v with token %q: WWW-Authenticate header is missing", test.method, test.path, test.token)
+		}
+	}
+}
+
+// Without authenticator, the API is open.
+func TestAuthHandlerUnconfigured(t *testing.T) {
+	handler := NewAuthHandler(principalHandler{}, nil, methodRole)
+	r, err := http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code = %v, expected 200", w.Code)
+	}
+}
+
+func TestLoadStaticTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainr-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens")
+	content := "# CI server\nci-token submitter ci\n\nops-token admin ops\nteam-token viewer,team-a:submitter,team-b:viewer team\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := LoadStaticTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err := tokens.Authenticate("ci-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Name != "ci" || principal.Role != Submitter || len(principal.Projects) > 0 {
+		t.Errorf("principal = %v, expected ci submitter", principal)
+	}
+	principal, err = tokens.Authenticate("team-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.ProjectRole("team-a") != Submitter || principal.ProjectRole("team-b") != Viewer || principal.ProjectRole("team-c") != Viewer {
+		t.Errorf("principal = %v, expected team submitter of team-a, and viewer", principal)
+	}
+
+	for _, content := range []string{"token superuser root\n", "token :viewer root\n", "token team-a:owner root\n"} {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadStaticTokens(path); err == nil {
+			t.Errorf("%q: err = nil, expected unknown role", content)
+		}
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	first := make(StaticTokens)
+	first.Add("first", Principal{Name: "first", Role: Viewer})
+	second := make(StaticTokens)
+	second.Add("second", Principal{Name: "second", Role: Admin})
+	auth := Authenticators{first, second}
+
+	if principal, err := auth.Authenticate("second"); err != nil || principal.Name != "second" {
+		t.Errorf("principal = %v, err = %v, expected second", principal, err)
+	}
+	if _, err := auth.Authenticate("third"); err == nil {
+		t.Errorf("err = nil, expected invalid token")
+	}
+}
+
+func TestNewAuthenticatorJWTWithoutAudience(t *testing.T) {
+	os.Setenv("AUTH_JWKS_URL", "https://issuer.test/jwks")
+	defer os.Unsetenv("AUTH_JWKS_URL")
+	if _, err := NewAuthenticator(); err == nil {
+		t.Errorf("err = nil, expected the audience to be required")
+	}
+
+	os.Setenv("AUTH_JWT_AUDIENCE", "chainr")
+	defer os.Unsetenv("AUTH_JWT_AUDIENCE")
+	if _, err := NewAuthenticator(); err != nil {
+		t.Errorf("err = %v, expected nil", err)
+	}
+}
+
+func TestNewAuthenticatorUnconfigured(t *testing.T) {
+	if _, err := NewAuthenticator(); err == nil {
+		t.Errorf("err = nil, expected authentication to be required")
+	}
+
+	os.Setenv("AUTH_DISABLED", "true")
+	defer os.Unsetenv("AUTH_DISABLED")
+	auth, err := NewAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != nil {
+		t.Errorf("auth = %v, expected nil", auth)
+	}
+}
@@ -0,0 +1,362 @@
+package httputil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tolerated clock skew when checking the validity period of tokens.
+const jwtLeeway = time.Minute
+
+// Minimum delay between two fetches of a remote key set, so that tokens with
+// unknown key IDs do not flood the identity provider.
+const jwksRefreshInterval = time.Minute
+
+// KeySet returns the public keys used to verify JWT signatures.
+// If kid is empty, all the keys are returned.
+type KeySet interface {
+	Keys(kid string) ([]crypto.PublicKey, error)
+}
+
+// A JSON Web Key, as defined by RFC 7517. Only RSA and EC public keys are
+// supported.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %v", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// RemoteKeySet fetches keys from a JWKS URL, e.g. the jwks_uri of an OIDC
+// provider. Keys are cached, and fetched again when a token references an
+// unknown key ID, to support key rotation.
+type RemoteKeySet struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *RemoteKeySet) Keys(kid string) ([]crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := s.find(kid)
+	if len(keys) > 0 || time.Since(s.fetched) < jwksRefreshInterval {
+		return keys, nil
+	}
+
+	if err := s.fetch(); err != nil {
+		return nil, err
+	}
+	return s.find(kid), nil
+}
+
+func (s *RemoteKeySet) find(kid string) []crypto.PublicKey {
+	keys := make([]crypto.PublicKey, 0)
+	for keyID, key := range s.keys {
+		if len(kid) == 0 || keyID == kid {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *RemoteKeySet) fetch() error {
+	s.fetched = time.Now()
+
+	res, err := s.client.Get(s.url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch JWKS: unexpected status %v", res.Status)
+	}
+
+	var set jwks
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return fmt.Errorf("fetch JWKS: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i, k := range set.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Keys of unsupported types are ignored.
+			continue
+		}
+		kid := k.Kid
+		if len(kid) == 0 {
+			kid = fmt.Sprintf("#%v", i)
+		}
+		keys[kid] = key
+	}
+	s.keys = keys
+	return nil
+}
+
+// JWTAuthenticator validates signed JWTs, e.g. OIDC ID tokens or access
+// tokens.
+// Tokens must be signed by a key of the key set, with RS256, RS384, RS512,
+// ES256, ES384 or ES512, and expire: the exp claim is required. If issuer and
+// audience are set, the iss and aud claims must match them.
+// The principal is the sub claim, and its roles the grants found in the roles
+// claim, which can be nested, e.g. realm_access.roles: roles on all projects,
+// e.g. viewer, or on a project, e.g. team-a:submitter.
+type JWTAuthenticator struct {
+	keys       KeySet
+	issuer     string
+	audience   string
+	rolesClaim string
+	now        func() time.Time
+}
+
+func NewJWTAuthenticator(keys KeySet, issuer, audience, rolesClaim string) *JWTAuthenticator {
+	return &JWTAuthenticator{keys, issuer, audience, rolesClaim, time.Now}
+}
+
+// Supported signature algorithms, and their hash.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (a *JWTAuthenticator) Authenticate(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if err := a.verify(header, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := a.validateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	sub, _ := claims["sub"].(string)
+	return a.principal(sub, claims), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (a *JWTAuthenticator) verify(header jwtHeader, signed string, signature []byte) error {
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	keys, err := a.keys.Keys(header.Kid)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			if strings.HasPrefix(header.Alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if strings.HasPrefix(header.Alg, "ES") && verifyECDSA(k, digest, signature) {
+				return nil
+			}
+		}
+	}
+	return errors.New("invalid JWT signature")
+}
+
+// ECDSA signatures are the concatenation of r and s, as defined by RFC 7518.
+func verifyECDSA(key *ecdsa.PublicKey, digest, signature []byte) bool {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*size {
+		return false
+	}
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+	return ecdsa.Verify(key, digest, r, s)
+}
+
+func (a *JWTAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("JWT has no expiration time")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errors.New("JWT is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-jwtLeeway)) {
+		return errors.New("JWT is not valid yet")
+	}
+
+	if len(a.issuer) > 0 {
+		if iss, _ := claims["iss"].(string); iss != a.issuer {
+			return fmt.Errorf("unexpected JWT issuer %q", iss)
+		}
+	}
+	if len(a.audience) > 0 && !containsString(claims["aud"], a.audience) {
+		return errors.New("unexpected JWT audience")
+	}
+	return nil
+}
+
+// Returns the principal of the subject, granted the roles of the roles claim.
+// Entries of the claim which are not grants are ignored, see ParseGrant.
+func (a *JWTAuthenticator) principal(sub string, claims map[string]interface{}) *Principal {
+	principal := &Principal{Name: sub}
+	var value interface{} = claims
+	for _, name := range strings.Split(a.rolesClaim, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return principal
+		}
+		value = m[name]
+	}
+
+	var names []interface{}
+	switch v := value.(type) {
+	case string:
+		names = []interface{}{v}
+	case []interface{}:
+		names = v
+	}
+
+	for _, name := range names {
+		s, _ := name.(string)
+		if project, role, ok := ParseGrant(s); ok {
+			principal.Grant(project, role)
+		}
+	}
+	return principal
+}
+
+// The value is either a string, or an array of strings.
+func containsString(value interface{}, s string) bool {
+	switch v := value.(type) {
+	case string:
+		return v == s
+	case []interface{}:
+		for _, item := range v {
+			if item == s {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package httputil
+
+import (
+	"testing"
+
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(t, jwtHeader{"RS256", kid}) + "." + encodeSegment(t, claims)
+	h := crypto.SHA256.New()
+	h.Write([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(t, jwtHeader{"ES256", kid}) + "." + encodeSegment(t, claims)
+	h := crypto.SHA256.New()
+	h.Write([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rb):32], rb)
+	copy(signature[64-len(sb):], sb)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// Serves the JWKS of the keys, and counts the requests.
+func newJWKSServer(rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey, requests *int) *httptest.Server {
+	set := jwks{[]jwk{
+		{
+			Kid: "rsa",
+			Kty: "RSA",
+			Use: "sig",
+			N:   encodeBigInt(rsaKey.N),
+			E:   encodeBigInt(big.NewInt(int64(rsaKey.E))),
+		},
+		{
+			Kid: "ec",
+			Kty: "EC",
+			Crv: "P-256",
+			X:   encodeBigInt(ecKey.X),
+			Y:   encodeBigInt(ecKey.Y),
+		},
+	}}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		json.NewEncoder(w).Encode(set)
+	}))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := 0
+	server := newJWKSServer(rsaKey, ecKey, &requests)
+	defer server.Close()
+
+	auth := NewJWTAuthenticator(NewRemoteKeySet(server.URL), "https://issuer.test", "chainr", "realm_access.roles")
+	now := time.Now()
+	claims := func(roles ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":          "https://issuer.test",
+			"aud":          []string{"chainr", "other"},
+			"sub":          "alice",
+			"exp":          now.Add(time.Hour).Unix(),
+			"realm_access": map[string]interface{}{"roles": roles},
+		}
+	}
+
+	principal, err := auth.Authenticate(signRS256(t, rsaKey, "rsa", claims("offline_access", "submitter")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Name != "alice" || principal.Role != Submitter {
+		t.Errorf("principal = %v, expected alice submitter", principal)
+	}
+
+	principal, err = auth.Authenticate(signES256(t, ecKey, "ec", claims("viewer", "admin")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Role != Admin {
+		t.Errorf("principal.Role = %v, expected admin", principal.Role)
+	}
+
+	principal, err = auth.Authenticate(signRS256(t, rsaKey, "rsa", claims("team-a:submitter", "team-b:owner")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Role != Anonymous || principal.ProjectRole("team-a") != Submitter || principal.ProjectRole("team-b") != Anonymous {
+		t.Errorf("principal = %v, expected submitter of team-a only", principal)
+	}
+
+	principal, err = auth.Authenticate(signRS256(t, rsaKey, "rsa", claims()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Role != Anonymous {
+		t.Errorf("principal.Role = %v, expected anonymous", principal.Role)
+	}
+
+	expired := claims("admin")
+	expired["exp"] = now.Add(-time.Hour).Unix()
+	noExpiration := claims("admin")
+	delete(noExpiration, "exp")
+	wrongIssuer := claims("admin")
+	wrongIssuer["iss"] = "https://other.test"
+	wrongAudience := claims("admin")
+	wrongAudience["aud"] = "other"
+	invalid := map[string]string{
+		"expired":        signRS256(t, rsaKey, "rsa", expired),
+		"no expiration":  signRS256(t, rsaKey, "rsa", noExpiration),
+		"wrong issuer":   signRS256(t, rsaKey, "rsa", wrongIssuer),
+		"wrong audience": signRS256(t, rsaKey, "rsa", wrongAudience),
+		"wrong key":      signRS256(t, otherKey, "rsa", claims("admin")),
+		"unknown kid":    signRS256(t, rsaKey, "unknown", claims("admin")),
+		"not a JWT":      "static-token",
+	}
+	for name, token := range invalid {
+		if _, err := auth.Authenticate(token); err == nil {
+			t.Errorf("%v: err = nil, expected an error", name)
+		}
+	}
+
+	none := encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, claims("admin")) + "."
+	if _, err := auth.Authenticate(none); err == nil || !strings.Contains(err.Error(), "algorithm") {
+		t.Errorf("err = %v, expected unsupported algorithm", err)
+	}
+
+	// The unknown kid must not refetch the keys before the refresh interval.
+	if requests != 1 {
+		t.Errorf("requests = %v, expected 1", requests)
+	}
+}
@@ -0,0 +1,198 @@
+package run
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Conditions of jobs are expressions evaluated by the workers, once the
+// dependencies of the jobs completed. They are parsed when pipelines are
+// created, so that invalid expressions are refused rather than failing runs.
+// The syntax is the one of the worker:
+// - string literals, in double quotes: "prod"
+// - number literals: 42, 1.5
+// - boolean literals: true, false
+// - references to the run context: params.env, jobs.extract.status
+// - comparison operators: ==, !=, <, <=, >, >=
+// - logical operators: &&, ||, !
+// - parentheses
+
+// Returns an error if the expression is invalid.
+func validateExpr(expr string) error {
+	tokens, err := tokenizeExpr(expr)
+	if err != nil {
+		return err
+	}
+
+	p := exprParser{tokens: tokens}
+	if err := p.parseOr(); err != nil {
+		return err
+	}
+	if p.pos < len(p.tokens) {
+		return errors.New("unexpected token " + p.tokens[p.pos].val)
+	}
+	return nil
+}
+
+const (
+	tokenString = iota
+	tokenNumber
+	tokenIdent
+	tokenOperator
+)
+
+type exprToken struct {
+	kind int
+	val  string
+}
+
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+func tokenizeExpr(expr string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0)
+	runes := []rune(expr)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '"':
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+			}
+			if j >= len(runes) {
+				return nil, errors.New("unterminated string in expression")
+			}
+			tokens = append(tokens, exprToken{tokenString, string(runes[i+1 : j])})
+			i = j + 1
+
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, exprToken{tokenNumber, string(runes[i:j])})
+			i = j
+
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || strings.ContainsRune("_-.", runes[j])) {
+				j++
+			}
+			tokens = append(tokens, exprToken{tokenIdent, string(runes[i:j])})
+			i = j
+
+		default:
+			found := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, exprToken{tokenOperator, op})
+					i += len([]rune(op))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, errors.New("unexpected character " + string(r) + " in expression")
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) acceptOperator(ops ...string) bool {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenOperator {
+		return false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].val == op {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() error {
+	if err := p.parseAnd(); err != nil {
+		return err
+	}
+	for p.acceptOperator("||") {
+		if err := p.parseAnd(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *exprParser) parseAnd() error {
+	if err := p.parseNot(); err != nil {
+		return err
+	}
+	for p.acceptOperator("&&") {
+		if err := p.parseNot(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *exprParser) parseNot() error {
+	if p.acceptOperator("!") {
+		return p.parseNot()
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() error {
+	if err := p.parsePrimary(); err != nil {
+		return err
+	}
+	if !p.acceptOperator("==", "!=", "<=", ">=", "<", ">") {
+		return nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() error {
+	if p.pos >= len(p.tokens) {
+		return errors.New("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+
+	switch t.kind {
+	case tokenString, tokenIdent:
+		return nil
+	case tokenNumber:
+		if _, err := strconv.ParseFloat(t.val, 64); err != nil {
+			return errors.New("invalid number " + t.val)
+		}
+		return nil
+	}
+
+	if t.val == "(" {
+		if err := p.parseOr(); err != nil {
+			return err
+		}
+		if !p.acceptOperator(")") {
+			return errors.New("missing closing parenthesis in expression")
+		}
+		return nil
+	}
+
+	return errors.New("unexpected token " + t.val)
+}
@@ -0,0 +1,38 @@
+package run
+
+import "testing"
+
+func TestValidateExpr(t *testing.T) {
+	exprs := []string{
+		`params.env == "prod"`,
+		`params.env == "prod" && jobs.extract.outputs.rows > 0`,
+		`!(jobs.extract.status == "FAILED") || jobs.build.reason == "Evicted"`,
+		`"a\"b" == "a\"b"`,
+		`1.5 < 2`,
+		`true`,
+	}
+	for _, expr := range exprs {
+		if err := validateExpr(expr); err != nil {
+			t.Errorf("validateExpr(%v) returned error %v", expr, err)
+		}
+	}
+}
+
+func TestValidateExprInvalid(t *testing.T) {
+	exprs := []string{
+		``,
+		`params.env ==`,
+		`"unterminated`,
+		`(true`,
+		`true)`,
+		`1.2.3 == 1`,
+		`params.env = "prod"`,
+		`params.env == "prod" ; rm -rf /`,
+		`==`,
+	}
+	for _, expr := range exprs {
+		if err := validateExpr(expr); err == nil {
+			t.Errorf("validateExpr(%v) returned a nil error", expr)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package run
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Matches references to matrix parameters, like ${{ matrix.region }}.
+var matrixRefRegexp = regexp.MustCompile(`\$\{\{\s*matrix\.([A-Za-z0-9_-]+)\s*\}\}`)
+
+// Expands jobs having a matrix into one job per combination of
+// matrix values.
+// Expanded jobs are named after the matrix job and the values, in the order
+// of the sorted parameter names, e.g. "load-eu-users" for the job "load" with
+// the matrix {"region": ["eu"], "table": ["users"]}.
+// References to matrix parameters in the image, the run command, the command
+// and arguments, the working directory, the environment, the condition, the
+// steps, the services, the mount paths, the outputs, the labels and
+// annotations, and the strings of the pod template are replaced by their
+// values.
+// Dependencies and inputs referencing a matrix job are replaced by references
+// to all its expansions.
+func expandMatrices(jobs map[string]Job) (map[string]Job, error) {
+	expanded := make(map[string]Job, len(jobs))
+	expansions := make(map[string][]string)
+
+	for name, job := range jobs {
+		if len(job.Matrix) == 0 {
+			expanded[name] = job
+			continue
+		}
+
+		for _, combination := range matrixCombinations(job.Matrix) {
+			jobName := name + "-" + strings.Join(combination.values, "-")
+			if len(jobName) > nameMaxLength {
+				return nil, errors.New("matrix expansion " + jobName + " is longer than " + strconv.Itoa(nameMaxLength) + " characters")
+			}
+			_, exists := jobs[jobName]
+			_, expandedExists := expanded[jobName]
+			if exists || expandedExists {
+				return nil, errors.New("matrix expansion " + jobName + " conflicts with an existing job")
+			}
+
+			expanded[jobName] = Job{
+				Image:        combination.replace(job.Image),
+				Run:          combination.replace(job.Run),
+				Command:      combination.replaceAll(job.Command),
+				Args:         combination.replaceAll(job.Args),
+				WorkingDir:   combination.replace(job.WorkingDir),
+				Shell:        job.Shell,
+				Env:          combination.replaceValues(job.Env),
+				If:           combination.replace(job.If),
+				Steps:        combination.replaceSteps(job.Steps),
+				VolumeMounts: combination.replaceVolumeMounts(job.VolumeMounts),
+				Services:     combination.replaceServices(job.Services),
+				DependsOn:    job.DependsOn,
+				Outputs:      combination.replaceAll(job.Outputs),
+				Inputs:       job.Inputs,
+				Labels:       combination.replaceValues(job.Labels),
+				Annotations:  combination.replaceValues(job.Annotations),
+				Runner:       job.Runner,
+				PodTemplate:  combination.replaceTemplate(job.PodTemplate),
+			}
+			expansions[name] = append(expansions[name], jobName)
+		}
+	}
+
+	for name, job := range expanded {
+		job.DependsOn = expandDependencies(job.DependsOn, expansions)
+		job.Inputs = expandInputs(job.Inputs, expansions)
+		expanded[name] = job
+	}
+
+	return expanded, nil
+}
+
+func expandDependencies(deps []JobDependency, expansions map[string][]string) []JobDependency {
+	expandedDeps := make([]JobDependency, 0, len(deps))
+	for _, dep := range deps {
+		jobNames, ok := expansions[dep.Job]
+		if !ok {
+			expandedDeps = append(expandedDeps, dep)
+			continue
+		}
+
+		for _, jobName := range jobNames {
+			expandedDeps = append(expandedDeps, JobDependency{
+				Job:        jobName,
+				Conditions: dep.Conditions,
+			})
+		}
+	}
+	return expandedDeps
+}
+
+func expandInputs(inputs []string, expansions map[string][]string) []string {
+	expandedInputs := make([]string, 0, len(inputs))
+	for _, input := range inputs {
+		if jobNames, ok := expansions[input]; ok {
+			expandedInputs = append(expandedInputs, jobNames...)
+		} else {
+			expandedInputs = append(expandedInputs, input)
+		}
+	}
+	return expandedInputs
+}
+
+// A single combination of matrix values.
+type matrixCombination struct {
+	params map[string]string
+	values []string
+}
+
+// Replaces references to matrix parameters in str.
+// Unknown parameters are left untouched.
+func (c matrixCombination) replace(str string) string {
+	return matrixRefRegexp.ReplaceAllStringFunc(str, func(ref string) string {
+		param := matrixRefRegexp.FindStringSubmatch(ref)[1]
+		if val, ok := c.params[param]; ok {
+			return val
+		}
+		return ref
+	})
+}
+
+func (c matrixCombination) replaceAll(strs []string) []string {
+	if strs == nil {
+		return nil
+	}
+	replaced := make([]string, 0, len(strs))
+	for _, str := range strs {
+		replaced = append(replaced, c.replace(str))
+	}
+	return replaced
+}
+
+// Replaces references in the values of the map, e.g. of the environment.
+func (c matrixCombination) replaceValues(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	replaced := make(map[string]string, len(values))
+	for k, v := range values {
+		replaced[k] = c.replace(v)
+	}
+	return replaced
+}
+
+func (c matrixCombination) replaceSteps(steps []JobStep) []JobStep {
+	if steps == nil {
+		return nil
+	}
+	replaced := make([]JobStep, 0, len(steps))
+	for _, step := range steps {
+		replaced = append(replaced, JobStep{
+			Name:  step.Name,
+			Image: c.replace(step.Image),
+			Run:   c.replace(step.Run),
+		})
+	}
+	return replaced
+}
+
+// The volume name must reference a declared volume, so it is not replaced.
+func (c matrixCombination) replaceVolumeMounts(mounts []VolumeMount) []VolumeMount {
+	if mounts == nil {
+		return nil
+	}
+	replaced := make([]VolumeMount, 0, len(mounts))
+	for _, mount := range mounts {
+		replaced = append(replaced, VolumeMount{
+			Name:      mount.Name,
+			MountPath: c.replace(mount.MountPath),
+			SubPath:   c.replace(mount.SubPath),
+			ReadOnly:  mount.ReadOnly,
+		})
+	}
+	return replaced
+}
+
+func (c matrixCombination) replaceServices(services map[string]Service) map[string]Service {
+	if services == nil {
+		return nil
+	}
+	replaced := make(map[string]Service, len(services))
+	for name, service := range services {
+		replaced[name] = Service{
+			Image: c.replace(service.Image),
+			Env:   c.replaceValues(service.Env),
+		}
+	}
+	return replaced
+}
+
+// Replaces references in the strings of the pod template, at any depth.
+func (c matrixCombination) replaceTemplate(template map[string]interface{}) map[string]interface{} {
+	if template == nil {
+		return nil
+	}
+	return c.replaceTemplateValue(template).(map[string]interface{})
+}
+
+func (c matrixCombination) replaceTemplateValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return c.replace(v)
+	case map[string]interface{}:
+		replaced := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			replaced[k] = c.replaceTemplateValue(item)
+		}
+		return replaced
+	case []interface{}:
+		replaced := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			replaced = append(replaced, c.replaceTemplateValue(item))
+		}
+		return replaced
+	}
+	return value
+}
+
+// Returns the cartesian product of the matrix values.
+// Combinations are ordered according to the sorted parameter names,
+// and to the order of the values.
+func matrixCombinations(matrix map[string][]string) []matrixCombination {
+	params := make([]string, 0, len(matrix))
+	for param := range matrix {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+
+	combinations := []matrixCombination{
+		matrixCombination{make(map[string]string), []string{}},
+	}
+	for _, param := range params {
+		next := make([]matrixCombination, 0, len(combinations)*len(matrix[param]))
+		for _, c := range combinations {
+			for _, val := range matrix[param] {
+				m := make(map[string]string, len(c.params)+1)
+				for k, v := range c.params {
+					m[k] = v
+				}
+				m[param] = val
+
+				values := make([]string, len(c.values), len(c.values)+1)
+				copy(values, c.values)
+				values = append(values, val)
+
+				next = append(next, matrixCombination{m, values})
+			}
+		}
+		combinations = next
+	}
+
+	return combinations
+}
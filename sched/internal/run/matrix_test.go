@@ -0,0 +1,163 @@
+package run
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandMatrices(t *testing.T) {
+	jobs := map[string]Job{
+		"load": Job{
+			Image:  "loader:${{ matrix.region }}",
+			Run:    "load ${{ matrix.table }} ${{ matrix.unknown }}",
+			Args:   []string{"--table", "${{ matrix.table }}"},
+			Labels: map[string]string{"team": "data"},
+			Runner: "cpu",
+			Matrix: map[string][]string{
+				"table":  []string{"users", "orders"},
+				"region": []string{"eu", "us"},
+			},
+		},
+		"report": Job{
+			Image: "busybox",
+			Run:   "exit 0",
+			DependsOn: []JobDependency{
+				JobDependency{Job: "load"},
+			},
+		},
+	}
+
+	expanded, err := expandMatrices(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expanded) != 5 {
+		t.Fatalf("len(expanded) = %v, expected 5", len(expanded))
+	}
+
+	job, ok := expanded["load-us-orders"]
+	if !ok {
+		t.Fatalf("load-us-orders was not found in %v", expanded)
+	}
+	if job.Image != "loader:us" {
+		t.Errorf("job.Image = %v, expected loader:us", job.Image)
+	}
+	if job.Run != "load orders ${{ matrix.unknown }}" {
+		t.Errorf("job.Run = %v, expected load orders ${{ matrix.unknown }}", job.Run)
+	}
+	if len(job.Args) != 2 || job.Args[1] != "orders" {
+		t.Errorf("job.Args = %v, expected [--table orders]", job.Args)
+	}
+	if job.Matrix != nil {
+		t.Errorf("job.Matrix = %v, expected nil", job.Matrix)
+	}
+	if job.Labels["team"] != "data" {
+		t.Errorf("job.Labels = %v, expected team data", job.Labels)
+	}
+	if job.Runner != "cpu" {
+		t.Errorf("job.Runner = %v, expected cpu", job.Runner)
+	}
+
+	expectedDeps := []string{"load-eu-users", "load-eu-orders", "load-us-users", "load-us-orders"}
+	deps := expanded["report"].DependsOn
+	if len(deps) != len(expectedDeps) {
+		t.Fatalf("len(deps) = %v, expected %v", len(deps), len(expectedDeps))
+	}
+	for i := range expectedDeps {
+		if deps[i].Job != expectedDeps[i] {
+			t.Errorf("deps[%v].Job = %v, expected %v", i, deps[i].Job, expectedDeps[i])
+		}
+	}
+}
+
+func TestExpandMatricesFields(t *testing.T) {
+	jobs := map[string]Job{
+		"train": Job{
+			Image: "trainer",
+			Run:   "train",
+			VolumeMounts: []VolumeMount{
+				VolumeMount{Name: "data", MountPath: "/data/${{ matrix.model }}", SubPath: "${{ matrix.model }}"},
+			},
+			Services: map[string]Service{
+				"db": Service{Image: "postgres:${{ matrix.pg }}", Env: map[string]string{"MODEL": "${{ matrix.model }}"}},
+			},
+			Outputs:     []string{"/out/${{ matrix.model }}.bin"},
+			Labels:      map[string]string{"model": "${{ matrix.model }}"},
+			Annotations: map[string]string{"chainr.test/pg": "${{ matrix.pg }}"},
+			PodTemplate: map[string]interface{}{
+				"nodeSelector": map[string]interface{}{"model": "${{ matrix.model }}"},
+				"tolerations":  []interface{}{map[string]interface{}{"key": "${{ matrix.pg }}"}},
+				"priority":     float64(1),
+			},
+			Matrix: map[string][]string{
+				"model": []string{"bert"},
+				"pg":    []string{"13"},
+			},
+		},
+	}
+
+	expanded, err := expandMatrices(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, ok := expanded["train-bert-13"]
+	if !ok {
+		t.Fatalf("train-bert-13 was not found in %v", expanded)
+	}
+
+	if mount := job.VolumeMounts[0]; mount.Name != "data" || mount.MountPath != "/data/bert" || mount.SubPath != "bert" {
+		t.Errorf("job.VolumeMounts = %v, expected data mounted in /data/bert from bert", job.VolumeMounts)
+	}
+	if db := job.Services["db"]; db.Image != "postgres:13" || db.Env["MODEL"] != "bert" {
+		t.Errorf("job.Services = %v, expected postgres:13 with MODEL bert", job.Services)
+	}
+	if job.Outputs[0] != "/out/bert.bin" {
+		t.Errorf("job.Outputs = %v, expected /out/bert.bin", job.Outputs)
+	}
+	if job.Labels["model"] != "bert" || job.Annotations["chainr.test/pg"] != "13" {
+		t.Errorf("job.Labels = %v, job.Annotations = %v, expected model bert and pg 13", job.Labels, job.Annotations)
+	}
+	expectedTemplate := map[string]interface{}{
+		"nodeSelector": map[string]interface{}{"model": "bert"},
+		"tolerations":  []interface{}{map[string]interface{}{"key": "13"}},
+		"priority":     float64(1),
+	}
+	if !reflect.DeepEqual(job.PodTemplate, expectedTemplate) {
+		t.Errorf("job.PodTemplate = %v, expected %v", job.PodTemplate, expectedTemplate)
+	}
+	if jobs["train"].Services["db"].Image != "postgres:${{ matrix.pg }}" {
+		t.Errorf("the matrix job was modified: %v", jobs["train"])
+	}
+}
+
+func TestExpandMatricesConflict(t *testing.T) {
+	jobs := map[string]Job{
+		"load": Job{
+			Matrix: map[string][]string{
+				"region": []string{"eu"},
+			},
+		},
+		"load-eu": Job{},
+	}
+
+	if _, err := expandMatrices(jobs); err == nil {
+		t.Errorf("err = nil, expected not nil")
+	}
+}
+
+func TestExpandMatricesLongName(t *testing.T) {
+	jobs := map[string]Job{
+		"load": Job{
+			Matrix: map[string][]string{
+				"region": []string{"eu"},
+				"table":  []string{strings.Repeat("a", 56)},
+			},
+		},
+	}
+
+	if _, err := expandMatrices(jobs); err == nil {
+		t.Errorf("err = nil, expected the expansion longer than 63 characters to be refused")
+	}
+}
@@ -3,14 +3,27 @@ package run
 import (
 	"encoding/json"
 	"errors"
+	"path"
 	"strings"
 
 	"github.com/qri-io/jsonschema"
 )
 
+// A pipeline of jobs, submitted with a run or stored to be run by triggers.
 type Pipeline struct {
-	Kind string         `json:"kind"`
-	Jobs map[string]Job `json:"jobs"`
+	// Name of the stored pipeline, empty for pipelines submitted with a run.
+	Name string `json:"-"`
+
+	Kind   string            `json:"kind"`
+	Params map[string]string `json:"params"`
+	// Runs of the pipeline are processed by priority: high, normal (default)
+	// or low.
+	Priority    string            `json:"priority"`
+	Source      *Source           `json:"source"`
+	On          *Triggers         `json:"on"`
+	Concurrency *Concurrency      `json:"concurrency"`
+	Volumes     map[string]Volume `json:"volumes"`
+	Jobs        map[string]Job    `json:"jobs"`
 }
 
 const pipelineSchema = `{
@@ -20,9 +33,38 @@ const pipelineSchema = `{
 		"kind": {
 			"const": "Pipeline"
 		},
+		"params": {
+			"type": "object",
+			"properties": {},
+			"additionalProperties": {
+				"type": "string"
+			}
+		},
+		"priority": {
+			"enum": ["high", "normal", "low"]
+		},
+		"source": ` + sourceSchema + `,
+		"on": ` + triggersSchema + `,
+		"concurrency": ` + concurrencySchema + `,
+		"volumes": {
+			"type": "object",
+			"properties": {},
+			"propertyNames": {
+				"pattern": "` + namePattern + `",
+				"maxLength": 63,
+				"not": {
+					"pattern": "^chainr-"
+				}
+			},
+			"additionalProperties": ` + volumeSchema + `
+		},
 		"jobs": {
 			"type": "object",
 			"properties": {},
+			"propertyNames": {
+				"pattern": "` + namePattern + `",
+				"maxLength": 63
+			},
 			"additionalProperties": ` + jobSchema + `
 		}
 	},
@@ -31,9 +73,28 @@ const pipelineSchema = `{
 }`
 
 type Job struct {
-	Image     string          `json:"image"`
-	Run       string          `json:"run"`
-	DependsOn []JobDependency `json:"dependsOn"`
+	Image        string              `json:"image"`
+	Run          string              `json:"run"`
+	Command      []string            `json:"command"`
+	Args         []string            `json:"args"`
+	WorkingDir   string              `json:"workingDir"`
+	Shell        string              `json:"shell"`
+	Env          map[string]string   `json:"env"`
+	If           string              `json:"if"`
+	Steps        []JobStep           `json:"steps"`
+	VolumeMounts []VolumeMount       `json:"volumeMounts"`
+	Services     map[string]Service  `json:"services"`
+	DependsOn    []JobDependency     `json:"dependsOn"`
+	Matrix       map[string][]string `json:"matrix"`
+	Outputs      []string            `json:"outputs"`
+	Inputs       []string            `json:"inputs"`
+	Labels       map[string]string   `json:"labels"`
+	Annotations  map[string]string   `json:"annotations"`
+	// Name of the runner of the job, as configured on the workers.
+	Runner string `json:"runner"`
+	// Partial Kubernetes pod spec merged onto the pod of the job by the
+	// workers, which check the fields it sets.
+	PodTemplate map[string]interface{} `json:"podTemplate"`
 }
 
 const jobSchema = `{
@@ -45,13 +106,397 @@ const jobSchema = `{
 		"run": {
 			"type": "string"
 		},
+		"command": {
+			"type": "array",
+			"items": {
+				"type": "string"
+			},
+			"minItems": 1
+		},
+		"args": {
+			"type": "array",
+			"items": {
+				"type": "string"
+			}
+		},
+		"workingDir": {
+			"type": "string",
+			"minLength": 1
+		},
+		"shell": {
+			"type": "string",
+			"minLength": 1
+		},
+		"env": {
+			"type": "object",
+			"properties": {},
+			"additionalProperties": {
+				"type": "string"
+			}
+		},
+		"if": {
+			"type": "string"
+		},
+		"steps": {
+			"type": "array",
+			"items": ` + jobStepSchema + `
+		},
+		"volumeMounts": {
+			"type": "array",
+			"items": ` + volumeMountSchema + `
+		},
+		"services": {
+			"type": "object",
+			"properties": {},
+			"propertyNames": {
+				"pattern": "` + namePattern + `",
+				"maxLength": 55
+			},
+			"additionalProperties": ` + serviceSchema + `
+		},
 		"dependsOn": {
 			"type": "array",
 			"items": ` + jobDependencySchema + `
+		},
+		"matrix": ` + jobMatrixSchema + `,
+		"outputs": {
+			"type": "array",
+			"items": {
+				"type": "string",
+				"minLength": 1
+			}
+		},
+		"inputs": {
+			"type": "array",
+			"items": {
+				"type": "string"
+			}
+		},
+		"labels": {
+			"type": "object",
+			"properties": {},
+			"propertyNames": ` + metadataKeySchema + `,
+			"additionalProperties": {
+				"type": "string",
+				"maxLength": 63,
+				"pattern": "^(([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9])?$"
+			}
+		},
+		"annotations": {
+			"type": "object",
+			"properties": {},
+			"propertyNames": ` + metadataKeySchema + `,
+			"additionalProperties": {
+				"type": "string"
+			}
+		},
+		"runner": {
+			"type": "string",
+			"pattern": "` + namePattern + `",
+			"maxLength": 63
+		},
+		"podTemplate": {
+			"type": "object"
 		}
 	},
 	"additionalProperties": false,
-	"required": ["image", "run"]
+	"required": ["image"],
+	"oneOf": [
+		{
+			"required": ["run"]
+		},
+		{
+			"anyOf": [
+				{"required": ["command"]},
+				{"required": ["args"]}
+			]
+		}
+	],
+	"dependencies": {
+		"shell": ["run"],
+		"outputs": {
+			"anyOf": [
+				{"required": ["run"]},
+				{"required": ["command"]}
+			]
+		}
+	}
+}`
+
+// Names used in Kubernetes resources must be valid DNS labels, of at most
+// 63 characters. Job, pipeline and project names are also label values of
+// the Kubernetes jobs, and the names of steps and services are prefixed to
+// name their containers, so their maximum length is shorter.
+const namePattern = "^[a-z0-9]([-a-z0-9]*[a-z0-9])?$"
+
+const nameMaxLength = 63
+
+// Labels and annotations of the Kubernetes job are keyed by qualified names,
+// optionally prefixed by a DNS subdomain. Keys set by chainr are reserved.
+const metadataKeySchema = `{
+	"pattern": "^([a-z0-9]([-a-z0-9]*[a-z0-9])?(\\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*/)?[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$",
+	"not": {
+		"pattern": "^(chainr\\.io/|app\\.kubernetes\\.io/managed-by$)"
+	}
+}`
+
+// Steps are run sequentially, before the job command.
+type JobStep struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	Run   string `json:"run"`
+}
+
+const jobStepSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {
+			"type": "string",
+			"pattern": "` + namePattern + `",
+			"maxLength": 58
+		},
+		"image": {
+			"type": "string"
+		},
+		"run": {
+			"type": "string"
+		}
+	},
+	"additionalProperties": false,
+	"required": ["name", "image", "run"]
+}`
+
+// Services are run alongside the job, e.g. a database for integration
+// tests. They are stopped when the job completes.
+type Service struct {
+	Image string            `json:"image"`
+	Env   map[string]string `json:"env"`
+}
+
+const serviceSchema = `{
+	"type": "object",
+	"properties": {
+		"image": {
+			"type": "string"
+		},
+		"env": {
+			"type": "object",
+			"properties": {},
+			"additionalProperties": {
+				"type": "string"
+			}
+		}
+	},
+	"additionalProperties": false,
+	"required": ["image"]
+}`
+
+// The source repository is cloned in every job before it starts.
+// The ref can be a branch, a tag or a commit SHA, and defaults to HEAD. It can
+// reference parameters, e.g. ${{ params.commit }}.
+// Credentials are the name of a secret holding a username and a password.
+type Source struct {
+	Repo        string `json:"repo"`
+	Ref         string `json:"ref,omitempty"`
+	Credentials string `json:"credentials,omitempty"`
+}
+
+const sourceSchema = `{
+	"type": "object",
+	"properties": {
+		"repo": {
+			"type": "string",
+			"pattern": "` + repoPattern + `"
+		},
+		"ref": {
+			"type": "string"
+		},
+		"credentials": {
+			"type": "string"
+		}
+	},
+	"additionalProperties": false,
+	"required": ["repo"]
+}`
+
+// Repositories are https, ssh or git URLs, or scp-like ssh addresses, e.g.
+// git@github.com:org/repo.git.
+const repoPattern = "^((https|ssh|git)://[^-[:space:]][^[:space:]]*|[A-Za-z0-9][-A-Za-z0-9._]*@[A-Za-z0-9][-A-Za-z0-9.]*:[^[:space:]]+)$"
+
+// Triggers define the git events running a stored pipeline.
+// Pull requests are filtered on their target branch.
+type Triggers struct {
+	Push        *BranchFilter `json:"push,omitempty"`
+	PullRequest *BranchFilter `json:"pullRequest,omitempty"`
+}
+
+// Branches are glob patterns, e.g. release/*. If there are no patterns, all
+// branches match.
+type BranchFilter struct {
+	Branches []string `json:"branches,omitempty"`
+}
+
+const triggersSchema = `{
+	"type": "object",
+	"properties": {
+		"push": ` + branchFilterSchema + `,
+		"pullRequest": ` + branchFilterSchema + `
+	},
+	"additionalProperties": false
+}`
+
+const branchFilterSchema = `{
+	"type": "object",
+	"properties": {
+		"branches": {
+			"type": "array",
+			"items": {
+				"type": "string",
+				"minLength": 1
+			}
+		}
+	},
+	"additionalProperties": false
+}`
+
+// Concurrency limits the runs of a stored pipeline processed at the same time,
+// and the jobs of these runs running at the same time. Zero is unlimited.
+type Concurrency struct {
+	MaxRuns int `json:"maxRuns,omitempty"`
+	MaxJobs int `json:"maxJobs,omitempty"`
+}
+
+const concurrencySchema = `{
+	"type": "object",
+	"properties": {
+		"maxRuns": {
+			"type": "integer",
+			"minimum": 0
+		},
+		"maxJobs": {
+			"type": "integer",
+			"minimum": 0
+		}
+	},
+	"additionalProperties": false
+}`
+
+// Volumes are declared by the pipeline, and mounted by its jobs.
+// Exactly one source must be set:
+//   - emptyDir: scratch space shared by the steps, services and command of a
+//     job
+//   - workspace: persistent volume created for the run, shared by its jobs
+//   - persistentVolumeClaim: existing persistent volume claim
+//   - configMap: existing ConfigMap
+//   - secret: existing Secret
+type Volume struct {
+	EmptyDir              *EmptyDirVolume  `json:"emptyDir,omitempty"`
+	Workspace             *WorkspaceVolume `json:"workspace,omitempty"`
+	PersistentVolumeClaim *NamedVolume     `json:"persistentVolumeClaim,omitempty"`
+	ConfigMap             *NamedVolume     `json:"configMap,omitempty"`
+	Secret                *NamedVolume     `json:"secret,omitempty"`
+}
+
+type EmptyDirVolume struct{}
+
+type WorkspaceVolume struct {
+	Size         string `json:"size"`
+	StorageClass string `json:"storageClass,omitempty"`
+}
+
+// References an existing Kubernetes resource by name.
+type NamedVolume struct {
+	Name string `json:"name"`
+}
+
+const volumeSchema = `{
+	"type": "object",
+	"properties": {
+		"emptyDir": {
+			"type": "object",
+			"properties": {},
+			"additionalProperties": false
+		},
+		"workspace": {
+			"type": "object",
+			"properties": {
+				"size": {
+					"type": "string",
+					"pattern": "^[0-9]+(\\.[0-9]+)?([KMGTPE]i?)?$"
+				},
+				"storageClass": {
+					"type": "string"
+				}
+			},
+			"additionalProperties": false,
+			"required": ["size"]
+		},
+		"persistentVolumeClaim": ` + namedVolumeSchema + `,
+		"configMap": ` + namedVolumeSchema + `,
+		"secret": ` + namedVolumeSchema + `
+	},
+	"additionalProperties": false,
+	"minProperties": 1,
+	"maxProperties": 1
+}`
+
+const namedVolumeSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {
+			"type": "string",
+			"minLength": 1
+		}
+	},
+	"additionalProperties": false,
+	"required": ["name"]
+}`
+
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	SubPath   string `json:"subPath,omitempty"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+const volumeMountSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {
+			"type": "string"
+		},
+		"mountPath": {
+			"type": "string",
+			"pattern": "^/"
+		},
+		"subPath": {
+			"type": "string"
+		},
+		"readOnly": {
+			"type": "boolean"
+		}
+	},
+	"additionalProperties": false,
+	"required": ["name", "mountPath"]
+}`
+
+// The matrix maps parameter names to their possible values.
+// A job with a matrix is expanded into one job per combination of values.
+// Parameter names are the ones matched by matrix references.
+const jobMatrixSchema = `{
+	"type": "object",
+	"properties": {},
+	"propertyNames": {
+		"pattern": "^[A-Za-z0-9_-]+$"
+	},
+	"additionalProperties": {
+		"type": "array",
+		"items": {
+			"type": "string",
+			"pattern": "` + namePattern + `"
+		},
+		"minItems": 1
+	}
 }`
 
 type JobDependency struct {
@@ -85,6 +530,19 @@ const jobDependencyConditionsSchema = `{
 	"additionalProperties": false
 }`
 
+// Overrides the pipeline parameters, e.g. with the parameters of the event
+// triggering a stored pipeline. Other parameters keep their default value.
+func (p *Pipeline) OverrideParams(params map[string]string) {
+	merged := make(map[string]string, len(p.Params)+len(params))
+	for k, v := range p.Params {
+		merged[k] = v
+	}
+	for k, v := range params {
+		merged[k] = v
+	}
+	p.Params = merged
+}
+
 // The PipelineFactory allows to create pipelines.
 type PipelineFactory interface {
 	Create(spec []byte) (Pipeline, error)
@@ -125,5 +583,89 @@ func (pf JSONPipelineFactory) Create(spec []byte) (Pipeline, error) {
 		return Pipeline{}, err
 	}
 
+	jobs, err := expandMatrices(p.Jobs)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	p.Jobs = jobs
+
+	if err := validateInputs(p.Jobs); err != nil {
+		return Pipeline{}, err
+	}
+	if err := validateOutputs(p.Jobs); err != nil {
+		return Pipeline{}, err
+	}
+	if err := validateVolumeMounts(p.Volumes, p.Jobs); err != nil {
+		return Pipeline{}, err
+	}
+	if err := validateConditions(p.Jobs); err != nil {
+		return Pipeline{}, err
+	}
+
 	return p, nil
 }
+
+// Inputs must reference dependencies of the job, to ensure artifacts are
+// available when the job starts.
+func validateInputs(jobs map[string]Job) error {
+	for name, job := range jobs {
+		for _, input := range job.Inputs {
+			found := false
+			for _, dep := range job.DependsOn {
+				if dep.Job == input {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return errors.New("input " + input + " of job " + name + " is not a dependency")
+			}
+			// Artifacts are stored on the runner of the job saving them.
+			if dep, ok := jobs[input]; ok && dep.Runner != job.Runner {
+				return errors.New("input " + input + " of job " + name + " runs on another runner")
+			}
+		}
+	}
+	return nil
+}
+
+// Outputs are copied in the artifacts directory of the job under their base
+// name, so two outputs of a job can not have the same base name.
+func validateOutputs(jobs map[string]Job) error {
+	for name, job := range jobs {
+		outputs := make(map[string]string, len(job.Outputs))
+		for _, output := range job.Outputs {
+			base := path.Base(output)
+			if other, ok := outputs[base]; ok {
+				return errors.New("outputs " + other + " and " + output + " of job " + name + " have the same name " + base)
+			}
+			outputs[base] = output
+		}
+	}
+	return nil
+}
+
+// Volume mounts must reference volumes declared by the pipeline.
+func validateVolumeMounts(volumes map[string]Volume, jobs map[string]Job) error {
+	for name, job := range jobs {
+		for _, mount := range job.VolumeMounts {
+			if _, ok := volumes[mount.Name]; !ok {
+				return errors.New("volume " + mount.Name + " mounted by job " + name + " is not declared")
+			}
+		}
+	}
+	return nil
+}
+
+// Conditions are parsed, once matrix values are replaced in them.
+func validateConditions(jobs map[string]Job) error {
+	for name, job := range jobs {
+		if len(job.If) == 0 {
+			continue
+		}
+		if err := validateExpr(job.If); err != nil {
+			return errors.New("invalid if of job " + name + ": " + err.Error())
+		}
+	}
+	return nil
+}
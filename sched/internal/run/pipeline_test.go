@@ -1,6 +1,9 @@
 package run
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 // Calling NewPipelineFactory() should not panic.
 func TestNewPipelineFactory(t *testing.T) {
@@ -55,3 +58,731 @@ func TestNewPipelineBadSchema(t *testing.T) {
 		t.Fatal("NewPipeline from an invalid schema returned a nil error")
 	}
 }
+
+func TestCreateMatrix(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "echo ${{ matrix.region }}",
+				"matrix": {
+					"region": ["eu", "us"]
+				}
+			}
+		}
+	}`)
+	p, err := NewPipelineFactory().Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Jobs) != 2 {
+		t.Fatalf("len(p.Jobs) = %v, expected 2", len(p.Jobs))
+	}
+	if run := p.Jobs["job1-eu"].Run; run != "echo eu" {
+		t.Errorf("run = %v, expected echo eu", run)
+	}
+}
+
+func TestCreateMatrixBadValue(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"matrix": {
+					"region": ["Not a name"]
+				}
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with an invalid matrix value returned a nil error")
+	}
+}
+
+func TestCreateMatrixBadParam(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "echo ${{ matrix.cloud.region }}",
+				"matrix": {
+					"cloud.region": ["eu"]
+				}
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with an invalid matrix parameter name returned a nil error")
+	}
+}
+
+func TestCreateInputNotDependency(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"outputs": ["/tmp/out"]
+			},
+			"job2": {
+				"image": "busybox",
+				"run": "exit 0",
+				"inputs": ["job1"]
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with an input that is not a dependency returned a nil error")
+	}
+}
+
+func TestCreateInputOtherRunner(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"outputs": ["/tmp/out"],
+				"runner": "gpu"
+			},
+			"job2": {
+				"image": "busybox",
+				"run": "exit 0",
+				"dependsOn": [{"job": "job1"}],
+				"inputs": ["job1"]
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with an input running on another runner returned a nil error")
+	}
+}
+
+func TestCreateOutputsSameName(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"outputs": ["a/out", "b/out/"]
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with outputs having the same name returned a nil error")
+	}
+}
+
+func TestCreateParamsAndCondition(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"params": {
+			"env": "prod"
+		},
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"if": "params.env == \"prod\""
+			}
+		}
+	}`)
+	p, err := NewPipelineFactory().Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Params["env"] != "prod" {
+		t.Errorf("p.Params = %v, expected env=prod", p.Params)
+	}
+	if cond := p.Jobs["job1"].If; cond != `params.env == "prod"` {
+		t.Errorf("cond = %v, expected params.env == \"prod\"", cond)
+	}
+}
+
+func TestCreateBadCondition(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"if": "params.env = \"prod\""
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with an invalid condition returned a nil error")
+	}
+}
+
+func TestCreateStepsAndServices(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"steps": [{
+					"name": "migrate",
+					"image": "migrate",
+					"run": "migrate up"
+				}],
+				"services": {
+					"postgres": {
+						"image": "postgres",
+						"env": {
+							"POSTGRES_PASSWORD": "test"
+						}
+					}
+				}
+			}
+		}
+	}`)
+	p, err := NewPipelineFactory().Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := p.Jobs["job1"]
+	if len(job.Steps) != 1 || job.Steps[0].Name != "migrate" {
+		t.Errorf("job.Steps = %v, expected migrate", job.Steps)
+	}
+	if job.Services["postgres"].Image != "postgres" {
+		t.Errorf("job.Services = %v, expected postgres", job.Services)
+	}
+}
+
+func TestCreateBadServiceName(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"services": {
+					"Not a name": {
+						"image": "postgres"
+					}
+				}
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with an invalid service name returned a nil error")
+	}
+}
+
+func TestCreateBadJobName(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"../job1": {
+				"image": "busybox",
+				"run": "exit 0"
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with an invalid job name returned a nil error")
+	}
+}
+
+func TestCreateLongJobName(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"` + strings.Repeat("a", 64) + `": {
+				"image": "busybox",
+				"run": "exit 0"
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with a job name longer than 63 characters returned a nil error")
+	}
+}
+
+func TestCreateCommand(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "gcr.io/distroless/static",
+				"command": ["/app"],
+				"args": ["--table", "users"],
+				"workingDir": "/data"
+			}
+		}
+	}`)
+	p, err := NewPipelineFactory().Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := p.Jobs["job1"]
+	if len(job.Command) != 1 || job.Command[0] != "/app" {
+		t.Errorf("job.Command = %v, expected [/app]", job.Command)
+	}
+	if len(job.Args) != 2 || job.Args[1] != "users" {
+		t.Errorf("job.Args = %v, expected [--table users]", job.Args)
+	}
+	if job.WorkingDir != "/data" {
+		t.Errorf("job.WorkingDir = %v, expected /data", job.WorkingDir)
+	}
+}
+
+func TestCreateCommandAndRun(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"command": ["true"]
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with both run and command returned a nil error")
+	}
+}
+
+func TestCreateNoCommand(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox"
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create without run nor command returned a nil error")
+	}
+}
+
+func TestCreateShellWithoutRun(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"command": ["true"],
+				"shell": "bash"
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with a shell but no run returned a nil error")
+	}
+}
+
+func TestCreateOutputsWithoutCommand(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"args": ["--verbose"],
+				"outputs": ["/tmp/out"]
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with outputs but only args returned a nil error")
+	}
+}
+
+func TestCreateVolumes(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"volumes": {
+			"workspace": {
+				"workspace": {
+					"size": "5Gi"
+				}
+			},
+			"config": {
+				"configMap": {
+					"name": "app-config"
+				}
+			}
+		},
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"volumeMounts": [{
+					"name": "workspace",
+					"mountPath": "/workspace"
+				}, {
+					"name": "config",
+					"mountPath": "/etc/app",
+					"readOnly": true
+				}]
+			}
+		}
+	}`)
+	p, err := NewPipelineFactory().Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws := p.Volumes["workspace"].Workspace; ws == nil || ws.Size != "5Gi" {
+		t.Errorf("p.Volumes[workspace] = %v, expected workspace of 5Gi", p.Volumes["workspace"])
+	}
+	if cm := p.Volumes["config"].ConfigMap; cm == nil || cm.Name != "app-config" {
+		t.Errorf("p.Volumes[config] = %v, expected configMap app-config", p.Volumes["config"])
+	}
+	if mounts := p.Jobs["job1"].VolumeMounts; len(mounts) != 2 || !mounts[1].ReadOnly {
+		t.Errorf("p.Jobs[job1].VolumeMounts = %v, expected 2 mounts", mounts)
+	}
+}
+
+func TestCreateVolumeNotDeclared(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"volumeMounts": [{
+					"name": "workspace",
+					"mountPath": "/workspace"
+				}]
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with an undeclared volume returned a nil error")
+	}
+}
+
+func TestCreateVolumeSeveralSources(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"volumes": {
+			"config": {
+				"configMap": {
+					"name": "app-config"
+				},
+				"secret": {
+					"name": "app-secret"
+				}
+			}
+		},
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0"
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with a volume having several sources returned a nil error")
+	}
+}
+
+func TestCreateVolumeReservedName(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"volumes": {
+			"chainr-artifacts": {
+				"emptyDir": {}
+			}
+		},
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0"
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with a reserved volume name returned a nil error")
+	}
+}
+
+func TestCreateSource(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"source": {
+			"repo": "https://github.com/Tyrame/chainr.git",
+			"ref": "${{ params.commit }}",
+			"credentials": "github"
+		},
+		"jobs": {
+			"job1": {
+				"image": "golang",
+				"run": "go test ./..."
+			}
+		}
+	}`)
+	p, err := NewPipelineFactory().Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Source == nil || p.Source.Repo != "https://github.com/Tyrame/chainr.git" {
+		t.Fatalf("p.Source = %v, expected https://github.com/Tyrame/chainr.git", p.Source)
+	}
+	if p.Source.Credentials != "github" {
+		t.Errorf("p.Source.Credentials = %v, expected github", p.Source.Credentials)
+	}
+}
+
+func TestCreateSourceWithoutRepo(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"source": {
+			"ref": "main"
+		},
+		"jobs": {
+			"job1": {
+				"image": "golang",
+				"run": "go test ./..."
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with a source without repo returned a nil error")
+	}
+}
+
+func TestCreateSourceBadRepo(t *testing.T) {
+	for _, repo := range []string{"--upload-pack=touch /tmp/pwned", "ext::sh -c touch% /tmp/pwned", "/srv/git/repo.git"} {
+		spec := []byte(`{
+			"kind": "Pipeline",
+			"source": {
+				"repo": "` + repo + `"
+			},
+			"jobs": {
+				"job1": {
+					"image": "golang",
+					"run": "go test ./..."
+				}
+			}
+		}`)
+		if _, err := NewPipelineFactory().Create(spec); err == nil {
+			t.Errorf("Create with repo %v returned a nil error", repo)
+		}
+	}
+}
+
+func TestCreateConcurrency(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"concurrency": {
+			"maxRuns": 1,
+			"maxJobs": 4
+		},
+		"jobs": {
+			"job1": {
+				"image": "golang",
+				"run": "go test ./..."
+			}
+		}
+	}`)
+	p, err := NewPipelineFactory().Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Concurrency == nil || p.Concurrency.MaxRuns != 1 || p.Concurrency.MaxJobs != 4 {
+		t.Errorf("p.Concurrency = %v, expected 1 run and 4 jobs", p.Concurrency)
+	}
+}
+
+func TestCreateConcurrencyNegative(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"concurrency": {
+			"maxJobs": -1
+		},
+		"jobs": {
+			"job1": {
+				"image": "golang",
+				"run": "go test ./..."
+			}
+		}
+	}`)
+	_, err := NewPipelineFactory().Create(spec)
+	if err == nil {
+		t.Fatal("Create with a negative concurrency returned a nil error")
+	}
+}
+
+func TestCreatePriority(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"priority": "high",
+		"jobs": {
+			"job1": {
+				"image": "golang",
+				"run": "go test ./..."
+			}
+		}
+	}`)
+	p, err := NewPipelineFactory().Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Priority != "high" {
+		t.Errorf("p.Priority = %v, expected high", p.Priority)
+	}
+
+	spec = []byte(`{
+		"kind": "Pipeline",
+		"priority": "urgent",
+		"jobs": {
+			"job1": {
+				"image": "golang",
+				"run": "go test ./..."
+			}
+		}
+	}`)
+	if _, err := NewPipelineFactory().Create(spec); err == nil {
+		t.Fatal("Create with an unknown priority returned a nil error")
+	}
+}
+
+func TestCreateLabels(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "golang",
+				"run": "go test ./...",
+				"labels": {"team": "data", "example.com/tier": "batch"},
+				"annotations": {"example.com/owner": "Data team <data@example.com>"}
+			}
+		}
+	}`)
+	p, err := NewPipelineFactory().Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job := p.Jobs["job1"]; job.Labels["example.com/tier"] != "batch" || len(job.Annotations) != 1 {
+		t.Errorf("job = %v, expected its labels and annotations", job)
+	}
+
+	for _, metadata := range []string{
+		`"labels": {"chainr.io/run": "abc"}`,
+		`"labels": {"app.kubernetes.io/managed-by": "me"}`,
+		`"labels": {"team": "data team"}`,
+		`"annotations": {"chainr.io/job": "job1"}`,
+		`"annotations": {"-invalid": "value"}`,
+	} {
+		spec := []byte(`{
+			"kind": "Pipeline",
+			"jobs": {
+				"job1": {
+					"image": "golang",
+					"run": "go test ./...",
+					` + metadata + `
+				}
+			}
+		}`)
+		if _, err := NewPipelineFactory().Create(spec); err == nil {
+			t.Errorf("Create with %v returned a nil error", metadata)
+		}
+	}
+}
+
+func TestCreateRunner(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "golang",
+				"run": "go test ./...",
+				"runner": "gpu-cluster"
+			}
+		}
+	}`)
+	p, err := NewPipelineFactory().Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runner := p.Jobs["job1"].Runner; runner != "gpu-cluster" {
+		t.Errorf("runner = %v, expected gpu-cluster", runner)
+	}
+
+	spec = []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "golang",
+				"run": "go test ./...",
+				"runner": "GPU cluster"
+			}
+		}
+	}`)
+	if _, err := NewPipelineFactory().Create(spec); err == nil {
+		t.Error("Create with an invalid runner returned a nil error")
+	}
+}
+
+func TestCreatePodTemplate(t *testing.T) {
+	spec := []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "golang",
+				"run": "go test ./...",
+				"podTemplate": {
+					"securityContext": {"runAsNonRoot": true},
+					"tolerations": [{"key": "gpu", "operator": "Exists"}]
+				}
+			}
+		}
+	}`)
+	p, err := NewPipelineFactory().Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template := p.Jobs["job1"].PodTemplate; len(template) != 2 {
+		t.Errorf("podTemplate = %v, expected the security context and tolerations", template)
+	}
+
+	spec = []byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "golang",
+				"run": "go test ./...",
+				"podTemplate": "hostNetwork: true"
+			}
+		}
+	}`)
+	if _, err := NewPipelineFactory().Create(spec); err == nil {
+		t.Error("Create with a pod template which is not an object returned a nil error")
+	}
+}
+
+func TestOverrideParams(t *testing.T) {
+	p := Pipeline{Params: map[string]string{"commit": "HEAD", "target": "prod"}}
+	p.OverrideParams(map[string]string{"commit": "abc"})
+	if p.Params["commit"] != "abc" || p.Params["target"] != "prod" {
+		t.Errorf("params = %v, expected the overridden commit and the default target", p.Params)
+	}
+}
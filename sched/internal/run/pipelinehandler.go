@@ -0,0 +1,173 @@
+package run
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/Tyrame/chainr/sched/internal/httputil"
+)
+
+// Names of stored pipelines and projects are DNS labels, as they are used in
+// Kubernetes objects names.
+var nameRegexp = regexp.MustCompile(namePattern)
+
+func validName(name string) bool {
+	return len(name) <= nameMaxLength && nameRegexp.MatchString(name)
+}
+
+// A stored pipeline, as returned by the API.
+type PipelineResource struct {
+	Kind     string           `json:"kind"`
+	Metadata PipelineMetadata `json:"metadata"`
+	Spec     json.RawMessage  `json:"spec"`
+}
+
+type PipelineMetadata struct {
+	SelfLink string `json:"selfLink"`
+	Name     string `json:"name"`
+}
+
+type PipelineList struct {
+	Kind     string               `json:"kind"`
+	Metadata PipelineListMetadata `json:"metadata"`
+	Items    []PipelineResource   `json:"items"`
+}
+
+type PipelineListMetadata struct {
+	SelfLink string `json:"selfLink"`
+}
+
+func newPipelineResource(pipeline StoredPipeline) PipelineResource {
+	return PipelineResource{
+		Kind: "StoredPipeline",
+		Metadata: PipelineMetadata{
+			SelfLink: "/api/pipelines/" + pipeline.Name,
+			Name:     pipeline.Name,
+		},
+		Spec: json.RawMessage(pipeline.Spec),
+	}
+}
+
+type pipelineHandler struct {
+	pf    PipelineFactory
+	store PipelineStore
+}
+
+func NewPipelineHandler() http.Handler {
+	return newPipelineHandler(
+		NewPipelineFactory(),
+		NewPipelineStore(),
+	)
+}
+func newPipelineHandler(pf PipelineFactory, store PipelineStore) http.Handler {
+	handler := &pipelineHandler{pf, store}
+
+	mux := httputil.NewServeMux()
+	mux.Handle("/api/pipelines", handler)
+	mux.Handle("/api/pipelines/", handler)
+	return mux
+}
+
+func (h *pipelineHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := r.URL.Path[len("/api/pipelines"):]
+	if len(name) == 0 {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			httputil.WriteError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.list(w)
+		return
+	}
+	name = name[1:]
+
+	switch r.Method {
+	case "GET":
+		h.get(w, name)
+	case "PUT":
+		h.put(w, r, name)
+	case "DELETE":
+		h.delete(w, name)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		httputil.WriteError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *pipelineHandler) list(w http.ResponseWriter) {
+	pipelines, err := h.store.List()
+	if err != nil {
+		log.Println("Unable to list pipelines:", err.Error())
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	list := PipelineList{
+		Kind: "PipelineList",
+		Metadata: PipelineListMetadata{
+			SelfLink: "/api/pipelines",
+		},
+		Items: make([]PipelineResource, 0, len(pipelines)),
+	}
+	for _, pipeline := range pipelines {
+		list.Items = append(list.Items, newPipelineResource(pipeline))
+	}
+	httputil.WriteResponse(w, list, http.StatusOK)
+}
+
+func (h *pipelineHandler) get(w http.ResponseWriter, name string) {
+	pipeline, err := h.store.Get(name)
+	if err != nil {
+		writePipelineStoreError(w, err)
+		return
+	}
+	httputil.WriteResponse(w, newPipelineResource(pipeline), http.StatusOK)
+}
+
+// The pipeline is created, or replaced if it already exists.
+func (h *pipelineHandler) put(w http.ResponseWriter, r *http.Request, name string) {
+	if !validName(name) {
+		httputil.WriteError(w, "Invalid pipeline name "+name, http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if _, err := h.pf.Create(body); err != nil {
+		httputil.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	pipeline := StoredPipeline{name, body}
+	if err := h.store.Save(pipeline); err != nil {
+		log.Println("Unable to save pipeline:", err.Error())
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	httputil.WriteResponse(w, newPipelineResource(pipeline), http.StatusOK)
+}
+
+func (h *pipelineHandler) delete(w http.ResponseWriter, name string) {
+	if err := h.store.Delete(name); err != nil {
+		writePipelineStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writePipelineStoreError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *PipelineNotFoundError:
+		httputil.WriteError(w, err, http.StatusNotFound)
+	default:
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,201 @@
+package run
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+type memoryPipelineStore struct {
+	pipelines map[string]StoredPipeline
+}
+
+func (s *memoryPipelineStore) Save(pipeline StoredPipeline) error {
+	s.pipelines[pipeline.Name] = pipeline
+	return nil
+}
+func (s *memoryPipelineStore) Get(name string) (StoredPipeline, error) {
+	pipeline, ok := s.pipelines[name]
+	if !ok {
+		return StoredPipeline{}, &PipelineNotFoundError{name}
+	}
+	return pipeline, nil
+}
+func (s *memoryPipelineStore) List() ([]StoredPipeline, error) {
+	pipelines := make([]StoredPipeline, 0, len(s.pipelines))
+	for _, pipeline := range s.pipelines {
+		pipelines = append(pipelines, pipeline)
+	}
+	return pipelines, nil
+}
+func (s *memoryPipelineStore) Delete(name string) error {
+	if _, ok := s.pipelines[name]; !ok {
+		return &PipelineNotFoundError{name}
+	}
+	delete(s.pipelines, name)
+	return nil
+}
+
+type failingPipelineStore struct{}
+
+func (s failingPipelineStore) Save(pipeline StoredPipeline) error {
+	return errors.New("fail")
+}
+func (s failingPipelineStore) Get(name string) (StoredPipeline, error) {
+	return StoredPipeline{}, errors.New("fail")
+}
+func (s failingPipelineStore) List() ([]StoredPipeline, error) {
+	return nil, errors.New("fail")
+}
+func (s failingPipelineStore) Delete(name string) error {
+	return errors.New("fail")
+}
+
+const testStoredPipeline = `{
+	"kind": "Pipeline",
+	"jobs": {
+		"job1": {
+			"image": "busybox",
+			"run": "exit 0"
+		}
+	}
+}`
+
+func TestNewPipelineHandler(t *testing.T) {
+	h := NewPipelineHandler()
+	if h == nil {
+		t.Errorf("h is nil, expected non-nil")
+	}
+}
+
+func TestPipelineHandler(t *testing.T) {
+	Convey("Scenario: manage stored pipelines", t, func() {
+		store := &memoryPipelineStore{make(map[string]StoredPipeline)}
+		handler := newPipelineHandler(NewPipelineFactory(), store)
+		w := httptest.NewRecorder()
+
+		Convey("Given a pipeline is stored", func() {
+			Convey("When the spec is valid", func() {
+				r, err := http.NewRequest("PUT", "/api/pipelines/ci", strings.NewReader(testStoredPipeline))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+				var res PipelineResource
+				json.NewDecoder(w.Body).Decode(&res)
+
+				Convey("The request should succeed with code 200", func() {
+					So(w.Code, ShouldEqual, 200)
+				})
+
+				Convey("The pipeline should be saved with its name", func() {
+					So(store.pipelines, ShouldContainKey, "ci")
+					So(res.Kind, ShouldEqual, "StoredPipeline")
+					So(res.Metadata.Name, ShouldEqual, "ci")
+					So(res.Metadata.SelfLink, ShouldEqual, "/api/pipelines/ci")
+				})
+			})
+
+			Convey("When the spec is invalid", func() {
+				r, err := http.NewRequest("PUT", "/api/pipelines/ci", strings.NewReader(`{"kind": "Pipeline"}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 400", func() {
+					So(w.Code, ShouldEqual, 400)
+					So(store.pipelines, ShouldBeEmpty)
+				})
+			})
+
+			Convey("When the name is invalid", func() {
+				r, err := http.NewRequest("PUT", "/api/pipelines/Not_A_Name", strings.NewReader(testStoredPipeline))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 400", func() {
+					So(w.Code, ShouldEqual, 400)
+				})
+			})
+
+			Convey("When the store fails", func() {
+				handler := newPipelineHandler(NewPipelineFactory(), failingPipelineStore{})
+				r, err := http.NewRequest("PUT", "/api/pipelines/ci", strings.NewReader(testStoredPipeline))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 500", func() {
+					So(w.Code, ShouldEqual, 500)
+				})
+			})
+		})
+
+		Convey("Given stored pipelines are requested", func() {
+			store.pipelines["ci"] = StoredPipeline{"ci", []byte(testStoredPipeline)}
+
+			Convey("When the list is requested", func() {
+				r, err := http.NewRequest("GET", "/api/pipelines", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+				var list PipelineList
+				json.NewDecoder(w.Body).Decode(&list)
+
+				Convey("The response should list the pipelines with their spec", func() {
+					So(w.Code, ShouldEqual, 200)
+					So(list.Kind, ShouldEqual, "PipelineList")
+					So(len(list.Items), ShouldEqual, 1)
+					So(string(list.Items[0].Spec), ShouldContainSubstring, `"kind"`)
+				})
+			})
+
+			Convey("When an unknown pipeline is requested", func() {
+				r, err := http.NewRequest("GET", "/api/pipelines/unknown", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 404", func() {
+					So(w.Code, ShouldEqual, 404)
+				})
+			})
+
+			Convey("When a pipeline is deleted", func() {
+				r, err := http.NewRequest("DELETE", "/api/pipelines/ci", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should succeed with code 204", func() {
+					So(w.Code, ShouldEqual, 204)
+					So(store.pipelines, ShouldBeEmpty)
+				})
+			})
+
+			Convey("When the method is not allowed", func() {
+				r, err := http.NewRequest("POST", "/api/pipelines", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 405", func() {
+					So(w.Code, ShouldEqual, 405)
+				})
+			})
+		})
+	})
+}
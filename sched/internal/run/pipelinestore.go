@@ -0,0 +1,102 @@
+package run
+
+import (
+	"sort"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// PipelineStore persists pipelines, so that runs can be created from them
+// without submitting their spec, e.g. by git hooks.
+type PipelineStore interface {
+	Save(pipeline StoredPipeline) error
+	Get(name string) (StoredPipeline, error)
+	// Returns the stored pipelines, sorted by name.
+	List() ([]StoredPipeline, error)
+	Delete(name string) error
+}
+
+// The spec is stored as submitted, and validated before being stored.
+type StoredPipeline struct {
+	Name string
+	Spec []byte
+}
+
+type PipelineNotFoundError struct {
+	Name string
+}
+
+func (e *PipelineNotFoundError) Error() string {
+	return "pipeline " + e.Name + " was not found"
+}
+
+type RedisPipelineStore struct {
+	client redis.Cmdable
+}
+
+func NewPipelineStore() PipelineStore {
+	return &RedisPipelineStore{newRedisClient()}
+}
+
+func makePipelinesKey() string {
+	return "pipelines"
+}
+
+func makePipelineKey(name string) string {
+	return "pipeline:" + name
+}
+
+func (s RedisPipelineStore) Save(pipeline StoredPipeline) error {
+	pipelineKey := makePipelineKey(pipeline.Name)
+	if err := s.client.HSet(pipelineKey, "name", pipeline.Name, "spec", string(pipeline.Spec)).Err(); err != nil {
+		return err
+	}
+	return s.client.SAdd(makePipelinesKey(), pipelineKey).Err()
+}
+
+func (s RedisPipelineStore) Get(name string) (StoredPipeline, error) {
+	return s.get(makePipelineKey(name), name)
+}
+
+func (s RedisPipelineStore) get(pipelineKey, name string) (StoredPipeline, error) {
+	pipeline, err := s.client.HGetAll(pipelineKey).Result()
+	if err != nil {
+		return StoredPipeline{}, err
+	}
+	if len(pipeline) == 0 {
+		return StoredPipeline{}, &PipelineNotFoundError{name}
+	}
+
+	return StoredPipeline{pipeline["name"], []byte(pipeline["spec"])}, nil
+}
+
+func (s RedisPipelineStore) List() ([]StoredPipeline, error) {
+	pipelines := make([]StoredPipeline, 0)
+
+	pipelineKeys, err := s.client.SMembers(makePipelinesKey()).Result()
+	if err != nil {
+		return pipelines, err
+	}
+	sort.Strings(pipelineKeys)
+
+	for _, pipelineKey := range pipelineKeys {
+		pipeline, err := s.get(pipelineKey, pipelineKey)
+		if err != nil {
+			return pipelines, err
+		}
+		pipelines = append(pipelines, pipeline)
+	}
+	return pipelines, nil
+}
+
+func (s RedisPipelineStore) Delete(name string) error {
+	pipelineKey := makePipelineKey(name)
+	deleted, err := s.client.Del(pipelineKey).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return &PipelineNotFoundError{name}
+	}
+	return s.client.SRem(makePipelinesKey(), pipelineKey).Err()
+}
@@ -0,0 +1,150 @@
+package run
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// Stores hashes, sets and lists in memory.
+type memoryClientMock struct {
+	*redis.Client
+	hashes map[string]map[string]string
+	sets   map[string]map[string]bool
+	lists  map[string][]string
+}
+
+func newMemoryClientMock() *memoryClientMock {
+	return &memoryClientMock{
+		hashes: make(map[string]map[string]string),
+		sets:   make(map[string]map[string]bool),
+		lists:  make(map[string][]string),
+	}
+}
+
+func (c *memoryClientMock) HSet(key string, values ...interface{}) *redis.IntCmd {
+	if _, ok := c.hashes[key]; !ok {
+		c.hashes[key] = make(map[string]string)
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		c.hashes[key][values[i].(string)] = values[i+1].(string)
+	}
+	return redis.NewIntResult(int64(len(values)/2), nil)
+}
+func (c *memoryClientMock) HGetAll(key string) *redis.StringStringMapCmd {
+	vals := make(map[string]string)
+	for k, v := range c.hashes[key] {
+		vals[k] = v
+	}
+	return redis.NewStringStringMapResult(vals, nil)
+}
+func (c *memoryClientMock) HGet(key, field string) *redis.StringCmd {
+	val, ok := c.hashes[key][field]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(val, nil)
+}
+func (c *memoryClientMock) HMGet(key string, fields ...string) *redis.SliceCmd {
+	vals := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if val, ok := c.hashes[key][field]; ok {
+			vals[i] = val
+		}
+	}
+	return redis.NewSliceResult(vals, nil)
+}
+func (c *memoryClientMock) Del(keys ...string) *redis.IntCmd {
+	var deleted int64
+	for _, key := range keys {
+		if _, ok := c.hashes[key]; ok {
+			delete(c.hashes, key)
+			deleted++
+		}
+	}
+	return redis.NewIntResult(deleted, nil)
+}
+func (c *memoryClientMock) SAdd(key string, members ...interface{}) *redis.IntCmd {
+	if _, ok := c.sets[key]; !ok {
+		c.sets[key] = make(map[string]bool)
+	}
+	for _, member := range members {
+		c.sets[key][member.(string)] = true
+	}
+	return redis.NewIntResult(int64(len(members)), nil)
+}
+func (c *memoryClientMock) SMembers(key string) *redis.StringSliceCmd {
+	members := make([]string, 0)
+	for member := range c.sets[key] {
+		members = append(members, member)
+	}
+	return redis.NewStringSliceResult(members, nil)
+}
+func (c *memoryClientMock) SRem(key string, members ...interface{}) *redis.IntCmd {
+	for _, member := range members {
+		delete(c.sets[key], member.(string))
+	}
+	return redis.NewIntResult(int64(len(members)), nil)
+}
+func (c *memoryClientMock) LPush(key string, values ...interface{}) *redis.IntCmd {
+	for _, value := range values {
+		c.lists[key] = append([]string{value.(string)}, c.lists[key]...)
+	}
+	return redis.NewIntResult(int64(len(c.lists[key])), nil)
+}
+func (c *memoryClientMock) RPush(key string, values ...interface{}) *redis.IntCmd {
+	for _, value := range values {
+		c.lists[key] = append(c.lists[key], value.(string))
+	}
+	return redis.NewIntResult(int64(len(c.lists[key])), nil)
+}
+func (c *memoryClientMock) LRange(key string, start, stop int64) *redis.StringSliceCmd {
+	return redis.NewStringSliceResult(append([]string{}, c.lists[key]...), nil)
+}
+
+func TestPipelineStore(t *testing.T) {
+	client := newMemoryClientMock()
+	s := RedisPipelineStore{client}
+
+	if err := s.Save(StoredPipeline{"nightly", []byte(`{"kind":"Pipeline"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(StoredPipeline{"ci", []byte(`{"kind":"Pipeline"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if !client.sets["pipelines"]["pipeline:ci"] {
+		t.Errorf("pipelines = %v, expected pipeline:ci", client.sets["pipelines"])
+	}
+
+	pipeline, err := s.Get("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pipeline.Name != "ci" || string(pipeline.Spec) != `{"kind":"Pipeline"}` {
+		t.Errorf("pipeline = %v, expected ci", pipeline)
+	}
+
+	pipelines, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pipelines) != 2 || pipelines[0].Name != "ci" || pipelines[1].Name != "nightly" {
+		t.Errorf("pipelines = %v, expected ci and nightly", pipelines)
+	}
+
+	if err := s.Delete("ci"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("ci"); err == nil {
+		t.Errorf("err = nil, expected not found")
+	} else if _, ok := err.(*PipelineNotFoundError); !ok {
+		t.Errorf("err = %v, expected not found", err)
+	}
+	if _, ok := client.sets["pipelines"]["pipeline:ci"]; ok {
+		t.Errorf("pipelines = %v, expected pipeline:ci to be removed", client.sets["pipelines"])
+	}
+
+	if err := s.Delete("ci"); err == nil {
+		t.Errorf("err = nil, expected not found")
+	}
+}
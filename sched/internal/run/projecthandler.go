@@ -0,0 +1,214 @@
+package run
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Tyrame/chainr/sched/internal/httputil"
+)
+
+// Service accounts names are DNS subdomains.
+var serviceAccountRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// A project, as returned by the API.
+type ProjectResource struct {
+	Kind     string          `json:"kind"`
+	Metadata ProjectMetadata `json:"metadata"`
+	Spec     ProjectSpec     `json:"spec"`
+}
+
+type ProjectMetadata struct {
+	SelfLink string `json:"selfLink"`
+	Name     string `json:"name"`
+}
+
+type ProjectSpec struct {
+	Namespace      string `json:"namespace,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	MaxRuns        int    `json:"maxRuns,omitempty"`
+	MaxJobs        int    `json:"maxJobs,omitempty"`
+}
+
+type ProjectList struct {
+	Kind     string              `json:"kind"`
+	Metadata ProjectListMetadata `json:"metadata"`
+	Items    []ProjectResource   `json:"items"`
+}
+
+type ProjectListMetadata struct {
+	SelfLink string `json:"selfLink"`
+}
+
+func newProjectResource(project Project) ProjectResource {
+	return ProjectResource{
+		Kind: "Project",
+		Metadata: ProjectMetadata{
+			SelfLink: "/api/projects/" + project.Name,
+			Name:     project.Name,
+		},
+		Spec: ProjectSpec{project.Namespace, project.ServiceAccount, project.MaxRuns, project.MaxJobs},
+	}
+}
+
+type projectHandler struct {
+	pf           PipelineFactory
+	store        ProjectStore
+	newScheduler func(project string) Scheduler
+}
+
+func NewProjectHandler() http.Handler {
+	client := newRedisClient()
+	return newProjectHandler(
+		NewPipelineFactory(),
+		&RedisProjectStore{client},
+		func(project string) Scheduler {
+			return &RedisScheduler{client, project}
+		},
+	)
+}
+func newProjectHandler(pf PipelineFactory, store ProjectStore, newScheduler func(project string) Scheduler) http.Handler {
+	handler := &projectHandler{pf, store, newScheduler}
+
+	mux := httputil.NewServeMux()
+	mux.Handle("/api/projects", handler)
+	mux.Handle("/api/projects/", handler)
+	return mux
+}
+
+// Projects are managed at /api/projects/<name>, and their runs at
+// /api/projects/<name>/runs.
+func (h *projectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	path := r.URL.Path[len("/api/projects"):]
+	if len(path) == 0 {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			httputil.WriteError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.list(w)
+		return
+	}
+
+	name := path[1:]
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, path = name[:i], name[i:]
+		if path != "/runs" && !strings.HasPrefix(path, "/runs/") {
+			httputil.WriteError(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		h.runs(w, r, name)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		h.get(w, name)
+	case "PUT":
+		h.put(w, r, name)
+	case "DELETE":
+		h.delete(w, name)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		httputil.WriteError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Runs of the project are served by a run handler scoped to the project.
+func (h *projectHandler) runs(w http.ResponseWriter, r *http.Request, name string) {
+	if _, err := h.store.Get(name); err != nil {
+		writeProjectStoreError(w, err)
+		return
+	}
+
+	handler := &runHandler{h.pf, h.newScheduler(name), "/api/projects/" + name + "/runs"}
+	handler.ServeHTTP(w, r)
+}
+
+func (h *projectHandler) list(w http.ResponseWriter) {
+	projects, err := h.store.List()
+	if err != nil {
+		log.Println("Unable to list projects:", err.Error())
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	list := ProjectList{
+		Kind: "ProjectList",
+		Metadata: ProjectListMetadata{
+			SelfLink: "/api/projects",
+		},
+		Items: make([]ProjectResource, 0, len(projects)),
+	}
+	for _, project := range projects {
+		list.Items = append(list.Items, newProjectResource(project))
+	}
+	httputil.WriteResponse(w, list, http.StatusOK)
+}
+
+func (h *projectHandler) get(w http.ResponseWriter, name string) {
+	project, err := h.store.Get(name)
+	if err != nil {
+		writeProjectStoreError(w, err)
+		return
+	}
+	httputil.WriteResponse(w, newProjectResource(project), http.StatusOK)
+}
+
+// The project is created, or replaced if it already exists.
+// Runs already scheduled keep the namespace and service account they were
+// scheduled with, but limits apply to them as soon as they are changed.
+func (h *projectHandler) put(w http.ResponseWriter, r *http.Request, name string) {
+	if !validName(name) {
+		httputil.WriteError(w, "Invalid project name "+name, http.StatusBadRequest)
+		return
+	}
+
+	var spec ProjectSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		httputil.WriteError(w, "Invalid project: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(spec.Namespace) > 0 && !validName(spec.Namespace) {
+		httputil.WriteError(w, "Invalid namespace "+spec.Namespace, http.StatusBadRequest)
+		return
+	}
+	if len(spec.ServiceAccount) > 0 && !serviceAccountRegexp.MatchString(spec.ServiceAccount) {
+		httputil.WriteError(w, "Invalid service account "+spec.ServiceAccount, http.StatusBadRequest)
+		return
+	}
+
+	if spec.MaxRuns < 0 || spec.MaxJobs < 0 {
+		httputil.WriteError(w, "Invalid limits: maxRuns and maxJobs must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	project := Project{name, spec.Namespace, spec.ServiceAccount, spec.MaxRuns, spec.MaxJobs}
+	if err := h.store.Save(project); err != nil {
+		log.Println("Unable to save project:", err.Error())
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	httputil.WriteResponse(w, newProjectResource(project), http.StatusOK)
+}
+
+func (h *projectHandler) delete(w http.ResponseWriter, name string) {
+	if err := h.store.Delete(name); err != nil {
+		writeProjectStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeProjectStoreError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *ProjectNotFoundError:
+		httputil.WriteError(w, err, http.StatusNotFound)
+	default:
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+	}
+}
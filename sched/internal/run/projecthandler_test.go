@@ -0,0 +1,184 @@
+package run
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func TestNewProjectHandler(t *testing.T) {
+	h := NewProjectHandler()
+	if h == nil {
+		t.Errorf("h is nil, expected non-nil")
+	}
+}
+
+func TestProjectHandler(t *testing.T) {
+	Convey("Scenario: manage projects and their runs", t, func() {
+		client := newMemoryClientMock()
+		store := &RedisProjectStore{client}
+		handler := newProjectHandler(NewPipelineFactory(), store, func(project string) Scheduler {
+			return &RedisScheduler{client, project}
+		})
+		w := httptest.NewRecorder()
+
+		Convey("Given a project is stored", func() {
+			Convey("When the spec is valid", func() {
+				r, err := http.NewRequest("PUT", "/api/projects/team-a", strings.NewReader(`{"namespace": "team-a", "serviceAccount": "runner", "maxJobs": 10}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+				var res ProjectResource
+				json.NewDecoder(w.Body).Decode(&res)
+
+				Convey("The project should be saved", func() {
+					So(w.Code, ShouldEqual, 200)
+					So(res.Kind, ShouldEqual, "Project")
+					So(res.Metadata.SelfLink, ShouldEqual, "/api/projects/team-a")
+					So(res.Spec.Namespace, ShouldEqual, "team-a")
+					So(res.Spec.MaxJobs, ShouldEqual, 10)
+					So(client.hashes["project:team-a"]["maxJobs"], ShouldEqual, "10")
+				})
+			})
+
+			Convey("When the namespace is invalid", func() {
+				r, err := http.NewRequest("PUT", "/api/projects/team-a", strings.NewReader(`{"namespace": "Team_A"}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 400", func() {
+					So(w.Code, ShouldEqual, 400)
+					So(client.hashes, ShouldBeEmpty)
+				})
+			})
+
+			Convey("When the name is longer than 63 characters", func() {
+				r, err := http.NewRequest("PUT", "/api/projects/"+strings.Repeat("a", 64), strings.NewReader(`{}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 400", func() {
+					So(w.Code, ShouldEqual, 400)
+					So(client.hashes, ShouldBeEmpty)
+				})
+			})
+
+			Convey("When a limit is negative", func() {
+				r, err := http.NewRequest("PUT", "/api/projects/team-a", strings.NewReader(`{"maxRuns": -1}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 400", func() {
+					So(w.Code, ShouldEqual, 400)
+					So(client.hashes, ShouldBeEmpty)
+				})
+			})
+		})
+
+		Convey("Given runs of a project are requested", func() {
+			if err := store.Save(Project{"team-a", "team-a", "runner", 0, 0}); err != nil {
+				t.Fatal(err)
+			}
+
+			Convey("When a run is submitted", func() {
+				r, err := http.NewRequest("POST", "/api/projects/team-a/runs", strings.NewReader(testStoredPipeline))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+				var run Run
+				json.NewDecoder(w.Body).Decode(&run)
+
+				Convey("The run should be scheduled in the project", func() {
+					So(w.Code, ShouldEqual, 202)
+					So(run.Metadata.SelfLink, ShouldEqual, "/api/projects/team-a/runs/"+run.Metadata.UID)
+					So(client.hashes, ShouldContainKey, "project:team-a:run:"+run.Metadata.UID)
+					So(client.hashes["project:team-a:run:"+run.Metadata.UID]["namespace"], ShouldEqual, "team-a")
+				})
+
+				Convey("The run should only be listed in the project", func() {
+					w := httptest.NewRecorder()
+					r, err := http.NewRequest("GET", "/api/projects/team-a/runs", nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					handler.ServeHTTP(w, r)
+					var list RunList
+					json.NewDecoder(w.Body).Decode(&list)
+					So(list.Metadata.SelfLink, ShouldEqual, "/api/projects/team-a/runs")
+					So(len(list.Items), ShouldEqual, 1)
+
+					w = httptest.NewRecorder()
+					r, err = http.NewRequest("GET", "/api/projects/default/runs", nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					handler.ServeHTTP(w, r)
+					json.NewDecoder(w.Body).Decode(&list)
+					So(len(list.Items), ShouldEqual, 0)
+				})
+
+				Convey("The run should be found with its self link", func() {
+					w := httptest.NewRecorder()
+					r, err := http.NewRequest("GET", run.Metadata.SelfLink, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					handler.ServeHTTP(w, r)
+					So(w.Code, ShouldEqual, 200)
+				})
+			})
+
+			Convey("When the project does not exist", func() {
+				r, err := http.NewRequest("POST", "/api/projects/unknown/runs", strings.NewReader(testStoredPipeline))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 404", func() {
+					So(w.Code, ShouldEqual, 404)
+				})
+			})
+
+			Convey("When the project resource is unknown", func() {
+				r, err := http.NewRequest("GET", "/api/projects/team-a/unknown", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 404", func() {
+					So(w.Code, ShouldEqual, 404)
+				})
+			})
+
+			Convey("When the projects are listed", func() {
+				r, err := http.NewRequest("GET", "/api/projects", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+				var list ProjectList
+				json.NewDecoder(w.Body).Decode(&list)
+
+				Convey("The default project should be listed", func() {
+					So(w.Code, ShouldEqual, 200)
+					So(len(list.Items), ShouldEqual, 2)
+					So(list.Items[0].Metadata.Name, ShouldEqual, DefaultProject)
+				})
+			})
+		})
+	})
+}
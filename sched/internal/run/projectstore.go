@@ -0,0 +1,133 @@
+package run
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// Runs submitted without project belong to the default project.
+const DefaultProject = "default"
+
+// A project isolates the runs of a team.
+// Its jobs are run in the Kubernetes namespace of the project, with its
+// service account. If they are empty, the namespace and service account of
+// the worker are used.
+// MaxRuns and MaxJobs limit the runs of the project processed at the same
+// time, and the jobs of the project running at the same time. Zero is
+// unlimited.
+type Project struct {
+	Name           string `json:"name"`
+	Namespace      string `json:"namespace,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	MaxRuns        int    `json:"maxRuns,omitempty"`
+	MaxJobs        int    `json:"maxJobs,omitempty"`
+}
+
+// ProjectStore persists projects.
+type ProjectStore interface {
+	Save(project Project) error
+	// The default project exists even if it is not stored.
+	Get(name string) (Project, error)
+	// Returns the projects, sorted by name.
+	List() ([]Project, error)
+	Delete(name string) error
+}
+
+type ProjectNotFoundError struct {
+	Name string
+}
+
+func (e *ProjectNotFoundError) Error() string {
+	return "project " + e.Name + " was not found"
+}
+
+type RedisProjectStore struct {
+	client redis.Cmdable
+}
+
+func NewProjectStore() ProjectStore {
+	return &RedisProjectStore{newRedisClient()}
+}
+
+func makeProjectsKey() string {
+	return "projects"
+}
+
+func makeProjectKey(name string) string {
+	return "project:" + name
+}
+
+func (s RedisProjectStore) Save(project Project) error {
+	projectKey := makeProjectKey(project.Name)
+	fields := []interface{}{
+		"name", project.Name,
+		"namespace", project.Namespace,
+		"serviceAccount", project.ServiceAccount,
+		"maxRuns", strconv.Itoa(project.MaxRuns),
+		"maxJobs", strconv.Itoa(project.MaxJobs),
+	}
+	if err := s.client.HSet(projectKey, fields...).Err(); err != nil {
+		return err
+	}
+	return s.client.SAdd(makeProjectsKey(), projectKey).Err()
+}
+
+func (s RedisProjectStore) Get(name string) (Project, error) {
+	project, err := s.client.HGetAll(makeProjectKey(name)).Result()
+	if err != nil {
+		return Project{}, err
+	}
+	if len(project) == 0 {
+		if name == DefaultProject {
+			return Project{Name: DefaultProject}, nil
+		}
+		return Project{}, &ProjectNotFoundError{name}
+	}
+
+	// Limits are unset for projects stored before they existed.
+	maxRuns, _ := strconv.Atoi(project["maxRuns"])
+	maxJobs, _ := strconv.Atoi(project["maxJobs"])
+	return Project{project["name"], project["namespace"], project["serviceAccount"], maxRuns, maxJobs}, nil
+}
+
+func (s RedisProjectStore) List() ([]Project, error) {
+	projects := make([]Project, 0)
+
+	projectKeys, err := s.client.SMembers(makeProjectsKey()).Result()
+	if err != nil {
+		return projects, err
+	}
+
+	hasDefault := false
+	for _, projectKey := range projectKeys {
+		project, err := s.Get(projectKey[len("project:"):])
+		if err != nil {
+			return projects, err
+		}
+		hasDefault = hasDefault || project.Name == DefaultProject
+		projects = append(projects, project)
+	}
+	if !hasDefault {
+		projects = append(projects, Project{Name: DefaultProject})
+	}
+
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].Name < projects[j].Name
+	})
+	return projects, nil
+}
+
+// Runs of the project are not deleted.
+func (s RedisProjectStore) Delete(name string) error {
+	projectKey := makeProjectKey(name)
+	deleted, err := s.client.Del(projectKey).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return &ProjectNotFoundError{name}
+	}
+	return s.client.SRem(makeProjectsKey(), projectKey).Err()
+}
@@ -0,0 +1,109 @@
+package run
+
+import "testing"
+
+func TestProjectStore(t *testing.T) {
+	client := newMemoryClientMock()
+	s := RedisProjectStore{client}
+
+	if err := s.Save(Project{"team-a", "team-a-ns", "team-a-runner", 2, 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	project, err := s.Get("team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if project.Namespace != "team-a-ns" || project.ServiceAccount != "team-a-runner" {
+		t.Errorf("project = %v, expected namespace team-a-ns and service account team-a-runner", project)
+	}
+	if project.MaxRuns != 2 || project.MaxJobs != 10 {
+		t.Errorf("project = %v, expected 2 runs and 10 jobs", project)
+	}
+
+	project, err = s.Get(DefaultProject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if project.Name != DefaultProject || len(project.Namespace) > 0 {
+		t.Errorf("project = %v, expected the default project", project)
+	}
+
+	projects, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != 2 || projects[0].Name != DefaultProject || projects[1].Name != "team-a" {
+		t.Errorf("projects = %v, expected default and team-a", projects)
+	}
+
+	if err := s.Delete("team-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("team-a"); err == nil {
+		t.Errorf("err = nil, expected not found")
+	} else if _, ok := err.(*ProjectNotFoundError); !ok {
+		t.Errorf("err = %v, expected not found", err)
+	}
+}
+
+// Keys of the runs of a project are prefixed, and the run is scheduled with
+// the project namespace and service account.
+func TestScheduleProject(t *testing.T) {
+	client := newMemoryClientMock()
+	if err := (RedisProjectStore{client}).Save(Project{"team-a", "team-a-ns", "team-a-runner", 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	s := RedisScheduler{client, "team-a"}
+
+	p, err := NewPipelineFactory().Create([]byte(`{
+		"kind": "Pipeline",
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0"
+			},
+			"job2": {
+				"image": "busybox",
+				"run": "exit 0",
+				"dependsOn": [{"job": "job1"}]
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := New(p)
+	run.Metadata.UID = "abc"
+	if _, err := s.Schedule(run); err != nil {
+		t.Fatal(err)
+	}
+
+	runHash := client.hashes["project:team-a:run:abc"]
+	if runHash["project"] != "team-a" || runHash["namespace"] != "team-a-ns" || runHash["serviceAccount"] != "team-a-runner" {
+		t.Errorf("run = %v, expected project team-a, with its namespace and service account", runHash)
+	}
+	if jobs := client.lists["jobs:project:team-a:run:abc"]; len(jobs) != 2 || jobs[0] != "job:job1:project:team-a:run:abc" {
+		t.Errorf("jobs = %v, expected prefixed job keys", jobs)
+	}
+	if dep := client.hashes["dependency:0:job:job2:project:team-a:run:abc"]; dep["job"] != "job:job1:project:team-a:run:abc" {
+		t.Errorf("dependency = %v, expected prefixed job key", dep)
+	}
+	if runs := client.lists["project:team-a:runs"]; len(runs) != 1 || runs[0] != "project:team-a:run:abc" {
+		t.Errorf("runs = %v, expected project:team-a:run:abc", runs)
+	}
+	if work := client.lists["runs:work"]; len(work) != 1 || work[0] != "project:team-a:run:abc" {
+		t.Errorf("work = %v, expected the shared work queue to contain the run", work)
+	}
+	if runs := client.lists["runs"]; len(runs) > 0 {
+		t.Errorf("runs = %v, expected the default project to have no runs", runs)
+	}
+
+	statusList, err := s.StatusList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statusList) != 1 || statusList[0].RunUID != "abc" || len(statusList[0].Status.Jobs) != 2 {
+		t.Errorf("statusList = %v, expected run abc with 2 jobs", statusList)
+	}
+}
@@ -16,12 +16,14 @@ import (
 
 // Possible values for run status:
 // - PENDING
+// - QUEUED: the run waits for its project or pipeline to be under its limit
 // - RUNNING
 // - SUCCESSFUL
 // - FAILED
 // - CANCELED
 // Possible values for jobs status:
 // - PENDING
+// - QUEUED: the job waits for its project or pipeline to be under its limit
 // - RUNNING
 // - SUCCESSFUL
 // - FAILED
@@ -34,12 +36,32 @@ type Run struct {
 	Jobs     []RunJob `json:"jobs"`
 }
 
+// The commit is the SHA of the pipeline source, once resolved.
 type Metadata struct {
 	SelfLink string `json:"selfLink"`
 	UID      string `json:"uid"`
+	Commit   string `json:"commit,omitempty"`
 }
 
+// Outputs are the key/value results written by the job.
+// Failed jobs have the reason of their failure, one of Failed,
+// InfrastructureError, ImageError, SourceError, Evicted and Timeout, and the
+// exit code of their command if it failed.
 type RunJob struct {
+	Name     string            `json:"name"`
+	Status   string            `json:"status"`
+	Reason   string            `json:"reason,omitempty"`
+	ExitCode int               `json:"exitCode,omitempty"`
+	Outputs  map[string]string `json:"outputs,omitempty"`
+	Steps    []RunJobStep      `json:"steps,omitempty"`
+}
+
+// Possible values for steps status:
+// - PENDING
+// - RUNNING
+// - SUCCESSFUL
+// - FAILED
+type RunJobStep struct {
 	Name   string `json:"name"`
 	Status string `json:"status"`
 }
@@ -76,35 +98,43 @@ type RunListItem struct {
 }
 
 func NewList(items []StatusListItem) RunList {
+	return newList("/api/runs", items)
+}
+
+// The base path is the path of the runs collection, e.g. /api/runs.
+func newList(basePath string, items []StatusListItem) RunList {
 	list := RunList{
 		Kind: "RunList",
 		Metadata: RunListMetadata{
-			SelfLink: "/api/runs",
+			SelfLink: basePath,
 		},
 		Items: make([]RunListItem, 0, len(items)),
 	}
 
 	for _, item := range items {
-		list.Items = append(list.Items, newListItem(item))
+		list.Items = append(list.Items, newListItem(basePath, item))
 	}
 
 	return list
 }
 
-func newListItem(item StatusListItem) RunListItem {
+func newListItem(basePath string, item StatusListItem) RunListItem {
 	return RunListItem{
 		Metadata: Metadata{
-			SelfLink: "/api/runs/" + item.RunUID,
+			SelfLink: basePath + "/" + item.RunUID,
 			UID:      item.RunUID,
+			Commit:   item.Status.Commit,
 		},
 		Status: item.Status.Run,
 		Jobs:   item.Status.Jobs,
 	}
 }
 
+// The handler serves the runs of a single project, under the base path.
 type runHandler struct {
-	pf    PipelineFactory
-	sched Scheduler
+	pf       PipelineFactory
+	sched    Scheduler
+	basePath string
 }
 
 func NewHandler() http.Handler {
@@ -114,7 +144,7 @@ func NewHandler() http.Handler {
 	)
 }
 func newHandler(pf PipelineFactory, sched Scheduler) http.Handler {
-	handler := &runHandler{pf, sched}
+	handler := &runHandler{pf, sched, "/api/runs"}
 
 	mux := httputil.NewServeMux()
 	mux.Handle("/api/runs", handler)
@@ -126,7 +156,7 @@ func (h *runHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	switch r.Method {
 	case "GET":
-		runUID := r.URL.Path[len("/api/runs"):]
+		runUID := r.URL.Path[len(h.basePath):]
 		if len(runUID) == 0 {
 			h.list(w)
 		} else {
@@ -148,7 +178,7 @@ func (h *runHandler) list(w http.ResponseWriter) {
 		return
 	}
 
-	runList := NewList(statusList)
+	runList := newList(h.basePath, statusList)
 	httputil.WriteResponse(w, runList, http.StatusOK)
 }
 
@@ -167,8 +197,9 @@ func (h *runHandler) get(w http.ResponseWriter, runUID string) {
 	run := Run{
 		Kind: "Run",
 		Metadata: Metadata{
-			SelfLink: "/api/runs/" + runUID,
+			SelfLink: h.basePath + "/" + runUID,
 			UID:      runUID,
+			Commit:   status.Commit,
 		},
 		Status: status.Run,
 		Jobs:   status.Jobs,
@@ -190,6 +221,7 @@ func (h *runHandler) post(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	run := New(p)
+	run.Metadata.SelfLink = h.basePath + "/" + run.Metadata.UID
 
 	status, err := h.sched.Schedule(run)
 	if err != nil {
@@ -30,8 +30,8 @@ func TestNewList(t *testing.T) {
 			Status: Status{
 				Run: "RUNNING",
 				Jobs: []RunJob{
-					RunJob{"job1", "PENDING"},
-					RunJob{"job2", "RUNNING"},
+					RunJob{Name: "job1", Status: "PENDING"},
+					RunJob{Name: "job2", Status: "RUNNING"},
 				},
 			},
 		},
@@ -80,8 +80,8 @@ func (s nonEmptyScheduler) Status(runUID string) (Status, error) {
 	return Status{
 		Run: "RUNNING",
 		Jobs: []RunJob{
-			RunJob{"job1", "RUNNING"},
-			RunJob{"job2", "PENDING"},
+			RunJob{Name: "job1", Status: "RUNNING"},
+			RunJob{Name: "job2", Status: "PENDING"},
 		},
 	}, nil
 }
@@ -92,8 +92,8 @@ func (s nonEmptyScheduler) StatusList() ([]StatusListItem, error) {
 			Status: Status{
 				Run: "RUNNING",
 				Jobs: []RunJob{
-					RunJob{"job1", "RUNNING"},
-					RunJob{"job2", "PENDING"},
+					RunJob{Name: "job1", Status: "RUNNING"},
+					RunJob{Name: "job2", Status: "PENDING"},
 				},
 			},
 		},
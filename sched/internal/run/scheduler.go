@@ -1,6 +1,7 @@
 package run
 
 import (
+	"encoding/json"
 	"log"
 	"os"
 	"sort"
@@ -20,8 +21,10 @@ type Scheduler interface {
 }
 
 type Status struct {
-	Run  string
-	Jobs []RunJob
+	Run string
+	// Commit SHA of the pipeline source, once resolved by the worker.
+	Commit string
+	Jobs   []RunJob
 }
 
 type StatusListItem struct {
@@ -37,11 +40,22 @@ func (e NotFoundError) Error() string {
 	return "run " + e.RunUID + " was not found"
 }
 
+// The scheduler manages the runs of a single project.
 type RedisScheduler struct {
-	client redis.Cmdable
+	client  redis.Cmdable
+	project string
 }
 
+// Returns a scheduler for the default project.
 func NewScheduler() Scheduler {
+	return &RedisScheduler{newRedisClient(), DefaultProject}
+}
+
+func (s RedisScheduler) prefix() string {
+	return makeProjectPrefix(s.project)
+}
+
+func newRedisClient() redis.UniversalClient {
 	addrs := []string{"chainr-redis:6379"}
 	masterName := ""
 	password := ""
@@ -67,7 +81,7 @@ func NewScheduler() Scheduler {
 		db = d
 	}
 
-	client := redis.NewUniversalClient(&redis.UniversalOptions{
+	return redis.NewUniversalClient(&redis.UniversalOptions{
 		Addrs:      addrs,
 		MasterName: masterName,
 
@@ -77,36 +91,48 @@ func NewScheduler() Scheduler {
 		MaxRetries:      6,
 		MaxRetryBackoff: 10 * time.Second,
 	})
+}
 
-	return &RedisScheduler{client}
+// Keys of the runs of the default project are not prefixed, so that runs
+// created before projects existed remain available.
+func makeProjectPrefix(project string) string {
+	if project == DefaultProject {
+		return ""
+	}
+	return "project:" + project + ":"
 }
 
-func makeRunsKey() string {
-	return "runs"
+func makeRunsKey(prefix string) string {
+	return prefix + "runs"
 }
 
-func makeRunKey(runUID string) string {
-	return "run:" + runUID
+func makeRunKey(prefix, runUID string) string {
+	return prefix + "run:" + runUID
 }
 
-func makeRunJobsKey(runUID string) string {
-	return "jobs:" + makeRunKey(runUID)
+func makeRunJobsKey(prefix, runUID string) string {
+	return "jobs:" + makeRunKey(prefix, runUID)
 }
 
-func makeWorkRunsKey() string {
-	return "runs:work"
+// Runs are queued by priority. Normal runs use the queue runs used before
+// priorities existed.
+func makeWorkRunsKey(priority string) string {
+	if len(priority) == 0 || priority == "normal" {
+		return "runs:work"
+	}
+	return "runs:work:" + priority
 }
 
-func makeJobKey(runUID string, jobName string) string {
-	return "job:" + jobName + ":" + makeRunKey(runUID)
+func makeJobKey(prefix, runUID string, jobName string) string {
+	return "job:" + jobName + ":" + makeRunKey(prefix, runUID)
 }
 
-func makeJobDependenciesKey(runUID string, jobName string) string {
-	return "dependencies:" + makeJobKey(runUID, jobName)
+func makeJobDependenciesKey(prefix, runUID string, jobName string) string {
+	return "dependencies:" + makeJobKey(prefix, runUID, jobName)
 }
 
-func makeJobDependencyKey(runUID string, jobName string, depIndex int) string {
-	return "dependency:" + strconv.Itoa(depIndex) + ":" + makeJobKey(runUID, jobName)
+func makeJobDependencyKey(prefix, runUID string, jobName string, depIndex int) string {
+	return "dependency:" + strconv.Itoa(depIndex) + ":" + makeJobKey(prefix, runUID, jobName)
 }
 
 // The jobItem struct is used internally to make a sorted
@@ -123,10 +149,10 @@ type jobItem struct {
 func (s RedisScheduler) Schedule(run Run) (Status, error) {
 	jobs := sortJobs(run.p.Jobs)
 
-	if err := s.scheduleJobs(run.Metadata.UID, jobs); err != nil {
+	if err := s.scheduleJobs(run.Metadata.UID, run.p.Name, jobs); err != nil {
 		return Status{}, err
 	}
-	if err := s.scheduleRun(run.Metadata.UID); err != nil {
+	if err := s.scheduleRun(run.Metadata.UID, run.p); err != nil {
 		return Status{}, err
 	}
 
@@ -136,8 +162,8 @@ func (s RedisScheduler) Schedule(run Run) (Status, error) {
 	}
 	for _, job := range jobs {
 		status.Jobs = append(status.Jobs, RunJob{
-			job.Name,
-			"PENDING",
+			Name:   job.Name,
+			Status: "PENDING",
 		})
 	}
 	return status, nil
@@ -176,7 +202,9 @@ func bla(s []jobItem) []string {
 
 // Jobs are added to the jobs list only if all jobs were successfully created.
 // This avoids partial scheduling due to technical errors.
-func (s RedisScheduler) scheduleJobs(runUID string, jobs []jobItem) error {
+// Jobs of stored pipelines have the pipeline name, used to label their
+// Kubernetes jobs.
+func (s RedisScheduler) scheduleJobs(runUID, pipeline string, jobs []jobItem) error {
 	jobKeys := make([]interface{}, 0, len(jobs))
 
 	for _, jobItem := range jobs {
@@ -187,13 +215,44 @@ func (s RedisScheduler) scheduleJobs(runUID string, jobs []jobItem) error {
 			return err
 		}
 
-		jobKey := makeJobKey(runUID, jobName)
+		jobKey := makeJobKey(s.prefix(), runUID, jobName)
 		fields := []interface{}{
 			"name", jobName,
 			"image", job.Image,
 			"run", job.Run,
 			"status", "PENDING",
 		}
+		if len(pipeline) > 0 {
+			fields = append(fields, "pipeline", pipeline)
+		}
+		if len(job.If) > 0 {
+			fields = append(fields, "if", job.If)
+		}
+		if len(job.Runner) > 0 {
+			fields = append(fields, "runner", job.Runner)
+		}
+		if len(job.Env) > 0 {
+			env, err := json.Marshal(job.Env)
+			if err != nil {
+				return err
+			}
+			fields = append(fields, "env", string(env))
+		}
+		containersFields, err := makeContainersFields(job)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, containersFields...)
+		artifactFields, err := makeArtifactFields(job)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, artifactFields...)
+		metadataFields, err := makeMetadataFields(job)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, metadataFields...)
 		if err := s.client.HSet(jobKey, fields...).Err(); err != nil {
 			return err
 		}
@@ -201,7 +260,7 @@ func (s RedisScheduler) scheduleJobs(runUID string, jobs []jobItem) error {
 	}
 
 	if len(jobKeys) > 0 {
-		if err := s.client.RPush(makeRunJobsKey(runUID), jobKeys...).Err(); err != nil {
+		if err := s.client.RPush(makeRunJobsKey(s.prefix(), runUID), jobKeys...).Err(); err != nil {
 			return err
 		}
 	}
@@ -209,6 +268,103 @@ func (s RedisScheduler) scheduleJobs(runUID string, jobs []jobItem) error {
 	return nil
 }
 
+// Command, steps, services, volume mounts and pod template fields are only set when
+// the job declares them. Arrays and objects are encoded in JSON.
+func makeContainersFields(job Job) ([]interface{}, error) {
+	fields := make([]interface{}, 0)
+	if len(job.Command) > 0 {
+		command, err := json.Marshal(job.Command)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, "command", string(command))
+	}
+	if len(job.Args) > 0 {
+		args, err := json.Marshal(job.Args)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, "args", string(args))
+	}
+	if len(job.WorkingDir) > 0 {
+		fields = append(fields, "workingDir", job.WorkingDir)
+	}
+	if len(job.Shell) > 0 {
+		fields = append(fields, "shell", job.Shell)
+	}
+	if len(job.Steps) > 0 {
+		steps, err := json.Marshal(job.Steps)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, "steps", string(steps))
+	}
+	if len(job.Services) > 0 {
+		services, err := json.Marshal(job.Services)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, "services", string(services))
+	}
+	if len(job.VolumeMounts) > 0 {
+		mounts, err := json.Marshal(job.VolumeMounts)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, "volumeMounts", string(mounts))
+	}
+	if len(job.PodTemplate) > 0 {
+		template, err := json.Marshal(job.PodTemplate)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, "podTemplate", string(template))
+	}
+	return fields, nil
+}
+
+// Artifacts fields are only set when the job declares outputs or inputs.
+// They are encoded in JSON.
+func makeArtifactFields(job Job) ([]interface{}, error) {
+	fields := make([]interface{}, 0)
+	if len(job.Outputs) > 0 {
+		outputs, err := json.Marshal(job.Outputs)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, "artifacts", string(outputs))
+	}
+	if len(job.Inputs) > 0 {
+		inputs, err := json.Marshal(job.Inputs)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, "inputs", string(inputs))
+	}
+	return fields, nil
+}
+
+// Labels and annotations fields are only set when the job declares them.
+// They are encoded in JSON.
+func makeMetadataFields(job Job) ([]interface{}, error) {
+	fields := make([]interface{}, 0)
+	if len(job.Labels) > 0 {
+		labels, err := json.Marshal(job.Labels)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, "labels", string(labels))
+	}
+	if len(job.Annotations) > 0 {
+		annotations, err := json.Marshal(job.Annotations)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, "annotations", string(annotations))
+	}
+	return fields, nil
+}
+
 func (s RedisScheduler) scheduleDependencies(runUID string, jobName string, job Job) error {
 	depKeys := make([]interface{}, 0, len(job.DependsOn))
 
@@ -217,9 +373,9 @@ func (s RedisScheduler) scheduleDependencies(runUID string, jobName string, job
 		if dep.Conditions.Failure {
 			failure = "true"
 		}
-		depKey := makeJobDependencyKey(runUID, jobName, i)
+		depKey := makeJobDependencyKey(s.prefix(), runUID, jobName, i)
 		fields := []interface{}{
-			"job", makeJobKey(runUID, dep.Job),
+			"job", makeJobKey(s.prefix(), runUID, dep.Job),
 			"failure", failure,
 		}
 		if err := s.client.HSet(depKey, fields...).Err(); err != nil {
@@ -229,7 +385,7 @@ func (s RedisScheduler) scheduleDependencies(runUID string, jobName string, job
 	}
 
 	if len(depKeys) > 0 {
-		depsKey := makeJobDependenciesKey(runUID, jobName)
+		depsKey := makeJobDependenciesKey(s.prefix(), runUID, jobName)
 		if err := s.client.SAdd(depsKey, depKeys...).Err(); err != nil {
 			return err
 		}
@@ -238,19 +394,59 @@ func (s RedisScheduler) scheduleDependencies(runUID string, jobName string, job
 	return nil
 }
 
-func (s RedisScheduler) scheduleRun(runUID string) error {
-	runKey := makeRunKey(runUID)
+func (s RedisScheduler) scheduleRun(runUID string, p Pipeline) error {
+	runKey := makeRunKey(s.prefix(), runUID)
 	fields := []interface{}{
 		"uid", runUID,
 		"status", "PENDING",
+		"project", s.project,
+	}
+	projectFields, err := s.makeProjectFields()
+	if err != nil {
+		return err
+	}
+	fields = append(fields, projectFields...)
+	if len(p.Name) > 0 {
+		fields = append(fields, "pipeline", p.Name)
+	}
+	if len(p.Priority) > 0 {
+		fields = append(fields, "priority", p.Priority)
+	}
+	if p.Concurrency != nil {
+		val, err := json.Marshal(p.Concurrency)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, "concurrency", string(val))
+	}
+	if len(p.Params) > 0 {
+		val, err := json.Marshal(p.Params)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, "params", string(val))
+	}
+	if p.Source != nil {
+		val, err := json.Marshal(p.Source)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, "source", string(val))
+	}
+	if len(p.Volumes) > 0 {
+		val, err := json.Marshal(p.Volumes)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, "volumes", string(val))
 	}
 	if err := s.client.HSet(runKey, fields...).Err(); err != nil {
 		return err
 	}
-	if err := s.client.LPush(makeWorkRunsKey(), runKey).Err(); err != nil {
+	if err := s.client.LPush(makeWorkRunsKey(p.Priority), runKey).Err(); err != nil {
 		return err
 	}
-	runsKey := makeRunsKey()
+	runsKey := makeRunsKey(s.prefix())
 	if err := s.client.LPush(runsKey, runKey).Err(); err != nil {
 		return err
 	}
@@ -258,13 +454,30 @@ func (s RedisScheduler) scheduleRun(runUID string) error {
 	return nil
 }
 
+// The namespace and service account of the project are copied in the run,
+// so that changing the project does not affect scheduled runs.
+func (s RedisScheduler) makeProjectFields() ([]interface{}, error) {
+	fields := make([]interface{}, 0)
+	vals, err := s.client.HMGet(makeProjectKey(s.project), "namespace", "serviceAccount").Result()
+	if err != nil {
+		return fields, err
+	}
+	if namespace, ok := vals[0].(string); ok && len(namespace) > 0 {
+		fields = append(fields, "namespace", namespace)
+	}
+	if serviceAccount, ok := vals[1].(string); ok && len(serviceAccount) > 0 {
+		fields = append(fields, "serviceAccount", serviceAccount)
+	}
+	return fields, nil
+}
+
 func (s RedisScheduler) Status(runUID string) (Status, error) {
 	status := Status{
 		Run:  "PENDING",
 		Jobs: make([]RunJob, 0),
 	}
 
-	run, err := s.client.HGetAll(makeRunKey(runUID)).Result()
+	run, err := s.client.HGetAll(makeRunKey(s.prefix(), runUID)).Result()
 	if err != nil {
 		return status, err
 	}
@@ -272,8 +485,9 @@ func (s RedisScheduler) Status(runUID string) (Status, error) {
 		return status, &NotFoundError{runUID}
 	}
 	status.Run = run["status"]
+	status.Commit = run["commit"]
 
-	jobKeys, err := s.client.LRange(makeRunJobsKey(runUID), 0, -1).Result()
+	jobKeys, err := s.client.LRange(makeRunJobsKey(s.prefix(), runUID), 0, -1).Result()
 	if err != nil {
 		return status, err
 	}
@@ -284,9 +498,34 @@ func (s RedisScheduler) Status(runUID string) (Status, error) {
 			return status, err
 		}
 
+		var outputs map[string]string
+		if val, ok := job["outputs"]; ok {
+			if err := json.Unmarshal([]byte(val), &outputs); err != nil {
+				return status, err
+			}
+		}
+
+		var steps []RunJobStep
+		if val, ok := job["stepsStatus"]; ok {
+			if err := json.Unmarshal([]byte(val), &steps); err != nil {
+				return status, err
+			}
+		}
+
+		var exitCode int
+		if val, ok := job["exitCode"]; ok {
+			if exitCode, err = strconv.Atoi(val); err != nil {
+				return status, err
+			}
+		}
+
 		status.Jobs = append(status.Jobs, RunJob{
-			job["name"],
-			job["status"],
+			Name:     job["name"],
+			Status:   job["status"],
+			Reason:   job["reason"],
+			ExitCode: exitCode,
+			Outputs:  outputs,
+			Steps:    steps,
 		})
 	}
 
@@ -296,7 +535,7 @@ func (s RedisScheduler) Status(runUID string) (Status, error) {
 func (s RedisScheduler) StatusList() ([]StatusListItem, error) {
 	statusList := make([]StatusListItem, 0)
 
-	runKeys, err := s.client.LRange(makeRunsKey(), 0, -1).Result()
+	runKeys, err := s.client.LRange(makeRunsKey(s.prefix()), 0, -1).Result()
 	if err != nil {
 		return statusList, err
 	}
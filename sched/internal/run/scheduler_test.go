@@ -143,7 +143,7 @@ func (c *redisClientMock) HSet(key string, values ...interface{}) *redis.IntCmd
 		expectedValues := []string{}
 		switch c.expectHSetK[i] {
 		case "run:abc":
-			expectedValues = []string{"uid", "abc", "status", "PENDING"}
+			expectedValues = []string{"uid", "abc", "status", "PENDING", "project", "default"}
 		case "job:job1:run:abc":
 			expectedValues = []string{"name", "job1", "image", "busybox", "run", "exit 0", "status", "PENDING"}
 		case "job:job2:run:abc":
@@ -253,23 +253,31 @@ func (c *redisClientMock) HGet(key, field string) *redis.StringCmd {
 	}
 	return redis.NewStringResult("abc", nil)
 }
+func (c *redisClientMock) HMGet(key string, fields ...string) *redis.SliceCmd {
+	return redis.NewSliceResult(make([]interface{}, len(fields)), nil)
+}
 func (c *redisClientMock) HGetAll(key string) *redis.StringStringMapCmd {
 	vals := make(map[string]string)
 	switch key {
 	case "run:abc":
 		vals["uid"] = "abc"
 		vals["status"] = "RUNNING"
+		vals["commit"] = "0123456789abcdef0123456789abcdef01234567"
 	case "run:notfound":
 	case "job:job1:run:abc":
 		vals["name"] = "job1"
 		vals["image"] = "busybox"
 		vals["run"] = "exit 0"
 		vals["status"] = "RUNNING"
+		vals["outputs"] = `{"rows":"42"}`
 	case "job:job2:run:abc":
 		vals["name"] = "job2"
 		vals["image"] = "busybox"
 		vals["run"] = "exit 1"
-		vals["status"] = "PENDING"
+		vals["status"] = "FAILED"
+		vals["reason"] = "Failed"
+		vals["exitCode"] = "1"
+		vals["stepsStatus"] = `[{"name":"migrate","status":"PENDING"}]`
 	default:
 		c.t.Errorf("HGetAll: unexpected key %v", key)
 	}
@@ -278,7 +286,7 @@ func (c *redisClientMock) HGetAll(key string) *redis.StringStringMapCmd {
 }
 
 func TestSchedule(t *testing.T) {
-	s := RedisScheduler{newRedisClientMock(t)}
+	s := RedisScheduler{newRedisClientMock(t), DefaultProject}
 
 	// job2 is before job1 in the map to ensure the ordering is done correctly.
 	// After ordering, job1 should always be before job2 in the list.
@@ -419,7 +427,7 @@ func TestSortJobsLoop(t *testing.T) {
 }
 
 func TestStatus(t *testing.T) {
-	s := RedisScheduler{newRedisClientMock(t)}
+	s := RedisScheduler{newRedisClientMock(t), DefaultProject}
 	status, err := s.Status("abc")
 	if err != nil {
 		t.Fatal(err)
@@ -428,22 +436,40 @@ func TestStatus(t *testing.T) {
 	if status.Run != "RUNNING" {
 		t.Errorf("status.Run = %v, expected RUNNING", status.Run)
 	}
+	if status.Commit != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("status.Commit = %v, expected 0123456789abcdef0123456789abcdef01234567", status.Commit)
+	}
 	if status.Jobs[0].Name != "job1" {
 		t.Errorf("status.Jobs[0].Name = %v, expected job1", status.Jobs[0].Name)
 	}
 	if status.Jobs[0].Status != "RUNNING" {
 		t.Errorf("status.Jobs[0].Status = %v, expected RUNNING", status.Jobs[0].Status)
 	}
+	if status.Jobs[0].Outputs["rows"] != "42" {
+		t.Errorf("status.Jobs[0].Outputs = %v, expected rows=42", status.Jobs[0].Outputs)
+	}
 	if status.Jobs[1].Name != "job2" {
 		t.Errorf("status.Jobs[1].Name = %v, expected job2", status.Jobs[1].Name)
 	}
-	if status.Jobs[1].Status != "PENDING" {
-		t.Errorf("status.Jobs[1].Status = %v, expected PENDING", status.Jobs[1].Status)
+	if status.Jobs[1].Status != "FAILED" {
+		t.Errorf("status.Jobs[1].Status = %v, expected FAILED", status.Jobs[1].Status)
+	}
+	if status.Jobs[1].Reason != "Failed" || status.Jobs[1].ExitCode != 1 {
+		t.Errorf("status.Jobs[1] = reason %v, exit code %v, expected reason Failed, exit code 1", status.Jobs[1].Reason, status.Jobs[1].ExitCode)
+	}
+	if status.Jobs[0].Reason != "" || status.Jobs[0].ExitCode != 0 {
+		t.Errorf("status.Jobs[0] = reason %v, exit code %v, expected no failure", status.Jobs[0].Reason, status.Jobs[0].ExitCode)
+	}
+	if status.Jobs[1].Outputs != nil {
+		t.Errorf("status.Jobs[1].Outputs = %v, expected nil", status.Jobs[1].Outputs)
+	}
+	if len(status.Jobs[1].Steps) != 1 || status.Jobs[1].Steps[0].Name != "migrate" {
+		t.Errorf("status.Jobs[1].Steps = %v, expected migrate", status.Jobs[1].Steps)
 	}
 }
 
 func TestStatusNotFound(t *testing.T) {
-	s := RedisScheduler{newRedisClientMock(t)}
+	s := RedisScheduler{newRedisClientMock(t), DefaultProject}
 	_, err := s.Status("notfound")
 	e := err.(*NotFoundError)
 	if e.RunUID != "notfound" {
@@ -452,7 +478,7 @@ func TestStatusNotFound(t *testing.T) {
 }
 
 func TestStatusList(t *testing.T) {
-	s := RedisScheduler{newRedisClientMock(t)}
+	s := RedisScheduler{newRedisClientMock(t), DefaultProject}
 	statusList, err := s.StatusList()
 	if err != nil {
 		t.Fatal(err)
@@ -473,7 +499,151 @@ func TestStatusList(t *testing.T) {
 	if statusList[0].Status.Jobs[1].Name != "job2" {
 		t.Errorf("statusList[0].Status.Jobs[1].Name = %v, expected job2", statusList[0].Status.Jobs[1].Name)
 	}
-	if statusList[0].Status.Jobs[1].Status != "PENDING" {
-		t.Errorf("statusList[0].Status.Jobs[1].Status = %v, expected PENDING", statusList[0].Status.Jobs[1].Status)
+	if statusList[0].Status.Jobs[1].Status != "FAILED" {
+		t.Errorf("statusList[0].Status.Jobs[1].Status = %v, expected FAILED", statusList[0].Status.Jobs[1].Status)
+	}
+}
+
+func TestMakeArtifactFields(t *testing.T) {
+	fields, err := makeArtifactFields(Job{
+		Outputs: []string{"/tmp/out"},
+		Inputs:  []string{"job1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"artifacts", `["/tmp/out"]`, "inputs", `["job1"]`}
+	vals := make([]string, len(fields))
+	for i, v := range fields {
+		vals[i] = v.(string)
+	}
+	if !equals(vals, expected) {
+		t.Errorf("fields = %v, expected %v", vals, expected)
+	}
+
+	fields, err = makeArtifactFields(Job{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 0 {
+		t.Errorf("fields = %v, expected empty", fields)
+	}
+}
+
+func TestMakeContainersFields(t *testing.T) {
+	fields, err := makeContainersFields(Job{
+		Command:    []string{"/app"},
+		Args:       []string{"--verbose"},
+		WorkingDir: "/data",
+		Steps:      []JobStep{JobStep{"migrate", "migrate", "migrate up"}},
+		Services:   map[string]Service{"postgres": Service{Image: "postgres"}},
+		VolumeMounts: []VolumeMount{
+			VolumeMount{Name: "workspace", MountPath: "/workspace"},
+		},
+		PodTemplate: map[string]interface{}{"nodeSelector": map[string]interface{}{"accelerator": "gpu"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"command", `["/app"]`,
+		"args", `["--verbose"]`,
+		"workingDir", "/data",
+		"steps", `[{"name":"migrate","image":"migrate","run":"migrate up"}]`,
+		"services", `{"postgres":{"image":"postgres","env":null}}`,
+		"volumeMounts", `[{"name":"workspace","mountPath":"/workspace"}]`,
+		"podTemplate", `{"nodeSelector":{"accelerator":"gpu"}}`,
+	}
+	vals := make([]string, len(fields))
+	for i, v := range fields {
+		vals[i] = v.(string)
+	}
+	if !equals(vals, expected) {
+		t.Errorf("fields = %v, expected %v", vals, expected)
+	}
+}
+
+func TestMakeMetadataFields(t *testing.T) {
+	fields, err := makeMetadataFields(Job{
+		Labels:      map[string]string{"team": "data"},
+		Annotations: map[string]string{"example.com/owner": "data"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"labels", `{"team":"data"}`, "annotations", `{"example.com/owner":"data"}`}
+	vals := make([]string, len(fields))
+	for i, v := range fields {
+		vals[i] = v.(string)
+	}
+	if !equals(vals, expected) {
+		t.Errorf("fields = %v, expected %v", vals, expected)
+	}
+}
+
+// Runs of stored pipelines are scheduled with the pipeline name and its
+// concurrency limits, enforced by the workers.
+func TestScheduleConcurrency(t *testing.T) {
+	client := newMemoryClientMock()
+	s := RedisScheduler{client, DefaultProject}
+
+	p, err := NewPipelineFactory().Create([]byte(`{
+		"kind": "Pipeline",
+		"concurrency": {"maxJobs": 2},
+		"jobs": {
+			"job1": {
+				"image": "busybox",
+				"run": "exit 0",
+				"runner": "cpu"
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Name = "backfill"
+	run := New(p)
+	run.Metadata.UID = "abc"
+	if _, err := s.Schedule(run); err != nil {
+		t.Fatal(err)
+	}
+
+	runHash := client.hashes["run:abc"]
+	if runHash["pipeline"] != "backfill" || runHash["concurrency"] != `{"maxJobs":2}` {
+		t.Errorf("run = %v, expected pipeline backfill with its concurrency", runHash)
+	}
+	if jobHash := client.hashes["job:job1:run:abc"]; jobHash["pipeline"] != "backfill" || jobHash["runner"] != "cpu" {
+		t.Errorf("job = %v, expected pipeline backfill on runner cpu", jobHash)
+	}
+}
+
+// Runs are queued by priority, and normal runs in the queue used before
+// priorities existed.
+func TestSchedulePriority(t *testing.T) {
+	client := newMemoryClientMock()
+	s := RedisScheduler{client, DefaultProject}
+
+	for uid, priority := range map[string]string{"abc": "high", "def": "normal", "ghi": "low", "jkl": ""} {
+		run := New(Pipeline{Kind: "Pipeline", Priority: priority, Jobs: map[string]Job{"job1": {Image: "busybox", Run: "exit 0"}}})
+		run.Metadata.UID = uid
+		if _, err := s.Schedule(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if work := client.lists["runs:work:high"]; len(work) != 1 || work[0] != "run:abc" {
+		t.Errorf("high = %v, expected run:abc", work)
+	}
+	if work := client.lists["runs:work"]; len(work) != 2 {
+		t.Errorf("normal = %v, expected run:def and run:jkl", work)
+	}
+	if work := client.lists["runs:work:low"]; len(work) != 1 || work[0] != "run:ghi" {
+		t.Errorf("low = %v, expected run:ghi", work)
+	}
+	if priority := client.hashes["run:abc"]["priority"]; priority != "high" {
+		t.Errorf("priority = %v, expected high", priority)
 	}
 }
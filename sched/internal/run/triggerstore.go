@@ -0,0 +1,115 @@
+package run
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// TriggerStore persists trigger tokens, allowing external systems to run a
+// stored pipeline without API credentials.
+type TriggerStore interface {
+	Save(trigger Trigger) error
+	Get(id string) (Trigger, error)
+	// Returns the triggers, sorted by pipeline and ID.
+	List() ([]Trigger, error)
+	Delete(id string) error
+}
+
+// Tokens are never stored: the ID of a trigger is the SHA-256 hash of its
+// token. Params is the list of parameters callers are allowed to set.
+type Trigger struct {
+	ID       string
+	Pipeline string
+	Params   []string
+}
+
+type TriggerNotFoundError struct {
+	ID string
+}
+
+func (e *TriggerNotFoundError) Error() string {
+	return "trigger " + e.ID + " was not found"
+}
+
+type RedisTriggerStore struct {
+	client redis.Cmdable
+}
+
+func NewTriggerStore() TriggerStore {
+	return &RedisTriggerStore{newRedisClient()}
+}
+
+func makeTriggersKey() string {
+	return "triggers"
+}
+
+func makeTriggerKey(id string) string {
+	return "trigger:" + id
+}
+
+func (s RedisTriggerStore) Save(trigger Trigger) error {
+	params, err := json.Marshal(trigger.Params)
+	if err != nil {
+		return err
+	}
+
+	triggerKey := makeTriggerKey(trigger.ID)
+	if err := s.client.HSet(triggerKey, "id", trigger.ID, "pipeline", trigger.Pipeline, "params", string(params)).Err(); err != nil {
+		return err
+	}
+	return s.client.SAdd(makeTriggersKey(), triggerKey).Err()
+}
+
+func (s RedisTriggerStore) Get(id string) (Trigger, error) {
+	trigger, err := s.client.HGetAll(makeTriggerKey(id)).Result()
+	if err != nil {
+		return Trigger{}, err
+	}
+	if len(trigger) == 0 {
+		return Trigger{}, &TriggerNotFoundError{id}
+	}
+
+	params := make([]string, 0)
+	if err := json.Unmarshal([]byte(trigger["params"]), &params); err != nil {
+		return Trigger{}, err
+	}
+	return Trigger{trigger["id"], trigger["pipeline"], params}, nil
+}
+
+func (s RedisTriggerStore) List() ([]Trigger, error) {
+	triggers := make([]Trigger, 0)
+
+	triggerKeys, err := s.client.SMembers(makeTriggersKey()).Result()
+	if err != nil {
+		return triggers, err
+	}
+
+	for _, triggerKey := range triggerKeys {
+		trigger, err := s.Get(triggerKey[len("trigger:"):])
+		if err != nil {
+			return triggers, err
+		}
+		triggers = append(triggers, trigger)
+	}
+	sort.Slice(triggers, func(i, j int) bool {
+		if triggers[i].Pipeline != triggers[j].Pipeline {
+			return triggers[i].Pipeline < triggers[j].Pipeline
+		}
+		return triggers[i].ID < triggers[j].ID
+	})
+	return triggers, nil
+}
+
+func (s RedisTriggerStore) Delete(id string) error {
+	triggerKey := makeTriggerKey(id)
+	deleted, err := s.client.Del(triggerKey).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return &TriggerNotFoundError{id}
+	}
+	return s.client.SRem(makeTriggersKey(), triggerKey).Err()
+}
@@ -0,0 +1,43 @@
+package run
+
+import "testing"
+
+func TestTriggerStore(t *testing.T) {
+	client := newMemoryClientMock()
+	s := RedisTriggerStore{client}
+
+	if err := s.Save(Trigger{"b2", "nightly", []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(Trigger{"a1", "ci", []string{"branch", "commit"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	trigger, err := s.Get("a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trigger.Pipeline != "ci" || len(trigger.Params) != 2 || trigger.Params[1] != "commit" {
+		t.Errorf("trigger = %v, expected ci with params branch and commit", trigger)
+	}
+
+	triggers, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(triggers) != 2 || triggers[0].ID != "a1" || triggers[1].ID != "b2" {
+		t.Errorf("triggers = %v, expected a1 and b2", triggers)
+	}
+
+	if err := s.Delete("a1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("a1"); err == nil {
+		t.Errorf("err = nil, expected not found")
+	} else if _, ok := err.(*TriggerNotFoundError); !ok {
+		t.Errorf("err = %v, expected not found", err)
+	}
+	if err := s.Delete("a1"); err == nil {
+		t.Errorf("err = nil, expected not found")
+	}
+}
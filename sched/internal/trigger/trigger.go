@@ -0,0 +1,302 @@
+// Package trigger contains the HTTP handler managing trigger tokens, and
+// scheduling runs of stored pipelines when the tokens are used.
+package trigger
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/Tyrame/chainr/sched/internal/httputil"
+	"github.com/Tyrame/chainr/sched/internal/run"
+)
+
+// A trigger, as returned by the API.
+// The token is only returned when the trigger is created.
+type Resource struct {
+	Kind     string   `json:"kind"`
+	Metadata Metadata `json:"metadata"`
+	Token    string   `json:"token,omitempty"`
+	Pipeline string   `json:"pipeline"`
+	Params   []string `json:"params"`
+}
+
+type Metadata struct {
+	SelfLink string `json:"selfLink"`
+	ID       string `json:"id"`
+}
+
+type List struct {
+	Kind     string       `json:"kind"`
+	Metadata ListMetadata `json:"metadata"`
+	Items    []Resource   `json:"items"`
+}
+
+type ListMetadata struct {
+	SelfLink string `json:"selfLink"`
+}
+
+func newResource(trigger run.Trigger) Resource {
+	return Resource{
+		Kind: "Trigger",
+		Metadata: Metadata{
+			SelfLink: "/api/triggers/" + trigger.ID,
+			ID:       trigger.ID,
+		},
+		Pipeline: trigger.Pipeline,
+		Params:   trigger.Params,
+	}
+}
+
+// Body of trigger creation requests.
+type createRequest struct {
+	Pipeline string   `json:"pipeline"`
+	Params   []string `json:"params"`
+}
+
+// Body of the requests using a token. It is optional.
+type runRequest struct {
+	Params map[string]string `json:"params"`
+}
+
+type triggerHandler struct {
+	pf        run.PipelineFactory
+	pipelines run.PipelineStore
+	triggers  run.TriggerStore
+	sched     run.Scheduler
+}
+
+func NewHandler() http.Handler {
+	return newHandler(
+		run.NewPipelineFactory(),
+		run.NewPipelineStore(),
+		run.NewTriggerStore(),
+		run.NewScheduler(),
+	)
+}
+func newHandler(pf run.PipelineFactory, pipelines run.PipelineStore, triggers run.TriggerStore, sched run.Scheduler) http.Handler {
+	handler := &triggerHandler{pf, pipelines, triggers, sched}
+
+	mux := httputil.NewServeMux()
+	mux.Handle("/api/triggers", handler)
+	mux.Handle("/api/triggers/", handler)
+	return mux
+}
+
+// Triggers are managed by ID, and used by posting to their token.
+func (h *triggerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := r.URL.Path[len("/api/triggers"):]
+	if len(name) == 0 {
+		switch r.Method {
+		case "GET":
+			h.list(w)
+		case "POST":
+			h.create(w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			httputil.WriteError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	name = name[1:]
+
+	switch r.Method {
+	case "GET":
+		h.get(w, name)
+	case "POST":
+		h.run(w, r, name)
+	case "DELETE":
+		h.delete(w, name)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		httputil.WriteError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *triggerHandler) list(w http.ResponseWriter) {
+	triggers, err := h.triggers.List()
+	if err != nil {
+		log.Println("Unable to list triggers:", err.Error())
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	list := List{
+		Kind: "TriggerList",
+		Metadata: ListMetadata{
+			SelfLink: "/api/triggers",
+		},
+		Items: make([]Resource, 0, len(triggers)),
+	}
+	for _, trigger := range triggers {
+		list.Items = append(list.Items, newResource(trigger))
+	}
+	httputil.WriteResponse(w, list, http.StatusOK)
+}
+
+func (h *triggerHandler) get(w http.ResponseWriter, id string) {
+	trigger, err := h.triggers.Get(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	httputil.WriteResponse(w, newResource(trigger), http.StatusOK)
+}
+
+// Creates a token for a stored pipeline. The token is returned once, and
+// only its hash is stored.
+func (h *triggerHandler) create(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.WriteError(w, "Invalid trigger: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Pipeline) == 0 {
+		httputil.WriteError(w, "Invalid trigger: pipeline is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.pipelines.Get(req.Pipeline); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if req.Params == nil {
+		req.Params = make([]string, 0)
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	trigger := run.Trigger{
+		ID:       hashToken(token),
+		Pipeline: req.Pipeline,
+		Params:   req.Params,
+	}
+	if err := h.triggers.Save(trigger); err != nil {
+		log.Println("Unable to save trigger:", err.Error())
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	res := newResource(trigger)
+	res.Token = token
+	httputil.WriteResponse(w, res, http.StatusCreated)
+}
+
+func (h *triggerHandler) delete(w http.ResponseWriter, id string) {
+	if err := h.triggers.Delete(id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Maximum size of the parameters of runs scheduled with a token.
+const maxRunRequestSize = 1 << 20
+
+// Schedules a run of the pipeline of the token, with the given parameters.
+// Parameters which are not allowed by the trigger are refused.
+func (h *triggerHandler) run(w http.ResponseWriter, r *http.Request, token string) {
+	trigger, err := h.triggers.Get(hashToken(token))
+	if err != nil {
+		switch err.(type) {
+		case *run.TriggerNotFoundError:
+			// Do not echo the token back in the error.
+			httputil.WriteError(w, "Invalid trigger token", http.StatusNotFound)
+		default:
+			httputil.WriteError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRunRequestSize))
+	if err != nil {
+		httputil.WriteError(w, err, http.StatusRequestEntityTooLarge)
+		return
+	}
+	var req runRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			httputil.WriteError(w, "Invalid parameters: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := checkParams(req.Params, trigger.Params); err != nil {
+		httputil.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	stored, err := h.pipelines.Get(trigger.Pipeline)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	p, err := h.pf.Create(stored.Spec)
+	if err != nil {
+		log.Printf("Stored pipeline %v is invalid: %v", stored.Name, err.Error())
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	p.OverrideParams(req.Params)
+	p.Name = stored.Name
+
+	rn := run.New(p)
+	status, err := h.sched.Schedule(rn)
+	if err != nil {
+		log.Println("Run scheduling failed:", err.Error())
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Scheduled run %v of pipeline %v from trigger %v", rn.Metadata.UID, stored.Name, trigger.ID)
+
+	rn.Status = status.Run
+	rn.Jobs = status.Jobs
+	httputil.WriteResponse(w, rn, http.StatusAccepted)
+}
+
+func checkParams(params map[string]string, allowed []string) error {
+	for name := range params {
+		found := false
+		for _, allowedName := range allowed {
+			if name == allowedName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("parameter %v is not allowed by the trigger", name)
+		}
+	}
+	return nil
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *run.PipelineNotFoundError, *run.TriggerNotFoundError:
+		httputil.WriteError(w, err, http.StatusNotFound)
+	default:
+		httputil.WriteError(w, err, http.StatusInternalServerError)
+	}
+}
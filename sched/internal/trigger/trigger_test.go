@@ -0,0 +1,272 @@
+package trigger
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/Tyrame/chainr/sched/internal/run"
+)
+
+type testPipelineStore struct {
+	pipelines map[string]run.StoredPipeline
+}
+
+func (s testPipelineStore) Save(pipeline run.StoredPipeline) error {
+	s.pipelines[pipeline.Name] = pipeline
+	return nil
+}
+func (s testPipelineStore) Get(name string) (run.StoredPipeline, error) {
+	pipeline, ok := s.pipelines[name]
+	if !ok {
+		return run.StoredPipeline{}, &run.PipelineNotFoundError{Name: name}
+	}
+	return pipeline, nil
+}
+func (s testPipelineStore) List() ([]run.StoredPipeline, error) {
+	return nil, nil
+}
+func (s testPipelineStore) Delete(name string) error {
+	delete(s.pipelines, name)
+	return nil
+}
+
+type testTriggerStore struct {
+	triggers map[string]run.Trigger
+}
+
+func (s testTriggerStore) Save(trigger run.Trigger) error {
+	s.triggers[trigger.ID] = trigger
+	return nil
+}
+func (s testTriggerStore) Get(id string) (run.Trigger, error) {
+	trigger, ok := s.triggers[id]
+	if !ok {
+		return run.Trigger{}, &run.TriggerNotFoundError{ID: id}
+	}
+	return trigger, nil
+}
+func (s testTriggerStore) List() ([]run.Trigger, error) {
+	triggers := make([]run.Trigger, 0, len(s.triggers))
+	for _, trigger := range s.triggers {
+		triggers = append(triggers, trigger)
+	}
+	return triggers, nil
+}
+func (s testTriggerStore) Delete(id string) error {
+	if _, ok := s.triggers[id]; !ok {
+		return &run.TriggerNotFoundError{ID: id}
+	}
+	delete(s.triggers, id)
+	return nil
+}
+
+// Counts the scheduled runs.
+type countingScheduler struct {
+	scheduled int
+}
+
+func (s *countingScheduler) Schedule(rn run.Run) (run.Status, error) {
+	s.scheduled++
+	return run.Status{Run: "PENDING", Jobs: make([]run.RunJob, 0)}, nil
+}
+func (s *countingScheduler) Status(runUID string) (run.Status, error) {
+	return run.Status{}, nil
+}
+func (s *countingScheduler) StatusList() ([]run.StatusListItem, error) {
+	return nil, nil
+}
+
+const testPipeline = `{
+	"kind": "Pipeline",
+	"params": {
+		"target": "staging"
+	},
+	"jobs": {
+		"deploy": {
+			"image": "busybox",
+			"run": "echo ${{ params.target }}"
+		}
+	}
+}`
+
+func TestNewHandler(t *testing.T) {
+	h := NewHandler()
+	if h == nil {
+		t.Errorf("h is nil, expected non-nil")
+	}
+}
+
+func TestTriggerHandler(t *testing.T) {
+	Convey("Scenario: run stored pipelines with trigger tokens", t, func() {
+		pipelines := testPipelineStore{map[string]run.StoredPipeline{
+			"deploy": run.StoredPipeline{Name: "deploy", Spec: []byte(testPipeline)},
+		}}
+		triggers := testTriggerStore{make(map[string]run.Trigger)}
+		sched := &countingScheduler{}
+		handler := newHandler(run.NewPipelineFactory(), pipelines, triggers, sched)
+		w := httptest.NewRecorder()
+
+		Convey("Given a trigger is created", func() {
+			Convey("When the pipeline exists", func() {
+				r, err := http.NewRequest("POST", "/api/triggers", strings.NewReader(`{"pipeline": "deploy", "params": ["target"]}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+				var res Resource
+				json.NewDecoder(w.Body).Decode(&res)
+
+				Convey("The request should succeed with code 201", func() {
+					So(w.Code, ShouldEqual, 201)
+				})
+
+				Convey("The token should be returned, and only its hash stored", func() {
+					So(len(res.Token), ShouldEqual, 64)
+					So(res.Metadata.ID, ShouldEqual, hashToken(res.Token))
+					So(triggers.triggers, ShouldContainKey, hashToken(res.Token))
+					So(triggers.triggers, ShouldNotContainKey, res.Token)
+				})
+			})
+
+			Convey("When the pipeline does not exist", func() {
+				r, err := http.NewRequest("POST", "/api/triggers", strings.NewReader(`{"pipeline": "unknown"}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 404", func() {
+					So(w.Code, ShouldEqual, 404)
+					So(triggers.triggers, ShouldBeEmpty)
+				})
+			})
+		})
+
+		Convey("Given a token is used", func() {
+			token := "secret-token"
+			triggers.triggers[hashToken(token)] = run.Trigger{
+				ID:       hashToken(token),
+				Pipeline: "deploy",
+				Params:   []string{"target"},
+			}
+
+			Convey("When the parameters are allowed", func() {
+				r, err := http.NewRequest("POST", "/api/triggers/"+token, strings.NewReader(`{"params": {"target": "prod"}}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("A run should be scheduled", func() {
+					So(w.Code, ShouldEqual, 202)
+					So(sched.scheduled, ShouldEqual, 1)
+				})
+			})
+
+			Convey("When no parameters are given", func() {
+				r, err := http.NewRequest("POST", "/api/triggers/"+token, strings.NewReader(""))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("A run should be scheduled", func() {
+					So(w.Code, ShouldEqual, 202)
+					So(sched.scheduled, ShouldEqual, 1)
+				})
+			})
+
+			Convey("When a parameter is not allowed", func() {
+				r, err := http.NewRequest("POST", "/api/triggers/"+token, strings.NewReader(`{"params": {"image": "evil"}}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 400", func() {
+					So(w.Code, ShouldEqual, 400)
+					So(sched.scheduled, ShouldEqual, 0)
+				})
+			})
+
+			Convey("When the parameters are too large", func() {
+				body := `{"params": {"target": "` + strings.Repeat("a", maxRunRequestSize) + `"}}`
+				r, err := http.NewRequest("POST", "/api/triggers/"+token, strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 413", func() {
+					So(w.Code, ShouldEqual, 413)
+					So(sched.scheduled, ShouldEqual, 0)
+				})
+			})
+
+			Convey("When the token is invalid", func() {
+				r, err := http.NewRequest("POST", "/api/triggers/other-token", strings.NewReader(""))
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The request should fail with code 404", func() {
+					So(w.Code, ShouldEqual, 404)
+					So(w.Body.String(), ShouldNotContainSubstring, "other-token")
+					So(sched.scheduled, ShouldEqual, 0)
+				})
+			})
+
+			Convey("When the trigger is revoked", func() {
+				r, err := http.NewRequest("DELETE", "/api/triggers/"+hashToken(token), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+
+				Convey("The token should not be usable anymore", func() {
+					So(w.Code, ShouldEqual, 204)
+
+					w := httptest.NewRecorder()
+					r, err := http.NewRequest("POST", "/api/triggers/"+token, strings.NewReader(""))
+					if err != nil {
+						t.Fatal(err)
+					}
+					handler.ServeHTTP(w, r)
+					So(w.Code, ShouldEqual, 404)
+				})
+			})
+
+			Convey("When the triggers are listed", func() {
+				r, err := http.NewRequest("GET", "/api/triggers", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.ServeHTTP(w, r)
+				var list List
+				json.NewDecoder(w.Body).Decode(&list)
+
+				Convey("The triggers should be listed without their token", func() {
+					So(w.Code, ShouldEqual, 200)
+					So(len(list.Items), ShouldEqual, 1)
+					So(list.Items[0].Token, ShouldBeEmpty)
+					So(list.Items[0].Pipeline, ShouldEqual, "deploy")
+				})
+			})
+		})
+	})
+}
+
+func TestCheckParams(t *testing.T) {
+	if err := checkParams(map[string]string{"target": "prod"}, []string{"target"}); err != nil {
+		t.Errorf("err = %v, expected nil", err)
+	}
+	if err := checkParams(map[string]string{"target": "prod"}, []string{}); err == nil {
+		t.Errorf("err = nil, expected not allowed")
+	}
+}
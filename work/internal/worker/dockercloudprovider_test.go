@@ -0,0 +1,402 @@
+package worker
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// In-memory Docker Engine, serving the endpoints used by the Docker cloud
+// provider. Containers exit as soon as they are waited for.
+type dockerEngineStub struct {
+	l          sync.Mutex
+	images     map[string]bool
+	containers map[string]*dockerContainerStub
+	// Configurations of the created containers, kept once they are removed.
+	created map[string]dockerContainerConfig
+	// Exit codes and termination logs of the containers, by name.
+	exitCodes map[string]int
+	outputs   map[string]string
+	pullError string
+	requests  []string
+}
+
+type dockerContainerStub struct {
+	name   string
+	config dockerContainerConfig
+	status string
+}
+
+func newDockerEngineStub() *dockerEngineStub {
+	return &dockerEngineStub{
+		images:     make(map[string]bool),
+		containers: make(map[string]*dockerContainerStub),
+		created:    make(map[string]dockerContainerConfig),
+		exitCodes:  make(map[string]int),
+		outputs:    make(map[string]string),
+	}
+}
+
+// Containers IDs are their names prefixed with id-.
+func (e *dockerEngineStub) container(ref string) (*dockerContainerStub, bool) {
+	c, ok := e.containers[strings.TrimPrefix(ref, "id-")]
+	return c, ok
+}
+
+func (e *dockerEngineStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.l.Lock()
+	defer e.l.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+dockerAPIVersion)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	e.requests = append(e.requests, r.Method+" "+path)
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "not found"})
+	}
+
+	switch {
+	case r.Method == "GET" && parts[0] == "images":
+		image := strings.Join(parts[1:len(parts)-1], "/")
+		if !e.images[image] {
+			notFound()
+			return
+		}
+		json.NewEncoder(w).Encode(dockerImage{})
+	case r.Method == "POST" && path == "/images/create":
+		w.Write([]byte(`{"status":"Pulling"}` + "\n"))
+		if len(e.pullError) > 0 {
+			json.NewEncoder(w).Encode(map[string]string{"error": e.pullError})
+			return
+		}
+		e.images[r.URL.Query().Get("fromImage")] = true
+	case r.Method == "POST" && path == "/containers/create":
+		var config dockerContainerConfig
+		json.NewDecoder(r.Body).Decode(&config)
+		name := r.URL.Query().Get("name")
+		if !e.images[config.Image] {
+			notFound()
+			return
+		}
+		if _, ok := e.containers[name]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		e.containers[name] = &dockerContainerStub{name, config, "created"}
+		e.created[name] = config
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"Id": "id-" + name})
+	case r.Method == "GET" && path == "/containers/json":
+		var filters map[string][]string
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		containers := []dockerContainer{}
+	containers:
+		for _, c := range e.containers {
+			for _, label := range filters["label"] {
+				kv := strings.SplitN(label, "=", 2)
+				if c.config.Labels[kv[0]] != kv[1] {
+					continue containers
+				}
+			}
+			containers = append(containers, dockerContainer{ID: "id-" + c.name, Labels: c.config.Labels})
+		}
+		json.NewEncoder(w).Encode(containers)
+	case parts[0] == "containers":
+		c, ok := e.container(parts[1])
+		if !ok {
+			notFound()
+			return
+		}
+		e.serveContainer(w, r, c, strings.Join(parts[2:], "/"))
+	case r.Method == "POST" && path == "/volumes/create":
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	case r.Method == "DELETE" && parts[0] == "volumes":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		notFound()
+	}
+}
+
+func (e *dockerEngineStub) serveContainer(w http.ResponseWriter, r *http.Request, c *dockerContainerStub, action string) {
+	switch {
+	case r.Method == "GET" && action == "json":
+		container := dockerContainer{ID: "id-" + c.name, Labels: c.config.Labels}
+		container.State.Status = c.status
+		json.NewEncoder(w).Encode(container)
+	case r.Method == "POST" && action == "start":
+		c.status = "running"
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && action == "wait":
+		c.status = "exited"
+		json.NewEncoder(w).Encode(map[string]int{"StatusCode": e.exitCodes[c.name]})
+	case r.Method == "GET" && action == "logs":
+		for stream, line := range []string{"", "out\n", "err\n"} {
+			if stream > 0 {
+				header := make([]byte, 8)
+				header[0] = byte(stream)
+				binary.BigEndian.PutUint32(header[4:], uint32(len(line)))
+				w.Write(append(header, line...))
+			}
+		}
+	case r.Method == "GET" && action == "archive":
+		data, ok := e.outputs[c.name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		archive := tar.NewWriter(w)
+		archive.WriteHeader(&tar.Header{Name: "termination-log", Mode: 0644, Size: int64(len(data))})
+		archive.Write([]byte(data))
+		archive.Close()
+	case r.Method == "DELETE" && action == "":
+		delete(e.containers, c.name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (e *dockerEngineStub) hasRequest(request string) bool {
+	e.l.Lock()
+	defer e.l.Unlock()
+	return contains(e.requests, request)
+}
+
+// Serves the stub on a unix socket, as the Docker Engine does.
+func newTestDockerCloudProvider(t *testing.T, engine *dockerEngineStub) (DockerCloudProvider, func()) {
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(engine)
+	server.Listener = listener
+	server.Start()
+
+	docker, err := newDockerClient("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := DockerCloudProvider{docker: docker, gitImage: defaultGitImage}
+	return cp, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDockerRunJob(t *testing.T) {
+	engine := newDockerEngineStub()
+	engine.outputs["chainr-abc-extract"] = "rows=42\n"
+	cp, cleanup := newTestDockerCloudProvider(t, engine)
+	defer cleanup()
+
+	job := Job{
+		RunID: "run:abc",
+		Name:  "extract",
+		Image: "busybox",
+		Run:   `echo "rows=42" > "$TERMINATION_LOG"`,
+		Steps: []Step{Step{Name: "prepare", Run: "true"}},
+	}
+	result, err := cp.WithProject(Project{Name: "etl"}).RunJob(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Outputs["rows"] != "42" {
+		t.Errorf("outputs = %v, expected rows=42", result.Outputs)
+	}
+	if !reflect.DeepEqual(result.Steps, []StepStatus{StepStatus{"prepare", "SUCCESSFUL"}}) {
+		t.Errorf("steps = %v, expected prepare successful", result.Steps)
+	}
+	if !engine.hasRequest("POST /images/create") {
+		t.Errorf("image was not pulled")
+	}
+	for _, name := range []string{"chainr-abc-extract-step-prepare", "chainr-abc-extract"} {
+		if !engine.hasRequest("DELETE /containers/id-" + name) {
+			t.Errorf("container %s was not removed", name)
+		}
+	}
+}
+
+func TestDockerRunJobConfig(t *testing.T) {
+	engine := newDockerEngineStub()
+	engine.images["busybox"] = true
+	engine.images[defaultGitImage] = true
+	cp, cleanup := newTestDockerCloudProvider(t, engine)
+	defer cleanup()
+
+	job := Job{
+		RunID:        "run:abc",
+		ID:           "job:1",
+		Name:         "build",
+		Image:        "busybox",
+		Command:      []string{"make"},
+		Args:         []string{"all"},
+		Env:          map[string]string{"TARGET": "all"},
+		Source:       &Source{Repo: "https://example.com/repo.git", Commit: "abc123"},
+		VolumeMounts: []VolumeMount{VolumeMount{Name: "cache", MountPath: "/cache"}},
+		Volumes:      []Volume{Volume{Name: "cache", Workspace: &WorkspaceVolume{}}},
+	}
+	if _, err := cp.RunJob(job); err != nil {
+		t.Fatal(err)
+	}
+
+	clone := engine.created["chainr-abc-build-clone"]
+	if clone.Image != defaultGitImage || !contains(clone.Env, "GIT_COMMIT=abc123") {
+		t.Errorf("clone container = %+v, expected the commit to be cloned with git", clone)
+	}
+	config := engine.created["chainr-abc-build"]
+	if !reflect.DeepEqual(config.Entrypoint, []string{"make"}) || !reflect.DeepEqual(config.Cmd, []string{"all"}) {
+		t.Errorf("command = %v %v, expected make all", config.Entrypoint, config.Cmd)
+	}
+	if config.WorkingDir != sourceMountPath || !contains(config.Env, "TARGET=all") {
+		t.Errorf("container = %+v, expected to run in the source with the job env", config)
+	}
+	if config.Labels[runIDAnnotation] != "run:abc" || config.Labels[jobLabel] != "build" {
+		t.Errorf("labels = %v, expected the run and job", config.Labels)
+	}
+	expected := []dockerMount{
+		dockerMount{Type: "volume", Source: "chainr-abc-build-source", Target: sourceMountPath},
+		dockerMount{Type: "volume", Source: workspaceClaimName("run:abc", "cache"), Target: "/cache"},
+	}
+	if !reflect.DeepEqual(config.HostConfig.Mounts, expected) {
+		t.Errorf("mounts = %v, expected %v", config.HostConfig.Mounts, expected)
+	}
+	if !engine.hasRequest("DELETE /volumes/chainr-abc-build-source") {
+		t.Errorf("source volume was not removed")
+	}
+	if engine.hasRequest("DELETE /volumes/" + workspaceClaimName("run:abc", "cache")) {
+		t.Errorf("workspace was removed with the job")
+	}
+}
+
+func TestDockerRunJobArtifacts(t *testing.T) {
+	engine := newDockerEngineStub()
+	engine.images["busybox"] = true
+	cp, cleanup := newTestDockerCloudProvider(t, engine)
+	defer cleanup()
+	location, err := ioutil.TempDir("", "chainr-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(location)
+
+	job := Job{RunID: "run:abc", Name: "consume", Image: "busybox", Run: "wc -l rows.txt", Artifacts: []string{"out"}, Inputs: []string{"produce"}, ArtifactsLocation: location}
+	if _, err := cp.RunJob(job); err != nil {
+		t.Fatal(err)
+	}
+	config := engine.created["chainr-abc-consume"]
+	if len(config.Entrypoint) != 4 || config.Entrypoint[2] != saveArtifactsScript(job.Artifacts, outputsMountPath) {
+		t.Errorf("entrypoint = %v, expected the artifacts to be saved", config.Entrypoint)
+	}
+	expected := []dockerMount{
+		dockerMount{Type: "bind", Source: filepath.Join(location, "consume"), Target: outputsMountPath},
+		dockerMount{Type: "bind", Source: filepath.Join(location, "produce"), Target: inputsMountPathRoot + "/produce", ReadOnly: true},
+	}
+	if !reflect.DeepEqual(config.HostConfig.Mounts, expected) {
+		t.Errorf("mounts = %v, expected %v", config.HostConfig.Mounts, expected)
+	}
+	if _, err := os.Stat(filepath.Join(location, "consume")); err != nil {
+		t.Errorf("outputs directory was not created: %v", err)
+	}
+}
+
+func TestDockerRunJobFailure(t *testing.T) {
+	engine := newDockerEngineStub()
+	engine.images["busybox"] = true
+	engine.exitCodes["chainr-abc-test-step-first"] = 3
+	cp, cleanup := newTestDockerCloudProvider(t, engine)
+	defer cleanup()
+
+	job := Job{
+		RunID: "run:abc",
+		Name:  "test",
+		Image: "busybox",
+		Run:   "true",
+		Steps: []Step{Step{Name: "first", Run: "exit 3"}, Step{Name: "second", Run: "true"}},
+	}
+	result, err := cp.RunJob(job)
+	if jobErr := asJobError(err); jobErr.Reason != ReasonFailed || jobErr.ExitCode != 3 {
+		t.Errorf("err = %v, expected the job to fail with exit code 3", err)
+	}
+	expected := []StepStatus{StepStatus{"first", "FAILED"}, StepStatus{"second", "PENDING"}}
+	if !reflect.DeepEqual(result.Steps, expected) {
+		t.Errorf("steps = %v, expected %v", result.Steps, expected)
+	}
+	if _, ok := engine.created["chainr-abc-test"]; ok {
+		t.Errorf("job container was created after a failed step")
+	}
+}
+
+func TestDockerRunJobImageError(t *testing.T) {
+	engine := newDockerEngineStub()
+	engine.pullError = "manifest unknown"
+	cp, cleanup := newTestDockerCloudProvider(t, engine)
+	defer cleanup()
+
+	_, err := cp.RunJob(Job{RunID: "run:abc", Name: "test", Image: "missing", Run: "true"})
+	if jobErr := asJobError(err); jobErr.Reason != ReasonImage || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Errorf("err = %v, expected an image error", err)
+	}
+}
+
+func TestDockerRunJobAttach(t *testing.T) {
+	engine := newDockerEngineStub()
+	engine.images["busybox"] = true
+	engine.containers["chainr-abc-test"] = &dockerContainerStub{"chainr-abc-test", dockerContainerConfig{Image: "busybox"}, "running"}
+	engine.exitCodes["chainr-abc-test"] = 1
+	cp, cleanup := newTestDockerCloudProvider(t, engine)
+	defer cleanup()
+
+	_, err := cp.RunJob(Job{RunID: "run:abc", Name: "test", Image: "busybox", Run: "true"})
+	if jobErr := asJobError(err); jobErr.Reason != ReasonFailed || jobErr.ExitCode != 1 {
+		t.Errorf("err = %v, expected the result of the existing container", err)
+	}
+	if engine.hasRequest("POST /containers/id-chainr-abc-test/start") {
+		t.Errorf("existing container was started again")
+	}
+}
+
+func TestDockerListDeleteJobs(t *testing.T) {
+	engine := newDockerEngineStub()
+	for _, name := range []string{"build", "test"} {
+		labels := makeLabels(Job{RunID: "run:abc", Name: name}, "")
+		engine.containers[name] = &dockerContainerStub{name, dockerContainerConfig{Labels: labels}, "running"}
+	}
+	labels := makeLabels(Job{RunID: "run:def", Name: "other"}, "")
+	engine.containers["other"] = &dockerContainerStub{"other", dockerContainerConfig{Labels: labels}, "running"}
+	cp, cleanup := newTestDockerCloudProvider(t, engine)
+	defer cleanup()
+
+	names, err := cp.ListJobs("run:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"build", "test"}) {
+		t.Errorf("jobs = %v, expected build and test", names)
+	}
+
+	if err := cp.DeleteJob("run:abc", "build"); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := cp.ListJobs("run:abc"); !reflect.DeepEqual(names, []string{"test"}) {
+		t.Errorf("jobs = %v, expected test", names)
+	}
+}
@@ -0,0 +1,286 @@
+package worker
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expressions are used to run jobs conditionally.
+// They are evaluated against the run context, and support:
+// - string literals, in double quotes: "prod"
+// - number literals: 42, 1.5
+// - boolean literals: true, false
+// - references to the run context: params.env, jobs.extract.status,
+//   jobs.extract.outputs.rows
+// - comparison operators: ==, !=, <, <=, >, >=
+// - logical operators: &&, ||, !
+// - parentheses
+//
+// All values are strings. Comparisons are numeric when both operands are
+// numbers, and lexicographic otherwise.
+// Empty strings, "false" and "0" are false, other values are true.
+// Unknown references evaluate to an empty string.
+
+// Evaluates the expression against the run context.
+// An error is returned if the expression is invalid.
+func evalExpr(expr string, ctx runContext) (bool, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return false, err
+	}
+
+	p := exprParser{tokens: tokens, ctx: ctx}
+	val, err := p.parseOr()
+	if err != nil {
+		return false, err
+	}
+	if p.pos < len(p.tokens) {
+		return false, errors.New("unexpected token " + p.tokens[p.pos].val)
+	}
+
+	return truthy(val), nil
+}
+
+const (
+	tokenString = iota
+	tokenNumber
+	tokenIdent
+	tokenOperator
+)
+
+type token struct {
+	kind int
+	val  string
+}
+
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+func tokenize(expr string) ([]token, error) {
+	tokens := make([]token, 0)
+	runes := []rune(expr)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '"':
+			j := i + 1
+			var sb strings.Builder
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				sb.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, errors.New("unterminated string in expression")
+			}
+			tokens = append(tokens, token{tokenString, sb.String()})
+			i = j + 1
+
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokenNumber, string(runes[i:j])})
+			i = j
+
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || strings.ContainsRune("_-.", runes[j])) {
+				j++
+			}
+			tokens = append(tokens, token{tokenIdent, string(runes[i:j])})
+			i = j
+
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, token{tokenOperator, op})
+					i += len([]rune(op))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, errors.New("unexpected character " + string(r) + " in expression")
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []token
+	pos    int
+	ctx    runContext
+}
+
+func (p *exprParser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *exprParser) acceptOperator(ops ...string) (string, bool) {
+	t, ok := p.peek()
+	if !ok || t.kind != tokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.val == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) parseOr() (string, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, ok := p.acceptOperator("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return "", err
+		}
+		left = strconv.FormatBool(truthy(left) || truthy(right))
+	}
+}
+
+func (p *exprParser) parseAnd() (string, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, ok := p.acceptOperator("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return "", err
+		}
+		left = strconv.FormatBool(truthy(left) && truthy(right))
+	}
+}
+
+func (p *exprParser) parseNot() (string, error) {
+	if _, ok := p.acceptOperator("!"); ok {
+		val, err := p.parseNot()
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(!truthy(val)), nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (string, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return "", err
+	}
+
+	op, ok := p.acceptOperator("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parsePrimary()
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatBool(compare(left, op, right)), nil
+}
+
+func (p *exprParser) parsePrimary() (string, error) {
+	t, ok := p.peek()
+	if !ok {
+		return "", errors.New("unexpected end of expression")
+	}
+	p.pos++
+
+	switch t.kind {
+	case tokenString:
+		return t.val, nil
+	case tokenNumber:
+		if _, err := strconv.ParseFloat(t.val, 64); err != nil {
+			return "", errors.New("invalid number " + t.val)
+		}
+		return t.val, nil
+	case tokenIdent:
+		switch t.val {
+		case "true", "false":
+			return t.val, nil
+		}
+		return p.ctx.lookup(t.val), nil
+	}
+
+	if t.val == "(" {
+		val, err := p.parseOr()
+		if err != nil {
+			return "", err
+		}
+		if _, ok := p.acceptOperator(")"); !ok {
+			return "", errors.New("missing closing parenthesis in expression")
+		}
+		return val, nil
+	}
+
+	return "", errors.New("unexpected token " + t.val)
+}
+
+func compare(left, op, right string) bool {
+	l, lerr := strconv.ParseFloat(left, 64)
+	r, rerr := strconv.ParseFloat(right, 64)
+	if lerr == nil && rerr == nil {
+		switch op {
+		case "==":
+			return l == r
+		case "!=":
+			return l != r
+		case "<":
+			return l < r
+		case "<=":
+			return l <= r
+		case ">":
+			return l > r
+		case ">=":
+			return l >= r
+		}
+	}
+
+	switch op {
+	case "==":
+		return left == right
+	case "!=":
+		return left != right
+	case "<":
+		return left < right
+	case "<=":
+		return left <= right
+	case ">":
+		return left > right
+	case ">=":
+		return left >= right
+	}
+	return false
+}
+
+func truthy(val string) bool {
+	return val != "" && val != "false" && val != "0"
+}
@@ -0,0 +1,54 @@
+package worker
+
+import "testing"
+
+func TestEvalExpr(t *testing.T) {
+	exprs := map[string]bool{
+		`params.env == "prod"`: true,
+		`params.env != "prod"`: false,
+		`params.env == "prod" && jobs.extract.outputs.rows > 0`:              true,
+		`jobs.extract.outputs.rows > 100`:                                    false,
+		`jobs.extract.outputs.rows >= 42 && jobs.extract.outputs.rows <= 42`: true,
+		`jobs.extract.outputs.rows > 5`:                                      true,
+		`jobs.extract.status == "SUCCESSFUL"`:                                true,
+		`!(jobs.extract.status == "FAILED")`:                                 true,
+		`params.unknown`:                                                     false,
+		`params.unknown == ""`:                                               true,
+		`false || params.env`:                                                true,
+		`true && false || true`:                                              true,
+		`true && (false || false)`:                                           false,
+		`"b" > "a"`:                                                          true,
+		`"a\"b" == "a\"b"`:                                                   true,
+		`1.5 < 2`:                                                            true,
+		`!0`:                                                                 true,
+	}
+	for expr, expected := range exprs {
+		val, err := evalExpr(expr, testRunContext)
+		if err != nil {
+			t.Errorf("evalExpr(%v) returned error %v", expr, err)
+			continue
+		}
+		if val != expected {
+			t.Errorf("evalExpr(%v) = %v, expected %v", expr, val, expected)
+		}
+	}
+}
+
+func TestEvalExprInvalid(t *testing.T) {
+	exprs := []string{
+		``,
+		`params.env ==`,
+		`"unterminated`,
+		`(true`,
+		`true)`,
+		`1.2.3 == 1`,
+		`params.env = "prod"`,
+		`params.env == "prod" ; rm -rf /`,
+		`==`,
+	}
+	for _, expr := range exprs {
+		if _, err := evalExpr(expr, testRunContext); err == nil {
+			t.Errorf("evalExpr(%v) returned a nil error", expr)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FSArtifactStore stores artifacts in a directory per run.
+// The location is an absolute path, which is mounted in jobs as a host path.
+// It is only suited for single-node clusters, or for jobs run locally.
+type FSArtifactStore struct {
+	root string
+}
+
+func NewFSArtifactStore() FSArtifactStore {
+	root := filepath.Join(os.TempDir(), "chainr-artifacts")
+	if val, ok := os.LookupEnv("ARTIFACTS_ROOT"); ok {
+		root = val
+	}
+	return FSArtifactStore{root}
+}
+
+func (as FSArtifactStore) Create(runID string) error {
+	return os.MkdirAll(as.Location(runID), 0777)
+}
+
+func (as FSArtifactStore) Location(runID string) string {
+	return filepath.Join(as.root, runUID(runID))
+}
+
+// Artifacts of all projects are stored in the same root.
+func (as FSArtifactStore) WithProject(project Project) ArtifactStore {
+	return as
+}
+
+// Runners storing artifacts on the filesystem share the same root.
+func (as FSArtifactStore) WithRunner(runner string) ArtifactStore {
+	return as
+}
+
+func (as FSArtifactStore) Delete(runID string) error {
+	return os.RemoveAll(as.Location(runID))
+}
@@ -0,0 +1,37 @@
+package worker
+
+import (
+	"testing"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func TestFSArtifactStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "chainr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	as := FSArtifactStore{root}
+	location := as.Location("run:abc")
+	if location != filepath.Join(root, "abc") {
+		t.Errorf("location = %v, expected %v", location, filepath.Join(root, "abc"))
+	}
+
+	if err := as.Create("run:abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(location); err != nil {
+		t.Errorf("artifacts directory was not created: %v", err)
+	}
+
+	if err := as.Delete("run:abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(location); !os.IsNotExist(err) {
+		t.Errorf("artifacts directory was not deleted")
+	}
+}
@@ -0,0 +1,123 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Matches full commit SHAs, which do not need to be resolved.
+var commitRegexp = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// Repositories are https, ssh or git URLs, or scp-like ssh addresses such as
+// git@github.com:org/repo.git. Other transports, e.g. ext:: or local paths,
+// are rejected, as are values which could be parsed as git options.
+var repoRegexp = regexp.MustCompile(`^((https|ssh|git)://[^-\s]\S*|[A-Za-z0-9][-A-Za-z0-9._]*@[A-Za-z0-9][-A-Za-z0-9.]*:\S+)$`)
+
+func validateRepo(repo string) error {
+	if !repoRegexp.MatchString(repo) {
+		return errors.New("repository " + repo + " is not an https, ssh or git URL")
+	}
+	return nil
+}
+
+// Credentials are read from the environment by the credential helper,
+// so that they do not appear in the command line.
+const gitCredentialHelper = `!f() { echo "username=$GIT_USERNAME"; echo "password=$GIT_PASSWORD"; }; f`
+
+type gitCredentials struct {
+	Username string
+	Password string
+}
+
+func (c gitCredentials) env() []string {
+	if len(c.Username) == 0 && len(c.Password) == 0 {
+		return nil
+	}
+	return []string{"GIT_USERNAME=" + c.Username, "GIT_PASSWORD=" + c.Password}
+}
+
+// Returns the environment of git commands run by the worker: PATH, HOME and
+// the GIT_ variables of the worker, and the credentials. Other variables,
+// such as the credentials of the worker, are not passed to git, nor to the
+// commands it runs, e.g. ssh or the credential helper.
+func gitEnv(creds gitCredentials) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name := kv[:strings.Index(kv, "=")]
+		if name == "PATH" || name == "HOME" || strings.HasPrefix(name, "GIT_") {
+			env = append(env, kv)
+		}
+	}
+	return append(append(env, "GIT_TERMINAL_PROMPT=0"), creds.env()...)
+}
+
+// Resolves the ref of the repository to a commit SHA.
+// The ref can be HEAD, a full ref name, a branch, a tag or a commit SHA.
+// Tags are resolved to the commit they point to.
+func resolveCommit(repo, ref string, creds gitCredentials) (string, error) {
+	if err := validateRepo(repo); err != nil {
+		return "", err
+	}
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+	if commitRegexp.MatchString(ref) {
+		return ref, nil
+	}
+
+	cmd := exec.Command("git", "-c", "credential.helper=", "-c", "credential.helper="+gitCredentialHelper, "ls-remote", "--", repo)
+	cmd.Env = gitEnv(creds)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.New("unable to list refs of " + repo + ": " + strings.TrimSpace(stderr.String()))
+	}
+
+	refs := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	candidates := []string{ref, "refs/heads/" + ref, "refs/tags/" + ref + "^{}", "refs/tags/" + ref}
+	for _, candidate := range candidates {
+		if sha, ok := refs[candidate]; ok {
+			return sha, nil
+		}
+	}
+	return "", errors.New("ref " + ref + " was not found in " + repo)
+}
+
+// Returns the error of the clone script of the source. The script exiting
+// with a non-zero code is a source error, while other errors, e.g. if the
+// script could not be run, are returned as is.
+func cloneError(repo string, err error) error {
+	var jobErr *JobError
+	if errors.As(err, &jobErr) && jobErr.Reason == ReasonFailed {
+		return &JobError{Reason: ReasonSource, Message: "unable to clone " + repo}
+	}
+	return errors.New("unable to clone " + repo + ": " + err.Error())
+}
+
+// Clones the commit GIT_COMMIT of the repository GIT_REPO in SOURCE_DIR.
+// Only the commit is fetched, without its history.
+// When GIT_USERNAME or GIT_PASSWORD are set, they are used as credentials.
+const cloneScript = `set -e
+git init -q "$SOURCE_DIR"
+cd "$SOURCE_DIR"
+if [ -n "$GIT_USERNAME" ] || [ -n "$GIT_PASSWORD" ]; then
+	git config credential.helper '` + gitCredentialHelper + `'
+fi
+git remote add -- origin "$GIT_REPO"
+git fetch -q --depth 1 origin "$GIT_COMMIT"
+git checkout -q FETCH_HEAD
+git rev-parse HEAD`
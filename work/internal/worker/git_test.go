@@ -0,0 +1,153 @@
+package worker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Creates a bare repository with a commit on main, tagged v1 with an
+// annotated tag, and returns its path and the commit SHA.
+func makeTestRepo(t *testing.T, dir string) (string, string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	repo := filepath.Join(dir, "repo.git")
+	work := filepath.Join(dir, "work")
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v", args, string(out))
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	git(dir, "init", "-q", "--bare", repo)
+	git(dir, "init", "-q", work)
+	if err := ioutil.WriteFile(filepath.Join(work, "README.md"), []byte("chainr"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(work, "add", "README.md")
+	git(work, "commit", "-q", "-m", "Initial commit")
+	git(work, "tag", "-a", "v1", "-m", "v1")
+	git(work, "push", "-q", repo, "HEAD:refs/heads/main", "v1")
+	git(repo, "symbolic-ref", "HEAD", "refs/heads/main")
+	git(repo, "update-server-info")
+
+	return repo, git(work, "rev-parse", "HEAD")
+}
+
+func TestResolveCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainr-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, sha := makeTestRepo(t, dir)
+
+	// The repository is served with the dumb HTTP protocol.
+	server := httptest.NewTLSServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	os.Setenv("GIT_SSL_NO_VERIFY", "true")
+	defer os.Unsetenv("GIT_SSL_NO_VERIFY")
+	repo := server.URL + "/" + filepath.Base(path)
+
+	for _, ref := range []string{"", "HEAD", "main", "refs/heads/main", "v1", sha} {
+		resolved, err := resolveCommit(repo, ref, gitCredentials{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved != sha {
+			t.Errorf("resolveCommit(%v) = %v, expected %v", ref, resolved, sha)
+		}
+	}
+
+	if _, err := resolveCommit(repo, "unknown", gitCredentials{}); err == nil {
+		t.Errorf("err = nil, expected not nil")
+	}
+	if _, err := resolveCommit(server.URL+"/notfound.git", "main", gitCredentials{}); err == nil {
+		t.Errorf("err = nil, expected not nil")
+	}
+}
+
+func TestResolveCommitInvalidRepo(t *testing.T) {
+	for _, repo := range []string{
+		"--upload-pack=touch /tmp/pwned",
+		"ext::sh -c touch% /tmp/pwned",
+		"file:///etc",
+		"/srv/git/repo.git",
+		"ssh://-oProxyCommand=touch /tmp/pwned/repo",
+	} {
+		if _, err := resolveCommit(repo, "0123456789abcdef0123456789abcdef01234567", gitCredentials{}); err == nil {
+			t.Errorf("resolveCommit(%v) returned a nil error", repo)
+		}
+	}
+	for _, repo := range []string{
+		"https://github.com/Tyrame/chainr.git",
+		"ssh://git@github.com/Tyrame/chainr.git",
+		"git://example.com/repo.git",
+		"git@github.com:Tyrame/chainr.git",
+	} {
+		if err := validateRepo(repo); err != nil {
+			t.Errorf("err = %v, expected %v to be valid", err, repo)
+		}
+	}
+}
+
+func TestGitEnv(t *testing.T) {
+	os.Setenv("REDIS_PASSWORD", "secret")
+	defer os.Unsetenv("REDIS_PASSWORD")
+	os.Setenv("GIT_SSL_NO_VERIFY", "true")
+	defer os.Unsetenv("GIT_SSL_NO_VERIFY")
+
+	env := gitEnv(gitCredentials{"user", "token"})
+	for _, expected := range []string{"PATH=" + os.Getenv("PATH"), "GIT_SSL_NO_VERIFY=true", "GIT_TERMINAL_PROMPT=0", "GIT_USERNAME=user", "GIT_PASSWORD=token"} {
+		if !contains(env, expected) {
+			t.Errorf("env = %v, expected %v", env, expected)
+		}
+	}
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "REDIS_PASSWORD=") {
+			t.Errorf("env = %v, expected REDIS_PASSWORD not to be passed", env)
+		}
+	}
+}
+
+func TestCloneScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainr-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo, sha := makeTestRepo(t, dir)
+
+	source := filepath.Join(dir, "source")
+	cmd := exec.Command("sh", "-c", cloneScript)
+	cmd.Env = append(os.Environ(), "SOURCE_DIR="+source, "GIT_REPO=file://"+repo, "GIT_COMMIT="+sha)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("clone failed: %v", string(out))
+	}
+	if strings.TrimSpace(string(out)) != sha {
+		t.Errorf("out = %v, expected %v", string(out), sha)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(source, "README.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "chainr" {
+		t.Errorf("README.md = %v, expected chainr", string(data))
+	}
+}
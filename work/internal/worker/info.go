@@ -3,9 +3,20 @@ package worker
 import "os"
 
 type Info struct {
-	Name         string
+	Name string
+	// Queue of the runs without priority.
 	Queue        string
 	ProcessQueue string
+	// Queues of the runs, in priority order.
+	PriorityQueues []PriorityQueue
+	// Queue of the jobs any worker can run.
+	JobQueue        string
+	JobProcessQueue string
+}
+
+type PriorityQueue struct {
+	Priority string
+	Queue    string
 }
 
 func NewInfo() Info {
@@ -15,5 +26,14 @@ func NewInfo() Info {
 	}
 	queue := "runs:work"
 	processQueue := "runs:worker:" + name
-	return Info{name, queue, processQueue}
+	return Info{name, queue, processQueue, makePriorityQueues(queue), "jobs:work", "jobs:worker:" + name}
+}
+
+// Normal runs use the queue of the runs without priority.
+func makePriorityQueues(queue string) []PriorityQueue {
+	return []PriorityQueue{
+		{"high", queue + ":high"},
+		{"normal", queue},
+		{"low", queue + ":low"},
+	}
 }
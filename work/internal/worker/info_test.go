@@ -13,4 +13,17 @@ func TestNewInfo(t *testing.T) {
 	if info.ProcessQueue != "runs:worker:"+info.Name {
 		t.Errorf("info.ProcessQueue = %v, expected runs:worker:%v", info.ProcessQueue, info.Name)
 	}
+	if info.JobQueue != "jobs:work" {
+		t.Errorf("info.JobQueue = %v, expected jobs:work", info.JobQueue)
+	}
+	if info.JobProcessQueue != "jobs:worker:"+info.Name {
+		t.Errorf("info.JobProcessQueue = %v, expected jobs:worker:%v", info.JobProcessQueue, info.Name)
+	}
+
+	expectedQueues := []string{"runs:work:high", "runs:work", "runs:work:low"}
+	for i, queue := range info.PriorityQueues {
+		if queue.Queue != expectedQueues[i] {
+			t.Errorf("info.PriorityQueues[%v] = %v, expected %v", i, queue.Queue, expectedQueues[i])
+		}
+	}
 }
@@ -0,0 +1,44 @@
+package worker
+
+import "errors"
+
+// Reasons of job failures, recorded with the job status.
+const (
+	// The job command, or one of its steps, exited with a non-zero code.
+	ReasonFailed = "Failed"
+	// The job could not be run, e.g. as the cloud provider was unavailable.
+	ReasonInfrastructure = "InfrastructureError"
+	// The image of the job, or of one of its steps or services, could not be
+	// pulled.
+	ReasonImage = "ImageError"
+	// The source of the job could not be checked out, e.g. as its commit was
+	// not found in the repository.
+	ReasonSource = "SourceError"
+	// The job was evicted, e.g. as its node ran out of memory.
+	ReasonEvicted = "Evicted"
+	// The job did not complete in time, e.g. as it could not be scheduled.
+	ReasonTimeout = "Timeout"
+)
+
+// Error returned by cloud providers when a job fails. Other errors are
+// considered infrastructure errors.
+type JobError struct {
+	Reason string
+	// Exit code of the command which failed, set for the Failed reason.
+	ExitCode int
+	Message  string
+}
+
+func (err *JobError) Error() string {
+	return err.Message
+}
+
+// Returns the job error err wraps, or an infrastructure error if it wraps
+// none.
+func asJobError(err error) *JobError {
+	var jobErr *JobError
+	if errors.As(err, &jobErr) {
+		return jobErr
+	}
+	return &JobError{Reason: ReasonInfrastructure, Message: err.Error()}
+}
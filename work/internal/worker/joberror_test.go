@@ -0,0 +1,19 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAsJobError(t *testing.T) {
+	err := fmt.Errorf("step failed: %w", &JobError{ReasonFailed, 3, "job execution failed"})
+	if jobErr := asJobError(err); jobErr.Reason != ReasonFailed || jobErr.ExitCode != 3 {
+		t.Errorf("job error = %v with exit code %v, expected Failed with exit code 3", jobErr.Reason, jobErr.ExitCode)
+	}
+
+	jobErr := asJobError(errors.New("connection refused"))
+	if jobErr.Reason != ReasonInfrastructure || jobErr.Message != "connection refused" {
+		t.Errorf("job error = %v: %v, expected an infrastructure error", jobErr.Reason, jobErr.Message)
+	}
+}
@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"log"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// If ARTIFACTS_STORE is set to "fs", artifacts are stored on the filesystem,
+// otherwise a persistent volume claim is created for each run.
+func NewArtifactStore(cp K8SCloudProvider) ArtifactStore {
+	if val, ok := os.LookupEnv("ARTIFACTS_STORE"); ok && val == "fs" {
+		return NewFSArtifactStore()
+	}
+	return NewK8SArtifactStore(cp)
+}
+
+// K8SArtifactStore creates a persistent volume claim for each run.
+// Jobs mount the claim to save and read artifacts.
+type K8SArtifactStore struct {
+	kube         kubernetes.Interface
+	namespace    string
+	size         string
+	storageClass string
+}
+
+func NewK8SArtifactStore(cp K8SCloudProvider) K8SArtifactStore {
+	size := "1Gi"
+	storageClass := ""
+	if val, ok := os.LookupEnv("ARTIFACTS_STORAGE_SIZE"); ok {
+		size = val
+	}
+	if val, ok := os.LookupEnv("ARTIFACTS_STORAGE_CLASS"); ok {
+		storageClass = val
+	}
+
+	return K8SArtifactStore{cp.kube, cp.namespace, size, storageClass}
+}
+
+func (as K8SArtifactStore) Create(runID string) error {
+	pvc, err := makePersistentVolumeClaim(as.Location(runID), as.size, as.storageClass)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating persistent volume claim", pvc.Name)
+	_, err = as.kube.CoreV1().PersistentVolumeClaims(as.namespace).Create(&pvc)
+	return ignoreAlreadyExists(err)
+}
+
+// The location is the name of the persistent volume claim.
+func (as K8SArtifactStore) Location(runID string) string {
+	return "chainr-artifacts-" + runUID(runID)
+}
+
+// Claims are created in the project namespace, so that its jobs can mount
+// them.
+func (as K8SArtifactStore) WithProject(project Project) ArtifactStore {
+	if len(project.Namespace) > 0 {
+		as.namespace = project.Namespace
+	}
+	return as
+}
+
+// The store is the one of a single runner.
+func (as K8SArtifactStore) WithRunner(runner string) ArtifactStore {
+	return as
+}
+
+func (as K8SArtifactStore) Delete(runID string) error {
+	name := as.Location(runID)
+	log.Println("Deleting persistent volume claim", name)
+	return as.kube.CoreV1().PersistentVolumeClaims(as.namespace).Delete(name, &metav1.DeleteOptions{})
+}
@@ -0,0 +1,31 @@
+package worker
+
+import "testing"
+
+func TestK8SArtifactStoreLocation(t *testing.T) {
+	as := NewK8SArtifactStore(K8SCloudProvider{})
+	if location := as.Location("run:abc"); location != "chainr-artifacts-abc" {
+		t.Errorf("location = %v, expected chainr-artifacts-abc", location)
+	}
+	if as.size != "1Gi" {
+		t.Errorf("as.size = %v, expected 1Gi", as.size)
+	}
+}
+
+func TestK8SArtifactStoreInvalidSize(t *testing.T) {
+	as := K8SArtifactStore{nil, "chainr", "invalid", ""}
+	if err := as.Create("run:abc"); err == nil {
+		t.Errorf("err = nil, expected not nil")
+	}
+}
+
+func TestK8SArtifactStoreProjectLocation(t *testing.T) {
+	as := K8SArtifactStore{nil, "chainr", "1Gi", ""}
+	projectAS := as.WithProject(Project{Name: "team-a", Namespace: "team-a"}).(K8SArtifactStore)
+	if projectAS.namespace != "team-a" {
+		t.Errorf("namespace = %v, expected team-a", projectAS.namespace)
+	}
+	if location := projectAS.Location("project:team-a:run:abc"); location != "chainr-artifacts-abc" {
+		t.Errorf("location = %v, expected chainr-artifacts-abc", location)
+	}
+}
@@ -5,12 +5,16 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -19,26 +23,49 @@ import (
 type K8SCloudProvider struct {
 	kube      kubernetes.Interface
 	namespace string
+	// Project of the jobs, used to label them.
+	project string
+	// Service account of the job pods. If empty, the namespace default
+	// service account is used.
+	serviceAccount string
+	// Image cloning the pipeline source, it must provide sh and git.
+	gitImage string
+	// Fields of the pod spec the pod templates of jobs can not set.
+	podTemplatePolicy podTemplatePolicy
 }
 
+const defaultGitImage = "alpine/git:latest"
+
 // If the Kubernetes client can not be created,
 // this function panics.
+// The image cloning the pipeline source can be overridden with GIT_IMAGE, and
+// the fields pod templates can not set with POD_TEMPLATE_DISALLOWED_FIELDS.
 func NewK8SCloudProvider() K8SCloudProvider {
 	var cp K8SCloudProvider
 
 	if val, ok := os.LookupEnv("KUBECONFIG"); ok {
 		log.Println("Program is running outside the cluster, loading config from", val)
-		cp = newOutsideCluster(val)
+		cp = newOutsideCluster(val, "")
 	} else {
 		log.Println("Program is running inside the cluster")
 		cp = newInsideCluster()
 	}
 
+	cp.gitImage = gitImageFromEnv()
+	cp.podTemplatePolicy = podTemplatePolicyFromEnv()
 	log.Println("Jobs will be run on namespace", cp.namespace)
 	return cp
 }
 
-func newOutsideCluster(kubeconfig string) K8SCloudProvider {
+func gitImageFromEnv() string {
+	if val, ok := os.LookupEnv("GIT_IMAGE"); ok {
+		return val
+	}
+	return defaultGitImage
+}
+
+// The current context of the kubeconfig is used if context is empty.
+func newOutsideCluster(kubeconfig, context string) K8SCloudProvider {
 	loadingRules := clientcmd.ClientConfigLoadingRules{
 		ExplicitPath: kubeconfig,
 	}
@@ -46,7 +73,7 @@ func newOutsideCluster(kubeconfig string) K8SCloudProvider {
 	if err != nil {
 		panic(err)
 	}
-	configOverrides := &clientcmd.ConfigOverrides{}
+	configOverrides := &clientcmd.ConfigOverrides{CurrentContext: context}
 	kubeConfig := clientcmd.NewDefaultClientConfig(*config, configOverrides)
 
 	clientConfig, err := kubeConfig.ClientConfig()
@@ -60,7 +87,7 @@ func newOutsideCluster(kubeconfig string) K8SCloudProvider {
 		panic(err)
 	}
 
-	return K8SCloudProvider{clientset, namespace}
+	return K8SCloudProvider{kube: clientset, namespace: namespace}
 }
 
 func newInsideCluster() K8SCloudProvider {
@@ -77,64 +104,608 @@ func newInsideCluster() K8SCloudProvider {
 	}
 	namespace := strings.TrimSpace(string(data))
 
-	return K8SCloudProvider{clientset, namespace}
+	return K8SCloudProvider{kube: clientset, namespace: namespace}
 }
 
-func (cp K8SCloudProvider) RunJob(job Job) error {
-	k8sJob := cp.makeK8SJob(job)
-	created, err := cp.kube.BatchV1().Jobs(cp.namespace).Create(&k8sJob)
+// Labels of the Kubernetes jobs, and of their pods, correlating them with
+// the run and the job.
+const (
+	managedByLabel  = "app.kubernetes.io/managed-by"
+	runLabel        = "chainr.io/run"
+	jobLabel        = "chainr.io/job"
+	pipelineLabel   = "chainr.io/pipeline"
+	projectLabel    = "chainr.io/project"
+	attemptLabel    = "chainr.io/attempt"
+	runIDAnnotation = "chainr.io/run-id"
+	jobIDAnnotation = "chainr.io/job-id"
+)
+
+// The pod of the job is watched rather than the job itself, as services
+// keep running after the job command completes. See podWatch.
+// If the Kubernetes job was already created, e.g. by a worker which was
+// killed, the worker re-attaches to it rather than creating another one.
+func (cp K8SCloudProvider) RunJob(job Job) (JobResult, error) {
+	var result JobResult
+
+	created, err := cp.findK8SJob(job)
 	if err != nil {
-		return err
+		return result, err
+	}
+	if created != nil {
+		log.Println("Re-attaching to Kubernetes job", created.Name)
+	} else {
+		k8sJob := cp.makeK8SJob(job)
+		if len(job.PodTemplate) > 0 {
+			if err := mergePodTemplate(&k8sJob.Spec.Template.Spec, job.PodTemplate, job.Name, cp.podTemplatePolicy); err != nil {
+				return result, err
+			}
+		}
+		if created, err = cp.kube.BatchV1().Jobs(cp.namespace).Create(&k8sJob); err != nil {
+			return result, err
+		}
 	}
 	defer cp.deleteK8SJob(created.Name)
 
-	watch, err := cp.kube.BatchV1().Jobs(cp.namespace).Watch(metav1.ListOptions{
-		FieldSelector: fields.Set{
-			"metadata.name": created.Name,
-		}.AsSelector().String(),
+	w := podWatch{
+		job:    job,
+		k8sJob: created.Name,
+		pods:   cp.kube.CoreV1().Pods(cp.namespace),
+		jobs:   cp.kube.BatchV1().Jobs(cp.namespace),
+	}
+	return w.Wait()
+}
+
+// Returns the Kubernetes job running the job, or nil if there is none.
+func (cp K8SCloudProvider) findK8SJob(job Job) (*batchv1.Job, error) {
+	k8sJobs, err := cp.listK8SJobs(jobSelector(job.RunID, job.Name))
+	if err != nil || len(k8sJobs) == 0 {
+		return nil, err
+	}
+	return &k8sJobs[0], nil
+}
+
+// Returns the Kubernetes jobs matching the selector, except the jobs being
+// deleted.
+func (cp K8SCloudProvider) listK8SJobs(selector string) ([]batchv1.Job, error) {
+	list, err := cp.kube.BatchV1().Jobs(cp.namespace).List(metav1.ListOptions{
+		LabelSelector: selector,
 	})
+	if err != nil {
+		return nil, err
+	}
+	k8sJobs := make([]batchv1.Job, 0, len(list.Items))
+	for _, k8sJob := range list.Items {
+		if k8sJob.DeletionTimestamp == nil {
+			k8sJobs = append(k8sJobs, k8sJob)
+		}
+	}
+	return k8sJobs, nil
+}
+
+func runSelector(runID string) string {
+	return managedByLabel + "=chainr," + runLabel + "=" + runUID(runID)
+}
+
+func jobSelector(runID, name string) string {
+	return runSelector(runID) + "," + jobLabel + "=" + name
+}
+
+// Jobs are listed by their labels, in the namespace of the project.
+func (cp K8SCloudProvider) ListJobs(runID string) ([]string, error) {
+	k8sJobs, err := cp.listK8SJobs(runSelector(runID))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(k8sJobs))
+	for _, k8sJob := range k8sJobs {
+		names = append(names, k8sJob.Labels[jobLabel])
+	}
+	return names, nil
+}
+
+func (cp K8SCloudProvider) DeleteJob(runID, name string) error {
+	k8sJobs, err := cp.listK8SJobs(jobSelector(runID, name))
 	if err != nil {
 		return err
 	}
+	for _, k8sJob := range k8sJobs {
+		cp.deleteK8SJob(k8sJob.Name)
+	}
+	return nil
+}
 
-	for event := range watch.ResultChan() {
-		j, ok := event.Object.(*batchv1.Job)
-		if !ok {
-			return errors.New("unexpected type")
+// Returns the result of the job run by the pod, and whether the job
+// command completed.
+// Outputs are read from the termination message of the job container.
+// Failures are returned as job errors.
+func podResult(job Job, pod *corev1.Pod) (JobResult, bool, error) {
+	result := JobResult{Steps: stepsStatus(job.Steps, pod)}
+
+	if pod.Status.Phase == corev1.PodFailed && pod.Status.Reason == "Evicted" {
+		return result, true, &JobError{Reason: ReasonEvicted, Message: "job pod was evicted: " + pod.Status.Message}
+	}
+	if pod.Status.Phase == corev1.PodFailed {
+		if job.Source != nil && cloneFailed(pod) {
+			return result, true, &JobError{Reason: ReasonSource, Message: "unable to clone " + job.Source.Repo}
 		}
-		if j.Status.Failed > 0 {
-			return errors.New("job execution failed")
-		} else if j.Status.Succeeded > 0 {
-			return nil
+		if exitCode, ok := failedExitCode(pod); ok {
+			return result, true, &JobError{ReasonFailed, exitCode, "job execution failed"}
 		}
+		return result, true, errors.New("job pod failed: " + pod.Status.Message)
 	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != job.Name || status.State.Terminated == nil {
+			continue
+		}
+		if status.State.Terminated.ExitCode != 0 {
+			return result, true, &JobError{ReasonFailed, int(status.State.Terminated.ExitCode), "job execution failed"}
+		}
+		result.Outputs = parseOutputs(status.State.Terminated.Message)
+		return result, true, nil
+	}
+	return result, false, nil
+}
 
-	return nil
+// Returns whether the init container cloning the source exited with a
+// non-zero code.
+func cloneFailed(pod *corev1.Pod) bool {
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name == cloneContainer && status.State.Terminated != nil && status.State.Terminated.ExitCode != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the exit code of the first container of the pod which failed,
+// steps included.
+func failedExitCode(pod *corev1.Pod) (int, bool) {
+	for _, status := range containerStatuses(pod) {
+		if status.State.Terminated != nil && status.State.Terminated.ExitCode != 0 {
+			return int(status.State.Terminated.ExitCode), true
+		}
+	}
+	return 0, false
+}
+
+// Returns the statuses of the init containers, then of the containers.
+func containerStatuses(pod *corev1.Pod) []corev1.ContainerStatus {
+	statuses := make([]corev1.ContainerStatus, 0, len(pod.Status.InitContainerStatuses)+len(pod.Status.ContainerStatuses))
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	return append(statuses, pod.Status.ContainerStatuses...)
+}
+
+// Steps are run as init containers, named after the step.
+func stepsStatus(steps []Step, pod *corev1.Pod) []StepStatus {
+	if len(steps) == 0 {
+		return nil
+	}
+
+	states := make(map[string]corev1.ContainerState, len(pod.Status.InitContainerStatuses))
+	for _, status := range pod.Status.InitContainerStatuses {
+		states[status.Name] = status.State
+	}
+
+	statuses := make([]StepStatus, 0, len(steps))
+	for _, step := range steps {
+		status := "PENDING"
+		state := states[stepContainerPrefix+step.Name]
+		if state.Terminated != nil && state.Terminated.ExitCode == 0 {
+			status = "SUCCESSFUL"
+		} else if state.Terminated != nil {
+			status = "FAILED"
+		} else if state.Running != nil {
+			status = "RUNNING"
+		}
+		statuses = append(statuses, StepStatus{step.Name, status})
+	}
+	return statuses
 }
 
 func (cp K8SCloudProvider) makeK8SJob(job Job) batchv1.Job {
 	var k8sJob batchv1.Job
 	k8sJob.GenerateName = "chainr-job-"
-	labels := map[string]string{
-		"app.kubernetes.io/managed-by": "chainr",
-	}
-	k8sJob.Labels = labels
+	k8sJob.Labels = makeLabels(job, cp.project)
+	k8sJob.Annotations = makeAnnotations(job)
 	var backoffLimit int32 = 0
 	k8sJob.Spec.BackoffLimit = &backoffLimit
-	k8sJob.Spec.Template.Labels = labels
-	k8sJob.Spec.Template.Spec.Containers = []corev1.Container{
-		corev1.Container{
-			Name:            job.Name,
-			Image:           job.Image,
-			ImagePullPolicy: corev1.PullIfNotPresent,
-			Command:         []string{"sh", "-c", job.Run},
-		},
+	k8sJob.Spec.Template.Labels = k8sJob.Labels
+	k8sJob.Spec.Template.Annotations = k8sJob.Annotations
+	command, args := jobCommand(job)
+	container := corev1.Container{
+		Name:            job.Name,
+		Image:           job.Image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         command,
+		Args:            args,
+		WorkingDir:      job.WorkingDir,
+		// The termination message file is also set in the environment, as
+		// with local processes and Docker containers.
+		Env: append(makeEnv(job.Env), corev1.EnvVar{Name: terminationLogEnv, Value: corev1.TerminationMessagePathDefault}),
+	}
+	if len(job.Artifacts) > 0 || len(job.Inputs) > 0 {
+		k8sJob.Spec.Template.Spec.Volumes = []corev1.Volume{
+			corev1.Volume{
+				Name:         artifactsVolume,
+				VolumeSource: artifactsVolumeSource(job.ArtifactsLocation),
+			},
+		}
+		container.VolumeMounts = artifactsVolumeMounts(job)
+	}
+	if len(job.Artifacts) > 0 {
+		wrapper := []string{"sh", "-c", saveArtifactsScript(job.Artifacts, outputsMountPath), "sh"}
+		container.Command = append(append(wrapper, command...), args...)
+		container.Args = nil
 	}
+	for _, volume := range job.Volumes {
+		k8sJob.Spec.Template.Spec.Volumes = append(k8sJob.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name:         volume.Name,
+			VolumeSource: volumeSource(job.RunID, volume),
+		})
+	}
+	container.VolumeMounts = append(container.VolumeMounts, makeVolumeMounts(job.VolumeMounts)...)
+	if job.Source != nil {
+		k8sJob.Spec.Template.Spec.Volumes = append(k8sJob.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name:         sourceVolume,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      sourceVolume,
+			MountPath: sourceMountPath,
+		})
+		if len(container.WorkingDir) == 0 {
+			container.WorkingDir = sourceMountPath
+		}
+		k8sJob.Spec.Template.Spec.InitContainers = []corev1.Container{cp.makeCloneContainer(*job.Source)}
+	}
+	k8sJob.Spec.Template.Spec.InitContainers = append(k8sJob.Spec.Template.Spec.InitContainers, makeStepContainers(job, container.VolumeMounts)...)
+	k8sJob.Spec.Template.Spec.Containers = append([]corev1.Container{container}, makeServiceContainers(job)...)
 	k8sJob.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	k8sJob.Spec.Template.Spec.ServiceAccountName = cp.serviceAccount
 
 	return k8sJob
 }
 
+// Labels set by the pipeline can not override the labels set by chainr.
+// Empty values are not set.
+func makeLabels(job Job, project string) map[string]string {
+	labels := make(map[string]string, len(job.Labels)+6)
+	for key, val := range job.Labels {
+		labels[key] = val
+	}
+	labels[managedByLabel] = "chainr"
+	labels[runLabel] = runUID(job.RunID)
+	labels[jobLabel] = job.Name
+	if len(job.Pipeline) > 0 {
+		labels[pipelineLabel] = job.Pipeline
+	}
+	if len(project) > 0 {
+		labels[projectLabel] = project
+	}
+	if job.Attempt > 0 {
+		labels[attemptLabel] = strconv.Itoa(job.Attempt)
+	}
+	return labels
+}
+
+// The identifiers of the run and of the job are annotations, as they are
+// not valid label values.
+func makeAnnotations(job Job) map[string]string {
+	annotations := make(map[string]string, len(job.Annotations)+2)
+	for key, val := range job.Annotations {
+		annotations[key] = val
+	}
+	if len(job.RunID) > 0 {
+		annotations[runIDAnnotation] = job.RunID
+	}
+	if len(job.ID) > 0 {
+		annotations[jobIDAnnotation] = job.ID
+	}
+	return annotations
+}
+
+// Jobs run either a shell command, or a command and its arguments.
+func jobCommand(job Job) ([]string, []string) {
+	if len(job.Run) > 0 {
+		return []string{shell(job), "-c", job.Run}, nil
+	}
+	return job.Command, job.Args
+}
+
+func shell(job Job) string {
+	if len(job.Shell) > 0 {
+		return job.Shell
+	}
+	return "sh"
+}
+
+const (
+	stepContainerPrefix    = "step-"
+	serviceContainerPrefix = "service-"
+)
+
+const (
+	sourceVolume    = "chainr-source"
+	sourceMountPath = "/chainr/source"
+	cloneContainer  = "chainr-clone"
+)
+
+// The source is cloned by the first init container of the pod, in a volume
+// shared with the steps and the job container.
+// Credentials are read from the username and password keys of the secret.
+func (cp K8SCloudProvider) makeCloneContainer(source Source) corev1.Container {
+	image := cp.gitImage
+	if len(image) == 0 {
+		image = defaultGitImage
+	}
+
+	env := []corev1.EnvVar{
+		corev1.EnvVar{Name: "SOURCE_DIR", Value: sourceMountPath},
+		corev1.EnvVar{Name: "GIT_REPO", Value: source.Repo},
+		corev1.EnvVar{Name: "GIT_COMMIT", Value: source.Commit},
+	}
+	if len(source.Credentials) > 0 {
+		env = append(env,
+			secretEnvVar("GIT_USERNAME", source.Credentials, "username"),
+			secretEnvVar("GIT_PASSWORD", source.Credentials, "password"),
+		)
+	}
+
+	return corev1.Container{
+		Name:            cloneContainer,
+		Image:           image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"sh", "-c", cloneScript},
+		Env:             env,
+		VolumeMounts: []corev1.VolumeMount{
+			corev1.VolumeMount{Name: sourceVolume, MountPath: sourceMountPath},
+		},
+	}
+}
+
+func secretEnvVar(name, secret, key string) corev1.EnvVar {
+	optional := true
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+				Key:                  key,
+				Optional:             &optional,
+			},
+		},
+	}
+}
+
+// Steps share the shell, the working directory, the environment and the
+// volumes of the job container.
+func makeStepContainers(job Job, mounts []corev1.VolumeMount) []corev1.Container {
+	containers := make([]corev1.Container, 0, len(job.Steps))
+	for _, step := range job.Steps {
+		containers = append(containers, corev1.Container{
+			Name:            stepContainerPrefix + step.Name,
+			Image:           step.Image,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{shell(job), "-c", step.Run},
+			WorkingDir:      job.WorkingDir,
+			Env:             makeEnv(job.Env),
+			VolumeMounts:    mounts,
+		})
+	}
+	return containers
+}
+
+func makeServiceContainers(job Job) []corev1.Container {
+	containers := make([]corev1.Container, 0, len(job.Services))
+	for _, service := range job.Services {
+		containers = append(containers, corev1.Container{
+			Name:            serviceContainerPrefix + service.Name,
+			Image:           service.Image,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Env:             makeEnv(service.Env),
+			VolumeMounts:    makeVolumeMounts(job.VolumeMounts),
+		})
+	}
+	return containers
+}
+
+// Variables are sorted by name, to keep the pod spec stable.
+func makeEnv(env map[string]string) []corev1.EnvVar {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := make([]corev1.EnvVar, 0, len(env))
+	for _, name := range names {
+		vars = append(vars, corev1.EnvVar{Name: name, Value: env[name]})
+	}
+	return vars
+}
+
+const (
+	artifactsVolume     = "chainr-artifacts"
+	outputsMountPath    = "/chainr/outputs"
+	inputsMountPathRoot = "/chainr/inputs"
+)
+
+// Returns a script running the command given as arguments, and copying the
+// artifacts to the outputs directory if the command succeeds.
+// The image must provide sh and cp.
+func saveArtifactsScript(artifacts []string, outputsDir string) string {
+	var sb strings.Builder
+	sb.WriteString("\"$@\"\nstatus=$?\nif [ $status -eq 0 ]; then\n")
+	for _, path := range artifacts {
+		sb.WriteString("\tcp -r " + shellQuote(path) + " " + shellQuote(outputsDir) + "/ || status=$?\n")
+	}
+	sb.WriteString("fi\nexit $status")
+	return sb.String()
+}
+
+func shellQuote(str string) string {
+	return "'" + strings.ReplaceAll(str, "'", `'\''`) + "'"
+}
+
+// Artifacts locations are persistent volume claims names, or absolute paths
+// on the host when stored on the filesystem.
+func artifactsVolumeSource(location string) corev1.VolumeSource {
+	if filepath.IsAbs(location) {
+		return corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: location},
+		}
+	}
+	return corev1.VolumeSource{
+		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: location},
+	}
+}
+
+// Each job saves its artifacts in a sub-directory named after the job.
+// Inputs are mounted read-only in a directory named after the input job.
+func artifactsVolumeMounts(job Job) []corev1.VolumeMount {
+	mounts := make([]corev1.VolumeMount, 0, len(job.Inputs)+1)
+	if len(job.Artifacts) > 0 {
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      artifactsVolume,
+			MountPath: outputsMountPath,
+			SubPath:   job.Name,
+		})
+	}
+	for _, input := range job.Inputs {
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      artifactsVolume,
+			MountPath: inputsMountPathRoot + "/" + input,
+			SubPath:   input,
+			ReadOnly:  true,
+		})
+	}
+	return mounts
+}
+
+// Jobs of the project are run in its namespace, with its service account.
+// The worker service account must be allowed to manage jobs in the namespace.
+func (cp K8SCloudProvider) WithProject(project Project) CloudProvider {
+	if len(project.Namespace) > 0 {
+		cp.namespace = project.Namespace
+	}
+	cp.serviceAccount = project.ServiceAccount
+	cp.project = project.Name
+	return cp
+}
+
+// Workspaces are persistent volume claims, named after the run and the
+// volume.
+func (cp K8SCloudProvider) CreateWorkspace(runID string, volume Volume) error {
+	name := workspaceClaimName(runID, volume.Name)
+	pvc, err := makePersistentVolumeClaim(name, volume.Workspace.Size, volume.Workspace.StorageClass)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Creating persistent volume claim", name)
+	_, err = cp.kube.CoreV1().PersistentVolumeClaims(cp.namespace).Create(&pvc)
+	return ignoreAlreadyExists(err)
+}
+
+// Claims of a run resumed by another worker already exist.
+func ignoreAlreadyExists(err error) error {
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+func (cp K8SCloudProvider) DeleteWorkspace(runID string, volume Volume) error {
+	name := workspaceClaimName(runID, volume.Name)
+	log.Println("Deleting persistent volume claim", name)
+	return cp.kube.CoreV1().PersistentVolumeClaims(cp.namespace).Delete(name, &metav1.DeleteOptions{})
+}
+
+// Credentials are read from the secret referenced by the source, in the
+// namespace of the project of the run, where its jobs read it.
+func (cp K8SCloudProvider) ResolveSource(source Source) (string, error) {
+	var creds gitCredentials
+	if len(source.Credentials) > 0 {
+		secret, err := cp.kube.CoreV1().Secrets(cp.namespace).Get(source.Credentials, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		creds = gitCredentials{string(secret.Data["username"]), string(secret.Data["password"])}
+	}
+	return resolveCommit(source.Repo, source.Ref, creds)
+}
+
+func workspaceClaimName(runID, volumeName string) string {
+	return "chainr-workspace-" + runUID(runID) + "-" + volumeName
+}
+
+// Jobs of a run may be scheduled on different nodes at the same time,
+// so claims can be mounted by several nodes.
+func makePersistentVolumeClaim(name, size, storageClass string) (corev1.PersistentVolumeClaim, error) {
+	var pvc corev1.PersistentVolumeClaim
+
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return pvc, err
+	}
+
+	pvc.Name = name
+	pvc.Labels = map[string]string{
+		managedByLabel: "chainr",
+	}
+	pvc.Spec.AccessModes = []corev1.PersistentVolumeAccessMode{
+		corev1.ReadWriteMany,
+	}
+	pvc.Spec.Resources.Requests = corev1.ResourceList{
+		corev1.ResourceStorage: quantity,
+	}
+	if len(storageClass) > 0 {
+		pvc.Spec.StorageClassName = &storageClass
+	}
+	return pvc, nil
+}
+
+func volumeSource(runID string, volume Volume) corev1.VolumeSource {
+	switch {
+	case volume.Workspace != nil:
+		return corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: workspaceClaimName(runID, volume.Name),
+			},
+		}
+	case volume.PersistentVolumeClaim != nil:
+		return corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: volume.PersistentVolumeClaim.Name,
+			},
+		}
+	case volume.ConfigMap != nil:
+		return corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: volume.ConfigMap.Name},
+			},
+		}
+	case volume.Secret != nil:
+		return corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: volume.Secret.Name},
+		}
+	}
+	return corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}
+}
+
+func makeVolumeMounts(mounts []VolumeMount) []corev1.VolumeMount {
+	volumeMounts := make([]corev1.VolumeMount, 0, len(mounts))
+	for _, mount := range mounts {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      mount.Name,
+			MountPath: mount.MountPath,
+			SubPath:   mount.SubPath,
+			ReadOnly:  mount.ReadOnly,
+		})
+	}
+	return volumeMounts
+}
+
 func (cp K8SCloudProvider) deleteK8SJob(name string) {
 	propagationPolicy := metav1.DeletePropagationForeground
 	opts := metav1.DeleteOptions{
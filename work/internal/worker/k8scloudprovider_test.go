@@ -1,11 +1,19 @@
 package worker
 
-import "testing"
+import (
+	"errors"
+	"os/exec"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
 
 func TestMakeK8SJob(t *testing.T) {
 	cp := K8SCloudProvider{}
 
-	job := Job{"test", "busybox", "exit 0"}
+	job := Job{Name: "test", Image: "busybox", Run: "exit 0"}
 	k8sJob := cp.makeK8SJob(job)
 
 	container := k8sJob.Spec.Template.Spec.Containers[0]
@@ -23,3 +31,451 @@ func TestMakeK8SJob(t *testing.T) {
 		}
 	}
 }
+
+func TestMakeK8SJobArtifacts(t *testing.T) {
+	cp := K8SCloudProvider{}
+
+	job := Job{
+		Name:              "test",
+		Image:             "busybox",
+		Run:               "exit 0",
+		Artifacts:         []string{"/tmp/out"},
+		Inputs:            []string{"dep"},
+		ArtifactsLocation: "chainr-artifacts-abc",
+	}
+	k8sJob := cp.makeK8SJob(job)
+
+	volume := k8sJob.Spec.Template.Spec.Volumes[0]
+	if volume.PersistentVolumeClaim == nil || volume.PersistentVolumeClaim.ClaimName != "chainr-artifacts-abc" {
+		t.Errorf("volume = %v, expected persistent volume claim chainr-artifacts-abc", volume)
+	}
+
+	container := k8sJob.Spec.Template.Spec.Containers[0]
+	if len(container.VolumeMounts) != 2 {
+		t.Fatalf("len(container.VolumeMounts) = %v, expected 2", len(container.VolumeMounts))
+	}
+	if mount := container.VolumeMounts[0]; mount.MountPath != "/chainr/outputs" || mount.SubPath != "test" {
+		t.Errorf("container.VolumeMounts[0] = %v, expected /chainr/outputs with sub-path test", mount)
+	}
+	if mount := container.VolumeMounts[1]; mount.MountPath != "/chainr/inputs/dep" || mount.SubPath != "dep" || !mount.ReadOnly {
+		t.Errorf("container.VolumeMounts[1] = %v, expected /chainr/inputs/dep with sub-path dep, read-only", mount)
+	}
+
+	expectedCommand := []string{"sh", "-c", saveArtifactsScript([]string{"/tmp/out"}, "/chainr/outputs"), "sh", "sh", "-c", "exit 0"}
+	if len(container.Command) != len(expectedCommand) {
+		t.Fatalf("container.Command = %v, expected %v", container.Command, expectedCommand)
+	}
+	for i := range container.Command {
+		if container.Command[i] != expectedCommand[i] {
+			t.Errorf("container.Command = %v, expected %v", container.Command, expectedCommand)
+		}
+	}
+}
+
+func TestArtifactsVolumeSourceHostPath(t *testing.T) {
+	source := artifactsVolumeSource("/var/chainr/abc")
+	if source.HostPath == nil || source.HostPath.Path != "/var/chainr/abc" {
+		t.Errorf("source = %v, expected host path /var/chainr/abc", source)
+	}
+}
+
+func TestMakeK8SJobEnv(t *testing.T) {
+	cp := K8SCloudProvider{}
+
+	job := Job{
+		Name:  "test",
+		Image: "busybox",
+		Run:   "exit 0",
+		Env:   map[string]string{"B": "2", "A": "1"},
+	}
+	k8sJob := cp.makeK8SJob(job)
+
+	env := k8sJob.Spec.Template.Spec.Containers[0].Env
+	if len(env) != 3 {
+		t.Fatalf("len(env) = %v, expected 3", len(env))
+	}
+	if env[0].Name != "A" || env[0].Value != "1" {
+		t.Errorf("env[0] = %v, expected A=1", env[0])
+	}
+	if env[1].Name != "B" || env[1].Value != "2" {
+		t.Errorf("env[1] = %v, expected B=2", env[1])
+	}
+	if env[2].Name != "TERMINATION_LOG" || env[2].Value != "/dev/termination-log" {
+		t.Errorf("env[2] = %v, expected TERMINATION_LOG=/dev/termination-log", env[2])
+	}
+}
+
+func TestMakeK8SJobStepsAndServices(t *testing.T) {
+	cp := K8SCloudProvider{}
+
+	job := Job{
+		Name:     "test",
+		Image:    "busybox",
+		Run:      "exit 0",
+		Steps:    []Step{Step{"migrate", "migrate", "migrate up"}},
+		Services: []Service{Service{"postgres", "postgres", map[string]string{"POSTGRES_DB": "test"}}},
+	}
+	k8sJob := cp.makeK8SJob(job)
+
+	initContainers := k8sJob.Spec.Template.Spec.InitContainers
+	if len(initContainers) != 1 {
+		t.Fatalf("len(initContainers) = %v, expected 1", len(initContainers))
+	}
+	if c := initContainers[0]; c.Name != "step-migrate" || c.Image != "migrate" || c.Command[2] != "migrate up" {
+		t.Errorf("initContainers[0] = %v, expected step-migrate running migrate up", c)
+	}
+
+	containers := k8sJob.Spec.Template.Spec.Containers
+	if len(containers) != 2 {
+		t.Fatalf("len(containers) = %v, expected 2", len(containers))
+	}
+	if containers[0].Name != "test" {
+		t.Errorf("containers[0].Name = %v, expected test", containers[0].Name)
+	}
+	if c := containers[1]; c.Name != "service-postgres" || c.Image != "postgres" || c.Env[0].Name != "POSTGRES_DB" {
+		t.Errorf("containers[1] = %v, expected service-postgres with POSTGRES_DB", c)
+	}
+}
+
+func TestPodResult(t *testing.T) {
+	job := Job{Name: "test", Steps: []Step{Step{Name: "first"}, Step{Name: "second"}}}
+	pod := &corev1.Pod{}
+	pod.Status.InitContainerStatuses = []corev1.ContainerStatus{
+		corev1.ContainerStatus{
+			Name:  "step-first",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}},
+		},
+		corev1.ContainerStatus{
+			Name:  "step-second",
+			State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+		},
+	}
+
+	result, done, err := podResult(job, pod)
+	if done || err != nil {
+		t.Errorf("done, err = %v, %v, expected false, nil", done, err)
+	}
+	expectedSteps := []StepStatus{StepStatus{"first", "SUCCESSFUL"}, StepStatus{"second", "RUNNING"}}
+	for i := range expectedSteps {
+		if result.Steps[i] != expectedSteps[i] {
+			t.Errorf("result.Steps = %v, expected %v", result.Steps, expectedSteps)
+		}
+	}
+
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+		corev1.ContainerStatus{
+			Name:  "service-postgres",
+			State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+		},
+		corev1.ContainerStatus{
+			Name:  "test",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0, Message: "rows=42"}},
+		},
+	}
+	result, done, err = podResult(job, pod)
+	if !done || err != nil {
+		t.Errorf("done, err = %v, %v, expected true, nil", done, err)
+	}
+	if result.Outputs["rows"] != "42" {
+		t.Errorf("result.Outputs = %v, expected rows=42", result.Outputs)
+	}
+}
+
+func TestPodResultFailed(t *testing.T) {
+	job := Job{Name: "test", Steps: []Step{Step{Name: "first"}}}
+	pod := &corev1.Pod{}
+	pod.Status.Phase = corev1.PodFailed
+	pod.Status.InitContainerStatuses = []corev1.ContainerStatus{
+		corev1.ContainerStatus{
+			Name:  "step-first",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}},
+		},
+	}
+
+	result, done, err := podResult(job, pod)
+	if !done || err == nil {
+		t.Errorf("done, err = %v, %v, expected true and an error", done, err)
+	}
+	if jobErr := asJobError(err); jobErr.Reason != ReasonFailed || jobErr.ExitCode != 1 {
+		t.Errorf("err = %v with exit code %v, expected Failed with exit code 1", jobErr.Reason, jobErr.ExitCode)
+	}
+	if result.Steps[0].Status != "FAILED" {
+		t.Errorf("result.Steps[0].Status = %v, expected FAILED", result.Steps[0].Status)
+	}
+}
+
+func TestPodResultCloneFailed(t *testing.T) {
+	job := Job{Name: "test", Source: &Source{Repo: "https://example.com/repo.git", Commit: "abc123"}}
+	pod := &corev1.Pod{}
+	pod.Status.Phase = corev1.PodFailed
+	pod.Status.InitContainerStatuses = []corev1.ContainerStatus{
+		corev1.ContainerStatus{
+			Name:  "chainr-clone",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 128}},
+		},
+	}
+
+	_, done, err := podResult(job, pod)
+	if !done || err == nil {
+		t.Errorf("done, err = %v, %v, expected true and an error", done, err)
+	}
+	if jobErr := asJobError(err); jobErr.Reason != ReasonSource {
+		t.Errorf("err = %v, expected SourceError", jobErr.Reason)
+	}
+}
+
+func TestMakeK8SJobCommand(t *testing.T) {
+	cp := K8SCloudProvider{}
+
+	job := Job{
+		Name:       "test",
+		Image:      "gcr.io/distroless/static",
+		Command:    []string{"/app"},
+		Args:       []string{"--table", "users"},
+		WorkingDir: "/data",
+	}
+	k8sJob := cp.makeK8SJob(job)
+
+	container := k8sJob.Spec.Template.Spec.Containers[0]
+	if len(container.Command) != 1 || container.Command[0] != "/app" {
+		t.Errorf("container.Command = %v, expected [/app]", container.Command)
+	}
+	if len(container.Args) != 2 || container.Args[0] != "--table" || container.Args[1] != "users" {
+		t.Errorf("container.Args = %v, expected [--table users]", container.Args)
+	}
+	if container.WorkingDir != "/data" {
+		t.Errorf("container.WorkingDir = %v, expected /data", container.WorkingDir)
+	}
+}
+
+func TestMakeK8SJobShell(t *testing.T) {
+	cp := K8SCloudProvider{}
+
+	job := Job{Name: "test", Image: "bash", Run: "exit 0", Shell: "bash"}
+	k8sJob := cp.makeK8SJob(job)
+
+	expectedCommand := []string{"bash", "-c", "exit 0"}
+	container := k8sJob.Spec.Template.Spec.Containers[0]
+	if len(container.Command) != len(expectedCommand) {
+		t.Fatalf("container.Command = %v, expected %v", container.Command, expectedCommand)
+	}
+	for i := range container.Command {
+		if container.Command[i] != expectedCommand[i] {
+			t.Errorf("container.Command = %v, expected %v", container.Command, expectedCommand)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	out, err := exec.Command("sh", "-c", "printf %s "+shellQuote("it's a $path")).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "it's a $path" {
+		t.Errorf("out = %v, expected it's a $path", string(out))
+	}
+}
+
+func TestMakeK8SJobVolumes(t *testing.T) {
+	cp := K8SCloudProvider{}
+
+	job := Job{
+		RunID: "run:abc",
+		Name:  "test",
+		Image: "busybox",
+		Run:   "exit 0",
+		Steps: []Step{Step{"prepare", "busybox", "exit 0"}},
+		VolumeMounts: []VolumeMount{
+			VolumeMount{Name: "config", MountPath: "/etc/app", ReadOnly: true},
+			VolumeMount{Name: "workspace", MountPath: "/workspace"},
+		},
+		Volumes: []Volume{
+			Volume{Name: "config", ConfigMap: &NamedVolume{"app-config"}},
+			Volume{Name: "workspace", Workspace: &WorkspaceVolume{Size: "1Gi"}},
+		},
+	}
+	k8sJob := cp.makeK8SJob(job)
+
+	volumes := k8sJob.Spec.Template.Spec.Volumes
+	if len(volumes) != 2 {
+		t.Fatalf("len(volumes) = %v, expected 2", len(volumes))
+	}
+	if v := volumes[0]; v.Name != "config" || v.ConfigMap == nil || v.ConfigMap.Name != "app-config" {
+		t.Errorf("volumes[0] = %v, expected config map app-config", v)
+	}
+	if v := volumes[1]; v.Name != "workspace" || v.PersistentVolumeClaim == nil || v.PersistentVolumeClaim.ClaimName != "chainr-workspace-abc-workspace" {
+		t.Errorf("volumes[1] = %v, expected persistent volume claim chainr-workspace-abc-workspace", v)
+	}
+
+	mounts := k8sJob.Spec.Template.Spec.Containers[0].VolumeMounts
+	if len(mounts) != 2 || mounts[0].MountPath != "/etc/app" || !mounts[0].ReadOnly {
+		t.Errorf("mounts = %v, expected /etc/app read-only and /workspace", mounts)
+	}
+	if stepMounts := k8sJob.Spec.Template.Spec.InitContainers[0].VolumeMounts; len(stepMounts) != 2 {
+		t.Errorf("stepMounts = %v, expected the job mounts", stepMounts)
+	}
+}
+
+func TestVolumeSource(t *testing.T) {
+	source := volumeSource("run:abc", Volume{Name: "scratch", EmptyDir: &EmptyDirVolume{}})
+	if source.EmptyDir == nil {
+		t.Errorf("source = %v, expected empty dir", source)
+	}
+
+	source = volumeSource("run:abc", Volume{Name: "data", PersistentVolumeClaim: &NamedVolume{"data"}})
+	if source.PersistentVolumeClaim == nil || source.PersistentVolumeClaim.ClaimName != "data" {
+		t.Errorf("source = %v, expected persistent volume claim data", source)
+	}
+
+	source = volumeSource("run:abc", Volume{Name: "credentials", Secret: &NamedVolume{"credentials"}})
+	if source.Secret == nil || source.Secret.SecretName != "credentials" {
+		t.Errorf("source = %v, expected secret credentials", source)
+	}
+}
+
+func TestMakePersistentVolumeClaim(t *testing.T) {
+	pvc, err := makePersistentVolumeClaim("chainr-workspace-abc-workspace", "5Gi", "nfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; size.String() != "5Gi" {
+		t.Errorf("size = %v, expected 5Gi", size.String())
+	}
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != "nfs" {
+		t.Errorf("pvc.Spec.StorageClassName = %v, expected nfs", pvc.Spec.StorageClassName)
+	}
+
+	if _, err := makePersistentVolumeClaim("chainr-workspace-abc-workspace", "invalid", ""); err == nil {
+		t.Errorf("err = nil, expected not nil")
+	}
+}
+
+func TestMakeK8SJobSource(t *testing.T) {
+	cp := K8SCloudProvider{gitImage: "git"}
+
+	job := Job{
+		Name:  "test",
+		Image: "golang",
+		Run:   "go test ./...",
+		Steps: []Step{Step{"vet", "golang", "go vet ./..."}},
+		Source: &Source{
+			Repo:        "https://example.com/repo.git",
+			Credentials: "git-credentials",
+			Commit:      "0123456789abcdef0123456789abcdef01234567",
+		},
+	}
+	k8sJob := cp.makeK8SJob(job)
+
+	initContainers := k8sJob.Spec.Template.Spec.InitContainers
+	if len(initContainers) != 2 {
+		t.Fatalf("len(initContainers) = %v, expected 2", len(initContainers))
+	}
+	clone := initContainers[0]
+	if clone.Name != "chainr-clone" || clone.Image != "git" {
+		t.Errorf("initContainers[0] = %v, expected chainr-clone with image git", clone)
+	}
+	env := make(map[string]corev1.EnvVar)
+	for _, v := range clone.Env {
+		env[v.Name] = v
+	}
+	if env["GIT_COMMIT"].Value != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("GIT_COMMIT = %v, expected 0123456789abcdef0123456789abcdef01234567", env["GIT_COMMIT"].Value)
+	}
+	if ref := env["GIT_PASSWORD"].ValueFrom; ref == nil || ref.SecretKeyRef.Name != "git-credentials" || ref.SecretKeyRef.Key != "password" {
+		t.Errorf("GIT_PASSWORD = %v, expected key password of secret git-credentials", env["GIT_PASSWORD"])
+	}
+	if initContainers[1].Name != "step-vet" {
+		t.Errorf("initContainers[1].Name = %v, expected step-vet", initContainers[1].Name)
+	}
+
+	container := k8sJob.Spec.Template.Spec.Containers[0]
+	if container.WorkingDir != "/chainr/source" {
+		t.Errorf("container.WorkingDir = %v, expected /chainr/source", container.WorkingDir)
+	}
+	if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].Name != "chainr-source" {
+		t.Errorf("container.VolumeMounts = %v, expected chainr-source", container.VolumeMounts)
+	}
+	if len(initContainers[1].VolumeMounts) != 1 {
+		t.Errorf("initContainers[1].VolumeMounts = %v, expected chainr-source", initContainers[1].VolumeMounts)
+	}
+}
+
+func TestK8SCloudProviderWithProject(t *testing.T) {
+	cp := K8SCloudProvider{namespace: "chainr"}
+
+	project := Project{Name: "team-a", ServiceAccount: "runner"}
+	projectCP := cp.WithProject(project).(K8SCloudProvider)
+	if projectCP.namespace != "chainr" {
+		t.Errorf("namespace = %v, expected chainr", projectCP.namespace)
+	}
+
+	project.Namespace = "team-a"
+	projectCP = cp.WithProject(project).(K8SCloudProvider)
+	if projectCP.namespace != "team-a" {
+		t.Errorf("namespace = %v, expected team-a", projectCP.namespace)
+	}
+	if cp.namespace != "chainr" {
+		t.Errorf("cp.namespace = %v, expected chainr to be unchanged", cp.namespace)
+	}
+
+	k8sJob := projectCP.makeK8SJob(Job{Name: "test", Image: "busybox", Run: "exit 0"})
+	if sa := k8sJob.Spec.Template.Spec.ServiceAccountName; sa != "runner" {
+		t.Errorf("ServiceAccountName = %v, expected runner", sa)
+	}
+}
+
+func TestMakeK8SJobLabels(t *testing.T) {
+	cp := K8SCloudProvider{project: "team-a"}
+
+	job := Job{
+		ID:          "job:test:project:team-a:run:abc",
+		RunID:       "project:team-a:run:abc",
+		Name:        "test",
+		Image:       "busybox",
+		Run:         "exit 0",
+		Pipeline:    "backfill",
+		Attempt:     2,
+		Labels:      map[string]string{"team": "data", runLabel: "override"},
+		Annotations: map[string]string{"example.com/owner": "data"},
+	}
+	k8sJob := cp.makeK8SJob(job)
+
+	expectedLabels := map[string]string{
+		managedByLabel: "chainr",
+		runLabel:       "abc",
+		jobLabel:       "test",
+		pipelineLabel:  "backfill",
+		projectLabel:   "team-a",
+		attemptLabel:   "2",
+		"team":         "data",
+	}
+	for _, labels := range []map[string]string{k8sJob.Labels, k8sJob.Spec.Template.Labels} {
+		if len(labels) != len(expectedLabels) {
+			t.Errorf("labels = %v, expected %v", labels, expectedLabels)
+		}
+		for key, val := range expectedLabels {
+			if labels[key] != val {
+				t.Errorf("labels[%v] = %v, expected %v", key, labels[key], val)
+			}
+		}
+	}
+
+	annotations := k8sJob.Spec.Template.Annotations
+	if annotations[runIDAnnotation] != job.RunID || annotations[jobIDAnnotation] != job.ID || annotations["example.com/owner"] != "data" {
+		t.Errorf("annotations = %v, expected the run and job identifiers", annotations)
+	}
+
+	if selector := jobSelector(job.RunID, job.Name); selector != "app.kubernetes.io/managed-by=chainr,chainr.io/run=abc,chainr.io/job=test" {
+		t.Errorf("selector = %v, expected the run and job labels", selector)
+	}
+}
+
+func TestIgnoreAlreadyExists(t *testing.T) {
+	exists := apierrors.NewAlreadyExists(schema.GroupResource{Resource: "persistentvolumeclaims"}, "chainr-artifacts-abc")
+	if err := ignoreAlreadyExists(exists); err != nil {
+		t.Errorf("err = %v, expected nil", err)
+	}
+	if err := ignoreAlreadyExists(errors.New("fail")); err == nil {
+		t.Errorf("err = nil, expected fail")
+	}
+}
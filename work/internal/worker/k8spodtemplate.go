@@ -0,0 +1,296 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Fields of the pod spec which jobs can not set in their pod template, as
+// dot-separated paths. Paths in lists, e.g. containers.securityContext,
+// apply to each item of the list. Setting a field is disallowed whatever its
+// value, as are all its nested fields.
+type podTemplatePolicy []string
+
+// Fields giving access to the nodes, to the worker credentials, or
+// preventing the worker from following the job.
+var defaultPodTemplatePolicy = append(append(podTemplatePolicy{
+	"hostNetwork",
+	"hostPID",
+	"hostIPC",
+	"hostAliases",
+	"nodeName",
+	"serviceAccountName",
+	"serviceAccount",
+	"automountServiceAccountToken",
+	"restartPolicy",
+	"securityContext",
+}, prefixPaths("volumes.", nodeVolumeTypes)...), containersPaths(containerSecurityFields)...)
+
+// Volume types mounting the filesystem of the node, or storage the node has
+// access to, rather than storage of the namespace.
+var nodeVolumeTypes = []string{
+	"hostPath",
+	"nfs",
+	"iscsi",
+	"fc",
+	"rbd",
+	"cephfs",
+	"glusterfs",
+	"csi",
+	"flexVolume",
+	"flocker",
+	"cinder",
+	"quobyte",
+	"scaleIO",
+	"storageos",
+	"portworxVolume",
+	"awsElasticBlockStore",
+	"gcePersistentDisk",
+	"azureDisk",
+	"azureFile",
+	"vsphereVolume",
+	"photonPersistentDisk",
+}
+
+// Fields of the security context of containers running them as another
+// user or with privileges.
+var containerSecurityFields = []string{
+	"securityContext.privileged",
+	"securityContext.capabilities",
+	"securityContext.allowPrivilegeEscalation",
+	"securityContext.runAsUser",
+	"securityContext.runAsGroup",
+	"securityContext.seLinuxOptions",
+	"securityContext.procMount",
+}
+
+func prefixPaths(prefix string, paths []string) podTemplatePolicy {
+	prefixed := make(podTemplatePolicy, 0, len(paths))
+	for _, path := range paths {
+		prefixed = append(prefixed, prefix+path)
+	}
+	return prefixed
+}
+
+// Returns the paths of the fields in each list of containers.
+func containersPaths(paths []string) podTemplatePolicy {
+	var policy podTemplatePolicy
+	for _, containers := range []string{"containers.", "initContainers.", "ephemeralContainers."} {
+		policy = append(policy, prefixPaths(containers, paths)...)
+	}
+	return policy
+}
+
+// The disallowed fields can be overridden with POD_TEMPLATE_DISALLOWED_FIELDS,
+// a comma-separated list of paths. When it is empty, all fields are allowed.
+func podTemplatePolicyFromEnv() podTemplatePolicy {
+	val, ok := os.LookupEnv("POD_TEMPLATE_DISALLOWED_FIELDS")
+	if !ok {
+		return defaultPodTemplatePolicy
+	}
+	policy := make(podTemplatePolicy, 0)
+	for _, path := range strings.Split(val, ",") {
+		if path = strings.TrimSpace(path); len(path) > 0 {
+			policy = append(policy, path)
+		}
+	}
+	return policy
+}
+
+// Returns an error naming the first disallowed field set by the template.
+func (p podTemplatePolicy) check(template map[string]interface{}) error {
+	for _, path := range p {
+		if isSet(template, strings.Split(path, ".")) {
+			return errors.New("field " + path + " of the pod template is not allowed")
+		}
+	}
+	return nil
+}
+
+func isSet(val interface{}, path []string) bool {
+	switch val := val.(type) {
+	case map[string]interface{}:
+		field, ok := val[path[0]]
+		return ok && (len(path) == 1 || isSet(field, path[1:]))
+	case []interface{}:
+		for _, item := range val {
+			if isSet(item, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Merges the pod template of the job onto the generated pod spec, as a
+// strategic merge patch: lists of containers, volumes, environment
+// variables, etc. are merged by name, following the patch strategies of the
+// Kubernetes API types, other lists are replaced. Null values delete fields.
+// Patch directives, such as $patch, are not supported.
+// Only the job container can be patched: the other containers generated by
+// the worker, and its volumes, can not.
+func mergePodTemplate(spec *corev1.PodSpec, template json.RawMessage, jobContainer string, policy podTemplatePolicy) error {
+	var patch map[string]interface{}
+	if err := json.Unmarshal(template, &patch); err != nil {
+		return errors.New("invalid pod template: " + err.Error())
+	}
+	if err := policy.check(patch); err != nil {
+		return err
+	}
+	if err := checkGeneratedNames(*spec, patch, jobContainer); err != nil {
+		return err
+	}
+	if err := decodePodSpec(template, &corev1.PodSpec{}); err != nil {
+		return errors.New("invalid pod template: " + err.Error())
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	var original map[string]interface{}
+	if err := json.Unmarshal(data, &original); err != nil {
+		return err
+	}
+	merged, err := json.Marshal(mergeValue(original, patch, reflect.TypeOf(*spec)))
+	if err != nil {
+		return err
+	}
+
+	var result corev1.PodSpec
+	if err := decodePodSpec(merged, &result); err != nil {
+		return errors.New("invalid pod template: " + err.Error())
+	}
+	*spec = result
+	return nil
+}
+
+// Returns an error if the template patches a container generated by the
+// worker other than the job container, e.g. the container cloning the
+// source or step containers, or a volume reserved by the worker.
+func checkGeneratedNames(spec corev1.PodSpec, patch map[string]interface{}, jobContainer string) error {
+	generated := make(map[string]bool, len(spec.InitContainers)+len(spec.Containers))
+	for _, container := range append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...) {
+		if container.Name != jobContainer {
+			generated[container.Name] = true
+		}
+	}
+	for _, list := range []string{"containers", "initContainers", "ephemeralContainers", "volumes"} {
+		items, _ := patch[list].([]interface{})
+		for _, item := range items {
+			fields, _ := item.(map[string]interface{})
+			name, _ := fields["name"].(string)
+			if (list != "volumes" && generated[name]) || strings.HasPrefix(name, "chainr-") {
+				return errors.New(list + " " + name + " of the pod template is generated by the worker")
+			}
+		}
+	}
+	return nil
+}
+
+// Unknown fields are rejected, so that typos are not silently ignored.
+func decodePodSpec(data []byte, spec *corev1.PodSpec) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(spec)
+}
+
+// Merges the patch onto the original value of type t, both decoded from
+// JSON.
+func mergeValue(original, patch interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	originalMap, ok := original.(map[string]interface{})
+	patchMap, isMap := patch.(map[string]interface{})
+	if !ok || !isMap {
+		return patch
+	}
+
+	merged := make(map[string]interface{}, len(originalMap)+len(patchMap))
+	for key, val := range originalMap {
+		merged[key] = val
+	}
+	for key, val := range patchMap {
+		if val == nil {
+			delete(merged, key)
+			continue
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			field, ok := jsonField(t, key)
+			if !ok {
+				merged[key] = val
+			} else if strategy := field.Tag.Get("patchStrategy"); field.Type.Kind() == reflect.Slice && strings.Contains(strategy, "merge") {
+				merged[key] = mergeList(merged[key], val, field.Type.Elem(), field.Tag.Get("patchMergeKey"))
+			} else {
+				merged[key] = mergeValue(merged[key], val, field.Type)
+			}
+		case reflect.Map:
+			merged[key] = mergeValue(merged[key], val, t.Elem())
+		default:
+			merged[key] = val
+		}
+	}
+	return merged
+}
+
+// Items of the patch replace the items of the original list with the same
+// merge key, and are appended otherwise. Lists of scalars, without merge
+// key, are merged as sets.
+func mergeList(original, patch interface{}, t reflect.Type, mergeKey string) interface{} {
+	originalList, ok := original.([]interface{})
+	patchList, isList := patch.([]interface{})
+	if !ok || !isList {
+		return patch
+	}
+
+	merged := append([]interface{}{}, originalList...)
+	for _, item := range patchList {
+		i := indexOf(merged, item, mergeKey)
+		if i < 0 {
+			merged = append(merged, item)
+		} else if len(mergeKey) > 0 {
+			merged[i] = mergeValue(merged[i], item, t)
+		}
+	}
+	return merged
+}
+
+func indexOf(list []interface{}, item interface{}, mergeKey string) int {
+	for i, val := range list {
+		if len(mergeKey) == 0 && reflect.DeepEqual(val, item) {
+			return i
+		}
+		valMap, ok := val.(map[string]interface{})
+		itemMap, isMap := item.(map[string]interface{})
+		if len(mergeKey) > 0 && ok && isMap && valMap[mergeKey] == itemMap[mergeKey] {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the field of the struct encoded with the JSON name, including the
+// fields of inlined structs, e.g. the source of volumes.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == name {
+			return field, true
+		}
+		if len(tag) == 0 && field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if inlined, ok := jsonField(field.Type, name); ok {
+				return inlined, true
+			}
+		}
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,133 @@
+package worker
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestMergePodTemplate(t *testing.T) {
+	job := Job{
+		RunID:      "run:abc",
+		Name:       "train",
+		Image:      "tensorflow",
+		Run:        "python train.py",
+		WorkingDir: "/app",
+		Env:        map[string]string{"EPOCHS": "10", "TARGET": "dev"},
+		Steps:      []Step{Step{Name: "prepare", Image: "python", Run: "python prepare.py"}},
+	}
+	k8sJob := K8SCloudProvider{}.makeK8SJob(job)
+	spec := k8sJob.Spec.Template.Spec
+
+	template := json.RawMessage(`{
+		"nodeSelector": {"accelerator": "gpu"},
+		"imagePullSecrets": [{"name": "registry"}],
+		"containers": [{
+			"name": "train",
+			"workingDir": null,
+			"env": [{"name": "TARGET", "value": "prod"}, {"name": "DEBUG", "value": "1"}],
+			"securityContext": {"runAsNonRoot": true},
+			"resources": {"limits": {"nvidia.com/gpu": "1"}}
+		}]
+	}`)
+	if err := mergePodTemplate(&spec, template, "train", defaultPodTemplatePolicy); err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.NodeSelector["accelerator"] != "gpu" || len(spec.ImagePullSecrets) != 1 {
+		t.Errorf("spec = %+v, expected the node selector and pull secrets of the template", spec)
+	}
+	if len(spec.Containers) != 1 || len(spec.InitContainers) != 1 || spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Fatalf("spec = %+v, expected the generated containers to be kept", spec)
+	}
+	container := spec.Containers[0]
+	if container.Image != "tensorflow" || !reflect.DeepEqual(container.Command, []string{"sh", "-c", "python train.py"}) {
+		t.Errorf("container = %+v, expected its image and command to be kept", container)
+	}
+	if len(container.WorkingDir) > 0 {
+		t.Errorf("workingDir = %v, expected null to delete it", container.WorkingDir)
+	}
+	expectedEnv := []corev1.EnvVar{
+		corev1.EnvVar{Name: "EPOCHS", Value: "10"},
+		corev1.EnvVar{Name: "TARGET", Value: "prod"},
+		corev1.EnvVar{Name: "TERMINATION_LOG", Value: "/dev/termination-log"},
+		corev1.EnvVar{Name: "DEBUG", Value: "1"},
+	}
+	if !reflect.DeepEqual(container.Env, expectedEnv) {
+		t.Errorf("env = %v, expected %v", container.Env, expectedEnv)
+	}
+	if gpus := container.Resources.Limits["nvidia.com/gpu"]; gpus.Cmp(resource.MustParse("1")) != 0 {
+		t.Errorf("limits = %v, expected 1 GPU", container.Resources.Limits)
+	}
+	if container.SecurityContext == nil || !*container.SecurityContext.RunAsNonRoot {
+		t.Errorf("securityContext = %v, expected runAsNonRoot", container.SecurityContext)
+	}
+}
+
+func TestMergePodTemplateErrors(t *testing.T) {
+	for _, template := range []string{
+		`{"hostNetwork": true}`,
+		`{"containers": [{"name": "test", "securityContext": {"privileged": true}}]}`,
+		`{"containers": [{"name": "test", "securityContext": {"capabilities": {"add": ["SYS_ADMIN"]}}}]}`,
+		`{"initContainers": [{"name": "setup", "securityContext": {"allowPrivilegeEscalation": true}}]}`,
+		`{"ephemeralContainers": [{"name": "debug", "securityContext": {"privileged": true}}]}`,
+		`{"initContainers": [{"name": "chainr-clone", "image": "evil"}]}`,
+		`{"initContainers": [{"name": "step-prepare", "command": ["sh", "-c", "evil"]}]}`,
+		`{"volumes": [{"name": "chainr-artifacts", "emptyDir": {}}]}`,
+		`{"volumes": [{"name": "docker", "hostPath": {"path": "/var/run/docker.sock"}}]}`,
+		`{"volumes": [{"name": "share", "nfs": {"server": "nfs.internal", "path": "/"}}]}`,
+		`{"volumes": [{"name": "driver", "csi": {"driver": "secrets-store.csi.k8s.io"}}]}`,
+		`{"volumes": [{"name": "driver", "flexVolume": {"driver": "vendor/driver"}}]}`,
+		`{"securityContext": {"runAsUser": 0}}`,
+		`{"securityContext": {"sysctls": [{"name": "kernel.shm_rmid_forced", "value": "1"}]}}`,
+		`{"automountServiceAccountToken": true}`,
+		`{"hostAliases": [{"ip": "10.0.0.1", "hostnames": ["registry.internal"]}]}`,
+		`{"containers": [{"name": "test", "securityContext": {"runAsUser": 0}}]}`,
+		`{"hostNetwrk": true}`,
+		`{"tolerations": {"key": "gpu"}}`,
+		`{"containers": [{"name": "test", "$patch": "delete"}]}`,
+		`[]`,
+	} {
+		job := Job{
+			RunID:  "run:abc",
+			Name:   "test",
+			Image:  "busybox",
+			Run:    "true",
+			Source: &Source{Repo: "https://example.com/repo.git", Commit: "abc123"},
+			Steps:  []Step{Step{Name: "prepare", Image: "busybox", Run: "true"}},
+		}
+		spec := K8SCloudProvider{}.makeK8SJob(job).Spec.Template.Spec
+		if err := mergePodTemplate(&spec, json.RawMessage(template), job.Name, defaultPodTemplatePolicy); err == nil {
+			t.Errorf("template %v returned a nil error", template)
+		}
+	}
+
+	spec := corev1.PodSpec{}
+	template := json.RawMessage(`{"containers": [{"name": "test", "securityContext": {"runAsNonRoot": true}}]}`)
+	if err := mergePodTemplate(&spec, template, "test", defaultPodTemplatePolicy); err != nil {
+		t.Errorf("err = %v, expected the security context to be allowed", err)
+	}
+	if err := mergePodTemplate(&spec, json.RawMessage(`{"hostNetwork": true}`), "test", nil); err != nil {
+		t.Errorf("err = %v, expected all fields to be allowed without policy", err)
+	}
+}
+
+func TestPodTemplatePolicyFromEnv(t *testing.T) {
+	defer os.Unsetenv("POD_TEMPLATE_DISALLOWED_FIELDS")
+
+	if policy := podTemplatePolicyFromEnv(); !reflect.DeepEqual(policy, defaultPodTemplatePolicy) {
+		t.Errorf("policy = %v, expected the default policy", policy)
+	}
+	os.Setenv("POD_TEMPLATE_DISALLOWED_FIELDS", "hostNetwork, volumes,")
+	if policy := podTemplatePolicyFromEnv(); !reflect.DeepEqual(policy, podTemplatePolicy{"hostNetwork", "volumes"}) {
+		t.Errorf("policy = %v, expected hostNetwork and volumes", policy)
+	}
+	os.Setenv("POD_TEMPLATE_DISALLOWED_FIELDS", "")
+	if policy := podTemplatePolicyFromEnv(); len(policy) != 0 {
+		t.Errorf("policy = %v, expected all fields to be allowed", policy)
+	}
+}
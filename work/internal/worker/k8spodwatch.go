@@ -0,0 +1,217 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// Lists and watches the pods of a namespace.
+type podClient interface {
+	List(opts metav1.ListOptions) (*corev1.PodList, error)
+	Watch(opts metav1.ListOptions) (watch.Interface, error)
+}
+
+type jobClient interface {
+	Get(name string, options metav1.GetOptions) (*batchv1.Job, error)
+}
+
+// Delay after which a pod which can not be scheduled fails its job, e.g.
+// when no node has enough resources and none can be added.
+var unschedulableTimeout = 10 * time.Minute
+
+// Reasons of the containers waiting for an image which can not be pulled.
+// ErrImagePull is not one of them, as failed pulls are retried.
+var imageErrorReasons = map[string]bool{
+	"ImagePullBackOff":  true,
+	"InvalidImageName":  true,
+	"ErrImageNeverPull": true,
+}
+
+// Waits for the pod of a Kubernetes job to complete the job command.
+// The pods are listed, then watched from the resource version of the list.
+// When the watch is closed, e.g. by the API server timeout, it is
+// re-established from the last resource version seen, so that no event is
+// missed. When that resource version has expired, the pods are listed again.
+type podWatch struct {
+	job    Job
+	k8sJob string
+	pods   podClient
+	jobs   jobClient
+
+	resourceVersion string
+	// Fires when the pod has been unschedulable for unschedulableTimeout.
+	unschedulable        <-chan time.Time
+	unschedulableMessage string
+}
+
+func (w *podWatch) Wait() (JobResult, error) {
+	for {
+		if len(w.resourceVersion) == 0 {
+			if result, done, err := w.list(); done {
+				return result, err
+			}
+		}
+		if result, done, err := w.watch(); done {
+			return result, err
+		}
+	}
+}
+
+func (w *podWatch) listOptions() metav1.ListOptions {
+	return metav1.ListOptions{
+		LabelSelector:   "job-name=" + w.k8sJob,
+		ResourceVersion: w.resourceVersion,
+	}
+}
+
+// Pods which completed while the worker was not watching, e.g. before it
+// re-attached to the job, are found by the list.
+func (w *podWatch) list() (JobResult, bool, error) {
+	list, err := w.pods.List(w.listOptions())
+	if err != nil {
+		return JobResult{}, true, err
+	}
+
+	for i := range list.Items {
+		if result, done, err := w.handle(&list.Items[i]); done {
+			return result, true, err
+		}
+	}
+	if len(list.Items) == 0 {
+		if err := w.checkJob(); err != nil {
+			return JobResult{}, true, err
+		}
+	}
+
+	w.resourceVersion = list.ResourceVersion
+	return JobResult{}, false, nil
+}
+
+// Returns whether the job is done. Otherwise, the watch has been closed and
+// must be re-established.
+func (w *podWatch) watch() (JobResult, bool, error) {
+	watcher, err := w.pods.Watch(w.listOptions())
+	if err != nil {
+		return JobResult{}, true, err
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-w.unschedulable:
+			return JobResult{}, true, unschedulableError(w.unschedulableMessage)
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				log.Println("Watch of the pods of Kubernetes job", w.k8sJob, "closed, re-establishing it")
+				return JobResult{}, false, nil
+			}
+			if event.Type == watch.Error {
+				err := apierrors.FromObject(event.Object)
+				if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+					w.resourceVersion = ""
+					return JobResult{}, false, nil
+				}
+				return JobResult{}, true, err
+			}
+
+			pod, ok := event.Object.(*corev1.Pod)
+			if !ok {
+				return JobResult{}, true, fmt.Errorf("unexpected object %T in the watch of the pods", event.Object)
+			}
+			w.resourceVersion = pod.ResourceVersion
+
+			if event.Type == watch.Deleted {
+				if err := w.checkJob(); err != nil {
+					return JobResult{}, true, err
+				}
+				continue
+			}
+			if result, done, err := w.handle(pod); done {
+				return result, true, err
+			}
+		}
+	}
+}
+
+// Returns the result of the job, and whether it is done, from the state of
+// the pod. Pods waiting for an image which can not be pulled fail the job at
+// once, while unschedulable pods fail it after unschedulableTimeout.
+func (w *podWatch) handle(pod *corev1.Pod) (JobResult, bool, error) {
+	result, done, err := podResult(w.job, pod)
+	if done {
+		return result, true, err
+	}
+	if err := imageError(pod); err != nil {
+		return result, true, err
+	}
+
+	cond, ok := unschedulableCondition(pod)
+	if !ok {
+		w.unschedulable = nil
+		return result, false, nil
+	}
+	remaining := time.Until(cond.LastTransitionTime.Add(unschedulableTimeout))
+	if remaining <= 0 {
+		return result, true, unschedulableError(cond.Message)
+	}
+	if w.unschedulable == nil {
+		log.Println("Pod", pod.Name, "can not be scheduled:", cond.Message)
+		w.unschedulable = time.After(remaining)
+	}
+	w.unschedulableMessage = cond.Message
+	return result, false, nil
+}
+
+// Pods are deleted with their job, but also by node drains, in which case
+// the job creates another pod.
+func (w *podWatch) checkJob() error {
+	k8sJob, err := w.jobs.Get(w.k8sJob, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || (err == nil && k8sJob.DeletionTimestamp != nil) {
+		return errors.New("Kubernetes job " + w.k8sJob + " was deleted")
+	} else if err != nil {
+		return err
+	}
+
+	for _, cond := range k8sJob.Status.Conditions {
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue && cond.Reason == "DeadlineExceeded" {
+			return &JobError{Reason: ReasonTimeout, Message: "Kubernetes job " + w.k8sJob + " failed: " + cond.Message}
+		} else if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+			return errors.New("Kubernetes job " + w.k8sJob + " failed: " + cond.Message)
+		}
+	}
+	return nil
+}
+
+func imageError(pod *corev1.Pod) error {
+	for _, status := range containerStatuses(pod) {
+		waiting := status.State.Waiting
+		if waiting != nil && imageErrorReasons[waiting.Reason] {
+			return &JobError{
+				Reason:  ReasonImage,
+				Message: fmt.Sprintf("image %v of container %v can not be pulled: %v", status.Image, status.Name, waiting.Message),
+			}
+		}
+	}
+	return nil
+}
+
+func unschedulableError(message string) error {
+	return &JobError{Reason: ReasonTimeout, Message: "job pod can not be scheduled: " + message}
+}
+
+func unschedulableCondition(pod *corev1.Pod) (corev1.PodCondition, bool) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse && cond.Reason == corev1.PodReasonUnschedulable {
+			return cond, true
+		}
+	}
+	return corev1.PodCondition{}, false
+}
@@ -0,0 +1,233 @@
+package worker
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// Returns the lists and the watchers in order, and records their options.
+type podClientStub struct {
+	lists    []*corev1.PodList
+	watchers []*watch.FakeWatcher
+	listed   []metav1.ListOptions
+	watched  []metav1.ListOptions
+}
+
+func (c *podClientStub) List(opts metav1.ListOptions) (*corev1.PodList, error) {
+	c.listed = append(c.listed, opts)
+	if len(c.lists) == 0 {
+		return nil, errors.New("unexpected list")
+	}
+	list := c.lists[0]
+	c.lists = c.lists[1:]
+	return list, nil
+}
+
+func (c *podClientStub) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	c.watched = append(c.watched, opts)
+	if len(c.watchers) == 0 {
+		return nil, errors.New("unexpected watch")
+	}
+	watcher := c.watchers[0]
+	c.watchers = c.watchers[1:]
+	return watcher, nil
+}
+
+type jobClientStub struct {
+	job *batchv1.Job
+	err error
+}
+
+func (c jobClientStub) Get(name string, options metav1.GetOptions) (*batchv1.Job, error) {
+	return c.job, c.err
+}
+
+func newPodList(resourceVersion string, pods ...corev1.Pod) *corev1.PodList {
+	list := &corev1.PodList{Items: pods}
+	list.ResourceVersion = resourceVersion
+	return list
+}
+
+// Returns a pod running the test job, or terminated with the exit code if it
+// is not negative.
+func newJobPod(resourceVersion string, exitCode int32) *corev1.Pod {
+	pod := &corev1.Pod{}
+	pod.Name = "test-abc"
+	pod.ResourceVersion = resourceVersion
+	state := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	if exitCode >= 0 {
+		state = corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: exitCode}}
+	}
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+		corev1.ContainerStatus{Name: "test", State: state},
+	}
+	return pod
+}
+
+// Returns a watcher sending the events, then closed.
+func newClosedWatcher(events ...watch.Event) *watch.FakeWatcher {
+	watcher := watch.NewFakeWithChanSize(len(events), false)
+	for _, event := range events {
+		watcher.Action(event.Type, event.Object)
+	}
+	watcher.Stop()
+	return watcher
+}
+
+func TestPodWatchReestablished(t *testing.T) {
+	pods := &podClientStub{
+		lists: []*corev1.PodList{newPodList("10")},
+		watchers: []*watch.FakeWatcher{
+			newClosedWatcher(watch.Event{Type: watch.Added, Object: newJobPod("11", -1)}),
+			newClosedWatcher(watch.Event{Type: watch.Modified, Object: newJobPod("12", 0)}),
+		},
+	}
+	w := podWatch{job: Job{Name: "test"}, k8sJob: "test-abc", pods: pods, jobs: jobClientStub{job: &batchv1.Job{}}}
+
+	if _, err := w.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.listed) != 1 || pods.listed[0].LabelSelector != "job-name=test-abc" {
+		t.Errorf("listed = %v, expected a single list of the pods of test-abc", pods.listed)
+	}
+	if len(pods.watched) != 2 || pods.watched[0].ResourceVersion != "10" || pods.watched[1].ResourceVersion != "11" {
+		t.Errorf("watched = %v, expected watches from resource versions 10 and 11", pods.watched)
+	}
+}
+
+func TestPodWatchExpired(t *testing.T) {
+	expired := apierrors.NewGone("too old resource version").ErrStatus
+	pods := &podClientStub{
+		lists: []*corev1.PodList{newPodList("10"), newPodList("20", *newJobPod("15", 1))},
+		watchers: []*watch.FakeWatcher{
+			newClosedWatcher(watch.Event{Type: watch.Error, Object: &expired}),
+		},
+	}
+	w := podWatch{job: Job{Name: "test"}, k8sJob: "test-abc", pods: pods, jobs: jobClientStub{job: &batchv1.Job{}}}
+
+	_, err := w.Wait()
+	if err == nil || err.Error() != "job execution failed" {
+		t.Errorf("err = %v, expected the job to fail", err)
+	}
+	if len(pods.listed) != 2 || pods.listed[1].ResourceVersion != "" {
+		t.Errorf("listed = %v, expected the pods to be listed again", pods.listed)
+	}
+}
+
+func TestPodWatchError(t *testing.T) {
+	internal := apierrors.NewInternalError(errors.New("etcd unavailable")).ErrStatus
+	pods := &podClientStub{
+		lists:    []*corev1.PodList{newPodList("10")},
+		watchers: []*watch.FakeWatcher{newClosedWatcher(watch.Event{Type: watch.Error, Object: &internal})},
+	}
+	w := podWatch{job: Job{Name: "test"}, k8sJob: "test-abc", pods: pods, jobs: jobClientStub{job: &batchv1.Job{}}}
+
+	_, err := w.Wait()
+	if !apierrors.IsInternalError(err) {
+		t.Errorf("err = %v, expected the internal error", err)
+	}
+}
+
+func TestPodWatchJobDeleted(t *testing.T) {
+	pods := &podClientStub{
+		lists:    []*corev1.PodList{newPodList("10", *newJobPod("10", -1))},
+		watchers: []*watch.FakeWatcher{newClosedWatcher(watch.Event{Type: watch.Deleted, Object: newJobPod("11", -1)})},
+	}
+	notFound := apierrors.NewNotFound(schema.GroupResource{Group: "batch", Resource: "jobs"}, "test-abc")
+	w := podWatch{job: Job{Name: "test"}, k8sJob: "test-abc", pods: pods, jobs: jobClientStub{err: notFound}}
+
+	_, err := w.Wait()
+	if err == nil || err.Error() != "Kubernetes job test-abc was deleted" {
+		t.Errorf("err = %v, expected the job to be deleted", err)
+	}
+	if reason := asJobError(err).Reason; reason != ReasonInfrastructure {
+		t.Errorf("reason = %v, expected %v", reason, ReasonInfrastructure)
+	}
+}
+
+// The job creates another pod when its pod is deleted by a node drain.
+func TestPodWatchPodDeleted(t *testing.T) {
+	pods := &podClientStub{
+		lists: []*corev1.PodList{newPodList("10", *newJobPod("10", -1))},
+		watchers: []*watch.FakeWatcher{newClosedWatcher(
+			watch.Event{Type: watch.Deleted, Object: newJobPod("11", -1)},
+			watch.Event{Type: watch.Added, Object: newJobPod("12", 0)},
+		)},
+	}
+	w := podWatch{job: Job{Name: "test"}, k8sJob: "test-abc", pods: pods, jobs: jobClientStub{job: &batchv1.Job{}}}
+
+	if _, err := w.Wait(); err != nil {
+		t.Errorf("err = %v, expected the job to succeed", err)
+	}
+}
+
+func TestPodWatchImageError(t *testing.T) {
+	pod := newJobPod("10", -1)
+	pod.Status.ContainerStatuses[0].Image = "unknown:latest"
+	pod.Status.ContainerStatuses[0].State = corev1.ContainerState{
+		Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"},
+	}
+	pods := &podClientStub{lists: []*corev1.PodList{newPodList("10", *pod)}}
+	w := podWatch{job: Job{Name: "test"}, k8sJob: "test-abc", pods: pods, jobs: jobClientStub{job: &batchv1.Job{}}}
+
+	_, err := w.Wait()
+	if err == nil || !strings.HasPrefix(err.Error(), "image unknown:latest of container test can not be pulled") {
+		t.Errorf("err = %v, expected an image error", err)
+	}
+	if reason := asJobError(err).Reason; reason != ReasonImage {
+		t.Errorf("reason = %v, expected %v", reason, ReasonImage)
+	}
+}
+
+func TestPodWatchUnschedulable(t *testing.T) {
+	defer func(timeout time.Duration) { unschedulableTimeout = timeout }(unschedulableTimeout)
+	unschedulableTimeout = 20 * time.Millisecond
+
+	pod := newJobPod("10", -1)
+	pod.Status.ContainerStatuses = nil
+	pod.Status.Conditions = []corev1.PodCondition{corev1.PodCondition{
+		Type:               corev1.PodScheduled,
+		Status:             corev1.ConditionFalse,
+		Reason:             corev1.PodReasonUnschedulable,
+		Message:            "0/3 nodes are available: 3 Insufficient cpu.",
+		LastTransitionTime: metav1.Now(),
+	}}
+	// The watch stays open without events.
+	pods := &podClientStub{
+		lists:    []*corev1.PodList{newPodList("10", *pod)},
+		watchers: []*watch.FakeWatcher{watch.NewFake()},
+	}
+	w := podWatch{job: Job{Name: "test"}, k8sJob: "test-abc", pods: pods, jobs: jobClientStub{job: &batchv1.Job{}}}
+
+	_, err := w.Wait()
+	if err == nil || err.Error() != "job pod can not be scheduled: 0/3 nodes are available: 3 Insufficient cpu." {
+		t.Errorf("err = %v, expected the pod not to be scheduled", err)
+	}
+	if reason := asJobError(err).Reason; reason != ReasonTimeout {
+		t.Errorf("reason = %v, expected %v", reason, ReasonTimeout)
+	}
+}
+
+func TestPodResultEvicted(t *testing.T) {
+	pod := newJobPod("10", -1)
+	pod.Status.Phase = corev1.PodFailed
+	pod.Status.Reason = "Evicted"
+	pod.Status.Message = "The node was low on resource: memory."
+
+	_, done, err := podResult(Job{Name: "test"}, pod)
+	if !done || err == nil || err.Error() != "job pod was evicted: The node was low on resource: memory." {
+		t.Errorf("done, err = %v, %v, expected the pod to be evicted", done, err)
+	}
+	if reason := asJobError(err).Reason; reason != ReasonEvicted {
+		t.Errorf("reason = %v, expected %v", reason, ReasonEvicted)
+	}
+}
@@ -0,0 +1,120 @@
+package worker
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Load counts the runs processed and the jobs running on the worker, and
+// limits them. Zero limits are unlimited.
+// Runs and jobs are taken from distinct queues, so that a worker saturated
+// with jobs still processes runs, whose jobs are run by other workers.
+// It is shared by the goroutines of the worker, and by the recycler
+// synchronization, which publishes it.
+type Load struct {
+	MaxRuns int
+	MaxJobs int
+
+	runs int
+	jobs int
+	cond *sync.Cond
+}
+
+func NewLoad(maxRuns, maxJobs int) *Load {
+	return &Load{
+		MaxRuns: maxRuns,
+		MaxJobs: maxJobs,
+		cond:    sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+// Reads the limits from MAX_RUNS and MAX_JOBS.
+func NewLoadFromEnv() *Load {
+	return NewLoad(readLimit("MAX_RUNS"), readLimit("MAX_JOBS"))
+}
+
+func readLimit(name string) int {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return 0
+	}
+	limit, err := strconv.Atoi(val)
+	if err != nil || limit < 0 {
+		log.Println("Invalid " + name + " value " + val + ", using default 0 (unlimited)")
+		return 0
+	}
+	return limit
+}
+
+// Blocks until the worker can process a new run.
+func (l *Load) AcquireRun() {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	if l.runsSaturated() {
+		log.Printf("Worker is saturated with %v runs, waiting before taking a new run", l.runs)
+	}
+	for l.runsSaturated() {
+		l.cond.Wait()
+	}
+	l.runs++
+}
+
+func (l *Load) ReleaseRun() {
+	l.cond.L.Lock()
+	l.runs--
+	l.cond.L.Unlock()
+	l.cond.Broadcast()
+}
+
+// Blocks until the worker can run a new job.
+func (l *Load) AcquireJob() {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	if l.jobsSaturated() {
+		log.Printf("Worker is saturated with %v jobs, waiting before taking a new job", l.jobs)
+	}
+	for l.jobsSaturated() {
+		l.cond.Wait()
+	}
+	l.jobs++
+}
+
+func (l *Load) ReleaseJob() {
+	l.cond.L.Lock()
+	l.jobs--
+	l.cond.L.Unlock()
+	l.cond.Broadcast()
+}
+
+// Returns the number of runs processed and jobs running.
+func (l *Load) Current() (int, int) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	return l.runs, l.jobs
+}
+
+// A run or job slot of the worker.
+type loadSlot struct {
+	acquire func()
+	release func()
+}
+
+func (l *Load) runSlot() loadSlot {
+	return loadSlot{l.AcquireRun, l.ReleaseRun}
+}
+
+func (l *Load) jobSlot() loadSlot {
+	return loadSlot{l.AcquireJob, l.ReleaseJob}
+}
+
+func (l *Load) runsSaturated() bool {
+	return l.MaxRuns > 0 && l.runs >= l.MaxRuns
+}
+
+func (l *Load) jobsSaturated() bool {
+	return l.MaxJobs > 0 && l.jobs >= l.MaxJobs
+}
@@ -0,0 +1,75 @@
+package worker
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewLoadFromEnv(t *testing.T) {
+	os.Setenv("MAX_RUNS", "2")
+	os.Setenv("MAX_JOBS", "invalid")
+	defer os.Unsetenv("MAX_RUNS")
+	defer os.Unsetenv("MAX_JOBS")
+
+	load := NewLoadFromEnv()
+	if load.MaxRuns != 2 || load.MaxJobs != 0 {
+		t.Errorf("load = %v runs and %v jobs, expected 2 runs and unlimited jobs", load.MaxRuns, load.MaxJobs)
+	}
+}
+
+func TestLoadRuns(t *testing.T) {
+	load := NewLoad(1, 0)
+	load.AcquireRun()
+
+	acquired := make(chan struct{})
+	go func() {
+		load.AcquireRun()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("run acquired, expected the worker to be saturated")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	load.ReleaseRun()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("run not acquired after a run was released")
+	}
+	if runs, _ := load.Current(); runs != 1 {
+		t.Errorf("runs = %v, expected 1", runs)
+	}
+}
+
+// A worker running as many jobs as it allows still takes new runs.
+func TestLoadJobs(t *testing.T) {
+	load := NewLoad(0, 1)
+	load.AcquireJob()
+
+	jobAcquired := make(chan struct{})
+	go func() {
+		load.AcquireJob()
+		close(jobAcquired)
+	}()
+
+	select {
+	case <-jobAcquired:
+		t.Fatal("job acquired, expected the worker to be saturated")
+	case <-time.After(20 * time.Millisecond):
+	}
+	load.AcquireRun()
+
+	load.ReleaseJob()
+	select {
+	case <-jobAcquired:
+	case <-time.After(time.Second):
+		t.Fatal("job not acquired after a job was released")
+	}
+	if runs, jobs := load.Current(); runs != 1 || jobs != 1 {
+		t.Errorf("load = %v runs and %v jobs, expected 1 run and 1 job", runs, jobs)
+	}
+}
@@ -0,0 +1,280 @@
+package worker
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// LocalProcessCloudProvider runs jobs as processes of the worker, without
+// containers, e.g. to run chainr on a laptop or in integration tests.
+// Images are ignored: commands run with the tools installed on the worker
+// host. Services, volumes and pod templates are not supported.
+type LocalProcessCloudProvider struct {
+	// Directory containing the working directories of the jobs.
+	root string
+	// Processes of the running jobs, shared with the providers returned by
+	// WithProject.
+	processes *processTable
+}
+
+func NewLocalProcessCloudProvider() LocalProcessCloudProvider {
+	root := filepath.Join(os.TempDir(), "chainr-jobs")
+	if val, ok := os.LookupEnv("LOCAL_JOBS_ROOT"); ok {
+		root = val
+	}
+	log.Println("Jobs will be run as local processes in", root)
+	return LocalProcessCloudProvider{root, newProcessTable()}
+}
+
+// Environment variables set in local jobs, replacing the paths mounted in
+// Kubernetes jobs.
+const (
+	// File the job writes its key=value outputs to, also set in Kubernetes
+	// and Docker jobs.
+	terminationLogEnv = "TERMINATION_LOG"
+	// Directory containing the artifacts of the input jobs, in a
+	// sub-directory named after each job.
+	inputsDirEnv = "CHAINR_INPUTS"
+)
+
+// Each job runs in its own directory, deleted when it completes. The source
+// is cloned in it, and it is the default working directory.
+// Steps run sequentially before the job command, and stop the job at the
+// first failure.
+func (cp LocalProcessCloudProvider) RunJob(job Job) (JobResult, error) {
+	var result JobResult
+	if len(job.Services) > 0 || len(job.Volumes) > 0 {
+		return result, errors.New("services and volumes are not supported by local processes")
+	}
+	if len(job.PodTemplate) > 0 {
+		return result, errors.New("pod templates are not supported by local processes")
+	}
+	if (len(job.Artifacts) > 0 || len(job.Inputs) > 0) && !filepath.IsAbs(job.ArtifactsLocation) {
+		return result, errors.New("artifacts of local processes must be stored on the filesystem")
+	}
+
+	dir, err := cp.jobDir(job)
+	if err != nil {
+		return result, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return result, err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(dir)
+
+	workingDir := job.WorkingDir
+	if job.Source != nil {
+		sourceDir := filepath.Join(dir, "source")
+		if err := cp.cloneSource(job, *job.Source, sourceDir); err != nil {
+			return result, err
+		}
+		if len(workingDir) == 0 {
+			workingDir = sourceDir
+		}
+	}
+	if len(workingDir) == 0 {
+		workingDir = dir
+	}
+
+	terminationLog := filepath.Join(dir, "termination-log")
+	env := append(hostEnv(), terminationLogEnv+"="+terminationLog)
+	if len(job.Inputs) > 0 {
+		env = append(env, inputsDirEnv+"="+job.ArtifactsLocation)
+	}
+	for name, val := range job.Env {
+		env = append(env, name+"="+val)
+	}
+
+	for i, step := range job.Steps {
+		err := cp.run(job, workingDir, env, shell(job), "-c", step.Run)
+		result.Steps = append(result.Steps, StepStatus{step.Name, "SUCCESSFUL"})
+		if err != nil {
+			result.Steps[i].Status = "FAILED"
+			for _, pending := range job.Steps[i+1:] {
+				result.Steps = append(result.Steps, StepStatus{pending.Name, "PENDING"})
+			}
+			return result, err
+		}
+	}
+
+	command, args := jobCommand(job)
+	if len(command) == 0 {
+		return result, errors.New("local processes must set run or command")
+	}
+	if len(job.Artifacts) > 0 {
+		outputsDir := filepath.Join(job.ArtifactsLocation, job.Name)
+		if err := os.MkdirAll(outputsDir, 0777); err != nil {
+			return result, err
+		}
+		wrapper := []string{"sh", "-c", saveArtifactsScript(job.Artifacts, outputsDir), "sh"}
+		command = append(append(wrapper, command...), args...)
+		args = nil
+	}
+	if err := cp.run(job, workingDir, env, command[0], append(command[1:], args...)...); err != nil {
+		return result, err
+	}
+
+	if data, err := ioutil.ReadFile(terminationLog); err == nil {
+		result.Outputs = parseOutputs(string(data))
+	}
+	return result, nil
+}
+
+// Variables of the worker environment passed to local processes. Other
+// variables, such as the credentials of the worker, are not inherited.
+var hostEnvAllowList = []string{"PATH", "HOME", "TMPDIR"}
+
+func hostEnv() []string {
+	var env []string
+	for _, name := range hostEnvAllowList {
+		if val, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+val)
+		}
+	}
+	return env
+}
+
+// Returns the working directory of the job under the root. The run and job
+// names must be single path elements, so that deleting the directory never
+// deletes files outside of the root.
+func (cp LocalProcessCloudProvider) jobDir(job Job) (string, error) {
+	for _, name := range []string{runUID(job.RunID), job.Name} {
+		if len(name) == 0 || name == "." || name == ".." || filepath.Base(name) != name {
+			return "", errors.New("invalid job directory name " + name)
+		}
+	}
+	root := filepath.Clean(cp.root)
+	dir := filepath.Join(root, runUID(job.RunID), job.Name)
+	if !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		return "", errors.New("job directory " + dir + " is not under " + root)
+	}
+	return dir, nil
+}
+
+// Commands exiting with a non-zero code fail the job. Commands killed by
+// DeleteJob, or which can not be started, are infrastructure errors.
+func (cp LocalProcessCloudProvider) run(job Job, dir string, env []string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cp.processes.start(job.RunID, job.Name, cmd); err != nil {
+		return err
+	}
+	defer cp.processes.remove(job.RunID, job.Name)
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return &JobError{ReasonFailed, exitErr.ExitCode(), "job execution failed"}
+	} else if errors.As(err, &exitErr) {
+		return errors.New("job process was killed")
+	}
+	return err
+}
+
+// The source is cloned with the script used by Kubernetes jobs, which
+// requires git on the worker host.
+func (cp LocalProcessCloudProvider) cloneSource(job Job, source Source, dir string) error {
+	env := append(hostEnv(),
+		"SOURCE_DIR="+dir,
+		"GIT_REPO="+source.Repo,
+		"GIT_COMMIT="+source.Commit,
+	)
+	if err := cp.run(job, filepath.Dir(dir), env, "sh", "-c", cloneScript); err != nil {
+		return cloneError(source.Repo, err)
+	}
+	return nil
+}
+
+// Workspaces are volumes, which are not supported.
+func (cp LocalProcessCloudProvider) CreateWorkspace(runID string, volume Volume) error {
+	return errors.New("workspaces are not supported by local processes")
+}
+
+func (cp LocalProcessCloudProvider) DeleteWorkspace(runID string, volume Volume) error {
+	return nil
+}
+
+// Credentials of the source are ignored: git uses the credentials of the
+// worker host.
+func (cp LocalProcessCloudProvider) ResolveSource(source Source) (string, error) {
+	return resolveCommit(source.Repo, source.Ref, gitCredentials{})
+}
+
+// Jobs of all projects run on the worker host.
+func (cp LocalProcessCloudProvider) WithProject(project Project) CloudProvider {
+	return cp
+}
+
+// Only the jobs run by this worker are listed, as the processes of killed
+// workers are killed with them.
+func (cp LocalProcessCloudProvider) ListJobs(runID string) ([]string, error) {
+	return cp.processes.list(runID), nil
+}
+
+func (cp LocalProcessCloudProvider) DeleteJob(runID, name string) error {
+	return cp.processes.kill(runID, name)
+}
+
+// Processes running jobs, by run and job name.
+type processTable struct {
+	l         sync.Mutex
+	processes map[string]map[string]*exec.Cmd
+}
+
+func newProcessTable() *processTable {
+	return &processTable{processes: make(map[string]map[string]*exec.Cmd)}
+}
+
+func (t *processTable) start(runID, name string, cmd *exec.Cmd) error {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if _, ok := t.processes[runID]; !ok {
+		t.processes[runID] = make(map[string]*exec.Cmd)
+	}
+	t.processes[runID][name] = cmd
+	return nil
+}
+
+func (t *processTable) remove(runID, name string) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	delete(t.processes[runID], name)
+	if len(t.processes[runID]) == 0 {
+		delete(t.processes, runID)
+	}
+}
+
+func (t *processTable) list(runID string) []string {
+	t.l.Lock()
+	defer t.l.Unlock()
+	names := make([]string, 0, len(t.processes[runID]))
+	for name := range t.processes[runID] {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (t *processTable) kill(runID, name string) error {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if cmd, ok := t.processes[runID][name]; ok {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
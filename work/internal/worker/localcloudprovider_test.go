@@ -0,0 +1,185 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestLocalProcessCloudProvider(t *testing.T) (LocalProcessCloudProvider, func()) {
+	root, err := ioutil.TempDir("", "chainr-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return LocalProcessCloudProvider{root, newProcessTable()}, func() { os.RemoveAll(root) }
+}
+
+func TestLocalRunJob(t *testing.T) {
+	cp, cleanup := newTestLocalProcessCloudProvider(t)
+	defer cleanup()
+
+	job := Job{
+		RunID: "run:abc",
+		Name:  "extract",
+		Image: "busybox",
+		Run:   `echo "rows=$ROWS" > "$TERMINATION_LOG"`,
+		Env:   map[string]string{"ROWS": "42"},
+		Steps: []Step{Step{Name: "prepare", Run: "true"}},
+	}
+	result, err := cp.RunJob(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Outputs["rows"] != "42" {
+		t.Errorf("outputs = %v, expected rows=42", result.Outputs)
+	}
+	if !reflect.DeepEqual(result.Steps, []StepStatus{StepStatus{"prepare", "SUCCESSFUL"}}) {
+		t.Errorf("steps = %v, expected prepare successful", result.Steps)
+	}
+	if _, err := os.Stat(filepath.Join(cp.root, "abc", "extract")); !os.IsNotExist(err) {
+		t.Errorf("job directory was not deleted")
+	}
+}
+
+func TestLocalRunJobEnv(t *testing.T) {
+	cp, cleanup := newTestLocalProcessCloudProvider(t)
+	defer cleanup()
+	os.Setenv("REDIS_PASSWORD", "secret")
+	defer os.Unsetenv("REDIS_PASSWORD")
+
+	job := Job{
+		RunID: "run:abc",
+		Name:  "test",
+		Run:   `test -z "$REDIS_PASSWORD" && test -n "$PATH" && test "$TARGET" = prod`,
+		Env:   map[string]string{"TARGET": "prod"},
+	}
+	if _, err := cp.RunJob(job); err != nil {
+		t.Errorf("err = %v, expected only the allowed variables of the worker to be set", err)
+	}
+}
+
+func TestLocalRunJobFailure(t *testing.T) {
+	cp, cleanup := newTestLocalProcessCloudProvider(t)
+	defer cleanup()
+
+	job := Job{
+		RunID: "run:abc",
+		Name:  "test",
+		Run:   "true",
+		Steps: []Step{Step{Name: "first", Run: "exit 3"}, Step{Name: "second", Run: "true"}},
+	}
+	result, err := cp.RunJob(job)
+	if jobErr := asJobError(err); jobErr.Reason != ReasonFailed || jobErr.ExitCode != 3 {
+		t.Errorf("err = %v, expected the job to fail with exit code 3", err)
+	}
+	expected := []StepStatus{StepStatus{"first", "FAILED"}, StepStatus{"second", "PENDING"}}
+	if !reflect.DeepEqual(result.Steps, expected) {
+		t.Errorf("steps = %v, expected %v", result.Steps, expected)
+	}
+}
+
+func TestLocalRunJobArtifacts(t *testing.T) {
+	cp, cleanup := newTestLocalProcessCloudProvider(t)
+	defer cleanup()
+	location := filepath.Join(cp.root, "artifacts")
+
+	producer := Job{RunID: "run:abc", Name: "produce", Run: "echo 42 > rows.txt", Artifacts: []string{"rows.txt"}, ArtifactsLocation: location}
+	if _, err := cp.RunJob(producer); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer := Job{RunID: "run:abc", Name: "consume", Run: `test "$(cat $CHAINR_INPUTS/produce/rows.txt)" = 42`, Inputs: []string{"produce"}, ArtifactsLocation: location}
+	if _, err := cp.RunJob(consumer); err != nil {
+		t.Errorf("err = %v, expected the input to be read", err)
+	}
+}
+
+func TestLocalRunJobCloneFailed(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	cp, cleanup := newTestLocalProcessCloudProvider(t)
+	defer cleanup()
+
+	source := &Source{Repo: "https://127.0.0.1:1/repo.git", Commit: "0123456789abcdef0123456789abcdef01234567"}
+	job := Job{RunID: "run:abc", Name: "test", Run: "true", Source: source}
+	if _, err := cp.RunJob(job); asJobError(err).Reason != ReasonSource {
+		t.Errorf("err = %v, expected a source error", err)
+	}
+}
+
+func TestLocalRunJobUnsupported(t *testing.T) {
+	cp, cleanup := newTestLocalProcessCloudProvider(t)
+	defer cleanup()
+
+	job := Job{RunID: "run:abc", Name: "test", Run: "true", Services: []Service{Service{Name: "postgres"}}}
+	if _, err := cp.RunJob(job); err == nil {
+		t.Errorf("services were accepted")
+	}
+	job = Job{RunID: "run:abc", Name: "test", Run: "true", Artifacts: []string{"out"}, ArtifactsLocation: "chainr-artifacts-abc"}
+	if _, err := cp.RunJob(job); err == nil {
+		t.Errorf("artifacts stored in a claim were accepted")
+	}
+}
+
+func TestLocalRunJobInvalidName(t *testing.T) {
+	cp, cleanup := newTestLocalProcessCloudProvider(t)
+	defer cleanup()
+	outside := filepath.Join(cp.root, "outside")
+	if err := os.Mkdir(outside, 0777); err != nil {
+		t.Fatal(err)
+	}
+	cp.root = filepath.Join(cp.root, "jobs")
+
+	for _, job := range []Job{
+		Job{RunID: "run:abc", Name: "..", Run: "true"},
+		Job{RunID: "run:abc", Name: "../../outside", Run: "true"},
+		Job{RunID: "run:..", Name: "outside", Run: "true"},
+		Job{RunID: "run:abc", Name: "", Run: "true"},
+	} {
+		if _, err := cp.RunJob(job); err == nil {
+			t.Errorf("job %v/%v returned a nil error", job.RunID, job.Name)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("err = %v, expected the directory outside of the root to be kept", err)
+	}
+}
+
+func TestLocalDeleteJob(t *testing.T) {
+	cp, cleanup := newTestLocalProcessCloudProvider(t)
+	defer cleanup()
+
+	errs := make(chan error)
+	go func() {
+		_, err := cp.RunJob(Job{RunID: "run:abc", Name: "sleep", Command: []string{"sleep", "10"}})
+		errs <- err
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for names, _ := cp.ListJobs("run:abc"); len(names) == 0; names, _ = cp.ListJobs("run:abc") {
+		if time.Now().After(deadline) {
+			t.Fatal("job was not listed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := cp.DeleteJob("run:abc", "sleep"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err == nil || asJobError(err).Reason != ReasonInfrastructure {
+			t.Errorf("err = %v, expected the job to be killed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not killed")
+	}
+	if names, _ := cp.ListJobs("run:abc"); len(names) != 0 {
+		t.Errorf("jobs = %v, expected none", names)
+	}
+}
@@ -0,0 +1,22 @@
+package worker
+
+import "strings"
+
+// Parses outputs written by a job.
+// Outputs are written as "key=value" lines, surrounding spaces are trimmed.
+// Lines without "=" are ignored.
+func parseOutputs(str string) map[string]string {
+	outputs := make(map[string]string)
+	for _, line := range strings.Split(str, "\n") {
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		if len(key) == 0 {
+			continue
+		}
+		outputs[key] = strings.TrimSpace(line[i+1:])
+	}
+	return outputs
+}
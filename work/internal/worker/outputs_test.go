@@ -0,0 +1,21 @@
+package worker
+
+import "testing"
+
+func TestParseOutputs(t *testing.T) {
+	outputs := parseOutputs("rows=42\ndate = 2020-01-01\r\n\ninvalid\n=novalue\nurl=http://a?b=c")
+
+	expected := map[string]string{
+		"rows": "42",
+		"date": "2020-01-01",
+		"url":  "http://a?b=c",
+	}
+	if len(outputs) != len(expected) {
+		t.Errorf("outputs = %v, expected %v", outputs, expected)
+	}
+	for k, v := range expected {
+		if outputs[k] != v {
+			t.Errorf("outputs[%v] = %v, expected %v", k, outputs[k], v)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package worker
+
+import (
+	"log"
+	"time"
+)
+
+// Duration of the lease of a semaphore slot. Slots are renewed well before
+// their lease expires, so a slot only expires when its worker was killed.
+const slotLease = 30 * time.Second
+
+const slotRenewInterval = slotLease / 3
+
+// Delay between two attempts to acquire the slots of a queued run or job.
+var slotRetryInterval = 2 * time.Second
+
+// A slot of a resource limited to a number of holders.
+type slot struct {
+	resource string
+	limit    int
+}
+
+// Returns the slots a run must hold to be processed.
+func runSlots(quotas []Quota) []slot {
+	slots := make([]slot, 0, len(quotas))
+	for _, quota := range quotas {
+		if quota.MaxRuns > 0 {
+			slots = append(slots, slot{quota.Resource + ":runs", quota.MaxRuns})
+		}
+	}
+	return slots
+}
+
+// Returns the slots a job must hold to run.
+func jobSlots(quotas []Quota) []slot {
+	slots := make([]slot, 0, len(quotas))
+	for _, quota := range quotas {
+		if quota.MaxJobs > 0 {
+			slots = append(slots, slot{quota.Resource + ":jobs", quota.MaxJobs})
+		}
+	}
+	return slots
+}
+
+// Blocks until the holder acquires all the slots, and returns a function
+// releasing them. Their leases are renewed until they are released.
+// If a slot is not available, the slots already acquired are released before
+// retrying, so that holders waiting for each other's slots do not deadlock.
+// The holder enters with its load slot, which it gives back while waiting, so
+// that the runs and jobs of a throttled project do not saturate the worker,
+// and holds again when the function returns.
+// The queued function is called once, when the holder starts waiting.
+func (w Worker) acquireSlots(holder string, slots []slot, load loadSlot, queued func()) (func(), error) {
+	if len(slots) == 0 {
+		return func() {}, nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			load.acquire()
+		}
+		acquired, err := w.tryAcquireSlots(holder, slots)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			break
+		}
+		load.release()
+		if attempt == 0 {
+			queued()
+		}
+		time.Sleep(slotRetryInterval)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w.renewSlots(holder, slots, done)
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		w.releaseSlots(holder, slots)
+	}, nil
+}
+
+func (w Worker) tryAcquireSlots(holder string, slots []slot) (bool, error) {
+	for i, s := range slots {
+		acquired, err := w.sem.TryAcquire(s.resource, holder, s.limit)
+		if err != nil || !acquired {
+			w.releaseSlots(holder, slots[:i])
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (w Worker) renewSlots(holder string, slots []slot, done <-chan struct{}) {
+	ticker := time.NewTicker(slotRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, s := range slots {
+				if _, err := w.sem.TryAcquire(s.resource, holder, s.limit); err != nil {
+					log.Printf("Unable to renew slot of %v for %v: %v", s.resource, holder, err.Error())
+				}
+			}
+		}
+	}
+}
+
+func (w Worker) releaseSlots(holder string, slots []slot) {
+	for _, s := range slots {
+		if err := w.sem.Release(s.resource, holder); err != nil {
+			log.Printf("Unable to release slot of %v for %v: %v", s.resource, holder, err.Error())
+		}
+	}
+}
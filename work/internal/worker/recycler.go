@@ -1,7 +1,9 @@
 package worker
 
 import (
+	"encoding/json"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v7"
@@ -10,10 +12,11 @@ import (
 type RedisRecycler struct {
 	info   Info
 	client redis.Cmdable
+	load   *Load
 }
 
-func NewRecycler(info Info) Recycler {
-	return &RedisRecycler{info, NewRedisClient()}
+func NewRecycler(info Info, load *Load) Recycler {
+	return &RedisRecycler{info, NewRedisClient(), load}
 }
 
 // This function registers the worker with the recycler, and
@@ -29,20 +32,55 @@ func (r RedisRecycler) StartSync() {
 	}
 }
 
-// This function sets the worker information and registers the worker
-// for the recycler.
+// This function sets the worker information and load, and registers the
+// worker for the recycler.
+// Runs are re-scheduled in the queue of their priority, or in the queue of
+// runs without priority. Jobs are re-scheduled in the job queue.
 func (r RedisRecycler) sync() {
 	workerKey := "worker:" + r.info.Name
 	workersKey := "workers"
 
+	expiry := time.Now().Add(15 * time.Second).Format(time.RFC3339)
 	fields := []interface{}{
 		"queue", r.info.Queue,
 		"processQueue", r.info.ProcessQueue,
-		"expiry", time.Now().Add(15 * time.Second).Format(time.RFC3339),
+		"expiry", expiry,
 	}
+	if len(r.info.PriorityQueues) > 0 {
+		queues := make(map[string]string, len(r.info.PriorityQueues))
+		for _, queue := range r.info.PriorityQueues {
+			queues[queue.Priority] = queue.Queue
+		}
+		val, err := json.Marshal(queues)
+		if err != nil {
+			log.Println("Unable to encode priority queues for recycler:", err)
+			return
+		}
+		fields = append(fields, "priorityQueues", string(val))
+	}
+	runs, jobs := r.load.Current()
+	fields = append(fields,
+		"runs", strconv.Itoa(runs),
+		"jobs", strconv.Itoa(jobs),
+		"maxRuns", strconv.Itoa(r.load.MaxRuns),
+		"maxJobs", strconv.Itoa(r.load.MaxJobs),
+	)
 	if err := r.client.HSet(workerKey, fields...).Err(); err != nil {
 		log.Println("Unable to set worker information for recycler:", err)
-	} else if err := r.client.SAdd(workersKey, workerKey).Err(); err != nil {
+		return
+	}
+
+	// The jobs taken by the worker are re-scheduled in the job queue. They
+	// are registered as another worker, expiring with the worker.
+	jobsWorkerKey := workerKey + ":jobs"
+	jobFields := []interface{}{
+		"queue", r.info.JobQueue,
+		"processQueue", r.info.JobProcessQueue,
+		"expiry", expiry,
+	}
+	if err := r.client.HSet(jobsWorkerKey, jobFields...).Err(); err != nil {
+		log.Println("Unable to set worker information for recycler:", err)
+	} else if err := r.client.SAdd(workersKey, workerKey, jobsWorkerKey).Err(); err != nil {
 		log.Println("Unable to register worker for recycler:", err)
 	}
 }
@@ -12,12 +12,24 @@ import (
 
 // Test that the recycler creation does not panic.
 func TestNewRecycler(t *testing.T) {
-	_ = NewRecycler(testInfo)
+	_ = NewRecycler(testInfo, NewLoad(0, 0))
 }
 
 type redisMock redisClientMock
 
 func (r redisMock) HSet(key string, values ...interface{}) *redis.IntCmd {
+	if key == "worker:xyz:jobs" {
+		expectedValues := []string{"queue", "jobs:work", "processQueue", "jobs:worker:xyz", "expiry"}
+		for i := range expectedValues {
+			if values[i] != expectedValues[i] {
+				r.t.Errorf("HSet: values[%v] = %v, expected %v", i, values[i], expectedValues[i])
+			}
+		}
+		if len(values) != len(expectedValues)+1 {
+			r.t.Errorf("HSet: %v values, expected %v", len(values), len(expectedValues)+1)
+		}
+		return redis.NewIntResult(1, nil)
+	}
 	if key != "worker:xyz" {
 		r.t.Errorf("HSet: key = %v, expected worker:xyz", key)
 	}
@@ -37,6 +49,16 @@ func (r redisMock) HSet(key string, values ...interface{}) *redis.IntCmd {
 		r.t.Errorf("HSet: expiry %v is not after now (%v)", exp, now)
 	}
 
+	expectedLoad := []string{
+		"priorityQueues", `{"high":"runs:work:high","low":"runs:work:low","normal":"runs:work"}`,
+		"runs", "0", "jobs", "0", "maxRuns", "2", "maxJobs", "10",
+	}
+	for i := range expectedLoad {
+		if values[len(expectedValues)+1+i] != expectedLoad[i] {
+			r.t.Errorf("HSet: values[%v] = %v, expected %v", len(expectedValues)+1+i, values[len(expectedValues)+1+i], expectedLoad[i])
+		}
+	}
+
 	return redis.NewIntResult(1, nil)
 }
 
@@ -44,11 +66,11 @@ func (r redisMock) SAdd(key string, members ...interface{}) *redis.IntCmd {
 	if key != "workers" {
 		r.t.Errorf("SAdd: key = %v, expected workers", key)
 	}
-	if len(members) != 1 {
-		r.t.Errorf("SAdd: adding %v members, expected 1", len(members))
+	if len(members) != 2 {
+		r.t.Fatalf("SAdd: adding %v members, expected 2", len(members))
 	}
-	if members[0].(string) != "worker:xyz" {
-		r.t.Errorf("SAdd: member is %v, expected worker:xyz", members[0])
+	if members[0].(string) != "worker:xyz" || members[1].(string) != "worker:xyz:jobs" {
+		r.t.Errorf("SAdd: members are %v, expected worker:xyz and worker:xyz:jobs", members)
 	}
 
 	return redis.NewIntResult(1, nil)
@@ -78,19 +100,19 @@ func TestSync(t *testing.T) {
 	Convey("Scenario: synchronize with recycler", t, func() {
 		Convey("Given the recycler is synchronizing", func() {
 			Convey("When everything goes well", func() {
-				RedisRecycler{testInfo, &redisMock{t: t}}.sync()
+				RedisRecycler{testInfo, &redisMock{t: t}, NewLoad(2, 10)}.sync()
 
-				Convey("The worker information should be synchronized", func() {
+				Convey("The worker information and load should be synchronized", func() {
 					// Tested in redisMock.HSet
 				})
 
-				Convey("The worker should be added to the workers set", func() {
+				Convey("The worker and its jobs should be added to the workers set", func() {
 					// Tested in redisMock.SAdd
 				})
 			})
 
 			Convey("When an error occurs during worker information synchronization", func() {
-				r := RedisRecycler{testInfo, &redisHSetErrorStub{}}
+				r := RedisRecycler{testInfo, &redisHSetErrorStub{}, NewLoad(0, 0)}
 
 				Convey("The synchronizer should not panic", func() {
 					r.sync()
@@ -98,7 +120,7 @@ func TestSync(t *testing.T) {
 			})
 
 			Convey("When an error occurs while adding worker to workers set", func() {
-				r := RedisRecycler{testInfo, &redisSAddErrorStub{}}
+				r := RedisRecycler{testInfo, &redisSAddErrorStub{}, NewLoad(0, 0)}
 
 				Convey("The synchronizer should not panic", func() {
 					r.sync()
@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+type RedisJobQueue struct {
+	info   Info
+	client redis.Cmdable
+}
+
+func NewRedisJobQueue(info Info) RedisJobQueue {
+	return RedisJobQueue{info, NewRedisClient()}
+}
+
+// Delay of the blocking wait on the job queue.
+const nextJobWait = time.Second
+
+// A job completion, pushed to the list of completed jobs of its run.
+type completedJob struct {
+	Job    string `json:"job"`
+	Status string `json:"status"`
+}
+
+func makeCompletedJobsKey(runKey string) string {
+	return "completed:jobs:" + runKey
+}
+
+// The job queue holds job keys. The run of a job is stored in its hash, so
+// that the recycler re-schedules jobs like runs.
+// Queued jobs have the QUEUED status, set in the same transaction, so that a
+// resumed run waits for the jobs in the queue rather than queueing them again.
+func (q RedisJobQueue) Queue(runKey, jobKey string) error {
+	_, err := q.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(jobKey, "run", runKey, "status", "QUEUED")
+		pipe.LPush(q.info.JobQueue, jobKey)
+		return nil
+	})
+	return err
+}
+
+// Jobs are moved atomically to the job processing queue, so that the recycler
+// can re-schedule them if the worker is killed.
+// The attempts of the job count the workers which took it.
+func (q RedisJobQueue) NextJob() (string, string, error) {
+	for {
+		jobKey, err := q.client.BRPopLPush(q.info.JobQueue, q.info.JobProcessQueue, nextJobWait).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return "", "", err
+		}
+
+		if err := q.client.HIncrBy(jobKey, "attempts", 1).Err(); err != nil {
+			return "", "", err
+		}
+
+		runKey, err := q.client.HGet(jobKey, "run").Result()
+		if err != nil {
+			return "", "", err
+		}
+		return runKey, jobKey, nil
+	}
+}
+
+func (q RedisJobQueue) Complete(runKey, jobKey, status string) error {
+	val, err := json.Marshal(completedJob{jobKey, status})
+	if err != nil {
+		return err
+	}
+	if err := q.client.LPush(makeCompletedJobsKey(runKey), string(val)).Err(); err != nil {
+		return err
+	}
+	return q.client.LRem(q.info.JobProcessQueue, -1, jobKey).Err()
+}
+
+func (q RedisJobQueue) DeleteCompletedJobs(runKey string) error {
+	return q.client.Del(makeCompletedJobsKey(runKey)).Err()
+}
+
+func (q RedisJobQueue) NextCompletedJob(runKey string, timeout time.Duration) (string, string, error) {
+	vals, err := q.client.BRPop(timeout, makeCompletedJobsKey(runKey)).Result()
+	if err == redis.Nil {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	var job completedJob
+	if err := json.Unmarshal([]byte(vals[1]), &job); err != nil {
+		return "", "", err
+	}
+	return job.Job, job.Status, nil
+}
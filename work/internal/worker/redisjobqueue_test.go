@@ -0,0 +1,185 @@
+package worker
+
+import (
+	"testing"
+
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+func TestNewRedisJobQueue(t *testing.T) {
+	// Test that NewRedisJobQueue does not panic.
+	_ = NewRedisJobQueue(testInfo)
+}
+
+// Stores hashes and lists in memory. Blocking pops do not wait.
+type jobQueueClientMock struct {
+	redisClientMock
+	hashes map[string]map[string]string
+	lists  map[string][]string
+}
+
+func newJobQueueClientMock(t *testing.T) *jobQueueClientMock {
+	return &jobQueueClientMock{
+		redisClientMock: redisClientMock{t: t},
+		hashes:          make(map[string]map[string]string),
+		lists:           make(map[string][]string),
+	}
+}
+
+func (c *jobQueueClientMock) HSet(key string, values ...interface{}) *redis.IntCmd {
+	if _, ok := c.hashes[key]; !ok {
+		c.hashes[key] = make(map[string]string)
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		c.hashes[key][values[i].(string)] = values[i+1].(string)
+	}
+	return redis.NewIntResult(int64(len(values)/2), nil)
+}
+func (c *jobQueueClientMock) HGet(key, field string) *redis.StringCmd {
+	val, ok := c.hashes[key][field]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(val, nil)
+}
+func (c *jobQueueClientMock) HIncrBy(key, field string, incr int64) *redis.IntCmd {
+	val, _ := strconv.ParseInt(c.hashes[key][field], 10, 64)
+	c.HSet(key, field, strconv.FormatInt(val+incr, 10))
+	return redis.NewIntResult(val+incr, nil)
+}
+func (c *jobQueueClientMock) LPush(key string, values ...interface{}) *redis.IntCmd {
+	for _, value := range values {
+		c.lists[key] = append([]string{value.(string)}, c.lists[key]...)
+	}
+	return redis.NewIntResult(int64(len(c.lists[key])), nil)
+}
+func (c *jobQueueClientMock) LRem(key string, count int64, value interface{}) *redis.IntCmd {
+	for i := len(c.lists[key]) - 1; i >= 0; i-- {
+		if c.lists[key][i] == value.(string) {
+			c.lists[key] = append(c.lists[key][:i], c.lists[key][i+1:]...)
+			return redis.NewIntResult(1, nil)
+		}
+	}
+	return redis.NewIntResult(0, nil)
+}
+func (c *jobQueueClientMock) Del(keys ...string) *redis.IntCmd {
+	for _, key := range keys {
+		delete(c.lists, key)
+	}
+	return redis.NewIntResult(int64(len(keys)), nil)
+}
+func (c *jobQueueClientMock) TxPipelined(fn func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	return nil, fn(jobQueuePipelineMock{c: c})
+}
+func (c *jobQueueClientMock) rpop(key string) (string, bool) {
+	list := c.lists[key]
+	if len(list) == 0 {
+		return "", false
+	}
+	c.lists[key] = list[:len(list)-1]
+	return list[len(list)-1], true
+}
+func (c *jobQueueClientMock) BRPopLPush(source, destination string, timeout time.Duration) *redis.StringCmd {
+	if timeout != nextJobWait {
+		c.t.Errorf("BRPopLPush waits %v, expected %v", timeout, nextJobWait)
+	}
+	val, ok := c.rpop(source)
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	c.LPush(destination, val)
+	return redis.NewStringResult(val, nil)
+}
+func (c *jobQueueClientMock) BRPop(timeout time.Duration, keys ...string) *redis.StringSliceCmd {
+	val, ok := c.rpop(keys[0])
+	if !ok {
+		return redis.NewStringSliceResult(nil, redis.Nil)
+	}
+	return redis.NewStringSliceResult([]string{keys[0], val}, nil)
+}
+
+// Runs the commands of the transaction on the client mock.
+type jobQueuePipelineMock struct {
+	redis.Pipeliner
+	c *jobQueueClientMock
+}
+
+func (p jobQueuePipelineMock) HSet(key string, values ...interface{}) *redis.IntCmd {
+	return p.c.HSet(key, values...)
+}
+func (p jobQueuePipelineMock) LPush(key string, values ...interface{}) *redis.IntCmd {
+	return p.c.LPush(key, values...)
+}
+
+func TestRedisJobQueue(t *testing.T) {
+	client := newJobQueueClientMock(t)
+	q := RedisJobQueue{testInfo, client}
+
+	if err := q.Queue("run:abc", "job:job1:run:abc"); err != nil {
+		t.Fatal(err)
+	}
+	if job := client.hashes["job:job1:run:abc"]; job["run"] != "run:abc" || job["status"] != "QUEUED" {
+		t.Errorf("job = %v, expected run run:abc and status QUEUED", job)
+	}
+
+	runID, jobID, err := q.NextJob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runID != "run:abc" || jobID != "job:job1:run:abc" {
+		t.Errorf("next job = %v of %v, expected job:job1:run:abc of run:abc", jobID, runID)
+	}
+	if len(client.lists["jobs:work"]) != 0 || len(client.lists["jobs:worker:xyz"]) != 1 {
+		t.Errorf("lists = %v, expected the job to be moved to jobs:worker:xyz", client.lists)
+	}
+	if attempts := client.hashes["job:job1:run:abc"]["attempts"]; attempts != "1" {
+		t.Errorf("attempts = %v, expected 1", attempts)
+	}
+
+	if jobID, _, err := q.NextCompletedJob("run:abc", time.Millisecond); err != nil || jobID != "" {
+		t.Errorf("completed job = %v (err: %v), expected none", jobID, err)
+	}
+
+	if err := q.Complete("run:abc", "job:job1:run:abc", "SUCCESSFUL"); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.lists["jobs:worker:xyz"]) != 0 {
+		t.Errorf("jobs:worker:xyz = %v, expected the job to be removed", client.lists["jobs:worker:xyz"])
+	}
+
+	jobID, status, err := q.NextCompletedJob("run:abc", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobID != "job:job1:run:abc" || status != "SUCCESSFUL" {
+		t.Errorf("completed job = %v with status %v, expected job:job1:run:abc with status SUCCESSFUL", jobID, status)
+	}
+
+	if err := q.Complete("run:abc", "job:job1:run:abc", "SUCCESSFUL"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.DeleteCompletedJobs("run:abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.lists["completed:jobs:run:abc"]; ok {
+		t.Errorf("lists = %v, expected completed:jobs:run:abc to be deleted", client.lists)
+	}
+}
+
+type jobQueueClientErrorMock redisClientMock
+
+func (c jobQueueClientErrorMock) BRPopLPush(source, destination string, timeout time.Duration) *redis.StringCmd {
+	return redis.NewStringResult("", errors.New("BRPopLPush failed"))
+}
+
+func TestNextJobError(t *testing.T) {
+	q := RedisJobQueue{testInfo, &jobQueueClientErrorMock{t: t}}
+	_, _, err := q.NextJob()
+	if err == nil || err.Error() != "BRPopLPush failed" {
+		t.Errorf("redis error was not forwarded")
+	}
+}
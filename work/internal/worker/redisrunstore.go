@@ -1,6 +1,13 @@
 package worker
 
-import "github.com/go-redis/redis/v7"
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
 
 type RedisRunStore struct {
 	info   Info
@@ -11,19 +18,173 @@ func NewRedisRunStore(info Info) RedisRunStore {
 	return RedisRunStore{info, NewRedisClient()}
 }
 
+// Delay of the blocking wait on the queue of runs without priority, after
+// which the priority queues are polled again.
+const nextRunWait = time.Second
+
+// Runs are taken from the priority queues in priority order.
+// As a blocking pop can only listen on a single list, the queues are polled,
+// and the worker waits on the queue of runs without priority, which gets most
+// runs, between polls.
+// Runs are moved atomically to the processing queue, so that the recycler can
+// re-schedule them if the worker is killed.
 func (rs RedisRunStore) NextRun() (string, error) {
-	val, err := rs.client.BRPopLPush(rs.info.Queue, rs.info.ProcessQueue, 0).Result()
-	if err != nil {
-		return "", err
-	}
+	for {
+		for _, queue := range rs.info.PriorityQueues {
+			val, err := rs.client.RPopLPush(queue.Queue, rs.info.ProcessQueue).Result()
+			if err == nil {
+				return val, nil
+			} else if err != redis.Nil {
+				return "", err
+			}
+		}
 
-	return val, nil
+		val, err := rs.client.BRPopLPush(rs.info.Queue, rs.info.ProcessQueue, nextRunWait).Result()
+		if err == nil {
+			return val, nil
+		} else if err != redis.Nil {
+			return "", err
+		}
+	}
 }
 
 func (rs RedisRunStore) SetRunStatus(runKey, status string) error {
 	return rs.client.HSet(runKey, "status", status).Err()
 }
 
+// Parameters are stored in JSON in the run hash.
+func (rs RedisRunStore) GetRunParams(runKey string) (map[string]string, error) {
+	params := make(map[string]string)
+
+	val, err := rs.client.HGet(runKey, "params").Result()
+	if err == redis.Nil {
+		return params, nil
+	} else if err != nil {
+		return params, err
+	}
+
+	if err := json.Unmarshal([]byte(val), &params); err != nil {
+		return params, err
+	}
+	return params, nil
+}
+
+// Volumes are stored in JSON in the run hash, as a map of names to volumes.
+// They are sorted by name.
+func (rs RedisRunStore) GetRunVolumes(runKey string) ([]Volume, error) {
+	val, err := rs.client.HGet(runKey, "volumes").Result()
+	if err == redis.Nil {
+		return []Volume{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var m map[string]Volume
+	if err := json.Unmarshal([]byte(val), &m); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	volumes := make([]Volume, 0, len(m))
+	for _, name := range names {
+		volume := m[name]
+		volume.Name = name
+		volumes = append(volumes, volume)
+	}
+	return volumes, nil
+}
+
+// The source is stored in JSON in the run hash, and the commit it resolved to
+// in a separate field.
+func (rs RedisRunStore) GetRunSource(runKey string) (*Source, error) {
+	vals, err := rs.client.HMGet(runKey, "source", "commit").Result()
+	if err != nil {
+		return nil, err
+	}
+	val, ok := vals[0].(string)
+	if !ok {
+		return nil, nil
+	}
+
+	var source Source
+	if err := json.Unmarshal([]byte(val), &source); err != nil {
+		return nil, err
+	}
+	if commit, ok := vals[1].(string); ok {
+		source.Commit = commit
+	}
+	return &source, nil
+}
+
+func (rs RedisRunStore) SetRunCommit(runKey, commit string) error {
+	return rs.client.HSet(runKey, "commit", commit).Err()
+}
+
+// The namespace and service account are copied in the run hash when it is
+// scheduled. Runs scheduled before projects existed have none.
+func (rs RedisRunStore) GetRunProject(runKey string) (Project, error) {
+	vals, err := rs.client.HMGet(runKey, "project", "namespace", "serviceAccount").Result()
+	if err != nil {
+		return Project{}, err
+	}
+
+	fields := make([]string, len(vals))
+	for i, val := range vals {
+		fields[i], _ = val.(string)
+	}
+	return Project{fields[0], fields[1], fields[2]}, nil
+}
+
+// The limits of the project are read from the project hash, so that changing
+// them applies to runs already scheduled. The limits of the pipeline are
+// stored in JSON in the run hash, and only apply to stored pipelines, which
+// are named.
+func (rs RedisRunStore) GetRunQuotas(runKey string) ([]Quota, error) {
+	quotas := make([]Quota, 0, 2)
+
+	vals, err := rs.client.HMGet(runKey, "project", "pipeline", "concurrency").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if project, ok := vals[0].(string); ok && len(project) > 0 {
+		limits, err := rs.client.HMGet("project:"+project, "maxRuns", "maxJobs").Result()
+		if err != nil {
+			return nil, err
+		}
+		quota := Quota{Resource: "project:" + project}
+		if val, ok := limits[0].(string); ok {
+			quota.MaxRuns, _ = strconv.Atoi(val)
+		}
+		if val, ok := limits[1].(string); ok {
+			quota.MaxJobs, _ = strconv.Atoi(val)
+		}
+		if quota.MaxRuns > 0 || quota.MaxJobs > 0 {
+			quotas = append(quotas, quota)
+		}
+	}
+
+	pipeline, _ := vals[1].(string)
+	concurrency, _ := vals[2].(string)
+	if len(pipeline) > 0 && len(concurrency) > 0 {
+		var limits struct {
+			MaxRuns int `json:"maxRuns"`
+			MaxJobs int `json:"maxJobs"`
+		}
+		if err := json.Unmarshal([]byte(concurrency), &limits); err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, Quota{"pipeline:" + pipeline, limits.MaxRuns, limits.MaxJobs})
+	}
+
+	return quotas, nil
+}
+
 func (rs RedisRunStore) GetJobs(runKey string) ([]string, error) {
 	runJobsKey := "jobs:" + runKey
 	return rs.client.LRange(runJobsKey, 0, -1).Result()
@@ -35,17 +196,180 @@ func (rs RedisRunStore) GetJob(jobKey string) (Job, error) {
 		return Job{}, err
 	}
 
+	var env map[string]string
+	if val, ok := job["env"]; ok {
+		if err := json.Unmarshal([]byte(val), &env); err != nil {
+			return Job{}, err
+		}
+	}
+	var artifacts []string
+	if val, ok := job["artifacts"]; ok {
+		if err := json.Unmarshal([]byte(val), &artifacts); err != nil {
+			return Job{}, err
+		}
+	}
+	var inputs []string
+	if val, ok := job["inputs"]; ok {
+		if err := json.Unmarshal([]byte(val), &inputs); err != nil {
+			return Job{}, err
+		}
+	}
+
+	var command []string
+	if val, ok := job["command"]; ok {
+		if err := json.Unmarshal([]byte(val), &command); err != nil {
+			return Job{}, err
+		}
+	}
+	var args []string
+	if val, ok := job["args"]; ok {
+		if err := json.Unmarshal([]byte(val), &args); err != nil {
+			return Job{}, err
+		}
+	}
+	var mounts []VolumeMount
+	if val, ok := job["volumeMounts"]; ok {
+		if err := json.Unmarshal([]byte(val), &mounts); err != nil {
+			return Job{}, err
+		}
+	}
+	var steps []Step
+	if val, ok := job["steps"]; ok {
+		if err := json.Unmarshal([]byte(val), &steps); err != nil {
+			return Job{}, err
+		}
+	}
+	var services []Service
+	if val, ok := job["services"]; ok {
+		if services, err = parseServices(val); err != nil {
+			return Job{}, err
+		}
+	}
+	var labels, annotations map[string]string
+	if val, ok := job["labels"]; ok {
+		if err := json.Unmarshal([]byte(val), &labels); err != nil {
+			return Job{}, err
+		}
+	}
+	if val, ok := job["annotations"]; ok {
+		if err := json.Unmarshal([]byte(val), &annotations); err != nil {
+			return Job{}, err
+		}
+	}
+	var attempt int
+	if val, ok := job["attempts"]; ok {
+		if attempt, err = strconv.Atoi(val); err != nil {
+			return Job{}, err
+		}
+	}
+	var podTemplate json.RawMessage
+	if val, ok := job["podTemplate"]; ok {
+		podTemplate = json.RawMessage(val)
+	}
+	var exitCode int
+	if val, ok := job["exitCode"]; ok {
+		if exitCode, err = strconv.Atoi(val); err != nil {
+			return Job{}, err
+		}
+	}
+
 	return Job{
-		job["name"],
-		job["image"],
-		job["run"],
+		Name:         job["name"],
+		Image:        job["image"],
+		Run:          job["run"],
+		Env:          env,
+		Status:       job["status"],
+		Reason:       job["reason"],
+		ExitCode:     exitCode,
+		If:           job["if"],
+		Artifacts:    artifacts,
+		Inputs:       inputs,
+		Command:      command,
+		Args:         args,
+		Shell:        job["shell"],
+		WorkingDir:   job["workingDir"],
+		Steps:        steps,
+		Services:     services,
+		VolumeMounts: mounts,
+		Pipeline:     job["pipeline"],
+		Runner:       job["runner"],
+		Attempt:      attempt,
+		Labels:       labels,
+		Annotations:  annotations,
+		PodTemplate:  podTemplate,
 	}, nil
 }
 
+// Services are stored in JSON as a map of names to services.
+// They are sorted by name, to keep the pod spec stable.
+func parseServices(val string) ([]Service, error) {
+	var m map[string]struct {
+		Image string            `json:"image"`
+		Env   map[string]string `json:"env"`
+	}
+	if err := json.Unmarshal([]byte(val), &m); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	services := make([]Service, 0, len(m))
+	for _, name := range names {
+		services = append(services, Service{name, m[name].Image, m[name].Env})
+	}
+	return services, nil
+}
+
 func (rs RedisRunStore) SetJobStatus(jobKey, status string) error {
 	return rs.client.HSet(jobKey, "status", status).Err()
 }
 
+// Outputs are stored in JSON in the job hash.
+func (rs RedisRunStore) SetJobOutputs(jobKey string, outputs map[string]string) error {
+	val, err := json.Marshal(outputs)
+	if err != nil {
+		return err
+	}
+	return rs.client.HSet(jobKey, "outputs", string(val)).Err()
+}
+
+func (rs RedisRunStore) GetJobOutputs(jobKey string) (map[string]string, error) {
+	outputs := make(map[string]string)
+
+	val, err := rs.client.HGet(jobKey, "outputs").Result()
+	if err == redis.Nil {
+		return outputs, nil
+	} else if err != nil {
+		return outputs, err
+	}
+
+	if err := json.Unmarshal([]byte(val), &outputs); err != nil {
+		return outputs, err
+	}
+	return outputs, nil
+}
+
+// Steps status are stored in JSON in the job hash.
+func (rs RedisRunStore) SetJobStepsStatus(jobKey string, steps []StepStatus) error {
+	val, err := json.Marshal(steps)
+	if err != nil {
+		return err
+	}
+	return rs.client.HSet(jobKey, "stepsStatus", string(val)).Err()
+}
+
+// The exit code is only stored for failed commands.
+func (rs RedisRunStore) SetJobFailure(jobKey string, failure *JobError) error {
+	if failure.Reason == ReasonFailed {
+		return rs.client.HSet(jobKey, "reason", failure.Reason, "exitCode", strconv.Itoa(failure.ExitCode)).Err()
+	}
+	return rs.client.HSet(jobKey, "reason", failure.Reason).Err()
+}
+
 func (rs RedisRunStore) GetJobDependencies(jobKey string) ([]JobDependency, error) {
 	deps := make([]JobDependency, 0)
 
@@ -70,6 +394,11 @@ func (rs RedisRunStore) GetJobDependencies(jobKey string) ([]JobDependency, erro
 	return deps, nil
 }
 
+// The list of completed jobs of the run is deleted, in case the run was
+// closed before its jobs were processed.
 func (rs RedisRunStore) Close(runKey string) error {
+	if err := rs.client.Del(makeCompletedJobsKey(runKey)).Err(); err != nil {
+		return err
+	}
 	return rs.client.LRem(rs.info.ProcessQueue, -1, runKey).Err()
 }
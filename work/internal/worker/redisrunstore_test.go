@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"errors"
+	"reflect"
 	"time"
 
 	"github.com/go-redis/redis/v7"
@@ -16,18 +17,19 @@ func TestNewRedisRunStore(t *testing.T) {
 
 type nextRunClientMock redisClientMock
 
-func (c nextRunClientMock) BRPopLPush(source, destination string, timeout time.Duration) *redis.StringCmd {
-	if timeout != 0 {
-		c.t.Errorf("BRPopLPush should block indefinitely")
-	}
-	if source != "runs:work" {
-		c.t.Errorf("BRPopLPush listens on %v, expected runs:work", source)
-	}
+func (c nextRunClientMock) RPopLPush(source, destination string) *redis.StringCmd {
 	if destination != "runs:worker:xyz" {
-		c.t.Errorf("BRPopLPush listens on %v, expected runs:worker:xyz", destination)
+		c.t.Errorf("RPopLPush moves runs to %v, expected runs:worker:xyz", destination)
 	}
 
-	return redis.NewStringResult("run:abc", nil)
+	switch source {
+	case "runs:work:high":
+		return redis.NewStringResult("", redis.Nil)
+	case "runs:work":
+		return redis.NewStringResult("run:abc", nil)
+	}
+	c.t.Errorf("RPopLPush polls %v, expected the high priority queue before the normal one", source)
+	return redis.NewStringResult("", redis.Nil)
 }
 
 func TestNextRun(t *testing.T) {
@@ -41,16 +43,54 @@ func TestNextRun(t *testing.T) {
 	}
 }
 
+type nextRunEmptyClientMock struct {
+	redisClientMock
+	waits int
+}
+
+func (c *nextRunEmptyClientMock) RPopLPush(source, destination string) *redis.StringCmd {
+	return redis.NewStringResult("", redis.Nil)
+}
+
+func (c *nextRunEmptyClientMock) BRPopLPush(source, destination string, timeout time.Duration) *redis.StringCmd {
+	if source != "runs:work" || destination != "runs:worker:xyz" {
+		c.t.Errorf("BRPopLPush %v %v, expected runs:work and runs:worker:xyz", source, destination)
+	}
+	if timeout != nextRunWait {
+		c.t.Errorf("BRPopLPush waits %v, expected %v", timeout, nextRunWait)
+	}
+
+	c.waits++
+	if c.waits == 1 {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult("run:def", nil)
+}
+
+// When the queues are empty, the worker waits on the normal queue, and polls
+// the queues again.
+func TestNextRunEmpty(t *testing.T) {
+	client := &nextRunEmptyClientMock{redisClientMock: redisClientMock{t: t}}
+	rs := RedisRunStore{testInfo, client}
+	runID, err := rs.NextRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runID != "run:def" || client.waits != 2 {
+		t.Errorf("runID = %v after %v waits, expected run:def after 2 waits", runID, client.waits)
+	}
+}
+
 type nextRunClientErrorMock redisClientMock
 
-func (c nextRunClientErrorMock) BRPopLPush(source, destination string, timeout time.Duration) *redis.StringCmd {
-	return redis.NewStringResult("", errors.New("BRPopLPush failed"))
+func (c nextRunClientErrorMock) RPopLPush(source, destination string) *redis.StringCmd {
+	return redis.NewStringResult("", errors.New("RPopLPush failed"))
 }
 
 func TestNextRunError(t *testing.T) {
 	rs := RedisRunStore{testInfo, &nextRunClientErrorMock{t: t}}
 	_, err := rs.NextRun()
-	if err.Error() != "BRPopLPush failed" {
+	if err == nil || err.Error() != "RPopLPush failed" {
 		t.Errorf("redis error was not forwarded")
 	}
 }
@@ -143,10 +183,25 @@ func (c getJobClientMock) HGetAll(key string) *redis.StringStringMapCmd {
 	}
 
 	vals := map[string]string{
-		"name":   "job1",
-		"image":  "busybox",
-		"run":    "exit 0",
-		"status": "RUNNING",
+		"name":         "job1",
+		"image":        "busybox",
+		"run":          "exit 0",
+		"status":       "RUNNING",
+		"artifacts":    `["/tmp/out"]`,
+		"inputs":       `["dep1"]`,
+		"args":         `["--verbose"]`,
+		"shell":        "bash",
+		"volumeMounts": `[{"name":"workspace","mountPath":"/workspace","readOnly":true}]`,
+		"steps":        `[{"name":"migrate","image":"migrate","run":"migrate up"}]`,
+		"services":     `{"redis":{"image":"redis"},"postgres":{"image":"postgres","env":{"POSTGRES_DB":"test"}}}`,
+		"pipeline":     "backfill",
+		"runner":       "cpu",
+		"podTemplate":  `{"nodeSelector":{"accelerator":"gpu"}}`,
+		"attempts":     "2",
+		"reason":       "Failed",
+		"exitCode":     "2",
+		"labels":       `{"team":"data"}`,
+		"annotations":  `{"example.com/owner":"data"}`,
 	}
 	return redis.NewStringStringMapResult(vals, nil)
 }
@@ -166,6 +221,42 @@ func TestGetJob(t *testing.T) {
 	if job.Run != "exit 0" {
 		t.Errorf("job.Run = %v, expected exit 0", job.Run)
 	}
+	if len(job.Artifacts) != 1 || job.Artifacts[0] != "/tmp/out" {
+		t.Errorf("job.Artifacts = %v, expected [/tmp/out]", job.Artifacts)
+	}
+	if len(job.Inputs) != 1 || job.Inputs[0] != "dep1" {
+		t.Errorf("job.Inputs = %v, expected [dep1]", job.Inputs)
+	}
+	if len(job.Args) != 1 || job.Args[0] != "--verbose" {
+		t.Errorf("job.Args = %v, expected [--verbose]", job.Args)
+	}
+	if job.Shell != "bash" {
+		t.Errorf("job.Shell = %v, expected bash", job.Shell)
+	}
+	if len(job.VolumeMounts) != 1 || job.VolumeMounts[0] != (VolumeMount{"workspace", "/workspace", "", true}) {
+		t.Errorf("job.VolumeMounts = %v, expected workspace on /workspace", job.VolumeMounts)
+	}
+	if len(job.Steps) != 1 || job.Steps[0] != (Step{"migrate", "migrate", "migrate up"}) {
+		t.Errorf("job.Steps = %v, expected [migrate]", job.Steps)
+	}
+	if len(job.Services) != 2 || job.Services[0].Name != "postgres" || job.Services[1].Name != "redis" {
+		t.Errorf("job.Services = %v, expected [postgres redis]", job.Services)
+	}
+	if job.Services[0].Env["POSTGRES_DB"] != "test" {
+		t.Errorf("job.Services[0].Env = %v, expected POSTGRES_DB=test", job.Services[0].Env)
+	}
+	if job.Reason != "Failed" || job.ExitCode != 2 {
+		t.Errorf("job = reason %v, exit code %v, expected reason Failed, exit code 2", job.Reason, job.ExitCode)
+	}
+	if job.Pipeline != "backfill" || job.Attempt != 2 || job.Runner != "cpu" {
+		t.Errorf("job = pipeline %v, attempt %v, runner %v, expected pipeline backfill, attempt 2, runner cpu", job.Pipeline, job.Attempt, job.Runner)
+	}
+	if string(job.PodTemplate) != `{"nodeSelector":{"accelerator":"gpu"}}` {
+		t.Errorf("job.PodTemplate = %s, expected the node selector", job.PodTemplate)
+	}
+	if job.Labels["team"] != "data" || job.Annotations["example.com/owner"] != "data" {
+		t.Errorf("job = labels %v, annotations %v, expected team and owner data", job.Labels, job.Annotations)
+	}
 }
 
 type getJobClientErrorMock redisClientMock
@@ -309,6 +400,13 @@ func TestGetJobDependenciesErrorHGetAll(t *testing.T) {
 
 type closeClientMock redisClientMock
 
+func (c closeClientMock) Del(keys ...string) *redis.IntCmd {
+	if len(keys) != 1 || keys[0] != "completed:jobs:run:abc" {
+		c.t.Errorf("keys = %v, expected completed:jobs:run:abc", keys)
+	}
+	return redis.NewIntResult(1, nil)
+}
+
 func (c closeClientMock) LRem(key string, count int64, value interface{}) *redis.IntCmd {
 	if key != "runs:worker:xyz" {
 		c.t.Errorf("key = %v, expected runs:worker:xyz", key)
@@ -333,6 +431,10 @@ func TestClose(t *testing.T) {
 
 type closeClientErrorStub redisClientStub
 
+func (c closeClientErrorStub) Del(keys ...string) *redis.IntCmd {
+	return redis.NewIntResult(1, nil)
+}
+
 func (c closeClientErrorStub) LRem(key string, count int64, value interface{}) *redis.IntCmd {
 	return redis.NewIntResult(0, errors.New("LRem failed"))
 }
@@ -344,3 +446,305 @@ func TestCloseError(t *testing.T) {
 		t.Errorf("redis error was not forwarded")
 	}
 }
+
+type setJobOutputsClientMock redisClientMock
+
+func (c setJobOutputsClientMock) HSet(key string, values ...interface{}) *redis.IntCmd {
+	if key != "job:job1:run:abc" {
+		c.t.Errorf("key = %v, expected job:job1:run:abc", key)
+	}
+	if values[0] != "outputs" {
+		c.t.Errorf("values[0] = %v, expected outputs", values[0])
+	}
+	if values[1] != `{"rows":"42"}` {
+		c.t.Errorf("values[1] = %v, expected {\"rows\":\"42\"}", values[1])
+	}
+
+	return redis.NewIntResult(0, nil)
+}
+
+func TestSetJobOutputs(t *testing.T) {
+	rs := RedisRunStore{testInfo, &setJobOutputsClientMock{t: t}}
+	err := rs.SetJobOutputs("job:job1:run:abc", map[string]string{"rows": "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type getJobOutputsClientMock redisClientMock
+
+func (c getJobOutputsClientMock) HGet(key, field string) *redis.StringCmd {
+	if field != "outputs" {
+		c.t.Errorf("field = %v, expected outputs", field)
+	}
+
+	switch key {
+	case "job:job1:run:abc":
+		return redis.NewStringResult(`{"rows":"42"}`, nil)
+	case "job:job2:run:abc":
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult("", errors.New("HGet failed"))
+}
+
+func TestGetJobOutputs(t *testing.T) {
+	rs := RedisRunStore{testInfo, &getJobOutputsClientMock{t: t}}
+
+	outputs, err := rs.GetJobOutputs("job:job1:run:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outputs["rows"] != "42" {
+		t.Errorf("outputs = %v, expected rows=42", outputs)
+	}
+
+	outputs, err = rs.GetJobOutputs("job:job2:run:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 0 {
+		t.Errorf("outputs = %v, expected empty", outputs)
+	}
+
+	if _, err := rs.GetJobOutputs("job:job3:run:abc"); err == nil || err.Error() != "HGet failed" {
+		t.Errorf("redis error was not forwarded")
+	}
+}
+
+type getRunParamsClientMock redisClientMock
+
+func (c getRunParamsClientMock) HGet(key, field string) *redis.StringCmd {
+	if field != "params" {
+		c.t.Errorf("field = %v, expected params", field)
+	}
+
+	switch key {
+	case "run:abc":
+		return redis.NewStringResult(`{"env":"prod"}`, nil)
+	case "run:def":
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult("", errors.New("HGet failed"))
+}
+
+func TestGetRunParams(t *testing.T) {
+	rs := RedisRunStore{testInfo, &getRunParamsClientMock{t: t}}
+
+	params, err := rs.GetRunParams("run:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["env"] != "prod" {
+		t.Errorf("params = %v, expected env=prod", params)
+	}
+
+	params, err = rs.GetRunParams("run:def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(params) != 0 {
+		t.Errorf("params = %v, expected empty", params)
+	}
+
+	if _, err := rs.GetRunParams("run:ghi"); err == nil || err.Error() != "HGet failed" {
+		t.Errorf("redis error was not forwarded")
+	}
+}
+
+type setJobStepsStatusClientMock redisClientMock
+
+func (c setJobStepsStatusClientMock) HSet(key string, values ...interface{}) *redis.IntCmd {
+	if values[0] != "stepsStatus" {
+		c.t.Errorf("values[0] = %v, expected stepsStatus", values[0])
+	}
+	if values[1] != `[{"name":"migrate","status":"SUCCESSFUL"}]` {
+		c.t.Errorf("values[1] = %v, expected migrate step successful", values[1])
+	}
+
+	return redis.NewIntResult(0, nil)
+}
+
+func TestSetJobStepsStatus(t *testing.T) {
+	rs := RedisRunStore{testInfo, &setJobStepsStatusClientMock{t: t}}
+	err := rs.SetJobStepsStatus("job:job1:run:abc", []StepStatus{StepStatus{"migrate", "SUCCESSFUL"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Records the values set on each key.
+type setJobFailureClientMock struct {
+	redisClientMock
+	values map[string][]interface{}
+}
+
+func (c *setJobFailureClientMock) HSet(key string, values ...interface{}) *redis.IntCmd {
+	c.values[key] = values
+	return redis.NewIntResult(0, nil)
+}
+
+func TestSetJobFailure(t *testing.T) {
+	client := &setJobFailureClientMock{redisClientMock{t: t}, make(map[string][]interface{})}
+	rs := RedisRunStore{testInfo, client}
+
+	if err := rs.SetJobFailure("job:job1:run:abc", &JobError{ReasonFailed, 2, "job execution failed"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.SetJobFailure("job:job2:run:abc", &JobError{Reason: ReasonEvicted, Message: "job pod was evicted"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]interface{}{
+		"job:job1:run:abc": []interface{}{"reason", "Failed", "exitCode", "2"},
+		"job:job2:run:abc": []interface{}{"reason", "Evicted"},
+	}
+	if !reflect.DeepEqual(client.values, expected) {
+		t.Errorf("values = %v, expected %v", client.values, expected)
+	}
+}
+
+type getRunVolumesClientMock redisClientMock
+
+func (c getRunVolumesClientMock) HGet(key, field string) *redis.StringCmd {
+	if field != "volumes" {
+		c.t.Errorf("field = %v, expected volumes", field)
+	}
+
+	switch key {
+	case "run:abc":
+		return redis.NewStringResult(`{"workspace":{"workspace":{"size":"1Gi"}},"config":{"configMap":{"name":"app-config"}}}`, nil)
+	case "run:def":
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult("", errors.New("HGet failed"))
+}
+
+func TestGetRunVolumes(t *testing.T) {
+	rs := RedisRunStore{testInfo, &getRunVolumesClientMock{t: t}}
+
+	volumes, err := rs.GetRunVolumes("run:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 2 {
+		t.Fatalf("len(volumes) = %v, expected 2", len(volumes))
+	}
+	if v := volumes[0]; v.Name != "config" || v.ConfigMap == nil || v.ConfigMap.Name != "app-config" {
+		t.Errorf("volumes[0] = %v, expected config map app-config", v)
+	}
+	if v := volumes[1]; v.Name != "workspace" || v.Workspace == nil || v.Workspace.Size != "1Gi" {
+		t.Errorf("volumes[1] = %v, expected workspace of 1Gi", v)
+	}
+
+	volumes, err = rs.GetRunVolumes("run:def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 0 {
+		t.Errorf("volumes = %v, expected empty", volumes)
+	}
+
+	if _, err := rs.GetRunVolumes("run:ghi"); err == nil || err.Error() != "HGet failed" {
+		t.Errorf("redis error was not forwarded")
+	}
+}
+
+type getRunSourceClientMock redisClientMock
+
+func (c getRunSourceClientMock) HMGet(key string, fields ...string) *redis.SliceCmd {
+	switch key {
+	case "run:abc":
+		return redis.NewSliceResult([]interface{}{`{"repo":"https://example.com/repo.git","ref":"main"}`, "0123456789abcdef0123456789abcdef01234567"}, nil)
+	case "run:def":
+		return redis.NewSliceResult([]interface{}{nil, nil}, nil)
+	}
+	return redis.NewSliceResult(nil, errors.New("HMGet failed"))
+}
+
+func TestGetRunSource(t *testing.T) {
+	rs := RedisRunStore{testInfo, &getRunSourceClientMock{t: t}}
+
+	source, err := rs.GetRunSource("run:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source == nil || source.Repo != "https://example.com/repo.git" || source.Ref != "main" {
+		t.Fatalf("source = %v, expected https://example.com/repo.git at main", source)
+	}
+	if source.Commit != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("source.Commit = %v, expected 0123456789abcdef0123456789abcdef01234567", source.Commit)
+	}
+
+	source, err = rs.GetRunSource("run:def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != nil {
+		t.Errorf("source = %v, expected nil", source)
+	}
+
+	if _, err := rs.GetRunSource("run:ghi"); err == nil || err.Error() != "HMGet failed" {
+		t.Errorf("redis error was not forwarded")
+	}
+}
+
+type setRunCommitClientMock redisClientMock
+
+func (c setRunCommitClientMock) HSet(key string, values ...interface{}) *redis.IntCmd {
+	if key != "run:abc" {
+		c.t.Errorf("key = %v, expected run:abc", key)
+	}
+	if values[0] != "commit" || values[1] != "0123456789abcdef0123456789abcdef01234567" {
+		c.t.Errorf("values = %v, expected commit", values)
+	}
+	return redis.NewIntResult(0, nil)
+}
+
+func TestSetRunCommit(t *testing.T) {
+	rs := RedisRunStore{testInfo, &setRunCommitClientMock{t: t}}
+	if err := rs.SetRunCommit("run:abc", "0123456789abcdef0123456789abcdef01234567"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type getRunQuotasClientMock redisClientMock
+
+func (c getRunQuotasClientMock) HMGet(key string, fields ...string) *redis.SliceCmd {
+	switch key {
+	case "run:abc":
+		return redis.NewSliceResult([]interface{}{"team-a", "backfill", `{"maxRuns":1}`}, nil)
+	case "run:def":
+		return redis.NewSliceResult([]interface{}{"default", nil, `{"maxRuns":1}`}, nil)
+	case "project:team-a":
+		return redis.NewSliceResult([]interface{}{"0", "10"}, nil)
+	case "project:default":
+		return redis.NewSliceResult([]interface{}{nil, nil}, nil)
+	}
+	return redis.NewSliceResult(nil, errors.New("HMGet failed"))
+}
+
+func TestGetRunQuotas(t *testing.T) {
+	rs := RedisRunStore{testInfo, &getRunQuotasClientMock{t: t}}
+
+	quotas, err := rs.GetRunQuotas("run:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Quota{{"project:team-a", 0, 10}, {"pipeline:backfill", 1, 0}}
+	if len(quotas) != len(expected) || quotas[0] != expected[0] || quotas[1] != expected[1] {
+		t.Errorf("quotas = %v, expected %v", quotas, expected)
+	}
+
+	// Unlimited projects and unnamed pipelines have no quota.
+	quotas, err = rs.GetRunQuotas("run:def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quotas) != 0 {
+		t.Errorf("quotas = %v, expected none", quotas)
+	}
+
+	if _, err := rs.GetRunQuotas("run:ghi"); err == nil || err.Error() != "HMGet failed" {
+		t.Errorf("redis error was not forwarded")
+	}
+}
@@ -0,0 +1,57 @@
+package worker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// Slots are the members of a sorted set, scored by the expiry of their lease.
+// Expired slots are removed before counting the slots held, and a holder
+// acquiring its own slot again renews its lease.
+var acquireScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[3])
+if redis.call("ZSCORE", KEYS[1], ARGV[1]) or redis.call("ZCARD", KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call("ZADD", KEYS[1], ARGV[4], ARGV[1])
+	redis.call("PEXPIRE", KEYS[1], ARGV[5])
+	return 1
+end
+return 0
+`)
+
+type RedisSemaphore struct {
+	client redis.Cmdable
+}
+
+func NewRedisSemaphore() RedisSemaphore {
+	return RedisSemaphore{NewRedisClient()}
+}
+
+func makeSemaphoreKey(resource string) string {
+	return "semaphore:" + resource
+}
+
+func (s RedisSemaphore) TryAcquire(resource, holder string, limit int) (bool, error) {
+	now := time.Now()
+	args := []interface{}{
+		holder,
+		limit,
+		strconv.FormatInt(toMillis(now), 10),
+		strconv.FormatInt(toMillis(now.Add(slotLease)), 10),
+		strconv.FormatInt(int64(slotLease/time.Millisecond), 10),
+	}
+	acquired, err := acquireScript.Run(s.client, []string{makeSemaphoreKey(resource)}, args...).Int()
+	if err != nil {
+		return false, err
+	}
+	return acquired == 1, nil
+}
+
+func (s RedisSemaphore) Release(resource, holder string) error {
+	return s.client.ZRem(makeSemaphoreKey(resource), holder).Err()
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,68 @@
+package worker
+
+import (
+	"testing"
+
+	"errors"
+	"strconv"
+
+	"github.com/go-redis/redis/v7"
+)
+
+func TestNewRedisSemaphore(t *testing.T) {
+	// Test that NewRedisSemaphore does not panic.
+	_ = NewRedisSemaphore()
+}
+
+type semaphoreClientMock redisClientMock
+
+func (c semaphoreClientMock) EvalSha(sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	if len(keys) != 1 || keys[0] != "semaphore:project:team-a:jobs" {
+		c.t.Errorf("keys = %v, expected semaphore:project:team-a:jobs", keys)
+	}
+	if args[0] != "job:job1:run:abc" || args[1] != 2 {
+		c.t.Errorf("args = %v, expected holder job:job1:run:abc and limit 2", args)
+	}
+	now, _ := strconv.ParseInt(args[2].(string), 10, 64)
+	expiry, _ := strconv.ParseInt(args[3].(string), 10, 64)
+	if expiry-now != int64(slotLease.Seconds()*1000) {
+		c.t.Errorf("lease = %vms, expected %v", expiry-now, slotLease)
+	}
+	return redis.NewCmdResult(int64(1), nil)
+}
+
+func (c semaphoreClientMock) ZRem(key string, members ...interface{}) *redis.IntCmd {
+	if key != "semaphore:project:team-a:jobs" || members[0] != "job:job1:run:abc" {
+		c.t.Errorf("ZRem %v %v, expected the holder slot", key, members)
+	}
+	return redis.NewIntResult(1, nil)
+}
+
+func TestRedisSemaphore(t *testing.T) {
+	s := RedisSemaphore{&semaphoreClientMock{t: t}}
+
+	acquired, err := s.TryAcquire("project:team-a:jobs", "job:job1:run:abc", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acquired {
+		t.Errorf("acquired = false, expected true")
+	}
+
+	if err := s.Release("project:team-a:jobs", "job:job1:run:abc"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type semaphoreClientErrorMock redisClientMock
+
+func (c semaphoreClientErrorMock) EvalSha(sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	return redis.NewCmdResult(nil, errors.New("EvalSha failed"))
+}
+
+func TestRedisSemaphoreError(t *testing.T) {
+	s := RedisSemaphore{&semaphoreClientErrorMock{t: t}}
+	if _, err := s.TryAcquire("project:team-a:jobs", "job:job1:run:abc", 2); err == nil || err.Error() != "EvalSha failed" {
+		t.Errorf("redis error was not forwarded")
+	}
+}
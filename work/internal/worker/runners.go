@@ -0,0 +1,257 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Runners is a cloud provider running each job on the cloud provider of
+// its runner, e.g. to run preprocessing jobs in a cluster without GPUs and
+// training jobs in another one. Jobs without runner run on the default
+// runner.
+// Workspaces are created on the runner of the jobs mounting them, and
+// artifacts are stored by the artifact store of the runner of the jobs
+// saving or reading them.
+type Runners struct {
+	def       string
+	providers map[string]CloudProvider
+}
+
+// Name of the runner of workers configured without a runners file.
+const defaultRunner = "default"
+
+// Configuration of the runners, read from a JSON file.
+type runnersConfig struct {
+	// Name of the default runner. It can be omitted if there is only one
+	// runner.
+	Default string                  `json:"default"`
+	Runners map[string]runnerConfig `json:"runners"`
+}
+
+type runnerConfig struct {
+	// kubernetes, local or docker.
+	Type string `json:"type"`
+	// Kubeconfig and context of the cluster running Kubernetes jobs.
+	// The worker cluster is used if the kubeconfig is empty, and the
+	// current context if the context is empty.
+	Kubeconfig string `json:"kubeconfig"`
+	Context    string `json:"context"`
+	// Namespace of the Kubernetes jobs. Default: the namespace of the
+	// context, or of the worker.
+	Namespace string `json:"namespace"`
+	// Directory containing the working directories of local processes.
+	// Default: $TMPDIR/chainr-jobs.
+	Root string `json:"root"`
+	// Docker Engine running containers. Default: the local unix socket.
+	Host string `json:"host"`
+}
+
+// Reads the runners file at path. Kubernetes runners panic if their client
+// can not be created, as NewK8SCloudProvider does.
+func LoadRunners(path string) (Runners, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Runners{}, err
+	}
+	var config runnersConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Runners{}, errors.New(path + ": " + err.Error())
+	}
+	return newRunners(config)
+}
+
+func newRunners(config runnersConfig) (Runners, error) {
+	if len(config.Runners) == 0 {
+		return Runners{}, errors.New("no runner is configured")
+	}
+	if len(config.Default) == 0 && len(config.Runners) == 1 {
+		for name := range config.Runners {
+			config.Default = name
+		}
+	}
+	if _, ok := config.Runners[config.Default]; !ok {
+		return Runners{}, errors.New("default runner " + config.Default + " is not configured")
+	}
+
+	r := Runners{config.Default, make(map[string]CloudProvider, len(config.Runners))}
+	for name, runner := range config.Runners {
+		cp, err := newRunner(runner)
+		if err != nil {
+			return Runners{}, errors.New("runner " + name + ": " + err.Error())
+		}
+		log.Printf("Runner %v runs jobs on %v", name, runner.Type)
+		r.providers[name] = cp
+	}
+	return r, nil
+}
+
+func newRunner(config runnerConfig) (CloudProvider, error) {
+	switch config.Type {
+	case "kubernetes":
+		var cp K8SCloudProvider
+		if len(config.Kubeconfig) > 0 {
+			cp = newOutsideCluster(config.Kubeconfig, config.Context)
+		} else {
+			cp = newInsideCluster()
+		}
+		if len(config.Namespace) > 0 {
+			cp.namespace = config.Namespace
+		}
+		cp.gitImage = gitImageFromEnv()
+		cp.podTemplatePolicy = podTemplatePolicyFromEnv()
+		return cp, nil
+	case "local":
+		root := config.Root
+		if len(root) == 0 {
+			root = filepath.Join(os.TempDir(), "chainr-jobs")
+		}
+		return LocalProcessCloudProvider{root, newProcessTable()}, nil
+	case "docker":
+		host := config.Host
+		if len(host) == 0 {
+			host = defaultDockerHost
+		}
+		docker, err := newDockerClient(host)
+		if err != nil {
+			return nil, err
+		}
+		return DockerCloudProvider{docker: docker, gitImage: gitImageFromEnv()}, nil
+	}
+	return nil, errors.New("unknown runner type " + config.Type)
+}
+
+// Returns the artifact stores of the runners: Kubernetes runners store
+// artifacts in their cluster, and the other runners on the filesystem.
+func (r Runners) artifactStore() ArtifactStore {
+	stores := make(map[string]ArtifactStore, len(r.providers))
+	for name, cp := range r.providers {
+		if k8s, ok := cp.(K8SCloudProvider); ok {
+			stores[name] = NewArtifactStore(k8s)
+		} else {
+			stores[name] = NewFSArtifactStore()
+		}
+	}
+	return runnerArtifactStores{r.def, stores}
+}
+
+// The artifact stores of the runners, by runner name. The store of the
+// default runner stores the artifacts of jobs without runner, and of jobs
+// whose runner is not configured, which fail.
+type runnerArtifactStores struct {
+	def    string
+	stores map[string]ArtifactStore
+}
+
+func (as runnerArtifactStores) Create(runID string) error {
+	return as.stores[as.def].Create(runID)
+}
+
+func (as runnerArtifactStores) Location(runID string) string {
+	return as.stores[as.def].Location(runID)
+}
+
+func (as runnerArtifactStores) Delete(runID string) error {
+	return as.stores[as.def].Delete(runID)
+}
+
+func (as runnerArtifactStores) WithProject(project Project) ArtifactStore {
+	stores := make(map[string]ArtifactStore, len(as.stores))
+	for name, store := range as.stores {
+		stores[name] = store.WithProject(project)
+	}
+	return runnerArtifactStores{as.def, stores}
+}
+
+func (as runnerArtifactStores) WithRunner(runner string) ArtifactStore {
+	if store, ok := as.stores[runner]; ok {
+		return store
+	}
+	return as.stores[as.def]
+}
+
+func (r Runners) get(name string) (CloudProvider, error) {
+	if len(name) == 0 {
+		name = r.def
+	}
+	cp, ok := r.providers[name]
+	if !ok {
+		return nil, errors.New("runner " + name + " is not configured")
+	}
+	return cp, nil
+}
+
+func (r Runners) RunJob(job Job) (JobResult, error) {
+	cp, err := r.get(job.Runner)
+	if err != nil {
+		return JobResult{}, err
+	}
+	return cp.RunJob(job)
+}
+
+func (r Runners) CreateWorkspace(runID string, volume Volume) error {
+	cp, err := r.get(volume.Runner)
+	if err != nil {
+		return err
+	}
+	return cp.CreateWorkspace(runID, volume)
+}
+
+func (r Runners) DeleteWorkspace(runID string, volume Volume) error {
+	cp, err := r.get(volume.Runner)
+	if err != nil {
+		return err
+	}
+	return cp.DeleteWorkspace(runID, volume)
+}
+
+// The source is resolved with the credentials of the default runner.
+func (r Runners) ResolveSource(source Source) (string, error) {
+	return r.providers[r.def].ResolveSource(source)
+}
+
+func (r Runners) WithProject(project Project) CloudProvider {
+	providers := make(map[string]CloudProvider, len(r.providers))
+	for name, cp := range r.providers {
+		providers[name] = cp.WithProject(project)
+	}
+	return Runners{r.def, providers}
+}
+
+// Jobs are listed on all the runners, sorted by name. If listing the jobs of
+// a runner fails, e.g. as its cluster is unreachable, the jobs of the other
+// runners are still returned, with the last error.
+func (r Runners) ListJobs(runID string) ([]string, error) {
+	var names []string
+	var err error
+	for runner, cp := range r.providers {
+		jobs, listErr := cp.ListJobs(runID)
+		if listErr != nil {
+			err = errors.New("runner " + runner + ": " + listErr.Error())
+			continue
+		}
+		for _, name := range jobs {
+			if !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, err
+}
+
+// The job is deleted on all the runners, as the runner of a job listed by
+// ListJobs is not known.
+func (r Runners) DeleteJob(runID, name string) error {
+	var err error
+	for _, cp := range r.providers {
+		if deleteErr := cp.DeleteJob(runID, name); deleteErr != nil {
+			err = deleteErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package worker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadRunners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainr-runners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "runners.json")
+	config := `{
+		"default": "local",
+		"runners": {
+			"local": {"type": "local", "root": "/tmp/jobs"},
+			"docker": {"type": "docker", "host": "tcp://127.0.0.1:2375"}
+		}
+	}`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := LoadRunners(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.def != "local" || len(r.providers) != 2 {
+		t.Errorf("runners = %+v, expected local and docker, local by default", r)
+	}
+	if cp, ok := r.providers["local"].(LocalProcessCloudProvider); !ok || cp.root != "/tmp/jobs" {
+		t.Errorf("local runner = %+v, expected local processes in /tmp/jobs", r.providers["local"])
+	}
+	if cp, ok := r.providers["docker"].(DockerCloudProvider); !ok || cp.docker.url != "http://127.0.0.1:2375/"+dockerAPIVersion {
+		t.Errorf("docker runner = %+v, expected the Docker Engine at 127.0.0.1:2375", r.providers["docker"])
+	}
+	as := r.artifactStore()
+	for _, runner := range []string{"local", "docker", ""} {
+		if _, ok := as.WithRunner(runner).(FSArtifactStore); !ok {
+			t.Errorf("artifacts of runner %q were not stored on the filesystem", runner)
+		}
+	}
+}
+
+func TestNewRunnersErrors(t *testing.T) {
+	for _, config := range []runnersConfig{
+		runnersConfig{},
+		runnersConfig{Runners: map[string]runnerConfig{"a": runnerConfig{Type: "local"}, "b": runnerConfig{Type: "local"}}},
+		runnersConfig{Default: "c", Runners: map[string]runnerConfig{"a": runnerConfig{Type: "local"}}},
+		runnersConfig{Runners: map[string]runnerConfig{"a": runnerConfig{Type: "vm"}}},
+		runnersConfig{Runners: map[string]runnerConfig{"a": runnerConfig{Type: "docker", Host: "ssh://host"}}},
+	} {
+		if _, err := newRunners(config); err == nil {
+			t.Errorf("newRunners(%+v) returned a nil error", config)
+		}
+	}
+
+	r, err := newRunners(runnersConfig{Runners: map[string]runnerConfig{"a": runnerConfig{Type: "local"}}})
+	if err != nil || r.def != "a" {
+		t.Errorf("runners = %+v, %v, expected the only runner to be the default", r, err)
+	}
+}
+
+// Records the jobs it runs and deletes.
+type runnerMock struct {
+	cloudProviderStub
+	jobs        []string
+	deleted     []string
+	unreachable bool
+}
+
+func (cp *runnerMock) RunJob(job Job) (JobResult, error) {
+	cp.jobs = append(cp.jobs, job.Name)
+	return JobResult{}, nil
+}
+func (cp *runnerMock) WithProject(project Project) CloudProvider {
+	return cp
+}
+func (cp *runnerMock) ListJobs(runID string) ([]string, error) {
+	if cp.unreachable {
+		return nil, errors.New("cluster is unreachable")
+	}
+	return cp.jobs, nil
+}
+func (cp *runnerMock) DeleteJob(runID, name string) error {
+	cp.deleted = append(cp.deleted, name)
+	return nil
+}
+
+func TestRunners(t *testing.T) {
+	cpu, gpu := &runnerMock{}, &runnerMock{}
+	r := Runners{"cpu", map[string]CloudProvider{"cpu": cpu, "gpu": gpu}}.WithProject(Project{Name: "etl"})
+
+	for _, job := range []Job{Job{Name: "prepare"}, Job{Name: "train", Runner: "gpu"}, Job{Name: "report", Runner: "cpu"}} {
+		if _, err := r.RunJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.RunJob(Job{Name: "other", Runner: "tpu"}); err == nil {
+		t.Errorf("job on an unknown runner returned a nil error")
+	}
+	if !reflect.DeepEqual(cpu.jobs, []string{"prepare", "report"}) || !reflect.DeepEqual(gpu.jobs, []string{"train"}) {
+		t.Errorf("jobs = cpu %v, gpu %v, expected prepare and report on cpu, train on gpu", cpu.jobs, gpu.jobs)
+	}
+
+	names, err := r.ListJobs("run:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"prepare", "report", "train"}) {
+		t.Errorf("jobs = %v, expected the jobs of all runners", names)
+	}
+	if err := r.DeleteJob("run:abc", "train"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cpu.deleted) != 1 || len(gpu.deleted) != 1 {
+		t.Errorf("deleted = cpu %v, gpu %v, expected the job to be deleted on all runners", cpu.deleted, gpu.deleted)
+	}
+	gpu.unreachable = true
+	names, err = r.ListJobs("run:abc")
+	if err == nil || !reflect.DeepEqual(names, []string{"prepare", "report"}) {
+		t.Errorf("jobs = %v (err: %v), expected the jobs of cpu and an error", names, err)
+	}
+}
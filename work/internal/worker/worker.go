@@ -5,8 +5,12 @@
 package worker
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,6 +20,10 @@ type Worker struct {
 	cp       CloudProvider
 	es       EventStore
 	recycler Recycler
+	as       ArtifactStore
+	sem      Semaphore
+	load     *Load
+	jq       JobQueue
 }
 
 type RunStore interface {
@@ -28,12 +36,33 @@ type RunStore interface {
 	// Persists the run status in the store.
 	// Status can be:
 	// - PENDING
+	// - QUEUED
 	// - RUNNING
 	// - SUCCESSFUL
 	// - FAILED
 	// - CANCELED
 	SetRunStatus(runID, status string) error
 
+	// Returns the parameters the run was scheduled with.
+	GetRunParams(runID string) (map[string]string, error)
+
+	// Returns the volumes declared by the run pipeline, sorted by name.
+	GetRunVolumes(runID string) ([]Volume, error)
+
+	// Returns the source of the run pipeline, or nil if it has none.
+	// The source commit is set once resolved.
+	GetRunSource(runID string) (*Source, error)
+
+	// Persists the commit SHA the source ref was resolved to.
+	SetRunCommit(runID, commit string) error
+
+	// Returns the project the run belongs to.
+	GetRunProject(runID string) (Project, error)
+
+	// Returns the quotas limiting the run and its jobs, e.g. the quotas of
+	// its project and its pipeline.
+	GetRunQuotas(runID string) ([]Quota, error)
+
 	// Returns a list of arbitrary string identifiers referencing all
 	// jobs contained in the run.
 	// A job identifier must be globally unique, meaning that "job1" from "run1"
@@ -46,12 +75,26 @@ type RunStore interface {
 	// Persists the job status in the store.
 	// Status can be:
 	// - PENDING
+	// - QUEUED
 	// - SKIPPED
 	// - RUNNING
 	// - SUCCESSFUL
 	// - FAILED
 	SetJobStatus(jobID, status string) error
 
+	// Persists the key/value outputs written by the job.
+	SetJobOutputs(jobID string, outputs map[string]string) error
+
+	// Returns the key/value outputs written by the job.
+	GetJobOutputs(jobID string) (map[string]string, error)
+
+	// Persists the status of the job steps.
+	SetJobStepsStatus(jobID string, steps []StepStatus) error
+
+	// Persists the reason of the job failure, and the exit code of its
+	// command if it failed.
+	SetJobFailure(jobID string, failure *JobError) error
+
 	// Returns a list of arbitrary string identifiers referencing all
 	// dependencies for the job.
 	// A dependency identifier must be globally unique.
@@ -62,10 +105,147 @@ type RunStore interface {
 	Close(runID string) error
 }
 
+// The project a run belongs to.
+// Its jobs are run in the project namespace, with its service account. If
+// they are empty, the defaults of the cloud provider are used.
+type Project struct {
+	Name           string
+	Namespace      string
+	ServiceAccount string
+}
+
+// A quota limits the runs processed at the same time, and the jobs running at
+// the same time, across workers. Zero is unlimited.
+type Quota struct {
+	// Resource limited by the quota, e.g. project:<name> or pipeline:<name>.
+	Resource string
+	MaxRuns  int
+	MaxJobs  int
+}
+
+// Run identifiers are the keys of the runs, e.g. run:<uid>, or
+// project:<name>:run:<uid> for runs of a project. Returns the run UID, used
+// to name the resources of the run.
+func runUID(runID string) string {
+	if i := strings.LastIndex(runID, "run:"); i >= 0 {
+		return runID[i+len("run:"):]
+	}
+	return runID
+}
+
 type Job struct {
+	// Identifiers of the job and of the run the job belongs to.
+	ID     string
+	RunID  string
+	Name   string
+	Image  string
+	Run    string
+	Env    map[string]string
+	Status string
+	// Reason of the job failure and, for failed commands, their exit code.
+	// See JobError.
+	Reason   string
+	ExitCode int
+
+	// Command and arguments run instead of the shell command.
+	// When the command is empty, the image entrypoint is used.
+	Command []string
+	Args    []string
+	// Shell running the shell commands, sh by default.
+	Shell      string
+	WorkingDir string
+
+	// Expression evaluated before the job starts.
+	// If it evaluates to false, the job is skipped.
+	If string
+
+	// Paths saved as artifacts when the job succeeds.
+	Artifacts []string
+	// Names of the jobs whose artifacts are made available to the job.
+	Inputs []string
+	// Location of the run artifacts, as returned by the artifact store.
+	ArtifactsLocation string
+
+	// Steps run sequentially before the job command.
+	Steps []Step
+	// Services run alongside the job command, sorted by name.
+	Services []Service
+
+	VolumeMounts []VolumeMount
+	// Volumes mounted by the job, sorted by name.
+	Volumes []Volume
+
+	// Source cloned before the job starts, if any.
+	Source *Source
+
+	// Name of the stored pipeline of the run, if any.
+	Pipeline string
+	// Name of the runner of the job, the default runner if empty.
+	// See Runners.
+	Runner string
+	// Number of times a worker took the job, starting at 1.
+	Attempt int
+	// Labels and annotations set by the pipeline on the resources of the job.
+	Labels      map[string]string
+	Annotations map[string]string
+	// Partial Kubernetes pod spec merged onto the pod of the job, in JSON.
+	PodTemplate json.RawMessage
+}
+
+// The source repository of the pipeline.
+// Credentials are the name of a secret holding a username and a password.
+type Source struct {
+	Repo        string `json:"repo"`
+	Ref         string `json:"ref"`
+	Credentials string `json:"credentials"`
+	// Commit SHA the ref was resolved to when the run started.
+	Commit string `json:"-"`
+}
+
+type Step struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	Run   string `json:"run"`
+}
+
+type Service struct {
 	Name  string
 	Image string
-	Run   string
+	Env   map[string]string
+}
+
+// Volumes are declared by the pipeline, and mounted by its jobs.
+// Exactly one source is set.
+type Volume struct {
+	Name                  string           `json:"-"`
+	EmptyDir              *EmptyDirVolume  `json:"emptyDir"`
+	Workspace             *WorkspaceVolume `json:"workspace"`
+	PersistentVolumeClaim *NamedVolume     `json:"persistentVolumeClaim"`
+	ConfigMap             *NamedVolume     `json:"configMap"`
+	Secret                *NamedVolume     `json:"secret"`
+	// Runner of the jobs mounting the workspace, on which it is created.
+	Runner string `json:"-"`
+}
+
+// Scratch space shared by the containers of a job.
+type EmptyDirVolume struct{}
+
+// Persistent volume created for the run, shared by its jobs.
+type WorkspaceVolume struct {
+	Size         string `json:"size"`
+	StorageClass string `json:"storageClass"`
+}
+
+// References an existing volume source by name.
+type NamedVolume struct {
+	Name string `json:"name"`
+}
+
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	SubPath   string `json:"subPath"`
+	ReadOnly  bool   `json:"readOnly"`
 }
 
 type JobDependency struct {
@@ -76,7 +256,49 @@ type JobDependency struct {
 type CloudProvider interface {
 	// Runs the job on the cloud provider.
 	// Blocks until the job completes.
-	RunJob(job Job) error
+	// The result is returned even if the job failed.
+	// Failures of the job are returned as job errors, other errors are
+	// considered infrastructure errors.
+	RunJob(job Job) (JobResult, error)
+
+	// Creates the workspace volume of the run.
+	// It is called before any job of the run starts.
+	CreateWorkspace(runID string, volume Volume) error
+
+	// Deletes the workspace volume of the run.
+	DeleteWorkspace(runID string, volume Volume) error
+
+	// Resolves the source ref to a commit SHA, using the source credentials.
+	ResolveSource(source Source) (string, error)
+
+	// Returns a cloud provider running the jobs of the project.
+	WithProject(project Project) CloudProvider
+
+	// Returns the names of the jobs of the run found on the cloud provider,
+	// including jobs started by killed workers.
+	// Jobs found can be returned along with an error, if only some of them
+	// could be listed.
+	ListJobs(runID string) ([]string, error)
+
+	// Stops the job of the run, and deletes its resources.
+	DeleteJob(runID, name string) error
+}
+
+type JobResult struct {
+	// Key/value outputs written by the job.
+	Outputs map[string]string
+	// Status of the job steps, in their order of execution.
+	Steps []StepStatus
+}
+
+// Status can be:
+// - PENDING
+// - RUNNING
+// - SUCCESSFUL
+// - FAILED
+type StepStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
 }
 
 type EventStore interface {
@@ -97,16 +319,111 @@ type Recycler interface {
 	StartSync()
 }
 
+// The ArtifactStore holds the files passed between the jobs of a run.
+type ArtifactStore interface {
+	// Creates the storage for the run artifacts.
+	// It is called before any job of the run starts.
+	Create(runID string) error
+
+	// Returns the location of the run artifacts, as understood by the
+	// cloud provider.
+	Location(runID string) string
+
+	// Deletes the run artifacts.
+	Delete(runID string) error
+
+	// Returns an artifact store storing the artifacts of the project runs.
+	WithProject(project Project) ArtifactStore
+
+	// Returns the artifact store of the jobs of the runner.
+	WithRunner(runner string) ArtifactStore
+}
+
+// Semaphore limits the number of holders of a resource, across workers.
+// Slots are leased, so that the slots of killed workers are freed: holders
+// must acquire their slot again to renew its lease.
+type Semaphore interface {
+	// Acquires a slot of the resource for the holder if less than limit slots
+	// are held, or renews the lease of the slot the holder already holds.
+	// Returns false if no slot is available.
+	TryAcquire(resource, holder string, limit int) (bool, error)
+
+	// Releases the slot of the holder.
+	Release(resource, holder string) error
+}
+
+// JobQueue distributes the jobs of the runs across workers.
+// The worker processing a run queues its jobs when they are ready to run, and
+// any worker can take them. Jobs taken by a killed worker are queued again,
+// so that the run is completed by other workers.
+type JobQueue interface {
+	// Queues the job, to be run by any worker, and sets its status to QUEUED.
+	Queue(runID, jobID string) error
+
+	// Actively listens to queued jobs, and when a job is available, returns
+	// it with the run it belongs to.
+	// Jobs returned by this function must be completed when they are run.
+	NextJob() (string, string, error)
+
+	// Tells the worker processing the run that the job completed with the
+	// given status.
+	// Post-job operations are done in this function.
+	Complete(runID, jobID, status string) error
+
+	// Waits for a job of the run to complete, and returns it with its status.
+	// Returns an empty identifier if no job completed before the timeout.
+	NextCompletedJob(runID string, timeout time.Duration) (string, string, error)
+
+	// Deletes the completed jobs of the run, once all its jobs completed.
+	DeleteCompletedJobs(runID string) error
+}
+
 func New() Worker {
 	info := NewInfo()
+	load := NewLoadFromEnv()
+	cp, as := newCloudProvider()
 	return Worker{
 		NewRedisRunStore(info),
-		NewK8SCloudProvider(),
+		cp,
 		NewRedisEventStore(),
-		NewRecycler(info),
+		NewRecycler(info, load),
+		as,
+		NewRedisSemaphore(),
+		load,
+		NewRedisJobQueue(info),
 	}
 }
 
+// The runners are read from RUNNERS_FILE. Otherwise the cloud provider of
+// the default runner is selected with CLOUD_PROVIDER: kubernetes (default),
+// local to run jobs as local processes, or docker to run them as Docker
+// containers. The artifacts of local processes and Docker containers are
+// stored on the filesystem.
+// If the runners file can not be read, this function panics.
+func newCloudProvider() (CloudProvider, ArtifactStore) {
+	if path, ok := os.LookupEnv("RUNNERS_FILE"); ok {
+		runners, err := LoadRunners(path)
+		if err != nil {
+			panic(err)
+		}
+		return runners, runners.artifactStore()
+	}
+
+	var cp CloudProvider
+	var as ArtifactStore
+	switch os.Getenv("CLOUD_PROVIDER") {
+	case "local":
+		cp, as = NewLocalProcessCloudProvider(), NewFSArtifactStore()
+	case "docker":
+		cp, as = NewDockerCloudProvider(), NewFSArtifactStore()
+	default:
+		k8s := NewK8SCloudProvider()
+		cp, as = k8s, NewArtifactStore(k8s)
+	}
+	runners := Runners{defaultRunner, map[string]CloudProvider{defaultRunner: cp}}
+	return runners, as
+}
+
 type mutexedJobStatus struct {
 	L      sync.Locker
 	Status string
@@ -166,11 +483,12 @@ func (dm dependencyMap) Status() string {
 	return "SUCCESSFUL"
 }
 
-// Start launches the worker loop.
+// Start launches the worker loops, processing runs and running jobs.
 // It runs indefinitely.
 // Upon starting, it synchronizes with the recycler.
 func (w Worker) Start() {
 	go w.recycler.StartSync()
+	go w.startJobs()
 
 	var wg sync.WaitGroup
 	defer func() {
@@ -190,9 +508,12 @@ func (w Worker) Start() {
 
 // ProcessNextRun is a blocking function, listening for a new run,
 // and processing it in a goroutine.
+// It does not listen while the worker is saturated.
 func (w Worker) ProcessNextRun(wg *sync.WaitGroup) error {
+	w.load.AcquireRun()
 	runID, err := w.rs.NextRun()
 	if err != nil {
+		w.load.ReleaseRun()
 		return err
 	}
 
@@ -201,10 +522,37 @@ func (w Worker) ProcessNextRun(wg *sync.WaitGroup) error {
 	return nil
 }
 
+func (w Worker) startJobs() {
+	var wg sync.WaitGroup
+	for {
+		if err := w.ProcessNextJob(&wg); err != nil {
+			log.Println(err)
+			time.Sleep(2 * time.Second)
+		}
+	}
+}
+
+// ProcessNextJob is a blocking function, listening for a queued job,
+// and running it in a goroutine.
+// It does not listen while the worker is saturated.
+func (w Worker) ProcessNextJob(wg *sync.WaitGroup) error {
+	w.load.AcquireJob()
+	runID, jobID, err := w.jq.NextJob()
+	if err != nil {
+		w.load.ReleaseJob()
+		return err
+	}
+
+	wg.Add(1)
+	go w.executeJob(wg, runID, jobID)
+	return nil
+}
+
 // ProcessRun blocks until the run is completed.
 // It should be called in a specific goroutine.
 func (w Worker) processRun(rwg *sync.WaitGroup, runID string) {
 	defer rwg.Done()
+	defer w.load.ReleaseRun()
 
 	status := "CANCELED"
 	defer w.closeRun(runID)
@@ -223,13 +571,196 @@ func (w Worker) processRun(rwg *sync.WaitGroup, runID string) {
 		return
 	}
 
+	quotas, err := w.rs.GetRunQuotas(runID)
+	if err != nil {
+		log.Printf("Unable to get quotas of run %v: %v", runID, err.Error())
+		status = "FAILED"
+		return
+	}
+	release, err := w.acquireSlots(runID, runSlots(quotas), w.load.runSlot(), func() {
+		log.Println("Run", runID, "is queued")
+		if err := w.rs.SetRunStatus(runID, "QUEUED"); err != nil {
+			log.Printf("Unable to set run %v status to QUEUED: %v", runID, err.Error())
+		}
+	})
+	if err != nil {
+		log.Printf("Unable to acquire slots for run %v: %v", runID, err.Error())
+		status = "FAILED"
+		return
+	}
+	defer release()
+
 	if err := w.startRun(runID); err != nil {
 		log.Printf("Unable to start run %v: %v", runID, err.Error())
 		status = "FAILED"
 		return
 	}
 
-	status = w.processJobs(jobIDs)
+	project, err := w.rs.GetRunProject(runID)
+	if err != nil {
+		log.Printf("Unable to get project of run %v: %v", runID, err.Error())
+		status = "FAILED"
+		return
+	}
+	w.cp = w.cp.WithProject(project)
+	w.as = w.as.WithProject(project)
+
+	if err := w.resolveSource(runID); err != nil {
+		log.Printf("Unable to resolve source for run %v: %v", runID, err.Error())
+		status = "FAILED"
+		return
+	}
+
+	artifacts, err := w.createArtifacts(runID, jobIDs)
+	if err != nil {
+		log.Printf("Unable to create artifacts for run %v: %v", runID, err.Error())
+		status = "FAILED"
+		return
+	}
+	defer w.deleteArtifacts(runID, artifacts)
+
+	workspaces, err := w.createWorkspaces(runID, jobIDs)
+	if err != nil {
+		log.Printf("Unable to create workspaces for run %v: %v", runID, err.Error())
+		status = "FAILED"
+		return
+	}
+	defer w.deleteWorkspaces(runID, workspaces)
+	defer w.deleteJobs(runID)
+
+	status = w.processJobs(runID, jobIDs)
+}
+
+// Resolves the source ref once per run, so that all jobs check out the same
+// commit, even if the ref moves while the run is processed.
+// The ref can reference the run parameters.
+func (w Worker) resolveSource(runID string) error {
+	source, err := w.rs.GetRunSource(runID)
+	if err != nil || source == nil || len(source.Commit) > 0 {
+		return err
+	}
+
+	if hasContextRefs(source.Ref) {
+		ctx, err := w.getRunContext(runID)
+		if err != nil {
+			return err
+		}
+		source.Ref = ctx.interpolate(source.Ref)
+	}
+
+	commit, err := w.cp.ResolveSource(*source)
+	if err != nil {
+		return err
+	}
+	log.Printf("Source %v at %v resolved to commit %v", source.Repo, source.Ref, commit)
+	return w.rs.SetRunCommit(runID, commit)
+}
+
+// Creates the workspace volumes of the run on the runners of the jobs
+// mounting them, and returns them. Workspaces mounted by no job are created
+// on the default runner.
+// If a creation fails, workspaces already created are deleted.
+func (w Worker) createWorkspaces(runID string, jobIDs []string) ([]Volume, error) {
+	volumes, err := w.rs.GetRunVolumes(runID)
+	if err != nil {
+		return nil, err
+	}
+
+	var runners map[string][]string
+	workspaces := make([]Volume, 0)
+	for _, volume := range volumes {
+		if volume.Workspace == nil {
+			continue
+		}
+		if runners == nil {
+			if runners, err = w.getVolumeRunners(jobIDs); err != nil {
+				return nil, err
+			}
+		}
+		names := runners[volume.Name]
+		if len(names) == 0 {
+			names = []string{""}
+		}
+		for _, runner := range names {
+			volume.Runner = runner
+			if err := w.cp.CreateWorkspace(runID, volume); err != nil {
+				w.deleteWorkspaces(runID, workspaces)
+				return nil, err
+			}
+			workspaces = append(workspaces, volume)
+		}
+	}
+	return workspaces, nil
+}
+
+// Returns the runners of the jobs mounting each volume, by volume name.
+func (w Worker) getVolumeRunners(jobIDs []string) (map[string][]string, error) {
+	runners := make(map[string][]string)
+	for _, jobID := range jobIDs {
+		job, err := w.rs.GetJob(jobID)
+		if err != nil {
+			return nil, err
+		}
+		for _, mount := range job.VolumeMounts {
+			if !contains(runners[mount.Name], job.Runner) {
+				runners[mount.Name] = append(runners[mount.Name], job.Runner)
+			}
+		}
+	}
+	return runners, nil
+}
+
+func (w Worker) deleteWorkspaces(runID string, workspaces []Volume) {
+	for _, volume := range workspaces {
+		if err := w.cp.DeleteWorkspace(runID, volume); err != nil {
+			log.Printf("Unable to delete workspace %v for run %v: %v", volume.Name, runID, err.Error())
+		}
+	}
+}
+
+// Deletes the jobs of the run left on the cloud provider, e.g. by workers
+// killed while running them.
+func (w Worker) deleteJobs(runID string) {
+	names, err := w.cp.ListJobs(runID)
+	if err != nil {
+		log.Printf("Unable to list jobs of run %v: %v", runID, err.Error())
+	}
+	for _, name := range names {
+		log.Println("Deleting job", name, "of run", runID, "left on the cloud provider")
+		if err := w.cp.DeleteJob(runID, name); err != nil {
+			log.Printf("Unable to delete job %v of run %v: %v", name, runID, err.Error())
+		}
+	}
+}
+
+// Creates the artifacts storage of the run on the runners of the jobs saving
+// or reading artifacts, and returns these runners.
+// If a creation fails, the storage already created is deleted.
+func (w Worker) createArtifacts(runID string, jobIDs []string) ([]string, error) {
+	runners := make([]string, 0)
+	for _, jobID := range jobIDs {
+		job, err := w.rs.GetJob(jobID)
+		if err != nil {
+			return nil, err
+		}
+		if (len(job.Artifacts) == 0 && len(job.Inputs) == 0) || contains(runners, job.Runner) {
+			continue
+		}
+		if err := w.as.WithRunner(job.Runner).Create(runID); err != nil {
+			w.deleteArtifacts(runID, runners)
+			return nil, err
+		}
+		runners = append(runners, job.Runner)
+	}
+	return runners, nil
+}
+
+func (w Worker) deleteArtifacts(runID string, runners []string) {
+	for _, runner := range runners {
+		if err := w.as.WithRunner(runner).Delete(runID); err != nil {
+			log.Printf("Unable to delete artifacts for run %v: %v", runID, err.Error())
+		}
+	}
 }
 
 func (w Worker) closeRun(runID string) {
@@ -328,37 +859,191 @@ func (w Worker) startRun(runID string) error {
 	return nil
 }
 
-func (w Worker) processJobs(jobIDs []string) string {
+// Delay of the wait for completed jobs, after which the worker checks whether
+// the run still has jobs to wait for.
+const completedJobWait = time.Second
+
+// The jobs are queued as soon as their dependencies completed and their
+// condition is met, and are run by any worker. The worker processing the run
+// waits for them to complete.
+func (w Worker) processJobs(runID string, jobIDs []string) string {
 	dm := newDependencyMap(jobIDs)
+	completed := make(map[string]chan string, len(jobIDs))
+	for _, jobID := range jobIDs {
+		completed[jobID] = make(chan string, 1)
+	}
+
+	done := make(chan struct{})
+	go w.waitCompletedJobs(runID, completed, done)
+	defer close(done)
+
 	var jwg sync.WaitGroup
 	for _, jobID := range jobIDs {
 		jwg.Add(1)
-		go w.processJob(&jwg, dm, jobID)
+		go w.processJob(&jwg, dm, completed[jobID], runID, jobID)
 	}
 	jwg.Wait()
 
+	if err := w.jq.DeleteCompletedJobs(runID); err != nil {
+		log.Printf("Unable to delete completed jobs of run %v: %v", runID, err.Error())
+	}
 	return dm.Status()
 }
 
-func (w Worker) processJob(wg *sync.WaitGroup, dm dependencyMap, jobID string) {
+// Sends the status of the completed jobs of the run, until done is closed.
+func (w Worker) waitCompletedJobs(runID string, completed map[string]chan string, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		jobID, status, err := w.jq.NextCompletedJob(runID, completedJobWait)
+		if err != nil {
+			log.Printf("Unable to get completed jobs of run %v: %v", runID, err.Error())
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		if len(jobID) == 0 {
+			continue
+		}
+		c, ok := completed[jobID]
+		if !ok {
+			log.Println("Job", jobID, "completed, but is not a job of run", runID)
+			continue
+		}
+		select {
+		case c <- status:
+		default:
+		}
+	}
+}
+
+func (w Worker) processJob(wg *sync.WaitGroup, dm dependencyMap, completed <-chan string, runID, jobID string) {
 	defer wg.Done()
 
-	status := "SUCCESSFUL"
-	defer func() { w.setJobStatus(dm, jobID, status) }()
+	status := "FAILED"
+	defer func() { dm.Broadcast(jobID, status) }()
+
+	// When the run is resumed by another worker, completed jobs are not run
+	// again, and jobs already queued are waited for.
+	job, err := w.rs.GetJob(jobID)
+	if err != nil {
+		log.Printf("Unable to get job %v: %v", jobID, err.Error())
+		w.setJobStatus(jobID, status)
+		return
+	}
+	switch {
+	case isCompleted(job.Status):
+		log.Println("Job", jobID, "already completed with status", job.Status)
+		status = job.Status
+		return
+	case job.Status == "QUEUED" || job.Status == "RUNNING":
+		log.Println("Job", jobID, "is already queued, waiting for it to complete")
+		status = <-completed
+		return
+	}
 
 	if err := w.waitJobDependencies(jobID, dm); err != nil {
 		log.Println("Conditions for job", jobID, "are not met:", err.Error())
 		status = "SKIPPED"
+		w.setJobStatus(jobID, status)
+		return
+	}
+
+	ok, err := w.evalJobCondition(runID, jobID)
+	if err != nil {
+		log.Println("Unable to evaluate condition of job", jobID+":", err.Error())
+		w.setJobStatus(jobID, status)
+		return
+	}
+	if !ok {
+		log.Println("Condition of job", jobID, "is false")
+		status = "SKIPPED"
+		w.setJobStatus(jobID, status)
+		return
+	}
+
+	if err := w.jq.Queue(runID, jobID); err != nil {
+		log.Printf("Unable to queue job %v: %v", jobID, err.Error())
+		w.setJobStatus(jobID, status)
+		return
+	}
+	status = <-completed
+}
+
+// Runs a job taken from the job queue, on behalf of the worker processing its
+// run.
+func (w Worker) executeJob(wg *sync.WaitGroup, runID, jobID string) {
+	defer wg.Done()
+	defer w.load.ReleaseJob()
+
+	// A job re-scheduled after its worker was killed may have completed.
+	if job, err := w.rs.GetJob(jobID); err == nil && isCompleted(job.Status) {
+		log.Println("Job", jobID, "already completed with status", job.Status)
+		if err := w.jq.Complete(runID, jobID, job.Status); err != nil {
+			log.Printf("Unable to complete job %v: %v", jobID, err.Error())
+		}
+		return
+	}
+
+	status := "FAILED"
+	failure := &JobError{Reason: ReasonInfrastructure}
+	defer func() {
+		if status == "FAILED" {
+			w.setJobFailure(jobID, failure)
+		}
+		w.setJobStatus(jobID, status)
+		if err := w.jq.Complete(runID, jobID, status); err != nil {
+			log.Printf("Unable to complete job %v: %v", jobID, err.Error())
+		}
+	}()
+
+	project, err := w.rs.GetRunProject(runID)
+	if err != nil {
+		log.Printf("Unable to get project of run %v: %v", runID, err.Error())
+		return
+	}
+	w.cp = w.cp.WithProject(project)
+	w.as = w.as.WithProject(project)
+
+	quotas, err := w.rs.GetRunQuotas(runID)
+	if err != nil {
+		log.Printf("Unable to get quotas of run %v: %v", runID, err.Error())
 		return
 	}
+	release, err := w.acquireSlots(jobID, jobSlots(quotas), w.load.jobSlot(), func() {
+		log.Println("Job", jobID, "is queued")
+		if err := w.rs.SetJobStatus(jobID, "QUEUED"); err != nil {
+			log.Printf("Unable to set job %v status to QUEUED: %v", jobID, err.Error())
+		}
+	})
+	if err != nil {
+		log.Printf("Unable to acquire slots for job %v: %v", jobID, err.Error())
+		return
+	}
+	defer release()
 
-	if err := w.runJob(jobID); err != nil {
+	if err := w.runJob(runID, jobID); err != nil {
 		log.Println("Job", jobID, "failed:", err.Error())
-		status = "FAILED"
+		failure = asJobError(err)
+		return
+	}
+	status = "SUCCESSFUL"
+}
+
+func isCompleted(status string) bool {
+	return status == "SUCCESSFUL" || status == "FAILED" || status == "SKIPPED"
+}
+
+func (w Worker) setJobFailure(jobID string, failure *JobError) {
+	if err := w.rs.SetJobFailure(jobID, failure); err != nil {
+		log.Printf("Unable to set job %v failure reason: %v", jobID, err.Error())
 	}
 }
 
-func (w Worker) setJobStatus(dm dependencyMap, jobID string, status string) {
+func (w Worker) setJobStatus(jobID string, status string) {
 	log.Println("Job", jobID, "completed with status", status)
 	if err := w.rs.SetJobStatus(jobID, status); err != nil {
 		log.Printf("Unable to set job %v status to %v: %v", jobID, status, err.Error())
@@ -374,8 +1059,6 @@ func (w Worker) setJobStatus(dm dependencyMap, jobID string, status string) {
 	if err := w.es.CreateEvent(event); err != nil {
 		log.Println("Unable to create event for job completion:", err.Error())
 	}
-
-	dm.Broadcast(jobID, status)
 }
 
 func (w Worker) waitJobDependencies(jobID string, dm dependencyMap) error {
@@ -400,11 +1083,23 @@ func (w Worker) waitJobDependencies(jobID string, dm dependencyMap) error {
 	return nil
 }
 
-func (w Worker) runJob(jobID string) error {
+func (w Worker) runJob(runID, jobID string) error {
 	job, err := w.rs.GetJob(jobID)
 	if err != nil {
 		return err
 	}
+	job.ID = jobID
+	job.RunID = runID
+	job.ArtifactsLocation = w.as.WithRunner(job.Runner).Location(runID)
+	if job.Volumes, err = w.getJobVolumes(runID, job); err != nil {
+		return err
+	}
+	if job.Source, err = w.rs.GetRunSource(runID); err != nil {
+		return err
+	}
+	if err := w.interpolateJob(runID, &job); err != nil {
+		return err
+	}
 
 	log.Printf(`Starting job %v
 	name: %v
@@ -418,9 +1113,134 @@ func (w Worker) runJob(jobID string) error {
 		return err
 	}
 
-	if err := w.cp.RunJob(job); err != nil {
+	result, err := w.cp.RunJob(job)
+	if len(result.Outputs) > 0 {
+		if err := w.rs.SetJobOutputs(jobID, result.Outputs); err != nil {
+			log.Printf("Unable to set job %v outputs: %v", jobID, err.Error())
+		}
+	}
+	if len(result.Steps) > 0 {
+		if err := w.rs.SetJobStepsStatus(jobID, result.Steps); err != nil {
+			log.Printf("Unable to set job %v steps status: %v", jobID, err.Error())
+		}
+	}
+
+	return err
+}
+
+// Returns the volumes mounted by the job.
+func (w Worker) getJobVolumes(runID string, job Job) ([]Volume, error) {
+	if len(job.VolumeMounts) == 0 {
+		return nil, nil
+	}
+
+	volumes, err := w.rs.GetRunVolumes(runID)
+	if err != nil {
+		return nil, err
+	}
+
+	mounted := make([]Volume, 0, len(job.VolumeMounts))
+	for _, volume := range volumes {
+		for _, mount := range job.VolumeMounts {
+			if mount.Name == volume.Name {
+				mounted = append(mounted, volume)
+				break
+			}
+		}
+	}
+	return mounted, nil
+}
+
+// Replaces references to the run context in the job command and
+// arguments, environment and steps commands. References in run scripts are
+// passed as environment variables.
+func (w Worker) interpolateJob(runID string, job *Job) error {
+	hasRefs := hasContextRefs(job.Run)
+	for _, arg := range job.Command {
+		hasRefs = hasRefs || hasContextRefs(arg)
+	}
+	for _, arg := range job.Args {
+		hasRefs = hasRefs || hasContextRefs(arg)
+	}
+	for _, v := range job.Env {
+		hasRefs = hasRefs || hasContextRefs(v)
+	}
+	for _, step := range job.Steps {
+		hasRefs = hasRefs || hasContextRefs(step.Run)
+	}
+	if !hasRefs {
+		return nil
+	}
+
+	ctx, err := w.getRunContext(runID)
+	if err != nil {
 		return err
 	}
 
+	env := make(map[string]string, len(job.Env))
+	for k, v := range job.Env {
+		env[k] = ctx.interpolate(v)
+	}
+	job.Run = ctx.interpolateScript(job.Run, env)
+	job.Command = ctx.interpolateAll(job.Command)
+	job.Args = ctx.interpolateAll(job.Args)
+	steps := make([]Step, 0, len(job.Steps))
+	for _, step := range job.Steps {
+		step.Run = ctx.interpolateScript(step.Run, env)
+		steps = append(steps, step)
+	}
+	job.Env = env
+	job.Steps = steps
 	return nil
 }
+
+// Returns true if the job has no condition, or if its condition evaluates
+// to true.
+func (w Worker) evalJobCondition(runID, jobID string) (bool, error) {
+	job, err := w.rs.GetJob(jobID)
+	if err != nil {
+		return false, err
+	}
+	if len(job.If) == 0 {
+		return true, nil
+	}
+
+	ctx, err := w.getRunContext(runID)
+	if err != nil {
+		return false, err
+	}
+	return evalExpr(job.If, ctx)
+}
+
+// Returns the run parameters, and the status and outputs of all jobs of
+// the run.
+func (w Worker) getRunContext(runID string) (runContext, error) {
+	params, err := w.rs.GetRunParams(runID)
+	if err != nil {
+		return runContext{}, err
+	}
+
+	jobIDs, err := w.rs.GetJobs(runID)
+	if err != nil {
+		return runContext{}, err
+	}
+
+	jobs := make(map[string]jobContext, len(jobIDs))
+	for _, jobID := range jobIDs {
+		job, err := w.rs.GetJob(jobID)
+		if err != nil {
+			return runContext{}, err
+		}
+		outputs, err := w.rs.GetJobOutputs(jobID)
+		if err != nil {
+			return runContext{}, err
+		}
+		exitCode := ""
+		if job.Reason == ReasonFailed {
+			exitCode = strconv.Itoa(job.ExitCode)
+		}
+		jobs[job.Name] = jobContext{job.Status, outputs, job.Reason, exitCode}
+	}
+
+	return runContext{params, jobs}, nil
+}
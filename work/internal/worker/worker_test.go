@@ -6,6 +6,7 @@ import (
 
 	"errors"
 	"sync"
+	"time"
 )
 
 // As the worker mostly works as a black box,
@@ -14,7 +15,7 @@ import (
 // behaviour-driven testing is still present, despite
 // not being perfectly suited.
 
-var testInfo = Info{"xyz", "runs:work", "runs:worker:xyz"}
+var testInfo = Info{"xyz", "runs:work", "runs:worker:xyz", makePriorityQueues("runs:work"), "jobs:work", "jobs:worker:xyz"}
 
 type brokenRunStoreStub struct{}
 
@@ -24,6 +25,24 @@ func (rs brokenRunStoreStub) NextRun() (string, error) {
 func (rs brokenRunStoreStub) SetRunStatus(runID, status string) error {
 	return nil
 }
+func (rs brokenRunStoreStub) GetRunParams(runID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs brokenRunStoreStub) GetRunVolumes(runID string) ([]Volume, error) {
+	return []Volume{}, nil
+}
+func (rs brokenRunStoreStub) GetRunSource(runID string) (*Source, error) {
+	return nil, nil
+}
+func (rs brokenRunStoreStub) SetRunCommit(runID, commit string) error {
+	return nil
+}
+func (rs brokenRunStoreStub) GetRunProject(runID string) (Project, error) {
+	return Project{}, nil
+}
+func (rs brokenRunStoreStub) GetRunQuotas(runID string) ([]Quota, error) {
+	return []Quota{}, nil
+}
 func (rs brokenRunStoreStub) GetJobs(runID string) ([]string, error) {
 	return []string{}, nil
 }
@@ -33,6 +52,18 @@ func (rs brokenRunStoreStub) GetJob(jobID string) (Job, error) {
 func (rs brokenRunStoreStub) SetJobStatus(jobID, status string) error {
 	return nil
 }
+func (rs brokenRunStoreStub) SetJobOutputs(jobID string, outputs map[string]string) error {
+	return nil
+}
+func (rs brokenRunStoreStub) GetJobOutputs(jobID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs brokenRunStoreStub) SetJobStepsStatus(jobID string, steps []StepStatus) error {
+	return nil
+}
+func (rs brokenRunStoreStub) SetJobFailure(jobID string, failure *JobError) error {
+	return nil
+}
 func (rs brokenRunStoreStub) GetJobDependencies(jobID string) ([]JobDependency, error) {
 	return []JobDependency{}, nil
 }
@@ -42,7 +73,25 @@ func (rs brokenRunStoreStub) Close(runID string) error {
 
 type cloudProviderStub struct{}
 
-func (cp cloudProviderStub) RunJob(job Job) error {
+func (cp cloudProviderStub) RunJob(job Job) (JobResult, error) {
+	return JobResult{}, nil
+}
+func (cp cloudProviderStub) CreateWorkspace(runID string, volume Volume) error {
+	return nil
+}
+func (cp cloudProviderStub) DeleteWorkspace(runID string, volume Volume) error {
+	return nil
+}
+func (cp cloudProviderStub) ResolveSource(source Source) (string, error) {
+	return "", nil
+}
+func (cp cloudProviderStub) WithProject(project Project) CloudProvider {
+	return cp
+}
+func (cp cloudProviderStub) ListJobs(runID string) ([]string, error) {
+	return []string{}, nil
+}
+func (cp cloudProviderStub) DeleteJob(runID, name string) error {
 	return nil
 }
 
@@ -56,10 +105,104 @@ type recyclerStub struct{}
 
 func (r recyclerStub) StartSync() {}
 
+type artifactStoreStub struct{}
+
+func (as artifactStoreStub) Create(runID string) error {
+	return nil
+}
+func (as artifactStoreStub) Location(runID string) string {
+	return ""
+}
+func (as artifactStoreStub) WithProject(project Project) ArtifactStore {
+	return as
+}
+func (as artifactStoreStub) WithRunner(runner string) ArtifactStore {
+	return as
+}
+func (as artifactStoreStub) Delete(runID string) error {
+	return nil
+}
+
+// Acquires all slots.
+type semaphoreStub struct{}
+
+func (s semaphoreStub) TryAcquire(resource, holder string, limit int) (bool, error) {
+	return true, nil
+}
+func (s semaphoreStub) Release(resource, holder string) error {
+	return nil
+}
+
+// Queues the jobs in memory.
+type jobQueueStub struct {
+	jobs      chan [2]string
+	completed map[string]chan [2]string
+	l         sync.Mutex
+}
+
+func newJobQueueStub() *jobQueueStub {
+	return &jobQueueStub{jobs: make(chan [2]string, 10), completed: make(map[string]chan [2]string)}
+}
+
+func (q *jobQueueStub) Queue(runID, jobID string) error {
+	q.jobs <- [2]string{runID, jobID}
+	return nil
+}
+func (q *jobQueueStub) NextJob() (string, string, error) {
+	job, ok := <-q.jobs
+	if !ok {
+		return "", "", errors.New("job queue closed")
+	}
+	return job[0], job[1], nil
+}
+func (q *jobQueueStub) Complete(runID, jobID, status string) error {
+	q.completedJobs(runID) <- [2]string{jobID, status}
+	return nil
+}
+func (q *jobQueueStub) NextCompletedJob(runID string, timeout time.Duration) (string, string, error) {
+	select {
+	case job := <-q.completedJobs(runID):
+		return job[0], job[1], nil
+	case <-time.After(timeout):
+		return "", "", nil
+	}
+}
+func (q *jobQueueStub) DeleteCompletedJobs(runID string) error {
+	q.l.Lock()
+	defer q.l.Unlock()
+	delete(q.completed, runID)
+	return nil
+}
+func (q *jobQueueStub) completedJobs(runID string) chan [2]string {
+	q.l.Lock()
+	defer q.l.Unlock()
+	if _, ok := q.completed[runID]; !ok {
+		q.completed[runID] = make(chan [2]string, 10)
+	}
+	return q.completed[runID]
+}
+
+// Runs the jobs queued by the worker, until the returned function is called.
+func runJobs(w Worker) func() {
+	var wg sync.WaitGroup
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for w.ProcessNextJob(&wg) == nil {
+		}
+	}()
+
+	return func() {
+		close(w.jq.(*jobQueueStub).jobs)
+		<-stopped
+		wg.Wait()
+	}
+}
+
 func TestStartError(t *testing.T) {
 	Convey("Scenario: the runs fetching panics", t, func() {
 		Convey("Given a run is scheduled", func() {
-			w := Worker{&brokenRunStoreStub{}, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}}
+			w := Worker{&brokenRunStoreStub{}, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
 
 			Convey("When the run fetching panics", func() {
 				w.Start()
@@ -97,11 +240,29 @@ func (rs *runStoreDepMock) SetRunStatus(runId, status string) error {
 	rs.setRunStatusI++
 	return nil
 }
+func (rs *runStoreDepMock) GetRunParams(runID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs *runStoreDepMock) GetRunVolumes(runID string) ([]Volume, error) {
+	return []Volume{}, nil
+}
+func (rs *runStoreDepMock) GetRunSource(runID string) (*Source, error) {
+	return nil, nil
+}
+func (rs *runStoreDepMock) SetRunCommit(runID, commit string) error {
+	return nil
+}
+func (rs *runStoreDepMock) GetRunProject(runID string) (Project, error) {
+	return Project{}, nil
+}
+func (rs *runStoreDepMock) GetRunQuotas(runID string) ([]Quota, error) {
+	return []Quota{}, nil
+}
 func (rs *runStoreDepMock) GetJobs(runID string) ([]string, error) {
 	return []string{"job:job1:run:abc", "job:dep1:run:abc"}, nil
 }
 func (rs *runStoreDepMock) GetJob(jobID string) (Job, error) {
-	return Job{"", "busybox", "exit 0"}, nil
+	return Job{Image: "busybox", Run: "exit 0"}, nil
 }
 func (rs *runStoreDepMock) SetJobStatus(jobID, status string) error {
 	expectedStatus := ""
@@ -124,6 +285,18 @@ func (rs *runStoreDepMock) SetJobStatus(jobID, status string) error {
 	rs.setJobStatusI++
 	return nil
 }
+func (rs *runStoreDepMock) SetJobOutputs(jobID string, outputs map[string]string) error {
+	return nil
+}
+func (rs *runStoreDepMock) GetJobOutputs(jobID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs *runStoreDepMock) SetJobStepsStatus(jobID string, steps []StepStatus) error {
+	return nil
+}
+func (rs *runStoreDepMock) SetJobFailure(jobID string, failure *JobError) error {
+	return nil
+}
 func (rs *runStoreDepMock) GetJobDependencies(jobID string) ([]JobDependency, error) {
 	deps := []JobDependency{}
 
@@ -145,7 +318,8 @@ func TestProcessNextRun(t *testing.T) {
 		Convey("Given a run is processed", func() {
 			Convey("When its dependency tree is valid, and everything goes well", func() {
 				Convey("The worker should run each job according to the dependency tree, and set statuses to SUCCESSFUL", func() {
-					w := Worker{&runStoreDepMock{t: t}, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}}
+					w := Worker{&runStoreDepMock{t: t}, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
 					var wg sync.WaitGroup
 					w.ProcessNextRun(&wg)
 					wg.Wait()
@@ -181,14 +355,32 @@ func (rs *runStoreFailureMock) SetRunStatus(runId, status string) error {
 	rs.setRunStatusI++
 	return nil
 }
+func (rs *runStoreFailureMock) GetRunParams(runID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs *runStoreFailureMock) GetRunVolumes(runID string) ([]Volume, error) {
+	return []Volume{}, nil
+}
+func (rs *runStoreFailureMock) GetRunSource(runID string) (*Source, error) {
+	return nil, nil
+}
+func (rs *runStoreFailureMock) SetRunCommit(runID, commit string) error {
+	return nil
+}
+func (rs *runStoreFailureMock) GetRunProject(runID string) (Project, error) {
+	return Project{}, nil
+}
+func (rs *runStoreFailureMock) GetRunQuotas(runID string) ([]Quota, error) {
+	return []Quota{}, nil
+}
 func (rs *runStoreFailureMock) GetJobs(runID string) ([]string, error) {
 	return []string{"job:job1:run:abc", "job:dep1:run:abc"}, nil
 }
 func (rs *runStoreFailureMock) GetJob(jobID string) (Job, error) {
 	if jobID == "job:dep1:run:abc" {
-		return Job{"", "busybox", "exit 1"}, nil
+		return Job{Image: "busybox", Run: "exit 1"}, nil
 	}
-	return Job{"", "busybox", "exit 0"}, nil
+	return Job{Image: "busybox", Run: "exit 0"}, nil
 }
 func (rs *runStoreFailureMock) SetJobStatus(jobID, status string) error {
 	expectedStatus := ""
@@ -211,6 +403,18 @@ func (rs *runStoreFailureMock) SetJobStatus(jobID, status string) error {
 	rs.setJobStatusI++
 	return nil
 }
+func (rs *runStoreFailureMock) SetJobOutputs(jobID string, outputs map[string]string) error {
+	return nil
+}
+func (rs *runStoreFailureMock) GetJobOutputs(jobID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs *runStoreFailureMock) SetJobStepsStatus(jobID string, steps []StepStatus) error {
+	return nil
+}
+func (rs *runStoreFailureMock) SetJobFailure(jobID string, failure *JobError) error {
+	return nil
+}
 func (rs *runStoreFailureMock) GetJobDependencies(jobID string) ([]JobDependency, error) {
 	deps := []JobDependency{}
 
@@ -226,10 +430,28 @@ func (rs *runStoreFailureMock) Close(runID string) error {
 
 type cloudProviderFailureStub struct{}
 
-func (cp cloudProviderFailureStub) RunJob(job Job) error {
+func (cp cloudProviderFailureStub) RunJob(job Job) (JobResult, error) {
 	if job.Run == "exit 1" {
-		return errors.New("failure")
+		return JobResult{}, errors.New("failure")
 	}
+	return JobResult{}, nil
+}
+func (cp cloudProviderFailureStub) CreateWorkspace(runID string, volume Volume) error {
+	return nil
+}
+func (cp cloudProviderFailureStub) DeleteWorkspace(runID string, volume Volume) error {
+	return nil
+}
+func (cp cloudProviderFailureStub) ResolveSource(source Source) (string, error) {
+	return "", nil
+}
+func (cp cloudProviderFailureStub) WithProject(project Project) CloudProvider {
+	return cp
+}
+func (cp cloudProviderFailureStub) ListJobs(runID string) ([]string, error) {
+	return []string{}, nil
+}
+func (cp cloudProviderFailureStub) DeleteJob(runID, name string) error {
 	return nil
 }
 
@@ -239,7 +461,8 @@ func TestProcessNextRunFailure(t *testing.T) {
 			Convey("When a job fails in the dependency tree", func() {
 				Convey("Subsequent jobs should be run if expecting a failure", func() {
 					Convey("And run should be set as failed", func() {
-						w := Worker{&runStoreFailureMock{t: t}, &cloudProviderFailureStub{}, &eventStoreStub{}, &recyclerStub{}}
+						w := Worker{&runStoreFailureMock{t: t}, &cloudProviderFailureStub{}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+						defer runJobs(w)()
 						var wg sync.WaitGroup
 						w.ProcessNextRun(&wg)
 						wg.Wait()
@@ -276,11 +499,29 @@ func (rs *runStoreSkippedMock) SetRunStatus(runId, status string) error {
 	rs.setRunStatusI++
 	return nil
 }
+func (rs *runStoreSkippedMock) GetRunParams(runID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs *runStoreSkippedMock) GetRunVolumes(runID string) ([]Volume, error) {
+	return []Volume{}, nil
+}
+func (rs *runStoreSkippedMock) GetRunSource(runID string) (*Source, error) {
+	return nil, nil
+}
+func (rs *runStoreSkippedMock) SetRunCommit(runID, commit string) error {
+	return nil
+}
+func (rs *runStoreSkippedMock) GetRunProject(runID string) (Project, error) {
+	return Project{}, nil
+}
+func (rs *runStoreSkippedMock) GetRunQuotas(runID string) ([]Quota, error) {
+	return []Quota{}, nil
+}
 func (rs *runStoreSkippedMock) GetJobs(runID string) ([]string, error) {
 	return []string{"job:job1:run:abc", "job:dep1:run:abc", "job:dep2:run:abc"}, nil
 }
 func (rs *runStoreSkippedMock) GetJob(jobID string) (Job, error) {
-	return Job{"", "busybox", "exit 0"}, nil
+	return Job{Image: "busybox", Run: "exit 0"}, nil
 }
 func (rs *runStoreSkippedMock) SetJobStatus(jobID, status string) error {
 	expectedStatus := ""
@@ -303,6 +544,18 @@ func (rs *runStoreSkippedMock) SetJobStatus(jobID, status string) error {
 	rs.setJobStatusI++
 	return nil
 }
+func (rs *runStoreSkippedMock) SetJobOutputs(jobID string, outputs map[string]string) error {
+	return nil
+}
+func (rs *runStoreSkippedMock) GetJobOutputs(jobID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs *runStoreSkippedMock) SetJobStepsStatus(jobID string, steps []StepStatus) error {
+	return nil
+}
+func (rs *runStoreSkippedMock) SetJobFailure(jobID string, failure *JobError) error {
+	return nil
+}
 func (rs *runStoreSkippedMock) GetJobDependencies(jobID string) ([]JobDependency, error) {
 	deps := []JobDependency{}
 
@@ -324,7 +577,8 @@ func TestProcessNextRunSkipped(t *testing.T) {
 		Convey("Given a run is processed", func() {
 			Convey("When the dependency tree contains jobs whose conditions are not met", func() {
 				Convey("The jobs, and all subsequent jobs in the branch, should be skipped", func() {
-					w := Worker{&runStoreSkippedMock{t: t}, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}}
+					w := Worker{&runStoreSkippedMock{t: t}, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
 					var wg sync.WaitGroup
 					w.ProcessNextRun(&wg)
 					wg.Wait()
@@ -357,16 +611,46 @@ func (rs *runStoreNotFoundMock) SetRunStatus(runId, status string) error {
 	rs.setRunStatusI++
 	return nil
 }
+func (rs *runStoreNotFoundMock) GetRunParams(runID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs *runStoreNotFoundMock) GetRunVolumes(runID string) ([]Volume, error) {
+	return []Volume{}, nil
+}
+func (rs *runStoreNotFoundMock) GetRunSource(runID string) (*Source, error) {
+	return nil, nil
+}
+func (rs *runStoreNotFoundMock) SetRunCommit(runID, commit string) error {
+	return nil
+}
+func (rs *runStoreNotFoundMock) GetRunProject(runID string) (Project, error) {
+	return Project{}, nil
+}
+func (rs *runStoreNotFoundMock) GetRunQuotas(runID string) ([]Quota, error) {
+	return []Quota{}, nil
+}
 func (rs *runStoreNotFoundMock) GetJobs(runID string) ([]string, error) {
 	return []string{"job:job1:run:abc"}, nil
 }
 func (rs *runStoreNotFoundMock) GetJob(jobID string) (Job, error) {
-	return Job{"", "busybox", "exit 0"}, nil
+	return Job{Image: "busybox", Run: "exit 0"}, nil
 }
 func (rs *runStoreNotFoundMock) SetJobStatus(jobID, status string) error {
 	rs.t.Errorf("SetJobStatus should not have been called")
 	return nil
 }
+func (rs *runStoreNotFoundMock) SetJobOutputs(jobID string, outputs map[string]string) error {
+	return nil
+}
+func (rs *runStoreNotFoundMock) GetJobOutputs(jobID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs *runStoreNotFoundMock) SetJobStepsStatus(jobID string, steps []StepStatus) error {
+	return nil
+}
+func (rs *runStoreNotFoundMock) SetJobFailure(jobID string, failure *JobError) error {
+	return nil
+}
 func (rs *runStoreNotFoundMock) GetJobDependencies(jobID string) ([]JobDependency, error) {
 	return []JobDependency{
 		JobDependency{"job:dep1:run:abc", false},
@@ -381,7 +665,8 @@ func TestProcessNextRunNotFound(t *testing.T) {
 		Convey("Given a run is processed", func() {
 			Convey("When the run contains references to unknown dependencies", func() {
 				Convey("The run should be set to FAILED, and its jobs should not be run", func() {
-					w := Worker{&runStoreNotFoundMock{t: t}, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}}
+					w := Worker{&runStoreNotFoundMock{t: t}, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
 					var wg sync.WaitGroup
 					w.ProcessNextRun(&wg)
 					wg.Wait()
@@ -414,6 +699,24 @@ func (rs *runStoreDepLoopMock) SetRunStatus(runId, status string) error {
 	rs.setRunStatusI++
 	return nil
 }
+func (rs *runStoreDepLoopMock) GetRunParams(runID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs *runStoreDepLoopMock) GetRunVolumes(runID string) ([]Volume, error) {
+	return []Volume{}, nil
+}
+func (rs *runStoreDepLoopMock) GetRunSource(runID string) (*Source, error) {
+	return nil, nil
+}
+func (rs *runStoreDepLoopMock) SetRunCommit(runID, commit string) error {
+	return nil
+}
+func (rs *runStoreDepLoopMock) GetRunProject(runID string) (Project, error) {
+	return Project{}, nil
+}
+func (rs *runStoreDepLoopMock) GetRunQuotas(runID string) ([]Quota, error) {
+	return []Quota{}, nil
+}
 func (rs *runStoreDepLoopMock) GetJobs(runID string) ([]string, error) {
 	return []string{
 		"job:job1:run:abc",
@@ -423,12 +726,24 @@ func (rs *runStoreDepLoopMock) GetJobs(runID string) ([]string, error) {
 	}, nil
 }
 func (rs *runStoreDepLoopMock) GetJob(jobID string) (Job, error) {
-	return Job{"", "busybox", "exit 0"}, nil
+	return Job{Image: "busybox", Run: "exit 0"}, nil
 }
 func (rs *runStoreDepLoopMock) SetJobStatus(jobID, status string) error {
 	rs.t.Errorf("SetJobStatus should not have been called")
 	return nil
 }
+func (rs *runStoreDepLoopMock) SetJobOutputs(jobID string, outputs map[string]string) error {
+	return nil
+}
+func (rs *runStoreDepLoopMock) GetJobOutputs(jobID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+func (rs *runStoreDepLoopMock) SetJobStepsStatus(jobID string, steps []StepStatus) error {
+	return nil
+}
+func (rs *runStoreDepLoopMock) SetJobFailure(jobID string, failure *JobError) error {
+	return nil
+}
 func (rs *runStoreDepLoopMock) GetJobDependencies(jobID string) ([]JobDependency, error) {
 	deps := []JobDependency{}
 
@@ -455,12 +770,1005 @@ func TestProcessNextRunDepLoop(t *testing.T) {
 		Convey("Given a run is processed", func() {
 			Convey("When the run has a loop in its dependencies", func() {
 				Convey("The run should be set to FAILED, and its jobs should not be run", func() {
-					w := Worker{&runStoreDepLoopMock{t: t}, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}}
+					w := Worker{&runStoreDepLoopMock{t: t}, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
+					var wg sync.WaitGroup
+					w.ProcessNextRun(&wg)
+					wg.Wait()
+				})
+			})
+		})
+	})
+}
+
+type runStoreOutputsMock struct {
+	runStoreDepMock
+	outputs map[string]map[string]string
+	l       sync.Mutex
+}
+
+func (rs *runStoreOutputsMock) SetRunStatus(runId, status string) error {
+	return nil
+}
+func (rs *runStoreOutputsMock) GetJob(jobID string) (Job, error) {
+	switch jobID {
+	case "job:dep1:run:abc":
+		return Job{Name: "dep1", Image: "busybox", Run: "exit 0"}, nil
+	default:
+		return Job{
+			Name:  "job1",
+			Image: "busybox",
+			Run:   "echo ${{ jobs.dep1.outputs.rows }}",
+			Env:   map[string]string{"ROWS": "${{ jobs.dep1.outputs.rows }}"},
+		}, nil
+	}
+}
+func (rs *runStoreOutputsMock) SetJobStatus(jobID, status string) error {
+	return nil
+}
+func (rs *runStoreOutputsMock) SetJobOutputs(jobID string, outputs map[string]string) error {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	rs.outputs[jobID] = outputs
+	return nil
+}
+func (rs *runStoreOutputsMock) GetJobOutputs(jobID string) (map[string]string, error) {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	return rs.outputs[jobID], nil
+}
+func (rs *runStoreOutputsMock) SetJobStepsStatus(jobID string, steps []StepStatus) error {
+	return nil
+}
+func (rs *runStoreOutputsMock) SetJobFailure(jobID string, failure *JobError) error {
+	return nil
+}
+
+type cloudProviderOutputsMock struct {
+	t *testing.T
+}
+
+func (cp cloudProviderOutputsMock) RunJob(job Job) (JobResult, error) {
+	if job.Name == "dep1" {
+		return JobResult{Outputs: map[string]string{"rows": "42"}}, nil
+	}
+
+	if job.Run != "echo ${CHAINR_JOBS_DEP1_OUTPUTS_ROWS}" || job.Env["CHAINR_JOBS_DEP1_OUTPUTS_ROWS"] != "42" {
+		cp.t.Errorf("job.Run = %v, env = %v, expected the output to be passed as an environment variable", job.Run, job.Env)
+	}
+	if job.Env["ROWS"] != "42" {
+		cp.t.Errorf("job.Env[ROWS] = %v, expected 42", job.Env["ROWS"])
+	}
+	return JobResult{}, nil
+}
+func (cp cloudProviderOutputsMock) CreateWorkspace(runID string, volume Volume) error {
+	return nil
+}
+func (cp cloudProviderOutputsMock) DeleteWorkspace(runID string, volume Volume) error {
+	return nil
+}
+func (cp cloudProviderOutputsMock) ResolveSource(source Source) (string, error) {
+	return "", nil
+}
+func (cp cloudProviderOutputsMock) WithProject(project Project) CloudProvider {
+	return cp
+}
+func (cp cloudProviderOutputsMock) ListJobs(runID string) ([]string, error) {
+	return []string{}, nil
+}
+func (cp cloudProviderOutputsMock) DeleteJob(runID, name string) error {
+	return nil
+}
+
+func TestProcessNextRunOutputs(t *testing.T) {
+	Convey("Scenario: process run with job outputs", t, func() {
+		Convey("Given a run is processed", func() {
+			Convey("When a job references the outputs of its dependency", func() {
+				Convey("The references should be replaced by the dependency outputs", func() {
+					rs := &runStoreOutputsMock{outputs: make(map[string]map[string]string)}
+					w := Worker{rs, &cloudProviderOutputsMock{t}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
+					var wg sync.WaitGroup
+					w.ProcessNextRun(&wg)
+					wg.Wait()
+
+					So(rs.outputs["job:dep1:run:abc"]["rows"], ShouldEqual, "42")
+				})
+			})
+		})
+	})
+}
+
+type runStoreConditionMock struct {
+	runStoreDepMock
+	statuses map[string]string
+	l        sync.Mutex
+}
+
+func (rs *runStoreConditionMock) SetRunStatus(runId, status string) error {
+	return nil
+}
+func (rs *runStoreConditionMock) GetRunParams(runID string) (map[string]string, error) {
+	return map[string]string{"env": "dev"}, nil
+}
+func (rs *runStoreConditionMock) GetRunVolumes(runID string) ([]Volume, error) {
+	return []Volume{}, nil
+}
+func (rs *runStoreConditionMock) GetRunSource(runID string) (*Source, error) {
+	return nil, nil
+}
+func (rs *runStoreConditionMock) SetRunCommit(runID, commit string) error {
+	return nil
+}
+func (rs *runStoreConditionMock) GetRunProject(runID string) (Project, error) {
+	return Project{}, nil
+}
+func (rs *runStoreConditionMock) GetRunQuotas(runID string) ([]Quota, error) {
+	return []Quota{}, nil
+}
+func (rs *runStoreConditionMock) GetJob(jobID string) (Job, error) {
+	switch jobID {
+	case "job:dep1:run:abc":
+		return Job{Name: "dep1", Image: "busybox", Run: "exit 0", If: `params.env == "prod"`}, nil
+	default:
+		return Job{Name: "job1", Image: "busybox", Run: "exit 0"}, nil
+	}
+}
+func (rs *runStoreConditionMock) SetJobStatus(jobID, status string) error {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	rs.statuses[jobID] = status
+	return nil
+}
+
+func TestProcessNextRunCondition(t *testing.T) {
+	Convey("Scenario: process run with conditional jobs", t, func() {
+		Convey("Given a run is processed", func() {
+			Convey("When the condition of a job is false", func() {
+				Convey("The job, and all subsequent jobs in the branch, should be skipped", func() {
+					rs := &runStoreConditionMock{statuses: make(map[string]string)}
+					w := Worker{rs, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
 					var wg sync.WaitGroup
 					w.ProcessNextRun(&wg)
 					wg.Wait()
+
+					So(rs.statuses["job:dep1:run:abc"], ShouldEqual, "SKIPPED")
+					So(rs.statuses["job:job1:run:abc"], ShouldEqual, "SKIPPED")
 				})
 			})
 		})
 	})
 }
+
+// The job depending on the failure of dep1 runs if it failed with exit code 2.
+type runStoreReasonMock struct {
+	runStoreConditionMock
+	failures map[string]JobError
+}
+
+func (rs *runStoreReasonMock) GetJob(jobID string) (Job, error) {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	switch jobID {
+	case "job:dep1:run:abc":
+		failure := rs.failures[jobID]
+		return Job{Name: "dep1", Image: "busybox", Run: "exit 2", Status: rs.statuses[jobID], Reason: failure.Reason, ExitCode: failure.ExitCode}, nil
+	default:
+		return Job{Name: "job1", Image: "busybox", Run: "exit 0", Status: rs.statuses[jobID], If: `jobs.dep1.reason == "Failed" && jobs.dep1.exitCode == 2`}, nil
+	}
+}
+func (rs *runStoreReasonMock) SetJobFailure(jobID string, failure *JobError) error {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	rs.failures[jobID] = *failure
+	return nil
+}
+func (rs *runStoreReasonMock) GetJobDependencies(jobID string) ([]JobDependency, error) {
+	if jobID == "job:job1:run:abc" {
+		return []JobDependency{JobDependency{"job:dep1:run:abc", true}}, nil
+	}
+	return []JobDependency{}, nil
+}
+
+// Fails the jobs running exit 2 with the error.
+type cloudProviderErrorStub struct {
+	cloudProviderStub
+	err error
+}
+
+func (cp *cloudProviderErrorStub) RunJob(job Job) (JobResult, error) {
+	if job.Run == "exit 2" {
+		return JobResult{}, cp.err
+	}
+	return JobResult{}, nil
+}
+func (cp *cloudProviderErrorStub) WithProject(project Project) CloudProvider {
+	return cp
+}
+
+func TestProcessNextRunFailureReason(t *testing.T) {
+	Convey("Scenario: process run with jobs depending on failure reasons", t, func() {
+		Convey("Given a run is processed", func() {
+			Convey("When a job command fails", func() {
+				rs := &runStoreReasonMock{runStoreConditionMock{statuses: make(map[string]string)}, make(map[string]JobError)}
+				w := Worker{rs, &cloudProviderErrorStub{err: &JobError{ReasonFailed, 2, "job execution failed"}}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+				defer runJobs(w)()
+				var wg sync.WaitGroup
+				w.ProcessNextRun(&wg)
+				wg.Wait()
+
+				Convey("The reason and exit code of the failure should be recorded", func() {
+					So(rs.failures["job:dep1:run:abc"], ShouldResemble, JobError{ReasonFailed, 2, "job execution failed"})
+				})
+
+				Convey("Conditions of subsequent jobs should be evaluated with them", func() {
+					So(rs.statuses["job:job1:run:abc"], ShouldEqual, "SUCCESSFUL")
+				})
+			})
+
+			Convey("When a job fails with another error", func() {
+				rs := &runStoreReasonMock{runStoreConditionMock{statuses: make(map[string]string)}, make(map[string]JobError)}
+				w := Worker{rs, &cloudProviderErrorStub{err: errors.New("cluster unavailable")}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+				defer runJobs(w)()
+				var wg sync.WaitGroup
+				w.ProcessNextRun(&wg)
+				wg.Wait()
+
+				Convey("The failure should be recorded as an infrastructure error", func() {
+					So(rs.failures["job:dep1:run:abc"].Reason, ShouldEqual, ReasonInfrastructure)
+					So(rs.statuses["job:job1:run:abc"], ShouldEqual, "SKIPPED")
+				})
+			})
+		})
+	})
+}
+
+type runStoreVolumesMock struct {
+	runStoreDepMock
+}
+
+func (rs *runStoreVolumesMock) GetRunVolumes(runID string) ([]Volume, error) {
+	return []Volume{
+		Volume{Name: "config", ConfigMap: &NamedVolume{"app-config"}},
+		Volume{Name: "workspace", Workspace: &WorkspaceVolume{Size: "1Gi"}},
+	}, nil
+}
+func (rs *runStoreVolumesMock) GetJob(jobID string) (Job, error) {
+	return Job{
+		Image:        "busybox",
+		Run:          "exit 0",
+		VolumeMounts: []VolumeMount{VolumeMount{Name: "workspace", MountPath: "/workspace"}},
+	}, nil
+}
+
+type cloudProviderVolumesMock struct {
+	workspaces map[string]bool
+	created    []string
+	volumes    [][]Volume
+	l          sync.Mutex
+}
+
+func (cp *cloudProviderVolumesMock) RunJob(job Job) (JobResult, error) {
+	cp.l.Lock()
+	defer cp.l.Unlock()
+	cp.volumes = append(cp.volumes, job.Volumes)
+	return JobResult{}, nil
+}
+func (cp *cloudProviderVolumesMock) CreateWorkspace(runID string, volume Volume) error {
+	cp.workspaces[volume.Name] = true
+	cp.created = append(cp.created, volume.Name)
+	return nil
+}
+func (cp *cloudProviderVolumesMock) DeleteWorkspace(runID string, volume Volume) error {
+	delete(cp.workspaces, volume.Name)
+	return nil
+}
+func (cp *cloudProviderVolumesMock) ResolveSource(source Source) (string, error) {
+	return "", nil
+}
+func (cp *cloudProviderVolumesMock) WithProject(project Project) CloudProvider {
+	return cp
+}
+func (cp *cloudProviderVolumesMock) ListJobs(runID string) ([]string, error) {
+	return []string{}, nil
+}
+func (cp *cloudProviderVolumesMock) DeleteJob(runID, name string) error {
+	return nil
+}
+
+func TestProcessNextRunVolumes(t *testing.T) {
+	Convey("Scenario: process run with volumes", t, func() {
+		Convey("Given a run is processed", func() {
+			Convey("When the pipeline declares a workspace mounted by the jobs", func() {
+				Convey("The workspace should be created, mounted by the jobs, and deleted once the run completes", func() {
+					cp := &cloudProviderVolumesMock{workspaces: make(map[string]bool)}
+					w := Worker{&runStoreVolumesMock{runStoreDepMock{t: t}}, cp, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
+					var wg sync.WaitGroup
+					w.ProcessNextRun(&wg)
+					wg.Wait()
+
+					So(cp.created, ShouldResemble, []string{"workspace"})
+					So(len(cp.volumes), ShouldEqual, 2)
+					for _, volumes := range cp.volumes {
+						So(len(volumes), ShouldEqual, 1)
+						So(volumes[0].Name, ShouldEqual, "workspace")
+					}
+					So(cp.workspaces, ShouldBeEmpty)
+				})
+			})
+		})
+	})
+}
+
+// Runs the dep1 job on the cpu runner, and the other jobs on the gpu runner.
+type runStoreRunnersMock struct {
+	runStoreVolumesMock
+}
+
+func (rs *runStoreRunnersMock) GetJob(jobID string) (Job, error) {
+	job, err := rs.runStoreVolumesMock.GetJob(jobID)
+	job.Runner = "gpu"
+	if jobID == "job:dep1:run:abc" {
+		job.Runner = "cpu"
+	}
+	return job, err
+}
+
+func TestProcessNextRunRunners(t *testing.T) {
+	Convey("Scenario: process run with jobs on several runners", t, func() {
+		Convey("Given a run is processed", func() {
+			Convey("When the jobs mounting a workspace run on different runners", func() {
+				Convey("Each job should run on its runner, where the workspace is created and deleted", func() {
+					cpu := &cloudProviderVolumesMock{workspaces: make(map[string]bool)}
+					gpu := &cloudProviderVolumesMock{workspaces: make(map[string]bool)}
+					cp := Runners{"cpu", map[string]CloudProvider{"cpu": cpu, "gpu": gpu}}
+					w := Worker{&runStoreRunnersMock{runStoreVolumesMock{runStoreDepMock{t: t}}}, cp, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
+					var wg sync.WaitGroup
+					w.ProcessNextRun(&wg)
+					wg.Wait()
+
+					So(cpu.created, ShouldResemble, []string{"workspace"})
+					So(gpu.created, ShouldResemble, []string{"workspace"})
+					So(len(cpu.volumes), ShouldEqual, 1)
+					So(len(gpu.volumes), ShouldEqual, 1)
+					So(cpu.workspaces, ShouldBeEmpty)
+					So(gpu.workspaces, ShouldBeEmpty)
+				})
+			})
+		})
+	})
+}
+
+// Runs the dep1 job on the cpu runner, and the other jobs on the gpu runner.
+// All jobs save artifacts.
+type runStoreArtifactsRunnersMock struct {
+	runStoreDepMock
+}
+
+func (rs *runStoreArtifactsRunnersMock) GetJob(jobID string) (Job, error) {
+	job, err := rs.runStoreDepMock.GetJob(jobID)
+	job.Name = jobID
+	job.Artifacts = []string{"/tmp/out"}
+	job.Runner = "gpu"
+	if jobID == "job:dep1:run:abc" {
+		job.Runner = "cpu"
+	}
+	return job, err
+}
+
+// Records the artifacts created and deleted by the store of a runner.
+type artifactStoreRunnerMock struct {
+	runner  string
+	created []string
+	deleted []string
+}
+
+func (as *artifactStoreRunnerMock) Create(runID string) error {
+	as.created = append(as.created, runID)
+	return nil
+}
+func (as *artifactStoreRunnerMock) Location(runID string) string {
+	return as.runner + "/" + runID
+}
+func (as *artifactStoreRunnerMock) WithProject(project Project) ArtifactStore {
+	return as
+}
+func (as *artifactStoreRunnerMock) WithRunner(runner string) ArtifactStore {
+	return as
+}
+func (as *artifactStoreRunnerMock) Delete(runID string) error {
+	as.deleted = append(as.deleted, runID)
+	return nil
+}
+
+// Records the artifacts location of the jobs.
+type cloudProviderArtifactsMock struct {
+	cloudProviderStub
+	locations map[string]string
+	l         sync.Mutex
+}
+
+func (cp *cloudProviderArtifactsMock) RunJob(job Job) (JobResult, error) {
+	cp.l.Lock()
+	defer cp.l.Unlock()
+	cp.locations[job.Name] = job.ArtifactsLocation
+	return JobResult{}, nil
+}
+func (cp *cloudProviderArtifactsMock) WithProject(project Project) CloudProvider {
+	return cp
+}
+
+func TestProcessNextRunArtifactsRunners(t *testing.T) {
+	Convey("Scenario: process run saving artifacts on several runners", t, func() {
+		Convey("Given a run is processed", func() {
+			Convey("When the jobs saving artifacts run on different runners", func() {
+				Convey("The artifacts should be created, used and deleted on the runner of each job", func() {
+					cpu := &artifactStoreRunnerMock{runner: "cpu"}
+					gpu := &artifactStoreRunnerMock{runner: "gpu"}
+					as := runnerArtifactStores{"cpu", map[string]ArtifactStore{"cpu": cpu, "gpu": gpu}}
+					cp := &cloudProviderArtifactsMock{locations: make(map[string]string)}
+					w := Worker{&runStoreArtifactsRunnersMock{runStoreDepMock{t: t}}, cp, &eventStoreStub{}, &recyclerStub{}, as, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
+					var wg sync.WaitGroup
+					w.ProcessNextRun(&wg)
+					wg.Wait()
+
+					So(cpu.created, ShouldResemble, []string{"run:abc"})
+					So(gpu.created, ShouldResemble, []string{"run:abc"})
+					So(cpu.deleted, ShouldResemble, []string{"run:abc"})
+					So(gpu.deleted, ShouldResemble, []string{"run:abc"})
+					So(cp.locations, ShouldResemble, map[string]string{"job:dep1:run:abc": "cpu/run:abc", "job:job1:run:abc": "gpu/run:abc"})
+				})
+			})
+		})
+	})
+}
+
+type runStoreSourceMock struct {
+	runStoreDepMock
+	commit string
+	l      sync.Mutex
+}
+
+func (rs *runStoreSourceMock) GetRunParams(runID string) (map[string]string, error) {
+	return map[string]string{"branch": "main"}, nil
+}
+func (rs *runStoreSourceMock) GetRunSource(runID string) (*Source, error) {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	return &Source{Repo: "https://example.com/repo.git", Ref: "${{ params.branch }}", Commit: rs.commit}, nil
+}
+func (rs *runStoreSourceMock) SetRunCommit(runID, commit string) error {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	rs.commit = commit
+	return nil
+}
+
+type cloudProviderSourceMock struct {
+	cloudProviderStub
+	t       *testing.T
+	commits []string
+	l       sync.Mutex
+}
+
+func (cp *cloudProviderSourceMock) RunJob(job Job) (JobResult, error) {
+	cp.l.Lock()
+	defer cp.l.Unlock()
+	if job.Source == nil {
+		cp.t.Errorf("job.Source = nil, expected not nil")
+		return JobResult{}, nil
+	}
+	cp.commits = append(cp.commits, job.Source.Commit)
+	return JobResult{}, nil
+}
+func (cp *cloudProviderSourceMock) ResolveSource(source Source) (string, error) {
+	if source.Ref != "main" {
+		cp.t.Errorf("source.Ref = %v, expected main", source.Ref)
+	}
+	return "0123456789abcdef0123456789abcdef01234567", nil
+}
+func (cp *cloudProviderSourceMock) WithProject(project Project) CloudProvider {
+	return cp
+}
+
+func TestProcessNextRunSource(t *testing.T) {
+	Convey("Scenario: process run with a source", t, func() {
+		Convey("Given a run is processed", func() {
+			Convey("When the pipeline declares a source", func() {
+				Convey("The source ref should be resolved once, and all jobs should clone the resolved commit", func() {
+					rs := &runStoreSourceMock{runStoreDepMock: runStoreDepMock{t: t}}
+					cp := &cloudProviderSourceMock{t: t}
+					w := Worker{rs, cp, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
+					var wg sync.WaitGroup
+					w.ProcessNextRun(&wg)
+					wg.Wait()
+
+					So(rs.commit, ShouldEqual, "0123456789abcdef0123456789abcdef01234567")
+					So(cp.commits, ShouldResemble, []string{
+						"0123456789abcdef0123456789abcdef01234567",
+						"0123456789abcdef0123456789abcdef01234567",
+					})
+				})
+			})
+		})
+	})
+}
+
+type runStoreProjectMock struct {
+	runStoreDepMock
+}
+
+func (rs *runStoreProjectMock) GetRunProject(runID string) (Project, error) {
+	return Project{Name: "team-a", Namespace: "team-a", ServiceAccount: "runner"}, nil
+}
+
+type cloudProviderProjectMock struct {
+	cloudProviderStub
+	project    Project
+	namespaces []string
+	l          sync.Mutex
+}
+
+func (cp *cloudProviderProjectMock) RunJob(job Job) (JobResult, error) {
+	cp.l.Lock()
+	defer cp.l.Unlock()
+	cp.namespaces = append(cp.namespaces, cp.project.Namespace)
+	return JobResult{}, nil
+}
+func (cp *cloudProviderProjectMock) WithProject(project Project) CloudProvider {
+	cp.project = project
+	return cp
+}
+
+func TestProcessNextRunProject(t *testing.T) {
+	Convey("Scenario: process run of a project", t, func() {
+		Convey("Given a run is processed", func() {
+			Convey("When the run belongs to a project mapped to a namespace", func() {
+				Convey("The jobs should run in the project namespace", func() {
+					cp := &cloudProviderProjectMock{}
+					w := Worker{&runStoreProjectMock{runStoreDepMock{t: t}}, cp, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
+					var wg sync.WaitGroup
+					w.ProcessNextRun(&wg)
+					wg.Wait()
+
+					So(cp.namespaces, ShouldResemble, []string{"team-a", "team-a"})
+				})
+			})
+		})
+	})
+}
+
+type runStoreQuotaMock struct {
+	runStoreDepMock
+	runStatus []string
+	jobStatus map[string][]string
+	queued    chan string
+	l         sync.Mutex
+}
+
+func (rs *runStoreQuotaMock) SetRunStatus(runID, status string) error {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	rs.runStatus = append(rs.runStatus, status)
+	return nil
+}
+func (rs *runStoreQuotaMock) GetRunQuotas(runID string) ([]Quota, error) {
+	return []Quota{{"pipeline:backfill", 1, 1}}, nil
+}
+func (rs *runStoreQuotaMock) GetJobs(runID string) ([]string, error) {
+	return []string{"job:job1:run:abc", "job:job2:run:abc", "job:job3:run:abc"}, nil
+}
+func (rs *runStoreQuotaMock) SetJobStatus(jobID, status string) error {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	rs.jobStatus[jobID] = append(rs.jobStatus[jobID], status)
+	if status == "QUEUED" {
+		rs.queued <- jobID
+	}
+	return nil
+}
+func (rs *runStoreQuotaMock) GetJobDependencies(jobID string) ([]JobDependency, error) {
+	return []JobDependency{}, nil
+}
+
+// Holds the slots in memory, and records the maximum number of holders of
+// each resource.
+type memorySemaphore struct {
+	holders    map[string]map[string]bool
+	maxHolders map[string]int
+	l          sync.Mutex
+}
+
+func (s *memorySemaphore) TryAcquire(resource, holder string, limit int) (bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if _, ok := s.holders[resource]; !ok {
+		s.holders[resource] = make(map[string]bool)
+	}
+	if !s.holders[resource][holder] && len(s.holders[resource]) >= limit {
+		return false, nil
+	}
+	s.holders[resource][holder] = true
+	if len(s.holders[resource]) > s.maxHolders[resource] {
+		s.maxHolders[resource] = len(s.holders[resource])
+	}
+	return true, nil
+}
+func (s *memorySemaphore) Release(resource, holder string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	delete(s.holders[resource], holder)
+	return nil
+}
+
+// The first job runs until another job is queued.
+type cloudProviderQuotaMock struct {
+	cloudProviderStub
+	queued <-chan string
+	once   sync.Once
+}
+
+func (cp *cloudProviderQuotaMock) RunJob(job Job) (JobResult, error) {
+	cp.once.Do(func() { <-cp.queued })
+	return JobResult{}, nil
+}
+func (cp *cloudProviderQuotaMock) WithProject(project Project) CloudProvider {
+	return cp
+}
+
+func TestProcessNextRunQuota(t *testing.T) {
+	Convey("Scenario: process run limited by a quota", t, func() {
+		slotRetryInterval = 5 * time.Millisecond
+		defer func() { slotRetryInterval = 2 * time.Second }()
+
+		Convey("Given a run is processed", func() {
+			Convey("When its pipeline limits the jobs running at the same time", func() {
+				Convey("The jobs should be queued, and run one at a time", func() {
+					rs := &runStoreQuotaMock{runStoreDepMock: runStoreDepMock{t: t}, jobStatus: make(map[string][]string), queued: make(chan string, 3)}
+					sem := &memorySemaphore{holders: make(map[string]map[string]bool), maxHolders: make(map[string]int)}
+					w := Worker{rs, &cloudProviderQuotaMock{queued: rs.queued}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, sem, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
+					var wg sync.WaitGroup
+					w.ProcessNextRun(&wg)
+					wg.Wait()
+
+					So(sem.maxHolders["pipeline:backfill:jobs"], ShouldEqual, 1)
+					So(sem.maxHolders["pipeline:backfill:runs"], ShouldEqual, 1)
+					So(sem.holders["pipeline:backfill:jobs"], ShouldBeEmpty)
+					So(sem.holders["pipeline:backfill:runs"], ShouldBeEmpty)
+
+					queued := 0
+					for _, statuses := range rs.jobStatus {
+						So(statuses[len(statuses)-1], ShouldEqual, "SUCCESSFUL")
+						if statuses[0] == "QUEUED" {
+							queued++
+						}
+					}
+					So(queued, ShouldBeGreaterThan, 0)
+					So(rs.runStatus, ShouldResemble, []string{"RUNNING", "SUCCESSFUL"})
+				})
+			})
+
+			Convey("When its pipeline has as many runs as it allows", func() {
+				Convey("The run should be queued until a run completes", func() {
+					rs := &runStoreQuotaMock{runStoreDepMock: runStoreDepMock{t: t}, jobStatus: make(map[string][]string), queued: make(chan string, 3)}
+					sem := &memorySemaphore{holders: make(map[string]map[string]bool), maxHolders: make(map[string]int)}
+					sem.TryAcquire("pipeline:backfill:runs", "run:other", 1)
+					go func() {
+						time.Sleep(20 * time.Millisecond)
+						sem.Release("pipeline:backfill:runs", "run:other")
+					}()
+					w := Worker{rs, &cloudProviderQuotaMock{queued: rs.queued}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, sem, NewLoad(0, 0), newJobQueueStub()}
+					defer runJobs(w)()
+					var wg sync.WaitGroup
+					w.ProcessNextRun(&wg)
+					wg.Wait()
+
+					So(rs.runStatus, ShouldResemble, []string{"QUEUED", "RUNNING", "SUCCESSFUL"})
+				})
+			})
+		})
+	})
+}
+
+// Runs run:a and run:b of two projects, run:a being limited by a quota.
+type runStoreProjectsQuotaMock struct {
+	runStoreDepMock
+	runs      chan string
+	runStatus map[string][]string
+	completed chan string
+	l         sync.Mutex
+}
+
+func (rs *runStoreProjectsQuotaMock) NextRun() (string, error) {
+	return <-rs.runs, nil
+}
+func (rs *runStoreProjectsQuotaMock) SetRunStatus(runID, status string) error {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	rs.runStatus[runID] = append(rs.runStatus[runID], status)
+	if status == "SUCCESSFUL" {
+		rs.completed <- runID
+	}
+	return nil
+}
+func (rs *runStoreProjectsQuotaMock) GetRunQuotas(runID string) ([]Quota, error) {
+	if runID == "run:a" {
+		return []Quota{{"project:a", 1, 0}}, nil
+	}
+	return []Quota{}, nil
+}
+func (rs *runStoreProjectsQuotaMock) GetJobs(runID string) ([]string, error) {
+	return []string{"job:job1:" + runID}, nil
+}
+func (rs *runStoreProjectsQuotaMock) SetJobStatus(jobID, status string) error {
+	return nil
+}
+func (rs *runStoreProjectsQuotaMock) GetJobDependencies(jobID string) ([]JobDependency, error) {
+	return []JobDependency{}, nil
+}
+func (rs *runStoreProjectsQuotaMock) Close(runID string) error {
+	return nil
+}
+
+func TestProcessNextRunQuotaSaturated(t *testing.T) {
+	Convey("Scenario: process runs of a project over its quota", t, func() {
+		slotRetryInterval = 5 * time.Millisecond
+		defer func() { slotRetryInterval = 2 * time.Second }()
+
+		Convey("Given the worker processes one run at a time", func() {
+			rs := &runStoreProjectsQuotaMock{runStoreDepMock: runStoreDepMock{t: t}, runs: make(chan string, 2), runStatus: make(map[string][]string), completed: make(chan string, 2)}
+			sem := &memorySemaphore{holders: make(map[string]map[string]bool), maxHolders: make(map[string]int)}
+			sem.TryAcquire("project:a:runs", "run:other", 1)
+			w := Worker{rs, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, sem, NewLoad(1, 1), newJobQueueStub()}
+			defer runJobs(w)()
+
+			Convey("When a run of a project over its quota is queued before a run of another project", func() {
+				rs.runs <- "run:a"
+				rs.runs <- "run:b"
+				var wg sync.WaitGroup
+				So(w.ProcessNextRun(&wg), ShouldBeNil)
+				So(w.ProcessNextRun(&wg), ShouldBeNil)
+
+				Convey("The run of the other project should be processed while the first one waits", func() {
+					So(<-rs.completed, ShouldEqual, "run:b")
+					sem.Release("project:a:runs", "run:other")
+					So(<-rs.completed, ShouldEqual, "run:a")
+					wg.Wait()
+
+					So(rs.runStatus["run:a"], ShouldResemble, []string{"QUEUED", "RUNNING", "SUCCESSFUL"})
+					So(rs.runStatus["run:b"], ShouldResemble, []string{"RUNNING", "SUCCESSFUL"})
+					runs, _ := w.load.Current()
+					So(runs, ShouldEqual, 0)
+				})
+			})
+		})
+	})
+}
+
+type runStoreNextRunMock struct {
+	runStoreDepMock
+	calls chan struct{}
+}
+
+func (rs *runStoreNextRunMock) NextRun() (string, error) {
+	rs.calls <- struct{}{}
+	return "run:abc", nil
+}
+
+func TestProcessNextRunSaturated(t *testing.T) {
+	Convey("Scenario: worker saturated", t, func() {
+		Convey("Given the worker processes as many runs as it allows", func() {
+			load := NewLoad(1, 0)
+			load.AcquireRun()
+			rs := &runStoreNextRunMock{runStoreDepMock{t: t}, make(chan struct{}, 1)}
+			w := Worker{rs, &cloudProviderStub{}, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, load, newJobQueueStub()}
+			defer runJobs(w)()
+			var wg sync.WaitGroup
+			processed := make(chan error)
+			go func() { processed <- w.ProcessNextRun(&wg) }()
+
+			Convey("When no run completes", func() {
+				Convey("The worker should not take a new run", func() {
+					select {
+					case <-rs.calls:
+						t.Errorf("NextRun was called, expected the worker to wait")
+					case <-time.After(20 * time.Millisecond):
+					}
+					load.ReleaseRun()
+					<-rs.calls
+					So(<-processed, ShouldBeNil)
+					wg.Wait()
+				})
+			})
+		})
+	})
+}
+
+// Counts the jobs run.
+type cloudProviderCountMock struct {
+	cloudProviderStub
+	jobs int
+	l    sync.Mutex
+}
+
+func (cp *cloudProviderCountMock) RunJob(job Job) (JobResult, error) {
+	cp.l.Lock()
+	cp.jobs++
+	cp.l.Unlock()
+	return JobResult{}, nil
+}
+func (cp *cloudProviderCountMock) WithProject(project Project) CloudProvider {
+	return cp
+}
+
+func TestProcessNextRunDistributed(t *testing.T) {
+	Convey("Scenario: jobs run by another worker", t, func() {
+		Convey("Given a run is processed by a worker", func() {
+			jq := newJobQueueStub()
+			owner := &cloudProviderCountMock{}
+			w := Worker{&runStoreDepMock{t: t}, owner, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), jq}
+
+			Convey("When its jobs are taken by another worker", func() {
+				other := &cloudProviderCountMock{}
+				defer runJobs(Worker{&runStoreDepMock{t: t}, other, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), jq})()
+				var wg sync.WaitGroup
+				w.ProcessNextRun(&wg)
+				wg.Wait()
+
+				Convey("The other worker should run the jobs, and the run should complete", func() {
+					So(owner.jobs, ShouldEqual, 0)
+					So(other.jobs, ShouldEqual, 2)
+				})
+			})
+		})
+	})
+}
+
+// Jobs have persisted statuses, as when the run was processed by a worker
+// which was killed.
+type runStoreResumeMock struct {
+	runStoreDepMock
+	statuses  map[string]string
+	jobStatus map[string][]string
+	l         sync.Mutex
+}
+
+func (rs *runStoreResumeMock) GetJob(jobID string) (Job, error) {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	return Job{Image: "busybox", Run: "exit 0", Status: rs.statuses[jobID]}, nil
+}
+func (rs *runStoreResumeMock) SetJobStatus(jobID, status string) error {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	rs.statuses[jobID] = status
+	rs.jobStatus[jobID] = append(rs.jobStatus[jobID], status)
+	return nil
+}
+
+func TestProcessNextRunResumed(t *testing.T) {
+	Convey("Scenario: resume a run", t, func() {
+		Convey("Given a run was processed by a worker which was killed", func() {
+			Convey("When a job already completed", func() {
+				rs := &runStoreResumeMock{runStoreDepMock: runStoreDepMock{t: t}, statuses: map[string]string{"job:dep1:run:abc": "SUCCESSFUL"}, jobStatus: make(map[string][]string)}
+				cp := &cloudProviderCountMock{}
+				w := Worker{rs, cp, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+				defer runJobs(w)()
+				var wg sync.WaitGroup
+				w.ProcessNextRun(&wg)
+				wg.Wait()
+
+				Convey("The job should not run again, and its dependent jobs should run", func() {
+					So(cp.jobs, ShouldEqual, 1)
+					So(rs.jobStatus["job:dep1:run:abc"], ShouldBeEmpty)
+					So(rs.jobStatus["job:job1:run:abc"], ShouldResemble, []string{"RUNNING", "SUCCESSFUL"})
+				})
+			})
+
+			Convey("When a job is still running", func() {
+				rs := &runStoreResumeMock{runStoreDepMock: runStoreDepMock{t: t}, statuses: map[string]string{"job:dep1:run:abc": "SUCCESSFUL", "job:job1:run:abc": "RUNNING"}, jobStatus: make(map[string][]string)}
+				cp := &cloudProviderCountMock{}
+				jq := newJobQueueStub()
+				w := Worker{rs, cp, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), jq}
+				defer runJobs(w)()
+				var wg sync.WaitGroup
+				w.ProcessNextRun(&wg)
+				jq.Complete("run:abc", "job:job1:run:abc", "SUCCESSFUL")
+				wg.Wait()
+
+				Convey("The job should not be queued again, and the worker should wait for it to complete", func() {
+					So(cp.jobs, ShouldEqual, 0)
+					So(rs.jobStatus, ShouldBeEmpty)
+				})
+			})
+		})
+
+		Convey("Given a re-scheduled job already completed", func() {
+			rs := &runStoreResumeMock{runStoreDepMock: runStoreDepMock{t: t}, statuses: map[string]string{"job:job1:run:abc": "FAILED"}, jobStatus: make(map[string][]string)}
+			cp := &cloudProviderCountMock{}
+			jq := newJobQueueStub()
+			w := Worker{rs, cp, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), jq}
+
+			Convey("When a worker takes it", func() {
+				jq.Queue("run:abc", "job:job1:run:abc")
+				var wg sync.WaitGroup
+				w.ProcessNextJob(&wg)
+				wg.Wait()
+
+				Convey("The job should not run again, and its completion should be sent", func() {
+					jobID, status, _ := jq.NextCompletedJob("run:abc", time.Second)
+					So(jobID, ShouldEqual, "job:job1:run:abc")
+					So(status, ShouldEqual, "FAILED")
+					So(cp.jobs, ShouldEqual, 0)
+					So(rs.jobStatus, ShouldBeEmpty)
+				})
+			})
+		})
+	})
+}
+
+// A job of the run is left on the cloud provider.
+type cloudProviderLeftoverMock struct {
+	cloudProviderStub
+	deleted []string
+}
+
+func (cp *cloudProviderLeftoverMock) ListJobs(runID string) ([]string, error) {
+	return []string{"dep1"}, nil
+}
+func (cp *cloudProviderLeftoverMock) DeleteJob(runID, name string) error {
+	cp.deleted = append(cp.deleted, runID+"/"+name)
+	return nil
+}
+func (cp *cloudProviderLeftoverMock) WithProject(project Project) CloudProvider {
+	return cp
+}
+
+func TestProcessNextRunLeftoverJobs(t *testing.T) {
+	Convey("Scenario: jobs left on the cloud provider", t, func() {
+		Convey("Given a run is processed", func() {
+			cp := &cloudProviderLeftoverMock{}
+			w := Worker{&runStoreDepMock{t: t}, cp, &eventStoreStub{}, &recyclerStub{}, &artifactStoreStub{}, &semaphoreStub{}, NewLoad(0, 0), newJobQueueStub()}
+			defer runJobs(w)()
+
+			Convey("When a job of the run is left on the cloud provider by a killed worker", func() {
+				var wg sync.WaitGroup
+				w.ProcessNextRun(&wg)
+				wg.Wait()
+
+				Convey("The job should be deleted when the run completes", func() {
+					So(cp.deleted, ShouldResemble, []string{"run:abc/dep1"})
+				})
+			})
+		})
+	})
+}
+
+func TestSlots(t *testing.T) {
+	quotas := []Quota{{"project:team-a", 0, 10}, {"pipeline:backfill", 2, 0}}
+	if slots := runSlots(quotas); len(slots) != 1 || slots[0] != (slot{"pipeline:backfill:runs", 2}) {
+		t.Errorf("runSlots = %v, expected pipeline:backfill:runs", slots)
+	}
+	if slots := jobSlots(quotas); len(slots) != 1 || slots[0] != (slot{"project:team-a:jobs", 10}) {
+		t.Errorf("jobSlots = %v, expected project:team-a:jobs", slots)
+	}
+}
+
+func TestRunUID(t *testing.T) {
+	for runID, expected := range map[string]string{
+		"run:abc":                "abc",
+		"project:team-a:run:abc": "abc",
+		"abc":                    "abc",
+	} {
+		if uid := runUID(runID); uid != expected {
+			t.Errorf("runUID(%v) = %v, expected %v", runID, uid, expected)
+		}
+	}
+}